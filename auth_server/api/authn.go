@@ -16,7 +16,10 @@
 
 package api
 
-import "errors"
+import (
+	"crypto/x509"
+	"errors"
+)
 
 type Labels map[string][]string
 
@@ -27,6 +30,8 @@ type Authenticator interface {
 	// A special NoMatch error is returned if the authorizer could not reach a decision,
 	// e.g. none of the rules matched.
 	// Another special WrongPass error is returned if the authorizer failed to authenticate.
+	// WrongTOTP is returned if the password is correct, but the second factor is not.
+	// PasswordExpired is returned if the password is correct, but has expired and must be changed.
 	// Implementations must be goroutine-safe.
 	Authenticate(user string, password PasswordString) (bool, Labels, error)
 
@@ -39,8 +44,50 @@ type Authenticator interface {
 	Name() string
 }
 
+// TokenAuthenticator may optionally be implemented by an Authenticator that accepts
+// tokens identifying the account, such as JWTs, in place of the password.
+// If implemented, AuthenticateToken is used instead of Authenticate and the account
+// of the request is replaced with the one returned.
+type TokenAuthenticator interface {
+	Authenticator
+
+	// AuthenticateToken validates the token and returns the account it was issued to.
+	// Same conventions apply with regard to errors. In particular, NoMatch should be
+	// returned if the token is not of the supported kind.
+	AuthenticateToken(token string) (string, bool, Labels, error)
+}
+
+// OAuth2Authenticator may optionally be implemented by an Authenticator of an OAuth2 provider
+// that can validate tokens the provider issued for our client, e.g. access or ID tokens.
+// If implemented, AuthenticateAccessToken is used instead of Authenticate for tokens presented
+// without a user name: bearer credentials and refresh tokens of OAuth2 token requests.
+// The account of the request is replaced with the one returned.
+type OAuth2Authenticator interface {
+	Authenticator
+
+	// AuthenticateAccessToken validates the token with the provider and returns the account
+	// it was issued to. Same conventions apply with regard to errors. In particular, NoMatch
+	// should be returned if the token was not issued by the provider.
+	AuthenticateAccessToken(token string) (string, bool, Labels, error)
+}
+
+// CertificateAuthenticator may optionally be implemented by an Authenticator that
+// authenticates clients by TLS certificates they present.
+// If implemented, AuthenticateCertificate is used instead of Authenticate and the account
+// of the request is replaced with the one returned.
+type CertificateAuthenticator interface {
+	Authenticator
+
+	// AuthenticateCertificate validates the certificate chain presented by the client (leaf first)
+	// and returns the account it identifies. Same conventions apply with regard to errors.
+	// In particular, NoMatch should be returned if no certificates were presented.
+	AuthenticateCertificate(certs []*x509.Certificate) (string, bool, Labels, error)
+}
+
 var NoMatch = errors.New("did not match any rule")
 var WrongPass = errors.New("wrong password for user")
+var WrongTOTP = errors.New("invalid or missing TOTP code")
+var PasswordExpired = errors.New("password expired")
 
 //go:generate go-bindata -pkg authn -modtime 1 -mode 420 -nocompress data/
 
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
 // Authorizer interface performs authorization of the request.
@@ -45,6 +46,76 @@ type Authorizer interface {
 	Name() string
 }
 
+// DetailedAuthorizer may optionally be implemented by an Authorizer to provide
+// more information about the decision than just the set of authorized actions.
+// If implemented, AuthorizeDetailed is used instead of Authorize.
+type DetailedAuthorizer interface {
+	Authorizer
+
+	// AuthorizeDetailed is like Authorize, but returns the decision along with its details.
+	// Same conventions apply with regard to errors, including NoMatch.
+	AuthorizeDetailed(ai *AuthRequestInfo) (*AuthzDecision, error)
+}
+
+// Explainer may optionally be implemented by an Authorizer to explain why it could not reach
+// a decision for the request, i.e. returned NoMatch.
+type Explainer interface {
+	// ExplainNoMatch returns a human-readable explanation, e.g. which rule came closest to matching.
+	// Empty if there is nothing to tell.
+	ExplainNoMatch(ai *AuthRequestInfo) string
+}
+
+// StrictWildcardAuthorizer may optionally be implemented by an Authorizer that honors
+// AuthRequestInfo.StrictWildcardName. Authorizers that don't are not consulted for such requests.
+type StrictWildcardAuthorizer interface {
+	HonorsStrictWildcardName()
+}
+
+// HealthChecker may optionally be implemented by an Authenticator or Authorizer
+// that depends on an external service, e.g. a database.
+type HealthChecker interface {
+	// HealthCheck verifies that the service can be reached and used.
+	// Returns nil if it can.
+	HealthCheck() error
+}
+
+type AuthzDecision struct {
+	// Authorized actions, same as returned by Authorize.
+	Actions []string
+	// Token expiration (in seconds) to use if any actions are authorized.
+	// Zero means the default for the server.
+	Expiration int64
+	// Additional claims to include in the token if any actions are authorized.
+	// Reserved claims (see ReservedClaims) must not be included.
+	Claims map[string]interface{}
+	// Human-readable reason why some of the requested actions were denied.
+	// It may reveal details of the policy, so it is only logged unless authz.explain is enabled.
+	Reason string
+	// The decision must not be cached, e.g. because it was made while the backend was failing.
+	NoCache bool
+	// Rules that decided the request, e.g. "ACL entry 3 (comment)", in the order they were evaluated.
+	// Optional, used in explanations of decisions.
+	Rules []string
+}
+
+// ReservedClaims are set by the server and cannot be overridden by additional claims.
+var ReservedClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "access"}
+
+// ValidateClaimNames checks that none of the claims are reserved.
+func ValidateClaimNames(claims map[string]string) error {
+	for _, rc := range ReservedClaims {
+		if _, found := claims[rc]; found {
+			return fmt.Errorf("claim %q is reserved and cannot be overridden", rc)
+		}
+	}
+	for name := range claims {
+		if name == "" {
+			return fmt.Errorf("claim name must not be empty")
+		}
+	}
+	return nil
+}
+
 type AuthRequestInfo struct {
 	Account string
 	Type    string
@@ -53,6 +124,13 @@ type AuthRequestInfo struct {
 	IP      net.IP
 	Actions []string
 	Labels  Labels
+	// Resource class, e.g. plugin for repository(plugin) scopes. Empty if the scope has none.
+	Class string
+	// Set if the name contains a wildcard and authz.deny_wildcard_resource is enabled: the request
+	// may only be granted by rules that explicitly allow wildcard names, see StrictWildcardAuthorizer.
+	StrictWildcardName bool `json:"-"`
+	// Time to evaluate time-dependent rules at, zero means now. Set when explaining decisions.
+	Time time.Time `json:"-"`
 }
 
 func (ai AuthRequestInfo) String() string {
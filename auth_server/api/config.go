@@ -0,0 +1,46 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package api
+
+import "fmt"
+
+// ConfigError is an error in the config value at Path, which consists of mapping keys (strings)
+// and sequence indices (ints), e.g. ["acl", 3, "match", "name"] is the name condition of the fourth
+// ACL entry. It is used to report where in the config file the value is.
+type ConfigError struct {
+	Path []interface{}
+	Err  error
+}
+
+func (ce *ConfigError) Error() string {
+	return ce.Err.Error()
+}
+
+// NewConfigError returns err as an error in the value at path.
+func NewConfigError(err error, path ...interface{}) error {
+	return &ConfigError{Path: path, Err: err}
+}
+
+// WrapConfigError prefixes the message of err with msg, like fmt.Errorf("%s: %s", msg, err),
+// and returns it as an error in the value at path. If err is a *ConfigError, its path is relative to path.
+func WrapConfigError(err error, msg string, path ...interface{}) error {
+	full := append([]interface{}{}, path...)
+	if ce, ok := err.(*ConfigError); ok {
+		full = append(full, ce.Path...)
+	}
+	return &ConfigError{Path: full, Err: fmt.Errorf("%s: %s", msg, err)}
+}
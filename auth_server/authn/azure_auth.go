@@ -0,0 +1,250 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const defaultAzureAuthority = "https://login.microsoftonline.com"
+
+type AzureAuthConfig struct {
+	// Directory (tenant) ID. Tokens issued by other tenants are rejected.
+	TenantID string `yaml:"tenant_id,omitempty"`
+	// Application (client) ID of the app registration tokens are issued for.
+	ClientID string `yaml:"client_id,omitempty"`
+	// Accepted "aud" values, default is the client ID and api://<client ID>.
+	AllowedAudiences []string `yaml:"allowed_audiences,omitempty"`
+	// Claim to use as account name, preferred_username by default.
+	// If the token does not have it, e.g. tokens of service principals, the "oid" claim is used.
+	AccountClaim string `yaml:"account_claim,omitempty"`
+	// Authority host, for national clouds, e.g. https://login.microsoftonline.us.
+	Authority string `yaml:"authority,omitempty"`
+	// How often the signing keys of the tenant are refreshed.
+	JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval,omitempty"`
+	HTTPTimeout         time.Duration `yaml:"http_timeout,omitempty"`
+}
+
+func (c *AzureAuthConfig) Validate(configKey string) error {
+	if c.TenantID == "" || c.ClientID == "" {
+		return fmt.Errorf("%s.{tenant_id,client_id} are required", configKey)
+	}
+	switch strings.ToLower(c.TenantID) {
+	case "common", "organizations", "consumers":
+		return fmt.Errorf("%s.tenant_id must be a directory ID, %q is not supported", configKey, c.TenantID)
+	}
+	if c.Authority == "" {
+		c.Authority = defaultAzureAuthority
+	}
+	if u, err := url.Parse(c.Authority); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%s.authority must be an https URL, got %q", configKey, c.Authority)
+	}
+	c.Authority = strings.TrimSuffix(c.Authority, "/")
+	if len(c.AllowedAudiences) == 0 {
+		c.AllowedAudiences = []string{c.ClientID, "api://" + c.ClientID}
+	}
+	if c.AccountClaim == "" {
+		c.AccountClaim = "preferred_username"
+	}
+	if c.JWKSRefreshInterval < 0 || c.HTTPTimeout < 0 {
+		return fmt.Errorf("%s.{jwks_refresh_interval,http_timeout} must not be negative", configKey)
+	}
+	if c.JWKSRefreshInterval == 0 {
+		c.JWKSRefreshInterval = time.Hour
+	}
+	if c.JWKSRefreshInterval < minJWKSRefetchInterval {
+		c.JWKSRefreshInterval = minJWKSRefetchInterval
+	}
+	if c.HTTPTimeout == 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	return nil
+}
+
+// azureClaims are the claims of Azure AD access and ID tokens that are used in addition to the registered ones.
+type azureClaims struct {
+	TenantID string   `json:"tid"`
+	ObjectID string   `json:"oid"`
+	Roles    []string `json:"roles"`
+	Groups   []string `json:"groups"`
+}
+
+// AzureAuth authenticates clients that present Azure AD tokens as the password.
+// Application roles and group object IDs are returned in the "roles" and "groups" labels.
+type AzureAuth struct {
+	config *AzureAuthConfig
+	// Issuers of v2.0 and v1.0 tokens of the tenant.
+	issuers []string
+	keys    *jwksCache
+}
+
+func NewAzureAuth(c *AzureAuthConfig) (*AzureAuth, error) {
+	aa := &AzureAuth{
+		config: c,
+		issuers: []string{
+			fmt.Sprintf("%s/%s/v2.0", c.Authority, c.TenantID),
+			fmt.Sprintf("https://sts.windows.net/%s/", c.TenantID),
+		},
+		keys: newJWKSCache("Azure AD", fmt.Sprintf("%s/%s/discovery/v2.0/keys", c.Authority, c.TenantID),
+			c.JWKSRefreshInterval, c.HTTPTimeout),
+	}
+	// Not fatal, the service may become reachable later.
+	if _, err := aa.keys.signingKeys("", false); err != nil {
+		glog.Warningf("Failed to fetch Azure AD signing keys: %s", err)
+	}
+	glog.Infof("Azure AD auth for tenant %s", c.TenantID)
+	return aa, nil
+}
+
+// unverifiedIssuer returns the issuer of the token, before its signature is checked.
+func unverifiedIssuer(token string) string {
+	return unverifiedClaim(token, "iss")
+}
+
+// unverifiedClaim returns the value of a string claim of the token, before its signature is checked.
+func unverifiedClaim(token, name string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	json.Unmarshal(payload, &claims)
+	s, _ := claims[name].(string)
+	return s
+}
+
+func (aa *AzureAuth) isTenantIssuer(iss string) bool {
+	for _, i := range aa.issuers {
+		if iss == i {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks signature and claims of the token and returns the account name and labels.
+func (aa *AzureAuth) verify(token string) (string, api.Labels, error) {
+	payload, err := aa.keys.verify(token)
+	if err != nil {
+		return "", nil, err
+	}
+	var claims jwt.Claims
+	var ac azureClaims
+	var allClaims map[string]interface{}
+	for _, v := range []interface{}{&claims, &ac, &allClaims} {
+		if err := json.Unmarshal(payload, v); err != nil {
+			return "", nil, fmt.Errorf("invalid claims: %s", err)
+		}
+	}
+	if claims.Expiry == nil {
+		return "", nil, errors.New("token has no expiration time")
+	}
+	switch err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, 0); err {
+	case nil:
+	case jwt.ErrExpired:
+		return "", nil, errJWTExpired
+	case jwt.ErrNotValidYet, jwt.ErrIssuedInTheFuture:
+		return "", nil, errJWTNotYet
+	default:
+		return "", nil, err
+	}
+	if !aa.isTenantIssuer(claims.Issuer) {
+		return "", nil, errJWTIssuer
+	}
+	if !strings.EqualFold(ac.TenantID, aa.config.TenantID) {
+		return "", nil, fmt.Errorf("token is issued by tenant %q", ac.TenantID)
+	}
+	audienceOK := false
+	for _, aud := range aa.config.AllowedAudiences {
+		if claims.Audience.Contains(aud) {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		return "", nil, errJWTAudience
+	}
+	account, _ := allClaims[aa.config.AccountClaim].(string)
+	if account == "" {
+		account = ac.ObjectID
+	}
+	if account == "" {
+		return "", nil, fmt.Errorf("token has neither %s nor oid claim", aa.config.AccountClaim)
+	}
+	labels := api.Labels{}
+	if len(ac.Roles) > 0 {
+		labels["roles"] = ac.Roles
+	}
+	if len(ac.Groups) > 0 {
+		labels["groups"] = ac.Groups
+	}
+	return account, labels, nil
+}
+
+func (aa *AzureAuth) AuthenticateToken(token string) (string, bool, api.Labels, error) {
+	// Tokens of other issuers are left to other authenticators, e.g. jwt_auth.
+	if !looksLikeJWT(token) || !aa.isTenantIssuer(unverifiedIssuer(token)) {
+		return "", false, nil, api.NoMatch
+	}
+	account, labels, err := aa.verify(token)
+	if err != nil {
+		glog.Warningf("Azure AD token rejected: %s", err)
+		return "", false, nil, nil
+	}
+	return account, true, labels, nil
+}
+
+// Authenticate is used if the account name is known, it must match the one in the token.
+func (aa *AzureAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	account, result, labels, err := aa.AuthenticateToken(string(password))
+	if err != nil || !result {
+		return result, labels, err
+	}
+	if account != user {
+		glog.Warningf("Azure AD token rejected: issued to %q, not %q", account, user)
+		return false, nil, nil
+	}
+	return true, labels, nil
+}
+
+// HealthCheck succeeds once signing keys have been fetched.
+func (aa *AzureAuth) HealthCheck() error {
+	_, err := aa.keys.signingKeys("", false)
+	return err
+}
+
+func (aa *AzureAuth) Stop() {
+}
+
+func (aa *AzureAuth) Name() string {
+	return "Azure AD"
+}
@@ -0,0 +1,136 @@
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeJWKS serves keys at path.
+type fakeJWKS struct {
+	path    string
+	lock    sync.Mutex
+	keys    jose.JSONWebKeySet
+	fetches int
+}
+
+func (f *fakeJWKS) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if req.URL.Path != f.path {
+		http.NotFound(rw, req)
+		return
+	}
+	f.fetches++
+	json.NewEncoder(rw).Encode(f.keys)
+}
+
+func (f *fakeJWKS) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.keys.Keys = append(f.keys.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"})
+	return key
+}
+
+func TestAzureAuth(t *testing.T) {
+	jwks := &fakeJWKS{path: "/tenant1/discovery/v2.0/keys"}
+	ts := httptest.NewTLSServer(jwks)
+	defer ts.Close()
+	key1 := jwks.addKey(t, "k1")
+
+	c := &AzureAuthConfig{TenantID: "tenant1", ClientID: "app1", Authority: ts.URL}
+	if err := c.Validate("azure_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	aa, err := NewAzureAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create AzureAuth: %s", err)
+	}
+	aa.keys.client = ts.Client()
+	if err := aa.HealthCheck(); err != nil {
+		t.Fatalf("failed to fetch keys: %s", err)
+	}
+
+	type claims struct {
+		jwt.Claims
+		azureClaims
+		PreferredUsername string `json:"preferred_username,omitempty"`
+	}
+	sign := func(key *rsa.PrivateKey, kid string, cl claims) string {
+		s, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := jwt.Signed(s).Claims(cl).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	valid := claims{
+		Claims: jwt.Claims{
+			Issuer:   ts.URL + "/tenant1/v2.0",
+			Audience: jwt.Audience{"api://app1"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		azureClaims:       azureClaims{TenantID: "tenant1", ObjectID: "oid1", Roles: []string{"Push"}, Groups: []string{"g1", "g2"}},
+		PreferredUsername: "alice@example.com",
+	}
+
+	account, ok, labels, err := aa.AuthenticateToken(sign(key1, "k1", valid))
+	if err != nil || !ok || account != "alice@example.com" ||
+		!reflect.DeepEqual(labels, api.Labels{"roles": {"Push"}, "groups": {"g1", "g2"}}) {
+		t.Errorf("expected valid token to be accepted, got %q %t %v %v", account, ok, labels, err)
+	}
+
+	app := valid
+	app.PreferredUsername, app.Roles, app.Groups = "", nil, nil
+	if account, ok, _, err := aa.AuthenticateToken(sign(key1, "k1", app)); err != nil || !ok || account != "oid1" {
+		t.Errorf("expected oid to be used as account, got %q %t %v", account, ok, err)
+	}
+
+	otherIssuer := valid
+	otherIssuer.Issuer = "https://ci.example.com"
+	if _, _, _, err := aa.AuthenticateToken(sign(key1, "k1", otherIssuer)); err != api.NoMatch {
+		t.Errorf("expected tokens of other issuers to be left to other authenticators, got %v", err)
+	}
+
+	wrongAud, wrongTenant, expired := valid, valid, valid
+	wrongAud.Audience = jwt.Audience{"app2"}
+	wrongTenant.TenantID = "tenant2"
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	for name, cl := range map[string]claims{"wrong audience": wrongAud, "wrong tenant": wrongTenant, "expired": expired} {
+		if _, ok, _, err := aa.AuthenticateToken(sign(key1, "k1", cl)); ok || err != nil {
+			t.Errorf("%s: expected token to be rejected, got %t %v", name, ok, err)
+		}
+	}
+	if ok, _, err := aa.Authenticate("bob@example.com", api.PasswordString(sign(key1, "k1", valid))); ok || err != nil {
+		t.Errorf("expected token of another user to be rejected, got %t %v", ok, err)
+	}
+
+	// Key rollover: unknown key ID results in a refetch, but not more often than once a minute.
+	key2 := jwks.addKey(t, "k2")
+	fetches := jwks.fetches
+	if _, ok, _, _ := aa.AuthenticateToken(sign(key2, "k2", valid)); ok || jwks.fetches != fetches {
+		t.Errorf("expected no refetch right after the last one, got %t, %d fetches", ok, jwks.fetches-fetches)
+	}
+	aa.keys.lastFetch = time.Now().Add(-2 * minJWKSRefetchInterval)
+	if _, ok, _, err := aa.AuthenticateToken(sign(key2, "k2", valid)); !ok || err != nil || jwks.fetches != fetches+1 {
+		t.Errorf("expected token signed with the new key to be accepted, got %t %v, %d fetches", ok, err, jwks.fetches-fetches)
+	}
+}
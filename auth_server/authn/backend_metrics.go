@@ -0,0 +1,149 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outcomes of backend calls.
+const (
+	BackendSuccess = "success"
+	// The backend answered, but rejected the credentials or had no such user.
+	BackendFailure = "failure"
+	BackendError   = "error"
+)
+
+// BackendCall identifies a kind of upstream call of a backend, e.g. {"ldap", "bind", "success"}.
+type BackendCall struct {
+	Backend, Op, Outcome string
+}
+
+// Latencies of upstream calls of backends, exported as metrics by the server. They are only
+// recorded when enabled by EnableBackendMetrics, so that the calls are not slowed down otherwise.
+var (
+	backendMetricsEnabled int32
+	backendCallsLock      sync.Mutex
+	backendCalls          = map[BackendCall]*latencyHistogram{}
+)
+
+// EnableBackendMetrics turns recording of backend call latencies on or off.
+func EnableBackendMetrics(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&backendMetricsEnabled, v)
+}
+
+// StartBackendCall returns the start time to pass to ObserveBackendCall, or zero time if backend
+// metrics are disabled.
+func StartBackendCall() time.Time {
+	if atomic.LoadInt32(&backendMetricsEnabled) == 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// ObserveBackendCall records the latency of the call that started at start, unless it is zero.
+func ObserveBackendCall(backend, op string, start time.Time, outcome string) {
+	if start.IsZero() {
+		return
+	}
+	d := time.Since(start)
+	c := BackendCall{Backend: backend, Op: op, Outcome: outcome}
+	backendCallsLock.Lock()
+	h := backendCalls[c]
+	if h == nil {
+		h = &latencyHistogram{}
+		backendCalls[c] = h
+	}
+	backendCallsLock.Unlock()
+	h.observe(d)
+}
+
+// BackendCallLatency returns the number and total duration in seconds of the calls, and the
+// cumulative counts by upper bound of GCSLatencyBuckets.
+func BackendCallLatency(c BackendCall) (uint64, float64, map[float64]uint64) {
+	backendCallsLock.Lock()
+	h := backendCalls[c]
+	backendCallsLock.Unlock()
+	return h.snapshot()
+}
+
+// BackendCalls returns the kinds of backend calls that were recorded so far.
+func BackendCalls() []BackendCall {
+	backendCallsLock.Lock()
+	defer backendCallsLock.Unlock()
+	calls := make([]BackendCall, 0, len(backendCalls))
+	for c := range backendCalls {
+		calls = append(calls, c)
+	}
+	return calls
+}
+
+// BackendOutcome returns the outcome of a call that returned err.
+func BackendOutcome(err error) string {
+	if err != nil {
+		return BackendError
+	}
+	return BackendSuccess
+}
+
+type latencyHistogram struct {
+	lock    sync.Mutex
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	s := d.Seconds()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(GCSLatencyBuckets))
+	}
+	h.count++
+	h.sum += s
+	for i, b := range GCSLatencyBuckets {
+		if s <= b {
+			h.buckets[i]++
+			break
+		}
+	}
+}
+
+// snapshot returns the count, the sum and the cumulative bucket counts, see BackendCallLatency.
+func (h *latencyHistogram) snapshot() (uint64, float64, map[float64]uint64) {
+	if h == nil {
+		return 0, 0, nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	buckets := make(map[float64]uint64, len(GCSLatencyBuckets))
+	var n uint64
+	for i, b := range GCSLatencyBuckets {
+		if h.buckets != nil {
+			n += h.buckets[i]
+		}
+		buckets[b] = n
+	}
+	return h.count, h.sum, buckets
+}
@@ -0,0 +1,51 @@
+package authn
+
+import "testing"
+
+func TestBackendMetrics(t *testing.T) {
+	calls := func(backend, op, outcome string) uint64 {
+		n, _, _ := BackendCallLatency(BackendCall{Backend: backend, Op: op, Outcome: outcome})
+		return n
+	}
+	ea := newTestExtAuth(t, `read user password
+[ "$password" = "s3cret" ] || exit 1
+`)
+	la := newFakeLDAPAuth(t, &fakeLDAPServer{}, nil)
+
+	// Nothing is recorded while disabled.
+	before := calls("ext", "command", BackendSuccess)
+	ea.Authenticate("alice", "s3cret")
+	if n := calls("ext", "command", BackendSuccess); n != before {
+		t.Errorf("expected no calls to be recorded while disabled, got %d", n-before)
+	}
+
+	EnableBackendMetrics(true)
+	defer EnableBackendMetrics(false)
+	expected := map[BackendCall]uint64{}
+	for _, c := range []BackendCall{
+		{"ext", "command", BackendSuccess},
+		{"ext", "command", BackendFailure},
+		{"ext", "command", BackendError},
+		{"ldap", "bind", BackendSuccess},
+		{"ldap", "bind", BackendFailure},
+	} {
+		expected[c] = calls(c.Backend, c.Op, c.Outcome) + 1
+	}
+	ea.Authenticate("alice", "s3cret")
+	ea.Authenticate("alice", "wrong")
+	newTestExtAuth(t, "exit 3\n").Authenticate("alice", "s3cret")
+	la.Authenticate("alice", "secret")
+	la.Authenticate("alice", "wrong")
+	for c, n := range expected {
+		if got := calls(c.Backend, c.Op, c.Outcome); got != n {
+			t.Errorf("%+v: expected %d calls, got %d", c, n, got)
+		}
+	}
+	found := false
+	for _, c := range BackendCalls() {
+		found = found || c == BackendCall{"ldap", "bind", BackendFailure}
+	}
+	if !found {
+		t.Errorf("expected recorded calls to be listed, got %v", BackendCalls())
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+type ClientCertAuthConfig struct {
+	// PEM file with certificates of the CAs that client certificates must be issued by.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Where to take the account name from: cn (default), san_dns, san_email or san_uri.
+	// For SANs, the first one is used.
+	AccountFrom string `yaml:"account_from,omitempty"`
+
+	pool *x509.CertPool
+}
+
+func (c *ClientCertAuthConfig) Validate(configKey string) error {
+	if c.CAFile == "" {
+		return fmt.Errorf("%s.ca_file is required", configKey)
+	}
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", c.CAFile, err)
+	}
+	c.pool = x509.NewCertPool()
+	if !c.pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", c.CAFile)
+	}
+	switch c.AccountFrom {
+	case "":
+		c.AccountFrom = "cn"
+	case "cn", "san_dns", "san_email", "san_uri":
+	default:
+		return fmt.Errorf("%s.account_from must be one of cn, san_dns, san_email, san_uri, got %q", configKey, c.AccountFrom)
+	}
+	return nil
+}
+
+// CertPool returns the pool of trusted CAs, loaded by Validate.
+func (c *ClientCertAuthConfig) CertPool() *x509.CertPool {
+	return c.pool
+}
+
+type ClientCertAuth struct {
+	config *ClientCertAuthConfig
+}
+
+func NewClientCertAuth(c *ClientCertAuthConfig) (*ClientCertAuth, error) {
+	if c.pool == nil {
+		return nil, fmt.Errorf("CA pool is not loaded")
+	}
+	glog.Infof("Client certificate auth with CAs from %s", c.CAFile)
+	return &ClientCertAuth{config: c}, nil
+}
+
+func (ca *ClientCertAuth) AuthenticateCertificate(certs []*x509.Certificate) (string, bool, api.Labels, error) {
+	if len(certs) == 0 {
+		return "", false, nil, api.NoMatch
+	}
+	// The listener may be configured to not verify certificates, so this is done here.
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	cert := certs[0]
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         ca.config.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		glog.Warningf("Client certificate %q rejected: %s", cert.Subject, err)
+		return "", false, nil, nil
+	}
+	account := ""
+	switch ca.config.AccountFrom {
+	case "cn":
+		account = cert.Subject.CommonName
+	case "san_dns":
+		if len(cert.DNSNames) > 0 {
+			account = cert.DNSNames[0]
+		}
+	case "san_email":
+		if len(cert.EmailAddresses) > 0 {
+			account = cert.EmailAddresses[0]
+		}
+	case "san_uri":
+		if len(cert.URIs) > 0 {
+			account = cert.URIs[0].String()
+		}
+	}
+	if account == "" {
+		glog.Warningf("Client certificate %q has no %s to use as account name", cert.Subject, ca.config.AccountFrom)
+		return "", false, nil, nil
+	}
+	return account, true, nil, nil
+}
+
+// Authenticate does not apply, client certificates are handled by AuthenticateCertificate.
+func (ca *ClientCertAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	return false, nil, api.NoMatch
+}
+
+func (ca *ClientCertAuth) Stop() {
+}
+
+func (ca *ClientCertAuth) Name() string {
+	return "client certificate"
+}
@@ -0,0 +1,79 @@
+package authn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn + ".example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca, caKey := newTestCert(t, "CA", nil, nil)
+	otherCA, otherCAKey := newTestCert(t, "Other CA", nil, nil)
+	client, _ := newTestCert(t, "builder", ca, caKey)
+	impostor, _ := newTestCert(t, "builder", otherCA, otherCAKey)
+
+	c := &ClientCertAuthConfig{pool: x509.NewCertPool()}
+	c.pool.AddCert(ca)
+	cases := []struct {
+		accountFrom string
+		certs       []*x509.Certificate
+		account     string
+		ok          bool
+	}{
+		{"cn", []*x509.Certificate{client}, "builder", true},
+		{"san_dns", []*x509.Certificate{client}, "builder.example.com", true},
+		{"san_email", []*x509.Certificate{client}, "", false},
+		{"cn", []*x509.Certificate{impostor}, "", false},
+	}
+	for i, tc := range cases {
+		c.AccountFrom = tc.accountFrom
+		cca, err := NewClientCertAuth(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		account, ok, _, err := cca.AuthenticateCertificate(tc.certs)
+		if err != nil || ok != tc.ok || account != tc.account {
+			t.Errorf("%d: expected %q %t, got %q %t %v", i, tc.account, tc.ok, account, ok, err)
+		}
+	}
+	cca, _ := NewClientCertAuth(c)
+	if _, _, _, err := cca.AuthenticateCertificate(nil); err != api.NoMatch {
+		t.Errorf("expected NoMatch without certificates, got %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+var (
+	awsRegionRegex         = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	cognitoUserPoolIDRegex = regexp.MustCompile(`^([a-z]{2}(-[a-z]+)+-[0-9]+)_[0-9A-Za-z]+$`)
+)
+
+type CognitoAuthConfig struct {
+	// AWS region of the user pool, e.g. eu-west-1.
+	Region string `yaml:"region,omitempty"`
+	// ID of the user pool, e.g. eu-west-1_AbCdEfGhI. Tokens issued by other pools are rejected.
+	UserPoolID string `yaml:"user_pool_id,omitempty"`
+	// App client IDs tokens must be issued to ("aud" of ID tokens, "client_id" of access tokens). Default is any.
+	ClientIDs []string `yaml:"client_ids,omitempty"`
+	// Kinds of tokens accepted, "access" and/or "id". Default is both.
+	TokenUse []string `yaml:"token_use,omitempty"`
+	// Claim to use as account name. Default is cognito:username for ID tokens and username for access tokens.
+	AccountClaim string `yaml:"account_claim,omitempty"`
+	// Base URL of the Cognito IdP service, default is https://cognito-idp.<region>.amazonaws.com.
+	// Tokens must be issued by <endpoint>/<user pool ID>.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// How often the signing keys of the pool are refreshed.
+	JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval,omitempty"`
+	HTTPTimeout         time.Duration `yaml:"http_timeout,omitempty"`
+}
+
+func (c *CognitoAuthConfig) Validate(configKey string) error {
+	if c.Region == "" || c.UserPoolID == "" {
+		return fmt.Errorf("%s.{region,user_pool_id} are required", configKey)
+	}
+	if !awsRegionRegex.MatchString(c.Region) {
+		return fmt.Errorf("%s.region is not a valid AWS region: %q", configKey, c.Region)
+	}
+	m := cognitoUserPoolIDRegex.FindStringSubmatch(c.UserPoolID)
+	if m == nil {
+		return fmt.Errorf("%s.user_pool_id must be <region>_<ID>, got %q", configKey, c.UserPoolID)
+	}
+	if m[1] != c.Region {
+		return fmt.Errorf("%s.user_pool_id %q is not in region %s", configKey, c.UserPoolID, c.Region)
+	}
+	if len(c.TokenUse) == 0 {
+		c.TokenUse = []string{"access", "id"}
+	}
+	for _, tu := range c.TokenUse {
+		if tu != "access" && tu != "id" {
+			return fmt.Errorf("%s.token_use must be access and/or id, got %q", configKey, tu)
+		}
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = fmt.Sprintf("https://cognito-idp.%s.amazonaws.com", c.Region)
+	}
+	if u, err := url.Parse(c.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%s.endpoint must be an https URL, got %q", configKey, c.Endpoint)
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	if c.JWKSRefreshInterval < 0 || c.HTTPTimeout < 0 {
+		return fmt.Errorf("%s.{jwks_refresh_interval,http_timeout} must not be negative", configKey)
+	}
+	if c.JWKSRefreshInterval == 0 {
+		c.JWKSRefreshInterval = time.Hour
+	}
+	if c.JWKSRefreshInterval < minJWKSRefetchInterval {
+		c.JWKSRefreshInterval = minJWKSRefetchInterval
+	}
+	if c.HTTPTimeout == 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	return nil
+}
+
+// cognitoClaims are the claims of Cognito access and ID tokens that are used in addition to the registered ones.
+type cognitoClaims struct {
+	TokenUse string   `json:"token_use"`
+	ClientID string   `json:"client_id"`
+	Groups   []string `json:"cognito:groups"`
+}
+
+// CognitoAuth authenticates clients that present Cognito user pool tokens as the password.
+// Groups of the user are returned in the "groups" label.
+type CognitoAuth struct {
+	config *CognitoAuthConfig
+	issuer string
+	keys   *jwksCache
+}
+
+func NewCognitoAuth(c *CognitoAuthConfig) (*CognitoAuth, error) {
+	issuer := fmt.Sprintf("%s/%s", c.Endpoint, c.UserPoolID)
+	ca := &CognitoAuth{
+		config: c,
+		issuer: issuer,
+		keys:   newJWKSCache("Cognito", issuer+"/.well-known/jwks.json", c.JWKSRefreshInterval, c.HTTPTimeout),
+	}
+	// Not fatal, the service may become reachable later.
+	if _, err := ca.keys.signingKeys("", false); err != nil {
+		glog.Warningf("Failed to fetch Cognito signing keys: %s", err)
+	}
+	glog.Infof("Cognito auth for user pool %s", c.UserPoolID)
+	return ca, nil
+}
+
+func (ca *CognitoAuth) tokenUseAllowed(tu string) bool {
+	for _, t := range ca.config.TokenUse {
+		if t == tu {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed checks the app client of the token, which is the audience of ID tokens
+// and the client_id claim of access tokens, which have no audience.
+func (ca *CognitoAuth) clientAllowed(claims *jwt.Claims, cc *cognitoClaims) bool {
+	if len(ca.config.ClientIDs) == 0 {
+		return true
+	}
+	for _, id := range ca.config.ClientIDs {
+		if (cc.TokenUse == "id" && claims.Audience.Contains(id)) || (cc.TokenUse == "access" && cc.ClientID == id) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks signature and claims of the token and returns the account name and labels.
+func (ca *CognitoAuth) verify(token string) (string, api.Labels, error) {
+	payload, err := ca.keys.verify(token)
+	if err != nil {
+		return "", nil, err
+	}
+	var claims jwt.Claims
+	var cc cognitoClaims
+	var allClaims map[string]interface{}
+	for _, v := range []interface{}{&claims, &cc, &allClaims} {
+		if err := json.Unmarshal(payload, v); err != nil {
+			return "", nil, fmt.Errorf("invalid claims: %s", err)
+		}
+	}
+	if claims.Expiry == nil {
+		return "", nil, errors.New("token has no expiration time")
+	}
+	switch err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, 0); err {
+	case nil:
+	case jwt.ErrExpired:
+		return "", nil, errJWTExpired
+	case jwt.ErrNotValidYet, jwt.ErrIssuedInTheFuture:
+		return "", nil, errJWTNotYet
+	default:
+		return "", nil, err
+	}
+	if claims.Issuer != ca.issuer {
+		return "", nil, errJWTIssuer
+	}
+	if !ca.tokenUseAllowed(cc.TokenUse) {
+		return "", nil, fmt.Errorf("%q tokens are not accepted", cc.TokenUse)
+	}
+	if !ca.clientAllowed(&claims, &cc) {
+		return "", nil, errJWTAudience
+	}
+	accountClaim := ca.config.AccountClaim
+	if accountClaim == "" {
+		accountClaim = "username"
+		if cc.TokenUse == "id" {
+			accountClaim = "cognito:username"
+		}
+	}
+	account, _ := allClaims[accountClaim].(string)
+	if account == "" {
+		return "", nil, fmt.Errorf("token has no %s claim", accountClaim)
+	}
+	labels := api.Labels{}
+	if len(cc.Groups) > 0 {
+		labels["groups"] = cc.Groups
+	}
+	return account, labels, nil
+}
+
+func (ca *CognitoAuth) AuthenticateToken(token string) (string, bool, api.Labels, error) {
+	// Tokens of other issuers are left to other authenticators, e.g. jwt_auth.
+	if !looksLikeJWT(token) || unverifiedIssuer(token) != ca.issuer {
+		return "", false, nil, api.NoMatch
+	}
+	account, labels, err := ca.verify(token)
+	if err != nil {
+		glog.Warningf("Cognito token rejected: %s", err)
+		return "", false, nil, nil
+	}
+	return account, true, labels, nil
+}
+
+// Authenticate is used if the account name is known, it must match the one in the token.
+func (ca *CognitoAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	account, result, labels, err := ca.AuthenticateToken(string(password))
+	if err != nil || !result {
+		return result, labels, err
+	}
+	if account != user {
+		glog.Warningf("Cognito token rejected: issued to %q, not %q", account, user)
+		return false, nil, nil
+	}
+	return true, labels, nil
+}
+
+// HealthCheck succeeds once signing keys have been fetched.
+func (ca *CognitoAuth) HealthCheck() error {
+	_, err := ca.keys.signingKeys("", false)
+	return err
+}
+
+func (ca *CognitoAuth) Stop() {
+}
+
+func (ca *CognitoAuth) Name() string {
+	return "Cognito"
+}
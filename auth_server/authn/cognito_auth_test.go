@@ -0,0 +1,126 @@
+package authn
+
+import (
+	"crypto/rsa"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestCognitoAuthConfig(t *testing.T) {
+	for _, c := range []CognitoAuthConfig{
+		{UserPoolID: "eu-west-1_AbCdEf"},
+		{Region: "eu-west-1"},
+		{Region: "Europe", UserPoolID: "eu-west-1_AbCdEf"},
+		{Region: "eu-west-1", UserPoolID: "AbCdEf"},
+		{Region: "eu-west-1", UserPoolID: "us-east-1_AbCdEf"},
+		{Region: "eu-west-1", UserPoolID: "eu-west-1_AbCdEf", TokenUse: []string{"refresh"}},
+	} {
+		if err := c.Validate("cognito_auth"); err == nil {
+			t.Errorf("%+v: expected to fail", c)
+		}
+	}
+	c := &CognitoAuthConfig{Region: "us-gov-west-1", UserPoolID: "us-gov-west-1_AbCdEf"}
+	if err := c.Validate("cognito_auth"); err != nil || c.Endpoint != "https://cognito-idp.us-gov-west-1.amazonaws.com" {
+		t.Errorf("expected valid config with default endpoint, got %q %v", c.Endpoint, err)
+	}
+}
+
+func TestCognitoAuth(t *testing.T) {
+	jwks := &fakeJWKS{path: "/eu-west-1_pool1/.well-known/jwks.json"}
+	ts := httptest.NewTLSServer(jwks)
+	defer ts.Close()
+	key1 := jwks.addKey(t, "k1")
+
+	c := &CognitoAuthConfig{Region: "eu-west-1", UserPoolID: "eu-west-1_pool1", ClientIDs: []string{"app1"}, Endpoint: ts.URL}
+	if err := c.Validate("cognito_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	ca, err := NewCognitoAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create CognitoAuth: %s", err)
+	}
+	ca.keys.client = ts.Client()
+	if err := ca.HealthCheck(); err != nil {
+		t.Fatalf("failed to fetch keys: %s", err)
+	}
+
+	type claims struct {
+		jwt.Claims
+		cognitoClaims
+		Username        string `json:"username,omitempty"`
+		CognitoUsername string `json:"cognito:username,omitempty"`
+	}
+	sign := func(key *rsa.PrivateKey, kid string, cl claims) string {
+		s, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := jwt.Signed(s).Claims(cl).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	access := claims{
+		Claims: jwt.Claims{
+			Issuer: ts.URL + "/eu-west-1_pool1",
+			Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		cognitoClaims: cognitoClaims{TokenUse: "access", ClientID: "app1", Groups: []string{"devs", "ops"}},
+		Username:      "alice",
+	}
+	id := access
+	id.TokenUse, id.ClientID, id.Username, id.CognitoUsername = "id", "", "", "alice"
+	id.Audience = jwt.Audience{"app1"}
+
+	for name, cl := range map[string]claims{"access": access, "id": id} {
+		account, ok, labels, err := ca.AuthenticateToken(sign(key1, "k1", cl))
+		if err != nil || !ok || account != "alice" || !reflect.DeepEqual(labels, api.Labels{"groups": {"devs", "ops"}}) {
+			t.Errorf("%s: expected valid token to be accepted, got %q %t %v %v", name, account, ok, labels, err)
+		}
+	}
+
+	otherPool := access
+	otherPool.Issuer = ts.URL + "/eu-west-1_pool2"
+	if _, _, _, err := ca.AuthenticateToken(sign(key1, "k1", otherPool)); err != api.NoMatch {
+		t.Errorf("expected tokens of other pools to be left to other authenticators, got %v", err)
+	}
+
+	wrongClient, wrongAud, refresh, expired := access, id, access, access
+	wrongClient.ClientID = "app2"
+	wrongAud.Audience = jwt.Audience{"app2"}
+	refresh.TokenUse = "refresh"
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	for name, cl := range map[string]claims{"wrong client": wrongClient, "wrong audience": wrongAud, "refresh": refresh, "expired": expired} {
+		if _, ok, _, err := ca.AuthenticateToken(sign(key1, "k1", cl)); ok || err != nil {
+			t.Errorf("%s: expected token to be rejected, got %t %v", name, ok, err)
+		}
+	}
+	if ok, _, err := ca.Authenticate("bob", api.PasswordString(sign(key1, "k1", access))); ok || err != nil {
+		t.Errorf("expected token of another user to be rejected, got %t %v", ok, err)
+	}
+
+	// Only ID tokens, account from a custom claim.
+	c.TokenUse, c.AccountClaim = []string{"id"}, "username"
+	id.Username = "alice@example.com"
+	if _, ok, _, _ := ca.AuthenticateToken(sign(key1, "k1", access)); ok {
+		t.Errorf("expected access token to be rejected")
+	}
+	if account, ok, _, err := ca.AuthenticateToken(sign(key1, "k1", id)); !ok || err != nil || account != "alice@example.com" {
+		t.Errorf("expected account from custom claim, got %q %t %v", account, ok, err)
+	}
+
+	// Key rotation: tokens signed with a new key are accepted after a refetch.
+	key2 := jwks.addKey(t, "k2")
+	ca.keys.lastFetch = time.Now().Add(-2 * minJWKSRefetchInterval)
+	if _, ok, _, err := ca.AuthenticateToken(sign(key2, "k2", id)); !ok || err != nil {
+		t.Errorf("expected token signed with the new key to be accepted, got %t %v", ok, err)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimit caps the number of simultaneous upstream calls of a backend, independently
+// of the number of requests the server handles. It is part of the configs of backends that support it.
+type ConcurrencyLimit struct {
+	// Maximum number of calls in progress. Default is 0, i.e. no limit.
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+	// What to do with calls over the limit: "queue" (default) waits for a call to complete,
+	// "reject" fails immediately. Either way, a call that does not start fails the request with 503.
+	OverLimit string `yaml:"over_limit,omitempty"`
+	// How long queued calls wait, default is 5s.
+	QueueTimeout time.Duration `yaml:"queue_timeout,omitempty"`
+}
+
+const defaultConcurrencyQueueTimeout = 5 * time.Second
+
+func (c *ConcurrencyLimit) Validate(configKey string) error {
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("%s.max_concurrent must not be negative", configKey)
+	}
+	switch c.OverLimit {
+	case "":
+		c.OverLimit = "queue"
+	case "queue", "reject":
+	default:
+		return fmt.Errorf("%s.over_limit must be queue or reject, got %q", configKey, c.OverLimit)
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("%s.queue_timeout must not be negative", configKey)
+	}
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = defaultConcurrencyQueueTimeout
+	}
+	return nil
+}
+
+// Number of calls in progress, by backend, exported as a metric by the server.
+var concurrencyInFlight = map[string]*int64{
+	"ext":   new(int64),
+	"ldap":  new(int64),
+	"mongo": new(int64),
+}
+
+// ConcurrentCalls returns the number of calls of the backend (ext, ldap, mongo) in progress.
+func ConcurrentCalls(backend string) int64 {
+	return atomic.LoadInt64(concurrencyInFlight[backend])
+}
+
+// concurrencyLimiter tracks calls in progress and, if there is a limit, enforces it.
+type concurrencyLimiter struct {
+	config   *ConcurrencyLimit
+	backend  string
+	slots    chan struct{}
+	inFlight *int64
+}
+
+func newConcurrencyLimiter(c *ConcurrencyLimit, backend string) *concurrencyLimiter {
+	cl := &concurrencyLimiter{config: c, backend: backend, inFlight: concurrencyInFlight[backend]}
+	if c.MaxConcurrent > 0 {
+		cl.slots = make(chan struct{}, c.MaxConcurrent)
+	}
+	return cl
+}
+
+// acquire waits for a slot if necessary. If it returns nil, release must be called when the call completes.
+func (cl *concurrencyLimiter) acquire() error {
+	if cl.slots != nil {
+		select {
+		case cl.slots <- struct{}{}:
+		default:
+			if cl.config.OverLimit == "reject" {
+				return fmt.Errorf("too many concurrent %s requests (%d)", cl.backend, cl.config.MaxConcurrent)
+			}
+			t := time.NewTimer(cl.config.QueueTimeout)
+			defer t.Stop()
+			select {
+			case cl.slots <- struct{}{}:
+			case <-t.C:
+				return fmt.Errorf("too many concurrent %s requests (%d), timed out after %s", cl.backend, cl.config.MaxConcurrent, cl.config.QueueTimeout)
+			}
+		}
+	}
+	atomic.AddInt64(cl.inFlight, 1)
+	return nil
+}
+
+func (cl *concurrencyLimiter) release() {
+	atomic.AddInt64(cl.inFlight, -1)
+	if cl.slots != nil {
+		<-cl.slots
+	}
+}
@@ -0,0 +1,63 @@
+package authn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	c := &ConcurrencyLimit{MaxConcurrent: 2, OverLimit: "reject"}
+	if err := c.Validate("ldap_auth"); err != nil {
+		t.Fatal(err)
+	}
+	cl := newConcurrencyLimiter(c, "ldap")
+	before := ConcurrentCalls("ldap")
+	for i := 0; i < 2; i++ {
+		if err := cl.acquire(); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	if n := ConcurrentCalls("ldap") - before; n != 2 {
+		t.Errorf("expected 2 calls in flight, got %d", n)
+	}
+	if err := cl.acquire(); err == nil {
+		t.Errorf("expected call over the limit to be rejected")
+	}
+
+	// Queued calls wait for a slot, up to the timeout.
+	c.OverLimit, c.QueueTimeout = "queue", 50*time.Millisecond
+	if err := cl.acquire(); err == nil {
+		t.Errorf("expected queued call to time out")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cl.release()
+	}()
+	if err := cl.acquire(); err != nil {
+		t.Errorf("expected queued call to get the released slot, got %s", err)
+	}
+	cl.release()
+	cl.release()
+	if n := ConcurrentCalls("ldap") - before; n != 0 {
+		t.Errorf("expected no calls in flight, got %d", n)
+	}
+
+	// No limit by default.
+	c = &ConcurrencyLimit{}
+	if err := c.Validate("ldap_auth"); err != nil {
+		t.Fatal(err)
+	}
+	cl = newConcurrencyLimiter(c, "ldap")
+	for i := 0; i < 100; i++ {
+		if err := cl.acquire(); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		cl.release()
+	}
+
+	if err := (&ConcurrencyLimit{MaxConcurrent: 1, OverLimit: "drop"}).Validate("ldap_auth"); err == nil {
+		t.Errorf("expected invalid over_limit to be rejected")
+	}
+}
@@ -17,11 +17,15 @@
 package authn
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/cesanta/glog"
 
@@ -31,8 +35,48 @@ import (
 type ExtAuthConfig struct {
 	Command string   `yaml:"command"`
 	Args    []string `yaml:"args"`
+	// Number of times to retry the command if it could not be run or returned an error.
+	// Denials and NoMatch are never retried.
+	Retries int `yaml:"retries,omitempty"`
+	// Delay before the first retry, doubled for every next one up to maxExtAuthRetryBackoff.
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+	// Overall time limit of the request: a retry is not attempted if it would start after it.
+	RetryDeadline time.Duration `yaml:"retry_deadline,omitempty"`
+	// Time limit of a single run of the command. When it is exceeded, the command and any processes
+	// it started are killed. Default is 30s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Names of the environment variables of the server that are passed to the command, others are not.
+	// Default is PATH, HOME, LANG, LC_ALL, TZ and TMPDIR.
+	Env []string `yaml:"env,omitempty"`
+	// Limits the number of runs of the command in progress at the same time, including retries.
+	ConcurrencyLimit `yaml:",inline"`
+	// What happens if the command fails, after retries, as opposed to denying the user: closed (default)
+	// fails authentication, open authenticates the user without checking the password, with
+	// fail_open_labels (default fail_open: ["true"]), which ACL entries can match to limit their access.
+	FailMode       string     `yaml:"fail_mode,omitempty"`
+	FailOpenLabels api.Labels `yaml:"fail_open_labels,omitempty"`
 }
 
+const (
+	defaultExtAuthRetryBackoff  = 100 * time.Millisecond
+	maxExtAuthRetryBackoff      = 5 * time.Second
+	defaultExtAuthRetryDeadline = 10 * time.Second
+	defaultExtAuthTimeout       = 30 * time.Second
+
+	ExtAuthFailClosed = "closed"
+	ExtAuthFailOpen   = "open"
+)
+
+// Number of users authenticated by ext_auth in fail-open mode, exported as a metric by the server.
+var extAuthFailOpen uint64
+
+// ExtAuthFailOpenRequests returns the number of users that ext_auth authenticated because the command failed.
+func ExtAuthFailOpenRequests() uint64 {
+	return atomic.LoadUint64(&extAuthFailOpen)
+}
+
+var defaultExtAuthEnv = []string{"PATH", "HOME", "LANG", "LC_ALL", "TZ", "TMPDIR"}
+
 type ExtAuthStatus int
 
 const (
@@ -50,53 +94,163 @@ func (c *ExtAuthConfig) Validate() error {
 	if c.Command == "" {
 		return fmt.Errorf("command is not set")
 	}
-	if _, err := exec.LookPath(c.Command); err != nil {
+	// Resolved here, so that it does not depend on PATH of the command's environment.
+	path, err := exec.LookPath(c.Command)
+	if err != nil {
 		return fmt.Errorf("invalid command %q: %s", c.Command, err)
 	}
-	return nil
+	c.Command = path
+	if c.Retries < 0 || c.RetryBackoff < 0 || c.RetryDeadline < 0 || c.Timeout < 0 {
+		return fmt.Errorf("retries, retry_backoff, retry_deadline and timeout must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultExtAuthTimeout
+	}
+	if c.Env == nil {
+		c.Env = defaultExtAuthEnv
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultExtAuthRetryBackoff
+	}
+	if c.RetryDeadline == 0 {
+		c.RetryDeadline = defaultExtAuthRetryDeadline
+	}
+	switch c.FailMode {
+	case "":
+		c.FailMode = ExtAuthFailClosed
+	case ExtAuthFailClosed, ExtAuthFailOpen:
+	default:
+		return fmt.Errorf("fail_mode must be %s or %s, got %q", ExtAuthFailClosed, ExtAuthFailOpen, c.FailMode)
+	}
+	if c.FailMode == ExtAuthFailOpen {
+		if c.FailOpenLabels == nil {
+			c.FailOpenLabels = api.Labels{"fail_open": {"true"}}
+		}
+	} else if len(c.FailOpenLabels) > 0 {
+		return fmt.Errorf("fail_open_labels requires fail_mode: %s", ExtAuthFailOpen)
+	}
+	return c.ConcurrencyLimit.Validate("ext_auth")
 }
 
 type extAuth struct {
-	cfg *ExtAuthConfig
+	cfg     *ExtAuthConfig
+	limiter *concurrencyLimiter
 }
 
 func NewExtAuth(cfg *ExtAuthConfig) *extAuth {
 	glog.Infof("External authenticator: %s %s", cfg.Command, strings.Join(cfg.Args, " "))
-	return &extAuth{cfg: cfg}
+	if cfg.FailMode == ExtAuthFailOpen {
+		glog.Warningf("External authentication fails open: if the command fails, users are authenticated with labels %v", cfg.FailOpenLabels)
+	}
+	return &extAuth{cfg: cfg, limiter: newConcurrencyLimiter(&cfg.ConcurrencyLimit, "ext")}
 }
 
 func (ea *extAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	if err := ea.limiter.acquire(); err != nil {
+		return false, nil, err
+	}
+	defer ea.limiter.release()
+	deadline := time.Now().Add(ea.cfg.RetryDeadline)
+	backoff := ea.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		es, output, et := ea.run(user, password)
+		switch ExtAuthStatus(es) {
+		case ExtAuthAllowed:
+			var resp ExtAuthResponse
+			if len(output) > 0 {
+				if err := json.Unmarshal(output, &resp); err != nil {
+					return false, nil, err
+				}
+			}
+			return true, resp.Labels, nil
+		case ExtAuthDenied:
+			return false, nil, nil
+		case ExtAuthNoMatch:
+			return false, nil, api.NoMatch
+		}
+		if attempt > ea.cfg.Retries || time.Now().Add(backoff).After(deadline) {
+			glog.Errorf("Ext command error: %d %s", es, et)
+			if ea.cfg.FailMode == ExtAuthFailOpen {
+				atomic.AddUint64(&extAuthFailOpen, 1)
+				glog.Errorf("FAIL OPEN: ext_auth command failed (%d), authenticating %q with labels %v", es, user, ea.cfg.FailOpenLabels)
+				return true, ea.failOpenLabels(), nil
+			}
+			if attempt > 1 {
+				return false, nil, fmt.Errorf("bad return code from command: %d (%d attempts)", es, attempt)
+			}
+			return false, nil, fmt.Errorf("bad return code from command: %d", es)
+		}
+		glog.V(2).Infof("Ext command error: %d %s, retrying in %s", es, et, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxExtAuthRetryBackoff {
+			backoff = maxExtAuthRetryBackoff
+		}
+	}
+}
+
+// failOpenLabels returns a copy of fail_open_labels, so that they are not modified by later stages.
+func (ea *extAuth) failOpenLabels() api.Labels {
+	labels := api.Labels{}
+	for k, v := range ea.cfg.FailOpenLabels {
+		labels[k] = append([]string(nil), v...)
+	}
+	return labels
+}
+
+// env returns the allowed variables of the server environment.
+func (ea *extAuth) env() []string {
+	env := []string{}
+	for _, name := range ea.cfg.Env {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// run runs the command once and returns its exit status, output and error output.
+// Credentials are only passed on stdin, so that they are not visible to other users in ps.
+func (ea *extAuth) run(user string, password api.PasswordString) (int, []byte, string) {
 	cmd := exec.Command(ea.cfg.Command, ea.cfg.Args...)
 	cmd.Stdin = strings.NewReader(fmt.Sprintf("%s %s", user, string(password)))
-	output, err := cmd.Output()
+	cmd.Env = ea.env()
+	// In its own process group, so that processes it starts can be killed along with it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	start := StartBackendCall()
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-time.After(ea.cfg.Timeout):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			err = fmt.Errorf("timed out after %s", ea.cfg.Timeout)
+		}
+	}
 	es := 0
 	et := ""
 	if err == nil {
 	} else if ee, ok := err.(*exec.ExitError); ok {
 		es = ee.Sys().(syscall.WaitStatus).ExitStatus()
-		et = string(ee.Stderr)
+		et = stderr.String()
 	} else {
 		es = int(ExtAuthError)
 		et = fmt.Sprintf("cmd run error: %s", err)
 	}
-	glog.V(2).Infof("%s %s -> %d %s", cmd.Path, cmd.Args, es, output)
 	switch ExtAuthStatus(es) {
 	case ExtAuthAllowed:
-		var resp ExtAuthResponse
-		if len(output) > 0 {
-			if err = json.Unmarshal(output, &resp); err != nil {
-				return false, nil, err
-			}
-		}
-		return true, resp.Labels, nil
-	case ExtAuthDenied:
-		return false, nil, nil
-	case ExtAuthNoMatch:
-		return false, nil, api.NoMatch
+		ObserveBackendCall("ext", "command", start, BackendSuccess)
+	case ExtAuthDenied, ExtAuthNoMatch:
+		ObserveBackendCall("ext", "command", start, BackendFailure)
 	default:
-		glog.Errorf("Ext command error: %d %s", es, et)
+		ObserveBackendCall("ext", "command", start, BackendError)
 	}
-	return false, nil, fmt.Errorf("bad return code from command: %d", es)
+	glog.V(2).Infof("%s %s -> %d %s", cmd.Path, cmd.Args, es, stdout.Bytes())
+	return es, stdout.Bytes(), et
 }
 
 func (sua *extAuth) Stop() {
@@ -0,0 +1,107 @@
+package authn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func newTestExtAuth(t *testing.T, script string) *extAuth {
+	dir, err := ioutil.TempDir("", "ext_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "auth.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := &ExtAuthConfig{Command: path, Timeout: time.Second}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewExtAuth(c)
+}
+
+func TestExtAuthStatus(t *testing.T) {
+	ea := newTestExtAuth(t, `read user password
+[ "$user $password" = "alice s3cret" ] || exit 1
+echo '{"labels": {"group": ["admins"]}}'
+`)
+	ok, labels, err := ea.Authenticate("alice", "s3cret")
+	if !ok || err != nil || !reflect.DeepEqual(labels, api.Labels{"group": {"admins"}}) {
+		t.Errorf("expected alice to be allowed with labels, got %t %v %v", ok, labels, err)
+	}
+	if ok, _, err := ea.Authenticate("alice", "wrong"); ok || err != nil {
+		t.Errorf("expected denial, got %t %v", ok, err)
+	}
+
+	if _, _, err := newTestExtAuth(t, "exit 2\n").Authenticate("alice", "s3cret"); err != api.NoMatch {
+		t.Errorf("expected no match, got %v", err)
+	}
+	if ok, _, err := newTestExtAuth(t, "exit 3\n").Authenticate("alice", "s3cret"); ok || err == nil {
+		t.Errorf("expected error, got %t %v", ok, err)
+	}
+}
+
+func TestExtAuthTimeout(t *testing.T) {
+	// The command exits only after its child, which would keep running if only the command was killed.
+	ea := newTestExtAuth(t, "sleep 10 &\nwait\n")
+	start := time.Now()
+	ok, _, err := ea.Authenticate("alice", "s3cret")
+	if ok || err == nil {
+		t.Errorf("expected error, got %t %v", ok, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected the command to be killed after 1s, took %s", d)
+	}
+}
+
+func TestExtAuthEnv(t *testing.T) {
+	os.Setenv("EXT_AUTH_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("EXT_AUTH_TEST_SECRET")
+	ea := newTestExtAuth(t, `[ -z "$EXT_AUTH_TEST_SECRET" ] && [ -n "$PATH" ] || exit 1
+`)
+	if ok, _, err := ea.Authenticate("alice", "s3cret"); !ok || err != nil {
+		t.Errorf("expected only allowed variables to be passed, got %t %v", ok, err)
+	}
+	ea.cfg.Env = append(ea.cfg.Env, "EXT_AUTH_TEST_SECRET")
+	if ok, _, err := ea.Authenticate("alice", "s3cret"); ok || err != nil {
+		t.Errorf("expected allowed variable to be passed, got %t %v", ok, err)
+	}
+}
+
+func TestExtAuthFailMode(t *testing.T) {
+	ea := newTestExtAuth(t, "exit 3\n")
+	ea.cfg.FailMode = ExtAuthFailOpen
+	if err := ea.cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	failOpen := ExtAuthFailOpenRequests()
+	ok, labels, err := ea.Authenticate("alice", "wrong")
+	if !ok || err != nil || !reflect.DeepEqual(labels, api.Labels{"fail_open": {"true"}}) {
+		t.Errorf("expected fail-open authentication, got %t %v %v", ok, labels, err)
+	}
+	if ExtAuthFailOpenRequests() != failOpen+1 {
+		t.Errorf("expected fail-open authentication to be counted")
+	}
+
+	// Denials and NoMatch are not affected.
+	for script, expectedErr := range map[string]error{"exit 1\n": nil, "exit 2\n": api.NoMatch} {
+		ea := newTestExtAuth(t, script)
+		ea.cfg.FailMode = ExtAuthFailOpen
+		if ok, _, err := ea.Authenticate("alice", "wrong"); ok || err != expectedErr {
+			t.Errorf("%q: expected %v in open mode, got %t %v", script, expectedErr, ok, err)
+		}
+	}
+
+	c := &ExtAuthConfig{Command: ea.cfg.Command, FailOpenLabels: api.Labels{"fail_open": {"true"}}}
+	if err := c.Validate(); err == nil {
+		t.Errorf("expected fail_open_labels without fail_mode: open to be rejected")
+	}
+}
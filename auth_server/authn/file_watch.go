@@ -0,0 +1,69 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"time"
+
+	"github.com/cesanta/glog"
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+// watchFile calls reload when the file changes, until stop is closed. If interval is set, reload
+// is also called periodically, for cases when change notifications are not reliable.
+func watchFile(path string, interval time.Duration, stop <-chan struct{}, reload func()) {
+	var events <-chan fsnotify.Event
+	watching := false
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Errorf("Failed to create watcher for %s: %s", path, err)
+	} else {
+		defer w.Close()
+		if err = w.Add(path); err != nil {
+			glog.Errorf("Failed to watch %s: %s", path, err)
+		}
+		events, watching = w.Events, err == nil
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// The file may have been replaced, watch the new one.
+				w.Remove(path)
+				if err := w.Add(path); err != nil {
+					glog.Warningf("Failed to watch %s: %s", path, err)
+					watching = false
+					continue
+				}
+			}
+			reload()
+		case <-tick:
+			if w != nil && !watching {
+				watching = w.Add(path) == nil
+			}
+			reload()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -56,22 +56,41 @@ type ParentGitHubTeam struct {
 }
 
 type GitHubAuthConfig struct {
-	Organization     string                `yaml:"organization,omitempty"`
-	ClientId         string                `yaml:"client_id,omitempty"`
-	ClientSecret     string                `yaml:"client_secret,omitempty"`
-	ClientSecretFile string                `yaml:"client_secret_file,omitempty"`
-	TokenDB          string                `yaml:"token_db,omitempty"`
-	GCSTokenDB       *GitHubGCSStoreConfig `yaml:"gcs_token_db,omitempty"`
-	HTTPTimeout      time.Duration         `yaml:"http_timeout,omitempty"`
-	RevalidateAfter  time.Duration         `yaml:"revalidate_after,omitempty"`
-	GithubWebUri     string                `yaml:"github_web_uri,omitempty"`
-	GithubApiUri     string                `yaml:"github_api_uri,omitempty"`
-	RegistryUrl      string                `yaml:"registry_url,omitempty"`
+	Organization       string                `yaml:"organization,omitempty"`
+	ClientId           string                `yaml:"client_id,omitempty"`
+	ClientSecret       string                `yaml:"client_secret,omitempty"`
+	ClientSecretFile   string                `yaml:"client_secret_file,omitempty"`
+	ClientSecretSource *SecretSource         `yaml:"client_secret_source,omitempty"`
+	TokenDB            string                `yaml:"token_db,omitempty"`
+	GCSTokenDB         *GitHubGCSStoreConfig `yaml:"gcs_token_db,omitempty"`
+	RedisTokenDB       *RedisTokenDBConfig   `yaml:"redis_token_db,omitempty"`
+	HTTPTimeout        time.Duration         `yaml:"http_timeout,omitempty"`
+	RevalidateAfter    time.Duration         `yaml:"revalidate_after,omitempty"`
+	GithubWebUri       string                `yaml:"github_web_uri,omitempty"`
+	GithubApiUri       string                `yaml:"github_api_uri,omitempty"`
+	RegistryUrl        string                `yaml:"registry_url,omitempty"`
+	// Caching of organization membership and teams, so that they are not looked up on every revalidation.
+	MembershipCache *MembershipCacheConfig `yaml:"membership_cache,omitempty"`
 }
 
 type GitHubGCSStoreConfig struct {
 	Bucket           string `yaml:"bucket,omitempty"`
 	ClientSecretFile string `yaml:"client_secret_file,omitempty"`
+	// Number of times to retry an operation after a transient error (429 and 5xx responses, network
+	// errors and timeouts). Missing objects are never retried. Default is 3, 0 disables retries.
+	Retries *int `yaml:"retries,omitempty"`
+	// Delay before the first retry, doubled for every next one up to max_retry_backoff.
+	// Defaults are 200ms and 5s.
+	RetryBackoff    time.Duration `yaml:"retry_backoff,omitempty"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff,omitempty"`
+	// Time limit of a single attempt of an operation. Default is 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Number of idle connections to GCS kept open for reuse. Default is 10.
+	MaxIdleConns int `yaml:"max_idle_conns,omitempty"`
+	// How long tokens read from the bucket are kept in memory. Tokens stored or deleted by this
+	// server are updated immediately, other replicas see the change after up to cache_ttl.
+	// Default is 0, tokens are read on every request.
+	CacheTTL time.Duration `yaml:"cache_ttl,omitempty"`
 }
 
 type GitHubAuthRequest struct {
@@ -86,11 +105,14 @@ type GitHubTokenUser struct {
 }
 
 type GitHubAuth struct {
-	config     *GitHubAuthConfig
-	db         TokenDB
-	client     *http.Client
-	tmpl       *template.Template
-	tmplResult *template.Template
+	config          *GitHubAuthConfig
+	db              TokenDB
+	client          *http.Client
+	tmpl            *template.Template
+	tmplResult      *template.Template
+	membershipCache *membershipCache
+	// Client secret, reloaded when client_secret_file changes.
+	secret *watchedSecret
 }
 
 type linkHeader struct {
@@ -161,12 +183,12 @@ func parseLinkHeader(linkLines []string) (linkHeader, error) {
 
 func NewGitHubAuth(c *GitHubAuthConfig) (*GitHubAuth, error) {
 	var db TokenDB
+	var dbName string
 	var err error
-	dbName := c.TokenDB
 	if c.GCSTokenDB == nil {
-		db, err = NewTokenDB(c.TokenDB)
+		db, dbName, err = openTokenDB(c.TokenDB, c.RedisTokenDB, "github")
 	} else {
-		db, err = NewGCSTokenDB(c.GCSTokenDB.Bucket, c.GCSTokenDB.ClientSecretFile)
+		db, err = NewGCSTokenDB(c.GCSTokenDB)
 		dbName = "GCS: " + c.GCSTokenDB.Bucket
 	}
 
@@ -180,6 +202,9 @@ func NewGitHubAuth(c *GitHubAuthConfig) (*GitHubAuth, error) {
 		client:     &http.Client{Timeout: 10 * time.Second},
 		tmpl:       template.Must(template.New("github_auth").Parse(string(MustAsset("data/github_auth.tmpl")))),
 		tmplResult: template.Must(template.New("github_auth_result").Parse(string(MustAsset("data/github_auth_result.tmpl")))),
+
+		membershipCache: newMembershipCache(c.MembershipCache, "github"),
+		secret:          newWatchedSecret("github_auth.client_secret", c.ClientSecret, c.ClientSecretFile, c.ClientSecretSource),
 	}, nil
 }
 
@@ -236,7 +261,7 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 	data := url.Values{
 		"code":          []string{string(code)},
 		"client_id":     []string{gha.config.ClientId},
-		"client_secret": []string{gha.config.ClientSecret},
+		"client_secret": []string{gha.secret.get()},
 	}
 
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/login/oauth/access_token", gha.getGithubWebUri()), bytes.NewBufferString(data.Encode()))
@@ -269,6 +294,11 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 	}
 
 	user, err := gha.validateAccessToken(c2t.AccessToken)
+	if err == nil {
+		if err = gha.checkOrganization(c2t.AccessToken, user); err != nil {
+			err = fmt.Errorf("could not validate organization: %s", err)
+		}
+	}
 	if err != nil {
 		glog.Errorf("Newly-acquired token is invalid: %+v %s", c2t, err)
 		http.Error(rw, "Newly-acquired token is invalid", http.StatusInternalServerError)
@@ -280,6 +310,8 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 	userTeams, err := gha.fetchTeams(c2t.AccessToken)
 	if err != nil {
 		glog.Errorf("could not fetch user teams: %s", err)
+	} else {
+		gha.membershipCache.put(user, userTeams)
 	}
 
 	v := &TokenDBValue{
@@ -324,15 +356,19 @@ func (gha *GitHubAuth) validateAccessToken(token string) (user string, err error
 	}
 	glog.V(2).Infof("Token user info: %+v", strings.Replace(string(body), "\n", " ", -1))
 
-	err = gha.checkOrganization(token, ti.Login)
-	if err != nil {
-		err = fmt.Errorf("could not validate organization: %s", err)
-		return
-	}
-
 	return ti.Login, nil
 }
 
+// membership checks organization membership of the user and returns their teams, using the cache if enabled.
+func (gha *GitHubAuth) membership(token, user string) ([]string, error) {
+	return gha.membershipCache.get(user, func() ([]string, error) {
+		if err := gha.checkOrganization(token, user); err != nil {
+			return nil, err
+		}
+		return gha.fetchTeams(token)
+	})
+}
+
 func (gha *GitHubAuth) checkOrganization(token, user string) (err error) {
 	if gha.config.Organization == "" {
 		return nil
@@ -355,7 +391,7 @@ func (gha *GitHubAuth) checkOrganization(token, user string) (err error) {
 	case http.StatusNoContent:
 		return nil
 	case http.StatusNotFound:
-		return fmt.Errorf("user %s is not a member of organization %s", user, gha.config.Organization)
+		return membershipDeniedError{fmt.Errorf("user %s is not a member of organization %s", user, gha.config.Organization)}
 	case http.StatusFound:
 		return fmt.Errorf("token %s could not get membership for organization %s", token, gha.config.Organization)
 	}
@@ -449,6 +485,12 @@ func (gha *GitHubAuth) validateServerToken(user string) (*TokenDBValue, error) {
 		glog.Errorf("token for wrong user: expected %s, found %s", user, tokenUser)
 		return nil, fmt.Errorf("found token for wrong user")
 	}
+	teams, err := gha.membership(v.AccessToken, user)
+	if err != nil {
+		glog.Warningf("Membership of %q could not be validated: %s", user, err)
+		return nil, fmt.Errorf("could not validate organization: %s", err)
+	}
+	v.Labels = map[string][]string{"teams": teams}
 
 	// Update revalidation timestamp
 	v.ValidUntil = time.Now().Add(gha.config.RevalidateAfter)
@@ -489,7 +531,66 @@ func (gha *GitHubAuth) Authenticate(user string, password api.PasswordString) (b
 	return true, v.Labels, nil
 }
 
+// checkAppToken asks GitHub whether the token was issued to the OAuth app and returns the login of its user.
+// Returns api.NoMatch if it was not.
+func (gha *GitHubAuth) checkAppToken(token string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"access_token": token})
+	apiURL := fmt.Sprintf("%s/applications/%s/token", gha.getGithubApiUri(), gha.config.ClientId)
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("could not create request to check token: %s", err)
+	}
+	req.SetBasicAuth(gha.config.ClientId, gha.secret.get())
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := gha.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not check token: %s", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusUnprocessableEntity:
+		return "", api.NoMatch
+	default:
+		return "", fmt.Errorf("could not check token: %s", resp.Status)
+	}
+	var at struct {
+		User GitHubTokenUser `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&at); err != nil {
+		return "", fmt.Errorf("could not unmarshal token info: %s", err)
+	}
+	if at.User.Login == "" {
+		return "", errors.New("no user in token info")
+	}
+	return at.User.Login, nil
+}
+
+// AuthenticateAccessToken accepts access tokens issued to the OAuth app, e.g. by a credential helper.
+// Organization membership is checked as for tokens in the token DB.
+func (gha *GitHubAuth) AuthenticateAccessToken(token string) (string, bool, api.Labels, error) {
+	if looksLikeJWT(token) {
+		return "", false, nil, api.NoMatch
+	}
+	user, err := gha.checkAppToken(token)
+	if err != nil {
+		return "", false, nil, err
+	}
+	teams, err := gha.membership(token, user)
+	if err != nil {
+		if _, denied := err.(membershipDeniedError); denied {
+			glog.Warningf("GitHub access token of %q rejected: %s", user, err)
+			return "", false, nil, nil
+		}
+		return "", false, nil, fmt.Errorf("could not validate organization: %s", err)
+	}
+	return user, true, api.Labels{"teams": teams}, nil
+}
+
 func (gha *GitHubAuth) Stop() {
+	gha.secret.Stop()
 	gha.db.Close()
 	glog.Info("Token DB closed")
 }
@@ -0,0 +1,333 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/dchest/uniuri"
+	"golang.org/x/oauth2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const gitlabStateCookie = "docker_auth_gitlab_state"
+
+type GitLabAuthConfig struct {
+	// URL of the GitLab instance, e.g. https://gitlab.com or https://gitlab.example.com.
+	BaseURL            string        `yaml:"base_url,omitempty"`
+	ClientId           string        `yaml:"client_id,omitempty"`
+	ClientSecret       string        `yaml:"client_secret,omitempty"`
+	ClientSecretFile   string        `yaml:"client_secret_file,omitempty"`
+	ClientSecretSource *SecretSource `yaml:"client_secret_source,omitempty"`
+	// URL GitLab redirects back to. Must point to /gitlab_auth on this server.
+	RedirectURL string `yaml:"redirect_url,omitempty"`
+	// If set, only members of these groups (full paths, e.g. "acme/devs") or their subgroups are allowed.
+	Groups          []string      `yaml:"groups,omitempty"`
+	TokenDB         string        `yaml:"token_db,omitempty"`
+	HTTPTimeout     time.Duration `yaml:"http_timeout,omitempty"`
+	RevalidateAfter time.Duration `yaml:"revalidate_after,omitempty"`
+	RegistryUrl     string        `yaml:"registry_url,omitempty"`
+	// Token DB in Redis, instead of token_db.
+	RedisTokenDB *RedisTokenDBConfig `yaml:"redis_token_db,omitempty"`
+}
+
+type GitLabUser struct {
+	Username string `json:"username"`
+	State    string `json:"state,omitempty"`
+}
+
+type GitLabGroup struct {
+	Id       int64  `json:"id"`
+	FullPath string `json:"full_path"`
+}
+
+type GitLabAuth struct {
+	config     *GitLabAuthConfig
+	db         TokenDB
+	client     *http.Client
+	tmplResult *template.Template
+	// Client secret, reloaded when client_secret_file changes.
+	secret *watchedSecret
+}
+
+func NewGitLabAuth(c *GitLabAuthConfig) (*GitLabAuth, error) {
+	db, dbName, err := openTokenDB(c.TokenDB, c.RedisTokenDB, "gitlab")
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("GitLab auth token DB at %s", dbName)
+	return &GitLabAuth{
+		config: c,
+		db:     db,
+		client: &http.Client{Timeout: c.HTTPTimeout},
+		secret: newWatchedSecret("gitlab_auth.client_secret", c.ClientSecret, c.ClientSecretFile, c.ClientSecretSource),
+		// Same page as for OIDC, with GitLab URL in place of the issuer.
+		tmplResult: template.Must(template.New("gitlab_auth_result").Parse(string(MustAsset("data/oidc_auth_result.tmpl")))),
+	}, nil
+}
+
+func (gla *GitLabAuth) baseURL() string {
+	return strings.TrimSuffix(gla.config.BaseURL, "/")
+}
+
+func (gla *GitLabAuth) context() context.Context {
+	return context.WithValue(context.Background(), oauth2.HTTPClient, gla.client)
+}
+
+func (gla *GitLabAuth) oauth2Config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     gla.config.ClientId,
+		ClientSecret: gla.secret.get(),
+		RedirectURL:  gla.config.RedirectURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  gla.baseURL() + "/oauth/authorize",
+			TokenURL: gla.baseURL() + "/oauth/token",
+		},
+		// Needed for the group list, read_user is not sufficient.
+		Scopes: []string{"read_api"},
+	}
+}
+
+func (gla *GitLabAuth) DoGitLabAuth(rw http.ResponseWriter, req *http.Request) {
+	code := req.URL.Query().Get("code")
+
+	if code != "" {
+		gla.doGitLabAuthCreateToken(rw, req, code)
+	} else if errStr := req.URL.Query().Get("error"); errStr != "" {
+		http.Error(rw, fmt.Sprintf("Authentication failed: %s %s", errStr, req.URL.Query().Get("error_description")), http.StatusUnauthorized)
+	} else if req.Method == "GET" {
+		// Send the user to GitLab, state protects the callback against CSRF.
+		state := uniuri.New()
+		http.SetCookie(rw, &http.Cookie{
+			Name:     gitlabStateCookie,
+			Value:    state,
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   req.TLS != nil,
+		})
+		http.Redirect(rw, req, gla.oauth2Config().AuthCodeURL(state), http.StatusFound)
+	}
+}
+
+func (gla *GitLabAuth) doGitLabAuthCreateToken(rw http.ResponseWriter, req *http.Request, code string) {
+	stateCookie, err := req.Cookie(gitlabStateCookie)
+	if err != nil || stateCookie.Value == "" || stateCookie.Value != req.URL.Query().Get("state") {
+		http.Error(rw, "Invalid state, please try signing in again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{Name: gitlabStateCookie, MaxAge: -1})
+
+	tok, err := gla.oauth2Config().Exchange(gla.context(), code)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get token: %s", err), http.StatusBadRequest)
+		return
+	}
+	user, labels, err := gla.validateAccessToken(tok.AccessToken)
+	if err != nil {
+		glog.Errorf("Newly-acquired token is invalid: %s", err)
+		http.Error(rw, fmt.Sprintf("Newly-acquired token is invalid: %s", err), http.StatusForbidden)
+		return
+	}
+
+	glog.Infof("New GitLab auth token for %s", user)
+
+	v := &TokenDBValue{
+		TokenType:    tok.TokenType,
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		ValidUntil:   time.Now().Add(gla.config.RevalidateAfter),
+		Labels:       labels,
+	}
+	dp, err := gla.db.StoreToken(user, v, true)
+	if err != nil {
+		glog.Errorf("Failed to record server token: %s", err)
+		http.Error(rw, "Failed to record server token", http.StatusInternalServerError)
+		return
+	}
+
+	if err := gla.tmplResult.Execute(rw, struct {
+		Issuer, Username, Password, RegistryUrl string
+	}{Issuer: gla.baseURL(),
+		Username:    user,
+		Password:    dp,
+		RegistryUrl: gla.config.RegistryUrl}); err != nil {
+		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// apiGet performs a GET request to the GitLab API and decodes the response into v.
+// Returns the next page number, if the response is paginated.
+func (gla *GitLabAuth) apiGet(token, path string, v interface{}) (string, error) {
+	req, err := http.NewRequest("GET", gla.baseURL()+"/api/v4"+path, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create request for %s: %s", path, err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err := gla.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GitLab API request %s failed: %s", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitLab API request %s failed: %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("could not parse response to %s: %s", path, err)
+	}
+	return resp.Header.Get("X-Next-Page"), nil
+}
+
+// validateAccessToken fetches the user name and groups of the token owner and checks group membership.
+// Group full paths are returned in the "groups" label.
+func (gla *GitLabAuth) validateAccessToken(token string) (string, api.Labels, error) {
+	glog.V(2).Infof("GitLab API: Fetching user info")
+	var u GitLabUser
+	if _, err := gla.apiGet(token, "/user", &u); err != nil {
+		return "", nil, err
+	}
+	if u.Username == "" {
+		return "", nil, errors.New("no user name in GitLab user info")
+	}
+	if u.State != "" && u.State != "active" {
+		return "", nil, fmt.Errorf("GitLab user %s is %s", u.Username, u.State)
+	}
+	groups, err := gla.fetchGroups(token)
+	if err != nil {
+		return "", nil, err
+	}
+	if !gla.isMember(groups) {
+		return "", nil, fmt.Errorf("user %s is not a member of any of %s", u.Username, strings.Join(gla.config.Groups, ", "))
+	}
+	return u.Username, api.Labels{"groups": groups}, nil
+}
+
+func (gla *GitLabAuth) fetchGroups(token string) ([]string, error) {
+	glog.V(2).Infof("GitLab API: Fetching user groups")
+	var groups []string
+	for page := "1"; page != ""; {
+		var pagedGroups []GitLabGroup
+		next, err := gla.apiGet(token, "/groups?min_access_level=10&per_page=100&page="+page, &pagedGroups)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range pagedGroups {
+			groups = append(groups, g.FullPath)
+		}
+		page = next
+	}
+	return groups, nil
+}
+
+func (gla *GitLabAuth) isMember(groups []string) bool {
+	if len(gla.config.Groups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		for _, rg := range gla.config.Groups {
+			if g == rg || strings.HasPrefix(g, rg+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// revalidateServerToken refreshes the access token, if there is a refresh token,
+// and re-checks the user and their groups.
+func (gla *GitLabAuth) revalidateServerToken(user string) (*TokenDBValue, error) {
+	v, err := gla.db.GetValue(user)
+	if err != nil || v == nil {
+		if err == nil {
+			err = errors.New("no db value, please sign out and sign in again")
+		}
+		return nil, err
+	}
+	glog.V(1).Infof("Token has expired. I will revalidate the access token.")
+	if v.RefreshToken != "" {
+		// Expiration time of the access token is not stored, so refresh is forced.
+		ts := gla.oauth2Config().TokenSource(gla.context(), &oauth2.Token{
+			AccessToken: v.AccessToken, RefreshToken: v.RefreshToken, Expiry: time.Now().Add(-time.Second),
+		})
+		tok, err := ts.Token()
+		if err != nil {
+			glog.Warningf("Failed to refresh token for %q: %s", user, err)
+			return nil, fmt.Errorf("failed to refresh token: %s", err)
+		}
+		v.TokenType, v.AccessToken = tok.TokenType, tok.AccessToken
+		if tok.RefreshToken != "" {
+			v.RefreshToken = tok.RefreshToken
+		}
+	}
+	tokenUser, labels, err := gla.validateAccessToken(v.AccessToken)
+	if err != nil {
+		glog.Warningf("Token for %q failed validation: %s", user, err)
+		return nil, fmt.Errorf("server token invalid: %s", err)
+	}
+	if tokenUser != user {
+		glog.Errorf("token for wrong user: expected %s, found %s", user, tokenUser)
+		return nil, fmt.Errorf("found token for wrong user")
+	}
+	v.Labels = labels
+	v.ValidUntil = time.Now().Add(gla.config.RevalidateAfter)
+	if _, err = gla.db.StoreToken(user, v, false); err != nil {
+		glog.Errorf("Failed to record server token: %s", err)
+		return nil, fmt.Errorf("Unable to store renewed token expiry time: %s", err)
+	}
+	glog.V(2).Infof("Successfully revalidated token for %s", user)
+	return v, nil
+}
+
+func (gla *GitLabAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	err := gla.db.ValidateToken(user, password)
+	if err == ExpiredToken {
+		v, err := gla.revalidateServerToken(user)
+		if err != nil {
+			return false, nil, err
+		}
+		return true, v.Labels, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	v, err := gla.db.GetValue(user)
+	if err != nil || v == nil {
+		if err == nil {
+			err = errors.New("no db value, please sign out and sign in again")
+		}
+		return false, nil, err
+	}
+	return true, v.Labels, nil
+}
+
+func (gla *GitLabAuth) Stop() {
+	gla.secret.Stop()
+	gla.db.Close()
+	glog.Info("Token DB closed")
+}
+
+func (gla *GitLabAuth) Name() string {
+	return "GitLab"
+}
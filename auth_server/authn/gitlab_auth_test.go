@@ -0,0 +1,102 @@
+package authn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func fakeGitLab() *httptest.Server {
+	groups := [][]GitLabGroup{
+		{{1, "acme"}, {2, "acme/devs"}},
+		{{3, "other"}},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access2", "refresh_token": "refresh2", "token_type": "Bearer", "expires_in": 7200}`))
+			return
+		}
+		token := r.Header.Get("Authorization")
+		if token != "Bearer access1" && token != "Bearer access2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v4/user":
+			w.Write([]byte(`{"username": "alice", "state": "active"}`))
+		case "/api/v4/groups":
+			page := 1
+			if r.FormValue("page") == "2" {
+				page = 2
+			} else {
+				w.Header().Set("X-Next-Page", "2")
+			}
+			json.NewEncoder(w).Encode(groups[page-1])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestGitLabAuth(t *testing.T) {
+	srv := fakeGitLab()
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "gitlab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gla, err := NewGitLabAuth(&GitLabAuthConfig{
+		BaseURL: srv.URL + "/", ClientId: "id", ClientSecret: "secret",
+		TokenDB: filepath.Join(dir, "tokens.ldb"), HTTPTimeout: 5 * time.Second, RevalidateAfter: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err)
+	}
+	defer gla.Stop()
+
+	user, labels, err := gla.validateAccessToken("access1")
+	if err != nil || user != "alice" || !reflect.DeepEqual(labels["groups"], []string{"acme", "acme/devs", "other"}) {
+		t.Errorf("unexpected result: %s %v %v", user, labels, err)
+	}
+	for groups, member := range map[string]bool{"acme": true, "acme/devs": true, "acme/ops": false, "acm": false} {
+		gla.config.Groups = []string{groups}
+		if _, _, err := gla.validateAccessToken("access1"); (err == nil) != member {
+			t.Errorf("%s: expected member: %t, got %v", groups, member, err)
+		}
+	}
+	gla.config.Groups = []string{"acme/devs"}
+	if _, _, err := gla.validateAccessToken("revoked"); err == nil {
+		t.Errorf("expected invalid token to be rejected")
+	}
+
+	// Expired server token is refreshed and revalidated.
+	dp, err := gla.db.StoreToken("alice", &TokenDBValue{
+		AccessToken: "access1", RefreshToken: "refresh1", ValidUntil: time.Now().Add(-time.Minute),
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, labels, err := gla.Authenticate("alice", api.PasswordString(dp))
+	if !ok || err != nil || len(labels["groups"]) != 3 {
+		t.Fatalf("expected alice to be authenticated, got %t %v %v", ok, labels, err)
+	}
+	v, _ := gla.db.GetValue("alice")
+	if v.AccessToken != "access2" || v.RefreshToken != "refresh2" || !v.ValidUntil.After(time.Now()) {
+		t.Errorf("expected token to be refreshed, got %+v", v)
+	}
+}
@@ -33,12 +33,17 @@ import (
 )
 
 type GoogleAuthConfig struct {
-	Domain           string `yaml:"domain,omitempty"`
-	ClientId         string `yaml:"client_id,omitempty"`
-	ClientSecret     string `yaml:"client_secret,omitempty"`
-	ClientSecretFile string `yaml:"client_secret_file,omitempty"`
-	TokenDB          string `yaml:"token_db,omitempty"`
-	HTTPTimeout      int    `yaml:"http_timeout,omitempty"`
+	Domain             string        `yaml:"domain,omitempty"`
+	ClientId           string        `yaml:"client_id,omitempty"`
+	ClientSecret       string        `yaml:"client_secret,omitempty"`
+	ClientSecretFile   string        `yaml:"client_secret_file,omitempty"`
+	ClientSecretSource *SecretSource `yaml:"client_secret_source,omitempty"`
+	TokenDB            string        `yaml:"token_db,omitempty"`
+	HTTPTimeout        int           `yaml:"http_timeout,omitempty"`
+	// Caching of access token validation, which checks the user's domain.
+	MembershipCache *MembershipCacheConfig `yaml:"membership_cache,omitempty"`
+	// Token DB in Redis, instead of token_db.
+	RedisTokenDB *RedisTokenDBConfig `yaml:"redis_token_db,omitempty"`
 }
 
 type GoogleAuthRequest struct {
@@ -120,23 +125,29 @@ type ProfileResponse struct {
 }
 
 type GoogleAuth struct {
-	config *GoogleAuthConfig
-	db     TokenDB
-	client *http.Client
-	tmpl   *template.Template
+	config          *GoogleAuthConfig
+	db              TokenDB
+	client          *http.Client
+	tmpl            *template.Template
+	membershipCache *membershipCache
+	// Client secret, reloaded when client_secret_file changes.
+	secret *watchedSecret
 }
 
 func NewGoogleAuth(c *GoogleAuthConfig) (*GoogleAuth, error) {
-	db, err := NewTokenDB(c.TokenDB)
+	db, dbName, err := openTokenDB(c.TokenDB, c.RedisTokenDB, "google")
 	if err != nil {
 		return nil, err
 	}
-	glog.Infof("Google auth token DB at %s", c.TokenDB)
+	glog.Infof("Google auth token DB at %s", dbName)
 	return &GoogleAuth{
 		config: c,
 		db:     db,
 		client: &http.Client{Timeout: 10 * time.Second},
 		tmpl:   template.Must(template.New("google_auth").Parse(string(MustAsset("data/google_auth.tmpl")))),
+		secret: newWatchedSecret("google_auth.client_secret", c.ClientSecret, c.ClientSecretFile, c.ClientSecretSource),
+
+		membershipCache: newMembershipCache(c.MembershipCache, "google"),
 	}, nil
 }
 
@@ -178,7 +189,7 @@ func (ga *GoogleAuth) doGoogleAuthCreateToken(rw http.ResponseWriter, code strin
 		url.Values{
 			"code":          []string{string(code)},
 			"client_id":     []string{ga.config.ClientId},
-			"client_secret": []string{ga.config.ClientSecret},
+			"client_secret": []string{ga.secret.get()},
 			"redirect_uri":  []string{"postmessage"},
 			"grant_type":    []string{"authorization_code"},
 		})
@@ -281,7 +292,7 @@ func (ga *GoogleAuth) checkDomain(email string) error {
 	}
 	parts := strings.Split(email, "@")
 	if parts[1] != ga.config.Domain {
-		return fmt.Errorf("only users from %s may login", ga.config.Domain)
+		return membershipDeniedError{fmt.Errorf("only users from %s may login", ga.config.Domain)}
 	}
 	return nil
 }
@@ -293,7 +304,7 @@ func (ga *GoogleAuth) refreshAccessToken(refreshToken string) (rtr RefreshTokenR
 		url.Values{
 			"refresh_token": []string{refreshToken},
 			"client_id":     []string{ga.config.ClientId},
-			"client_secret": []string{ga.config.ClientSecret},
+			"client_secret": []string{ga.secret.get()},
 			"grant_type":    []string{"refresh_token"},
 		})
 	if err != nil {
@@ -331,6 +342,19 @@ func (ga *GoogleAuth) validateAccessToken(toktype, token string) (user string, e
 	return pr.Email, nil
 }
 
+// validateUser validates the access token, unless it has been validated for the user
+// less than membership_cache.ttl ago, and returns the user it belongs to.
+func (ga *GoogleAuth) validateUser(user string, v *TokenDBValue) (string, error) {
+	users, err := ga.membershipCache.get(user, func() ([]string, error) {
+		tokenUser, err := ga.validateAccessToken(v.TokenType, v.AccessToken)
+		return []string{tokenUser}, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return users[0], nil
+}
+
 func (ga *GoogleAuth) validateServerToken(user string) (*TokenDBValue, error) {
 	v, err := ga.db.GetValue(user)
 	if err != nil || v == nil {
@@ -355,7 +379,7 @@ func (ga *GoogleAuth) validateServerToken(user string) (*TokenDBValue, error) {
 			return nil, fmt.Errorf("failed to record refreshed token: %s", err)
 		}
 	}
-	tokenUser, err := ga.validateAccessToken(v.TokenType, v.AccessToken)
+	tokenUser, err := ga.validateUser(user, v)
 	if err != nil {
 		glog.Warningf("Token for %q failed validation: %s", user, err)
 		return nil, fmt.Errorf("server token invalid: %s", err)
@@ -414,7 +438,21 @@ func (ga *GoogleAuth) Authenticate(user string, password api.PasswordString) (bo
 	return true, nil, nil
 }
 
+// AuthenticateAccessToken accepts Google ID tokens issued for the client, e.g. by a credential helper.
+func (ga *GoogleAuth) AuthenticateAccessToken(token string) (string, bool, api.Labels, error) {
+	if iss := unverifiedIssuer(token); !looksLikeJWT(token) || (iss != "accounts.google.com" && iss != "https://accounts.google.com") {
+		return "", false, nil, api.NoMatch
+	}
+	ti, err := ga.getIDTokenInfo(token)
+	if err != nil {
+		glog.Warningf("Google ID token rejected: %s", err)
+		return "", false, nil, nil
+	}
+	return ti.Email, true, nil, nil
+}
+
 func (ga *GoogleAuth) Stop() {
+	ga.secret.Stop()
 	ga.db.Close()
 	glog.Info("Token DB closed")
 }
@@ -0,0 +1,289 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// Formats of htpasswd password hashes.
+const (
+	htpasswdBcrypt = "bcrypt"
+	htpasswdAPR1   = "apr1"
+	htpasswdMD5    = "md5"
+	htpasswdSHA    = "sha"
+	htpasswdOther  = "other" // Other password hashes supported by comparePassword, i.e. scrypt and argon2id.
+)
+
+// HtpasswdAuthConfig specifies a password file in the format of Apache htpasswd,
+// one user:hash per line.
+type HtpasswdAuthConfig struct {
+	Path string `yaml:"path,omitempty"`
+	// The file is reloaded when it changes. In addition, it can be checked
+	// periodically, for cases when change notifications are not reliable.
+	ReloadInterval time.Duration `yaml:"reload_interval,omitempty"`
+}
+
+func (c *HtpasswdAuthConfig) Validate(configKey string) error {
+	if c.Path == "" {
+		return fmt.Errorf("%s.path is required", configKey)
+	}
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("%s.reload_interval must not be negative", configKey)
+	}
+	return nil
+}
+
+type htpasswdEntry struct {
+	format string
+	hash   string
+}
+
+// htpasswdHashFormat identifies the format of the hash. bcrypt ($2y$, $2a$, $2b$), MD5 ($apr1$, $1$)
+// and SHA-1 ({SHA}) hashes are supported, as well as scrypt and argon2id hashes in the format of
+// the users section. crypt(3) DES hashes and plain text passwords are not: they can't be told apart.
+func htpasswdHashFormat(hash string) (string, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return htpasswdBcrypt, nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		return htpasswdAPR1, nil
+	case strings.HasPrefix(hash, "$1$"):
+		return htpasswdMD5, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		if d, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):]); err != nil || len(d) != sha1.Size {
+			return "", fmt.Errorf("invalid {SHA} hash")
+		}
+		return htpasswdSHA, nil
+	case strings.HasPrefix(hash, "$scrypt$"), strings.HasPrefix(hash, "$argon2id$"):
+		return htpasswdOther, nil
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		return "", fmt.Errorf("SHA-256/SHA-512 crypt hashes are not supported, use bcrypt (htpasswd -B)")
+	case strings.HasPrefix(hash, "$"):
+		return "", fmt.Errorf("unsupported hash format %q", strings.SplitN(hash[1:], "$", 2)[0])
+	}
+	return "", fmt.Errorf("crypt and plain text passwords are not supported, use bcrypt (htpasswd -B)")
+}
+
+func parseHtpasswd(contents []byte) (map[string]htpasswdEntry, error) {
+	if len(bytes.TrimSpace(contents)) == 0 {
+		// Most likely caught in the middle of a write.
+		return nil, fmt.Errorf("file is empty")
+	}
+	users := map[string]htpasswdEntry{}
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		user, hash := line[:i], line[i+1:]
+		format, err := htpasswdHashFormat(hash)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %s", n, user, err)
+		}
+		if _, found := users[user]; found {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, user)
+		}
+		users[user] = htpasswdEntry{format: format, hash: hash}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ValidateHtpasswdFile checks that the file can be read and that all of its hashes are supported.
+func ValidateHtpasswdFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", path, err)
+	}
+	if _, err := parseHtpasswd(contents); err != nil {
+		return fmt.Errorf("invalid htpasswd file %s: %s", path, err)
+	}
+	return nil
+}
+
+type htpasswdAuth struct {
+	config *HtpasswdAuthConfig
+	stop   chan struct{}
+
+	lock     sync.RWMutex
+	users    map[string]htpasswdEntry
+	contents []byte
+}
+
+// NewHtpasswdAuth creates an authenticator with users from an htpasswd file.
+// The file is watched for changes and reloaded. If the new contents are invalid,
+// the previous set of users remains in effect.
+func NewHtpasswdAuth(c *HtpasswdAuthConfig) (*htpasswdAuth, error) {
+	ha := &htpasswdAuth{config: c, stop: make(chan struct{})}
+	if _, err := ha.reload(); err != nil {
+		return nil, err
+	}
+	glog.Infof("Loaded %d users from %s", len(ha.users), c.Path)
+	go watchFile(c.Path, c.ReloadInterval, ha.stop, ha.maybeReload)
+	return ha, nil
+}
+
+// reload re-reads the file and swaps the users if the contents have changed.
+func (ha *htpasswdAuth) reload() (bool, error) {
+	contents, err := ioutil.ReadFile(ha.config.Path)
+	if err != nil {
+		return false, fmt.Errorf("could not read %s: %s", ha.config.Path, err)
+	}
+	if ha.contents != nil && bytes.Equal(contents, ha.contents) {
+		return false, nil
+	}
+	users, err := parseHtpasswd(contents)
+	if err != nil {
+		return false, fmt.Errorf("invalid htpasswd file %s: %s", ha.config.Path, err)
+	}
+	ha.lock.Lock()
+	ha.users, ha.contents = users, contents
+	ha.lock.Unlock()
+	return true, nil
+}
+
+func (ha *htpasswdAuth) maybeReload() {
+	changed, err := ha.reload()
+	if err != nil {
+		glog.Errorf("Failed to reload htpasswd users (previous set remains in effect): %s", err)
+	} else if changed {
+		glog.Infof("Reloaded %d users from %s", len(ha.users), ha.config.Path)
+	}
+}
+
+func (ha *htpasswdAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	ha.lock.RLock()
+	e, found := ha.users[user]
+	ha.lock.RUnlock()
+	if !found {
+		return false, nil, api.NoMatch
+	}
+	switch e.format {
+	case htpasswdAPR1, htpasswdMD5:
+		magic := e.hash[:strings.Index(e.hash[1:], "$")+2]
+		salt := strings.SplitN(e.hash[len(magic):], "$", 2)[0]
+		computed := md5Crypt([]byte(password), []byte(salt), magic)
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(e.hash)) == 1, nil, nil
+	case htpasswdSHA:
+		sum := sha1.Sum([]byte(password))
+		computed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(e.hash)) == 1, nil, nil
+	}
+	ok, err := comparePassword(e.hash, password, "")
+	if err != nil {
+		return false, nil, fmt.Errorf("cannot verify password of user %q: %s", user, err)
+	}
+	return ok, nil, nil
+}
+
+const md5CryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// md5Crypt computes the MD5-based crypt of the password, as done by Apache ($apr1$) and glibc ($1$).
+func md5Crypt(password, salt []byte, magic string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	d := md5.New()
+	d.Write(password)
+	d.Write([]byte(magic))
+	d.Write(salt)
+
+	alt := md5.New()
+	alt.Write(password)
+	alt.Write(salt)
+	alt.Write(password)
+	final := alt.Sum(nil)
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(final)
+		} else {
+			d.Write(final[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(password[:1])
+		}
+	}
+	final = d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(password)
+		} else {
+			r.Write(final)
+		}
+		if i%3 != 0 {
+			r.Write(salt)
+		}
+		if i%7 != 0 {
+			r.Write(password)
+		}
+		if i&1 != 0 {
+			r.Write(final)
+		} else {
+			r.Write(password)
+		}
+		final = r.Sum(nil)
+	}
+
+	out := []byte(magic + string(salt) + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, md5CryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return string(out)
+}
+
+func (ha *htpasswdAuth) Stop() {
+	close(ha.stop)
+}
+
+func (ha *htpasswdAuth) Name() string {
+	return "htpasswd"
+}
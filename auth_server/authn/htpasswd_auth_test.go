@@ -0,0 +1,98 @@
+package authn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestHtpasswdAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	bcrypt2y := "$2y$" + strings.TrimPrefix(string(hash), "$2a$")
+
+	write(`# Generated by htpasswd
+alice:` + string(hash) + `
+bob:` + bcrypt2y + `
+
+carol:$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0
+dave:$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/
+erin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`)
+	if err := ValidateHtpasswdFile(path); err != nil {
+		t.Fatalf("expected file to be valid: %s", err)
+	}
+	ha, err := NewHtpasswdAuth(&HtpasswdAuthConfig{Path: path, ReloadInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to load htpasswd file: %s", err)
+	}
+	defer ha.Stop()
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if result, _, err := ha.Authenticate(user, "password"); err != nil || !result {
+			t.Errorf("expected %s to be authenticated, got %t %v", user, result, err)
+		}
+		if result, _, err := ha.Authenticate(user, "wrong"); err != nil || result {
+			t.Errorf("expected wrong password of %s to be rejected, got %t %v", user, result, err)
+		}
+	}
+	if _, _, err := ha.Authenticate("frank", "password"); err != api.NoMatch {
+		t.Errorf("expected unknown user not to match, got %v", err)
+	}
+
+	write("frank:" + string(hash) + "\n")
+	if !waitFor(func() bool { result, _, _ := ha.Authenticate("frank", "password"); return result }) {
+		t.Fatalf("new user was not picked up")
+	}
+	if _, _, err := ha.Authenticate("alice", "password"); err != api.NoMatch {
+		t.Errorf("expected removed user not to match, got %v", err)
+	}
+
+	// Files with unsupported hashes are rejected, the previous users remain in effect.
+	write("frank:" + string(hash) + "\ngrace:xyJ3Z8GJBvj4k\n")
+	time.Sleep(100 * time.Millisecond)
+	if result, _, _ := ha.Authenticate("frank", "password"); !result {
+		t.Errorf("expected previous users to remain in effect")
+	}
+}
+
+func TestHtpasswdUnsupportedFormats(t *testing.T) {
+	for hash, expected := range map[string]string{
+		"xyJ3Z8GJBvj4k":            "crypt and plain text passwords are not supported",
+		"password":                 "crypt and plain text passwords are not supported",
+		"$5$rounds=5000$salt$hash": "SHA-256/SHA-512 crypt hashes are not supported",
+		"$6$salt$hash":             "SHA-256/SHA-512 crypt hashes are not supported",
+		"$md5$salt$hash":           `unsupported hash format "md5"`,
+		"{SHA}not-base64":          "invalid {SHA} hash",
+		"{SHA}" + "cGFzc3dvcmQ=":   "invalid {SHA} hash",
+	} {
+		_, err := parseHtpasswd([]byte("alice:" + hash))
+		if err == nil || !strings.Contains(err.Error(), expected) || !strings.Contains(err.Error(), `line 1: user "alice"`) {
+			t.Errorf("%s: expected error %q, got %v", hash, expected, err)
+		}
+	}
+	for _, contents := range []string{"", "alice", ":$2y$05$abc"} {
+		if _, err := parseHtpasswd([]byte(contents)); err == nil {
+			t.Errorf("expected %q to be rejected", contents)
+		}
+	}
+	if err := ValidateHtpasswdFile("/nonexistent/htpasswd"); err == nil {
+		t.Errorf("expected missing file to be rejected")
+	}
+}
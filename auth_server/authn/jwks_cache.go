@@ -0,0 +1,121 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Keys are not fetched more often than this when a token with an unknown key ID is presented.
+const minJWKSRefetchInterval = time.Minute
+
+// jwksCache holds the signing keys of a token issuer, fetched from its JWKS URL.
+type jwksCache struct {
+	// Name of the issuer, for logging.
+	name            string
+	url             string
+	refreshInterval time.Duration
+	client          *http.Client
+
+	lock sync.Mutex
+	keys *jose.JSONWebKeySet
+	// Time of the last fetch attempt, successful or not.
+	lastFetch time.Time
+}
+
+func newJWKSCache(name, url string, refreshInterval, timeout time.Duration) *jwksCache {
+	return &jwksCache{name: name, url: url, refreshInterval: refreshInterval, client: &http.Client{Timeout: timeout}}
+}
+
+func (jc *jwksCache) fetch() (*jose.JSONWebKeySet, error) {
+	resp, err := jc.client.Get(jc.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", jc.url, resp.Status)
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("invalid JWKS from %s: %s", jc.url, err)
+	}
+	return &keys, nil
+}
+
+// signingKeys returns the keys with the given ID. Keys are refetched once the refresh interval
+// has passed or, to pick up new keys after rollover, if none of the cached ones have the ID.
+// If a refetch fails, cached keys are used.
+func (jc *jwksCache) signingKeys(kid string, lookup bool) ([]jose.JSONWebKey, error) {
+	jc.lock.Lock()
+	defer jc.lock.Unlock()
+	var keys []jose.JSONWebKey
+	if jc.keys != nil {
+		keys = keysWithID(jc.keys, kid)
+	}
+	sinceFetch := time.Since(jc.lastFetch)
+	if jc.keys == nil || sinceFetch > jc.refreshInterval ||
+		(lookup && len(keys) == 0 && sinceFetch > minJWKSRefetchInterval) {
+		jc.lastFetch = time.Now()
+		ks, err := jc.fetch()
+		if err != nil {
+			if jc.keys == nil {
+				return nil, err
+			}
+			glog.Warningf("Failed to refresh %s signing keys, using cached ones: %s", jc.name, err)
+		} else {
+			glog.V(2).Infof("Fetched %d %s signing keys", len(ks.Keys), jc.name)
+			jc.keys = ks
+			keys = keysWithID(ks, kid)
+		}
+	}
+	return keys, nil
+}
+
+// keysWithID returns all the keys if kid is empty.
+func keysWithID(ks *jose.JSONWebKeySet, kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return ks.Keys
+	}
+	return ks.Key(kid)
+}
+
+// verify checks the signature of the token, which must have a single one, and returns its payload.
+func (jc *jwksCache) verify(token string) ([]byte, error) {
+	jws, err := jose.ParseSigned(token)
+	if err != nil || len(jws.Signatures) != 1 {
+		return nil, errJWTSignature
+	}
+	keys, err := jc.signingKeys(jws.Signatures[0].Header.KeyID, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not get signing keys: %s", err)
+	}
+	for _, k := range keys {
+		if payload, err := jws.Verify(k); err == nil {
+			return payload, nil
+		}
+	}
+	glog.V(2).Infof("%s token signature verification failed (%d candidate keys)", jc.name, len(keys))
+	return nil, errJWTSignature
+}
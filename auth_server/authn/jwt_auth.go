@@ -0,0 +1,217 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/coreos/go-oidc"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+type JWTAuthConfig struct {
+	Issuer   string `yaml:"issuer,omitempty"`
+	Audience string `yaml:"audience,omitempty"`
+	// Keys to verify tokens with are either fetched from JWKSURL or read from PublicKeyFile (PEM).
+	JWKSURL       string `yaml:"jwks_url,omitempty"`
+	PublicKeyFile string `yaml:"public_key_file,omitempty"`
+	// Claim to use as account name.
+	AccountClaim string        `yaml:"account_claim,omitempty"`
+	HTTPTimeout  time.Duration `yaml:"http_timeout,omitempty"`
+}
+
+var (
+	errJWTSignature = errors.New("invalid token signature")
+	errJWTExpired   = errors.New("token has expired")
+	errJWTNotYet    = errors.New("token is not valid yet")
+	errJWTAudience  = errors.New("token is not intended for this audience")
+	errJWTIssuer    = errors.New("token is issued by an untrusted issuer")
+)
+
+type JWTAuth struct {
+	config    *JWTAuthConfig
+	ctx       context.Context
+	keySet    oidc.KeySet
+	publicKey *jose.JSONWebKey
+}
+
+func (c *JWTAuthConfig) Validate(configKey string) error {
+	if c.Issuer == "" || c.Audience == "" {
+		return fmt.Errorf("%s.{issuer,audience} are required", configKey)
+	}
+	if (c.JWKSURL == "") == (c.PublicKeyFile == "") {
+		return fmt.Errorf("exactly one of %s.jwks_url and %s.public_key_file is required", configKey, configKey)
+	}
+	if c.AccountClaim == "" {
+		c.AccountClaim = "sub"
+	}
+	if c.HTTPTimeout <= 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	return nil
+}
+
+func NewJWTAuth(c *JWTAuthConfig) (*JWTAuth, error) {
+	ja := &JWTAuth{config: c}
+	if c.PublicKeyFile != "" {
+		pk, err := loadPublicKey(c.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load %s: %s", c.PublicKeyFile, err)
+		}
+		ja.publicKey = &jose.JSONWebKey{Key: pk}
+	} else {
+		ja.ctx = oidc.ClientContext(context.Background(), &http.Client{Timeout: c.HTTPTimeout})
+		ja.keySet = oidc.NewRemoteKeySet(ja.ctx, c.JWKSURL)
+	}
+	glog.Infof("JWT auth for tokens issued by %s", c.Issuer)
+	return ja, nil
+}
+
+// loadPublicKey reads a PEM encoded public key or certificate.
+func loadPublicKey(fileName string) (interface{}, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// looksLikeJWT checks that s consists of three parts, the first of which is a JOSE header.
+func looksLikeJWT(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	hj, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	return json.Unmarshal(hj, &h) == nil && h.Alg != ""
+}
+
+// verify checks signature and claims of the token and returns the account name.
+func (ja *JWTAuth) verify(token string) (string, error) {
+	var payload []byte
+	var err error
+	if ja.publicKey != nil {
+		var jws *jose.JSONWebSignature
+		if jws, err = jose.ParseSigned(token); err == nil {
+			payload, err = jws.Verify(ja.publicKey)
+		}
+	} else {
+		payload, err = ja.keySet.VerifySignature(ja.ctx, token)
+	}
+	if err != nil {
+		glog.V(2).Infof("JWT signature verification failed: %s", err)
+		return "", errJWTSignature
+	}
+	var claims jwt.Claims
+	var allClaims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("invalid claims: %s", err)
+	}
+	if err := json.Unmarshal(payload, &allClaims); err != nil {
+		return "", fmt.Errorf("invalid claims: %s", err)
+	}
+	if claims.Expiry == nil {
+		return "", errors.New("token has no expiration time")
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   ja.config.Issuer,
+		Audience: jwt.Audience{ja.config.Audience},
+		Time:     time.Now(),
+	}, 0)
+	switch err {
+	case nil:
+	case jwt.ErrExpired:
+		return "", errJWTExpired
+	case jwt.ErrNotValidYet, jwt.ErrIssuedInTheFuture:
+		return "", errJWTNotYet
+	case jwt.ErrInvalidAudience:
+		return "", errJWTAudience
+	case jwt.ErrInvalidIssuer:
+		return "", errJWTIssuer
+	default:
+		return "", err
+	}
+	account, ok := allClaims[ja.config.AccountClaim].(string)
+	if !ok || account == "" {
+		return "", fmt.Errorf("token has no %s claim", ja.config.AccountClaim)
+	}
+	return account, nil
+}
+
+func (ja *JWTAuth) AuthenticateToken(token string) (string, bool, api.Labels, error) {
+	// Tokens of other issuers are left to other authenticators, e.g. azure_auth or k8s_sa_auth.
+	if !looksLikeJWT(token) || unverifiedIssuer(token) != ja.config.Issuer {
+		return "", false, nil, api.NoMatch
+	}
+	account, err := ja.verify(token)
+	if err != nil {
+		glog.Warningf("JWT rejected: %s", err)
+		return "", false, nil, nil
+	}
+	return account, true, nil, nil
+}
+
+// Authenticate is used if the account name is known, it must match the one in the token.
+func (ja *JWTAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	account, result, labels, err := ja.AuthenticateToken(string(password))
+	if err != nil || !result {
+		return result, labels, err
+	}
+	if account != user {
+		glog.Warningf("JWT rejected: issued to %q, not %q", account, user)
+		return false, nil, nil
+	}
+	return true, labels, nil
+}
+
+func (ja *JWTAuth) Stop() {
+}
+
+func (ja *JWTAuth) Name() string {
+	return "JWT"
+}
@@ -0,0 +1,95 @@
+package authn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestJWTAuth(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	f, err := ioutil.TempFile("", "jwt_auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	f.Close()
+
+	c := &JWTAuthConfig{Issuer: "https://ci.example.com", Audience: "docker_auth", PublicKeyFile: f.Name()}
+	if err := c.Validate("jwt_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	ja, err := NewJWTAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create JWTAuth: %s", err)
+	}
+
+	now := time.Now()
+	valid := jwt.Claims{
+		Issuer:   c.Issuer,
+		Audience: jwt.Audience{c.Audience},
+		Subject:  "ci-runner",
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	sign := func(k *ecdsa.PrivateKey, claims jwt.Claims) string {
+		s, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := jwt.Signed(s).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	expired, wrongAud, wrongIss := valid, valid, valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Minute))
+	wrongAud.Audience = jwt.Audience{"something else"}
+	wrongIss.Issuer = "https://evil.example.com"
+
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{sign(key, valid), nil},
+		{sign(key, expired), errJWTExpired},
+		{sign(key, wrongAud), errJWTAudience},
+		{sign(key, wrongIss), errJWTIssuer},
+		{sign(otherKey, valid), errJWTSignature},
+	}
+	for i, c := range cases {
+		account, err := ja.verify(c.token)
+		if err != c.err {
+			t.Errorf("%d: expected error %v, got %v", i, c.err, err)
+		} else if err == nil && account != "ci-runner" {
+			t.Errorf("%d: expected account ci-runner, got %q", i, account)
+		}
+	}
+
+	if _, _, _, err := ja.AuthenticateToken("p4ssw0rd"); err != api.NoMatch {
+		t.Errorf("expected NoMatch for a password, got %v", err)
+	}
+	if account, ok, _, err := ja.AuthenticateToken(sign(key, valid)); !ok || err != nil || account != "ci-runner" {
+		t.Errorf("expected token to be accepted, got %q %t %v", account, ok, err)
+	}
+	if _, ok, _, err := ja.AuthenticateToken(sign(key, expired)); ok || err != nil {
+		t.Errorf("expected expired token to be rejected, got %t %v", ok, err)
+	}
+	if _, _, _, err := ja.AuthenticateToken(sign(otherKey, wrongIss)); err != api.NoMatch {
+		t.Errorf("expected NoMatch for a token of another issuer, got %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const (
+	k8sServiceAccountDir    = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sServiceAccountPrefix = "system:serviceaccount:"
+	k8sPodNameExtra         = "authentication.kubernetes.io/pod-name"
+)
+
+type K8sSAAuthConfig struct {
+	// URL of the API server. If neither it nor kubeconfig is set, the in-cluster config of the pod is used.
+	APIServer string `yaml:"api_server,omitempty"`
+	// CA certificate of the API server. In-cluster default is the ca.crt of the pod's service account.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Token to authenticate to the API server with, it needs permission to create TokenReviews.
+	// In-cluster default is the token of the pod's service account. It is re-read on every request.
+	TokenFile string `yaml:"token_file,omitempty"`
+	// kubeconfig to take the API server, CA and credentials from, instead of the above.
+	Kubeconfig        string `yaml:"kubeconfig,omitempty"`
+	KubeconfigContext string `yaml:"kubeconfig_context,omitempty"`
+	// Tokens must have been issued for one of these audiences. Required.
+	Audiences   []string      `yaml:"audiences,omitempty"`
+	HTTPTimeout time.Duration `yaml:"http_timeout,omitempty"`
+
+	// Resolved from the above.
+	caData     []byte
+	token      string
+	clientCert *tls.Certificate
+}
+
+func (c *K8sSAAuthConfig) Validate(configKey string) error {
+	if len(c.Audiences) == 0 {
+		// Without it, tokens for the API server itself would be accepted.
+		return fmt.Errorf("%s.audiences is required", configKey)
+	}
+	if c.Kubeconfig != "" {
+		if c.APIServer != "" || c.CAFile != "" || c.TokenFile != "" {
+			return fmt.Errorf("%s.kubeconfig and {api_server,ca_file,token_file} are mutually exclusive", configKey)
+		}
+		if err := c.loadKubeconfig(); err != nil {
+			return fmt.Errorf("%s.kubeconfig: %s", configKey, err)
+		}
+	} else if c.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("%s.api_server or kubeconfig is required when not running in a cluster", configKey)
+		}
+		c.APIServer = "https://" + net.JoinHostPort(host, port)
+		if c.CAFile == "" {
+			c.CAFile = filepath.Join(k8sServiceAccountDir, "ca.crt")
+		}
+		if c.TokenFile == "" {
+			c.TokenFile = filepath.Join(k8sServiceAccountDir, "token")
+		}
+	}
+	if u, err := url.Parse(c.APIServer); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%s.api_server must be an https URL, got %q", configKey, c.APIServer)
+	}
+	c.APIServer = strings.TrimSuffix(c.APIServer, "/")
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("%s.ca_file: %s", configKey, err)
+		}
+		c.caData = data
+	}
+	if c.TokenFile != "" {
+		if _, err := ioutil.ReadFile(c.TokenFile); err != nil {
+			return fmt.Errorf("%s.token_file: %s", configKey, err)
+		}
+	}
+	if c.HTTPTimeout < 0 {
+		return fmt.Errorf("%s.http_timeout must not be negative", configKey)
+	}
+	if c.HTTPTimeout == 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	return nil
+}
+
+// kubeconfig is the subset of the kubeconfig file format that is supported.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// loadKubeconfig takes the API server, CA and credentials from the context of the kubeconfig.
+// Paths in it are relative to the directory of the file, *-data values are base64-encoded.
+func (c *K8sSAAuthConfig) loadKubeconfig() error {
+	data, err := ioutil.ReadFile(c.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return fmt.Errorf("could not parse: %s", err)
+	}
+	name := c.KubeconfigContext
+	if name == "" {
+		name = kc.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, ctx := range kc.Contexts {
+		if ctx.Name == name {
+			clusterName, userName, found = ctx.Context.Cluster, ctx.Context.User, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("context %q not found", name)
+	}
+	dir := filepath.Dir(c.Kubeconfig)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	found = false
+	for _, cl := range kc.Clusters {
+		if cl.Name == clusterName {
+			c.APIServer, c.CAFile = cl.Cluster.Server, resolve(cl.Cluster.CertificateAuthority)
+			if c.caData, err = base64.StdEncoding.DecodeString(cl.Cluster.CertificateAuthorityData); err != nil {
+				return fmt.Errorf("invalid certificate-authority-data of cluster %q: %s", clusterName, err)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("cluster %q of context %q not found", clusterName, name)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		c.token, c.TokenFile = u.User.Token, resolve(u.User.TokenFile)
+		certData, err := base64.StdEncoding.DecodeString(u.User.ClientCertificateData)
+		if err != nil {
+			return fmt.Errorf("invalid client-certificate-data of user %q: %s", userName, err)
+		}
+		keyData, err := base64.StdEncoding.DecodeString(u.User.ClientKeyData)
+		if err != nil {
+			return fmt.Errorf("invalid client-key-data of user %q: %s", userName, err)
+		}
+		if u.User.ClientCertificate != "" {
+			if certData, err = ioutil.ReadFile(resolve(u.User.ClientCertificate)); err != nil {
+				return err
+			}
+		}
+		if u.User.ClientKey != "" {
+			if keyData, err = ioutil.ReadFile(resolve(u.User.ClientKey)); err != nil {
+				return err
+			}
+		}
+		if len(certData) > 0 {
+			cert, err := tls.X509KeyPair(certData, keyData)
+			if err != nil {
+				return fmt.Errorf("invalid client certificate of user %q: %s", userName, err)
+			}
+			c.clientCert = &cert
+		}
+		return nil
+	}
+	return fmt.Errorf("user %q of context %q not found", userName, name)
+}
+
+// K8sSAAuth authenticates Kubernetes service accounts by their tokens, which are checked by the API server
+// with the TokenReview API. The account is <namespace>/<name>, labels are "namespace", "serviceaccount",
+// "groups" and, for tokens bound to a pod, "pod".
+type K8sSAAuth struct {
+	config *K8sSAAuthConfig
+	client *http.Client
+}
+
+// tokenReview is a TokenReview object of the authentication.k8s.io/v1 API.
+type tokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool `json:"authenticated"`
+		User          struct {
+			Username string              `json:"username"`
+			Groups   []string            `json:"groups"`
+			Extra    map[string][]string `json:"extra"`
+		} `json:"user"`
+		Audiences []string `json:"audiences"`
+		Error     string   `json:"error"`
+	} `json:"status"`
+}
+
+func NewK8sSAAuth(c *K8sSAAuthConfig) (*K8sSAAuth, error) {
+	tlsConfig := &tls.Config{}
+	if len(c.caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(c.caData) {
+			return nil, fmt.Errorf("k8s_sa_auth: no valid CA certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+	}
+	ka := &K8sSAAuth{
+		config: c,
+		client: &http.Client{Timeout: c.HTTPTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}
+	glog.Infof("Kubernetes service account auth with %s for audiences %s", c.APIServer, c.Audiences)
+	return ka, nil
+}
+
+// do sends a request to the API server with our credentials.
+func (ka *K8sSAAuth) do(method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ka.config.APIServer+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token := ka.config.token
+	if ka.config.TokenFile != "" {
+		// Projected tokens are rotated by the kubelet.
+		data, err := ioutil.ReadFile(ka.config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return ka.client.Do(req)
+}
+
+func (ka *K8sSAAuth) AuthenticateToken(token string) (string, bool, api.Labels, error) {
+	// Other tokens are left to other authenticators, e.g. jwt_auth.
+	if !looksLikeJWT(token) || !strings.HasPrefix(unverifiedClaim(token, "sub"), k8sServiceAccountPrefix) {
+		return "", false, nil, api.NoMatch
+	}
+	tr := &tokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	tr.Spec.Token, tr.Spec.Audiences = token, ka.config.Audiences
+	resp, err := ka.do("POST", "/apis/authentication.k8s.io/v1/tokenreviews", tr)
+	if err != nil {
+		return "", false, nil, fmt.Errorf("TokenReview failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", false, nil, fmt.Errorf("TokenReview failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var result tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", false, nil, fmt.Errorf("failed to parse TokenReview: %s", err)
+	}
+	st := result.Status
+	if !st.Authenticated {
+		glog.Warningf("Kubernetes service account token rejected: %s", st.Error)
+		return "", false, nil, nil
+	}
+	// The API server returns the audiences of the token that were requested. One that does not support
+	// audiences returns none, in which case the token may well have been issued for someone else.
+	if !ka.allowedAudience(st.Audiences) {
+		glog.Warningf("Kubernetes service account token of %s rejected: audiences %s are not allowed", st.User.Username, st.Audiences)
+		return "", false, nil, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(st.User.Username, k8sServiceAccountPrefix), ":")
+	if !strings.HasPrefix(st.User.Username, k8sServiceAccountPrefix) || len(parts) != 2 {
+		glog.Warningf("Kubernetes token of %s rejected: not a service account", st.User.Username)
+		return "", false, nil, nil
+	}
+	labels := api.Labels{"namespace": {parts[0]}, "serviceaccount": {parts[1]}}
+	if len(st.User.Groups) > 0 {
+		labels["groups"] = st.User.Groups
+	}
+	if pod := st.User.Extra[k8sPodNameExtra]; len(pod) > 0 {
+		labels["pod"] = pod
+	}
+	return parts[0] + "/" + parts[1], true, labels, nil
+}
+
+func (ka *K8sSAAuth) allowedAudience(audiences []string) bool {
+	for _, a := range audiences {
+		for _, allowed := range ka.config.Audiences {
+			if a == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticate is used if the account name is known, it must match the one of the token.
+func (ka *K8sSAAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	account, result, labels, err := ka.AuthenticateToken(string(password))
+	if err != nil || !result {
+		return result, labels, err
+	}
+	if account != user {
+		glog.Warningf("Kubernetes service account token rejected: issued to %q, not %q", account, user)
+		return false, nil, nil
+	}
+	return true, labels, nil
+}
+
+func (ka *K8sSAAuth) HealthCheck() error {
+	resp, err := ka.do("GET", "/version", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API server returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (ka *K8sSAAuth) Stop() {
+}
+
+func (ka *K8sSAAuth) Name() string {
+	return "Kubernetes service account"
+}
@@ -0,0 +1,170 @@
+package authn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeTokenReview accepts the tokens in reviews, with their audiences.
+type fakeTokenReview struct {
+	t       *testing.T
+	reviews map[string]*tokenReview
+}
+
+func (f *fakeTokenReview) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer reviewer-token" {
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Method == "GET" && req.URL.Path == "/version" {
+		fmt.Fprintln(rw, `{"major": "1", "minor": "29"}`)
+		return
+	}
+	if req.Method != "POST" || req.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+		http.NotFound(rw, req)
+		return
+	}
+	var tr tokenReview
+	if err := json.NewDecoder(req.Body).Decode(&tr); err != nil || tr.Kind != "TokenReview" {
+		f.t.Errorf("invalid TokenReview: %+v, %v", tr, err)
+	}
+	if r := f.reviews[tr.Spec.Token]; r != nil {
+		tr.Status = r.Status
+		// Only the requested audiences are returned.
+		tr.Status.Audiences = nil
+		for _, a := range r.Status.Audiences {
+			for _, requested := range tr.Spec.Audiences {
+				if a == requested {
+					tr.Status.Audiences = append(tr.Status.Audiences, a)
+				}
+			}
+		}
+		if len(r.Status.Audiences) > 0 && len(tr.Status.Audiences) == 0 {
+			tr.Status.Authenticated = false
+			tr.Status.Error = "token audiences are invalid"
+		}
+	} else {
+		tr.Status.Error = "invalid token"
+	}
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(tr)
+}
+
+// fakeJWT returns a token that looks like a JWT with the given subject, it is not signed.
+func fakeJWT(sub string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(fmt.Sprintf(`{"sub":%q}`, sub))) + ".c2ln"
+}
+
+func TestK8sSAAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s_sa_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	builder := fakeJWT("system:serviceaccount:ci:builder")
+	otherAudience := fakeJWT("system:serviceaccount:ci:other")
+	unreviewed := fakeJWT("system:serviceaccount:ci:unknown")
+	f := &fakeTokenReview{t: t, reviews: map[string]*tokenReview{}}
+	f.reviews[builder] = &tokenReview{}
+	f.reviews[builder].Status.Authenticated = true
+	f.reviews[builder].Status.User.Username = "system:serviceaccount:ci:builder"
+	f.reviews[builder].Status.User.Groups = []string{"system:serviceaccounts", "system:serviceaccounts:ci"}
+	f.reviews[builder].Status.User.Extra = map[string][]string{k8sPodNameExtra: {"builder-1"}}
+	f.reviews[builder].Status.Audiences = []string{"docker-registry"}
+	f.reviews[otherAudience] = &tokenReview{}
+	f.reviews[otherAudience].Status.Authenticated = true
+	f.reviews[otherAudience].Status.User.Username = "system:serviceaccount:ci:other"
+	f.reviews[otherAudience].Status.Audiences = []string{"https://kubernetes.default.svc"}
+	ts := httptest.NewTLSServer(f)
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	tokenFile := filepath.Join(dir, "token")
+	for name, data := range map[string][]byte{caFile: caPEM, tokenFile: []byte("reviewer-token\n")} {
+		if err := ioutil.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	err = ioutil.WriteFile(kubeconfig, []byte(fmt.Sprintf(`
+current-context: test
+contexts:
+- name: test
+  context: {cluster: test, user: reviewer}
+clusters:
+- name: test
+  cluster: {server: %q, certificate-authority-data: %q}
+users:
+- name: reviewer
+  user: {tokenFile: token}
+`, ts.URL, base64.StdEncoding.EncodeToString(caPEM))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&K8sSAAuthConfig{APIServer: ts.URL, CAFile: caFile, TokenFile: tokenFile}).Validate("k8s_sa_auth"); err == nil {
+		t.Errorf("expected config without audiences to be rejected")
+	}
+	configs := map[string]*K8sSAAuthConfig{
+		"api_server": {APIServer: ts.URL, CAFile: caFile, TokenFile: tokenFile, Audiences: []string{"docker-registry"}},
+		"kubeconfig": {Kubeconfig: kubeconfig, Audiences: []string{"docker-registry"}},
+	}
+	for name, c := range configs {
+		if err := c.Validate("k8s_sa_auth"); err != nil {
+			t.Fatalf("%s: invalid config: %s", name, err)
+		}
+		ka, err := NewK8sSAAuth(c)
+		if err != nil {
+			t.Fatalf("%s: failed to create K8sSAAuth: %s", name, err)
+		}
+		if err := ka.HealthCheck(); err != nil {
+			t.Errorf("%s: health check failed: %s", name, err)
+		}
+		account, result, labels, err := ka.AuthenticateToken(builder)
+		expectedLabels := api.Labels{
+			"namespace":      {"ci"},
+			"serviceaccount": {"builder"},
+			"groups":         {"system:serviceaccounts", "system:serviceaccounts:ci"},
+			"pod":            {"builder-1"},
+		}
+		if err != nil || !result || account != "ci/builder" || !reflect.DeepEqual(labels, expectedLabels) {
+			t.Errorf("%s: expected builder to be authenticated, got %q %t %v %v", name, account, result, labels, err)
+		}
+		for _, token := range []string{otherAudience, unreviewed} {
+			if _, result, _, err := ka.AuthenticateToken(token); err != nil || result {
+				t.Errorf("%s: expected token to be rejected, got %t %v", name, result, err)
+			}
+		}
+		for _, token := range []string{"password", fakeJWT("alice")} {
+			if _, _, _, err := ka.AuthenticateToken(token); err != api.NoMatch {
+				t.Errorf("%s: expected %q not to match, got %v", name, token, err)
+			}
+		}
+		if result, _, err := ka.Authenticate("ci/builder", api.PasswordString(builder)); err != nil || !result {
+			t.Errorf("%s: expected builder to be authenticated by password, got %t %v", name, result, err)
+		}
+		if result, _, err := ka.Authenticate("ci/other", api.PasswordString(builder)); err != nil || result {
+			t.Errorf("%s: expected token of another account to be rejected, got %t %v", name, result, err)
+		}
+	}
+
+	ioutil.WriteFile(tokenFile, []byte("rotated-token"), 0600)
+	ka, _ := NewK8sSAAuth(configs["api_server"])
+	if _, _, _, err := ka.AuthenticateToken(builder); err == nil {
+		t.Errorf("expected rotated token to be used and rejected by the API server")
+	}
+}
@@ -22,6 +22,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/cesanta/glog"
 	"github.com/go-ldap/ldap"
@@ -37,6 +40,7 @@ type LabelMap struct {
 type LDAPAuthConfig struct {
 	Addr                  string              `yaml:"addr,omitempty"`
 	TLS                   string              `yaml:"tls,omitempty"`
+	StartTLS              bool                `yaml:"start_tls,omitempty"`
 	InsecureTLSSkipVerify bool                `yaml:"insecure_tls_skip_verify,omitempty"`
 	CACertificate         string              `yaml:"ca_certificate,omitempty"`
 	Base                  string              `yaml:"base,omitempty"`
@@ -44,19 +48,158 @@ type LDAPAuthConfig struct {
 	BindDN                string              `yaml:"bind_dn,omitempty"`
 	BindPasswordFile      string              `yaml:"bind_password_file,omitempty"`
 	LabelMaps             map[string]LabelMap `yaml:"labels,omitempty"`
+	// Groups of the user are added as a label, see LDAPGroupSearchConfig.
+	GroupSearch *LDAPGroupSearchConfig `yaml:"group_search,omitempty"`
+	// Attributes of the user's entry to add as labels, attribute name -> label key. All the values
+	// of multi-valued attributes are added, attributes that the entry does not have are omitted.
+	AttributeLabels map[string]string `yaml:"attribute_labels,omitempty"`
+	// Maximum number of idle connections to keep for reuse.
+	PoolSize int `yaml:"pool_size,omitempty"`
+	// Idle connections are closed after this long. Zero means no limit.
+	PoolIdleTimeout time.Duration `yaml:"pool_idle_timeout,omitempty"`
+	// Multiple servers to fail over between, instead of Addr.
+	Addrs []string `yaml:"addrs,omitempty"`
+	// Servers that failed are not tried again for this long, unless no other servers are available.
+	ServerRetryInterval time.Duration `yaml:"server_retry_interval,omitempty"`
+	// Requests that fail due to connection errors are attempted up to this many times, default is 1 (no retries).
+	// Invalid credentials are never retried.
+	RetryAttempts int `yaml:"retry_attempts,omitempty"`
+	// Delay before the first retry, doubled after each one up to max_retry_backoff.
+	RetryBackoff    time.Duration `yaml:"retry_backoff,omitempty"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff,omitempty"`
+	// No more retries are made once this much time has passed since the first attempt. Zero means no limit.
+	RetryMaxElapsed time.Duration `yaml:"retry_max_elapsed,omitempty"`
+	// Limits the number of requests to the servers in progress at the same time, including retries.
+	ConcurrencyLimit `yaml:",inline"`
+	// Request the password policy control when binding as the user, see ldapPasswordPolicy.
+	PasswordPolicy bool `yaml:"password_policy,omitempty"`
+}
+
+const (
+	defaultLDAPRetryBackoff    = 100 * time.Millisecond
+	defaultLDAPMaxRetryBackoff = 5 * time.Second
+)
+
+// Number of retries made by all LDAP authenticators, exported as a metric by the server.
+var ldapRetries uint64
+
+// LDAPRetries returns the number of LDAP requests that have been retried due to connection errors.
+func LDAPRetries() uint64 {
+	return atomic.LoadUint64(&ldapRetries)
 }
 
 type LDAPAuth struct {
-	config *LDAPAuthConfig
+	config      *LDAPAuthConfig
+	pool        *ldapPool
+	groupFilter *template.Template
+	groupCache  ldapGroupCache
+	connect     func(addr string) (ldap.Client, error)
+	servers     ldapServers
+	limiter     *concurrencyLimiter
+}
+
+func (c *LDAPAuthConfig) Validate(configKey string) error {
+	if c.Addr == "" && len(c.Addrs) == 0 {
+		return fmt.Errorf("%s.addr or %s.addrs is required", configKey, configKey)
+	}
+	if c.Addr != "" && len(c.Addrs) > 0 {
+		return fmt.Errorf("only one of %s.addr and %s.addrs can be set", configKey, configKey)
+	}
+	if c.ServerRetryInterval < 0 {
+		return fmt.Errorf("%s.server_retry_interval must not be negative", configKey)
+	}
+	if c.ServerRetryInterval == 0 {
+		c.ServerRetryInterval = time.Minute
+	}
+	switch c.TLS {
+	case "", "none", "always", "starttls":
+	default:
+		return fmt.Errorf("%s.tls must be one of none, always, starttls, got %q", configKey, c.TLS)
+	}
+	if c.StartTLS {
+		for _, addr := range c.serverAddrs() {
+			if c.tlsMode(addr) == "always" {
+				return fmt.Errorf("%s.start_tls cannot be used with implicit TLS (tls: always or port 636)", configKey)
+			}
+		}
+		if c.TLS == "none" {
+			return fmt.Errorf("%s.start_tls cannot be used with tls: none", configKey)
+		}
+		c.TLS = "starttls"
+	}
+	if c.PoolSize < 0 {
+		return fmt.Errorf("%s.pool_size must not be negative", configKey)
+	}
+	if c.PoolSize == 0 {
+		c.PoolSize = 1
+	}
+	if c.PoolIdleTimeout < 0 {
+		return fmt.Errorf("%s.pool_idle_timeout must not be negative", configKey)
+	}
+	if c.RetryAttempts < 0 || c.RetryBackoff < 0 || c.MaxRetryBackoff < 0 || c.RetryMaxElapsed < 0 {
+		return fmt.Errorf("%s.{retry_attempts,retry_backoff,max_retry_backoff,retry_max_elapsed} must not be negative", configKey)
+	}
+	if c.RetryAttempts == 0 {
+		c.RetryAttempts = 1
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultLDAPRetryBackoff
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = defaultLDAPMaxRetryBackoff
+	}
+	if c.GroupSearch != nil {
+		if err := c.GroupSearch.Validate(configKey + ".group_search"); err != nil {
+			return err
+		}
+	}
+	for attr, label := range c.AttributeLabels {
+		if attr == "" || label == "" {
+			return fmt.Errorf("%s.attribute_labels: attribute names and label keys must not be empty", configKey)
+		}
+		if _, found := c.LabelMaps[label]; found {
+			return fmt.Errorf("%s.attribute_labels: label %s is also defined in %s.labels", configKey, label, configKey)
+		}
+	}
+	return c.ConcurrencyLimit.Validate(configKey)
+}
+
+func (c *LDAPAuthConfig) serverAddrs() []string {
+	if len(c.Addrs) > 0 {
+		return c.Addrs
+	}
+	return []string{c.Addr}
+}
+
+// tlsMode returns the TLS setting to connect to addr with. Port 636 implies TLS, unless configured otherwise.
+func (c *LDAPAuthConfig) tlsMode(addr string) string {
+	if c.TLS == "" && strings.HasSuffix(addr, ":636") {
+		return "always"
+	}
+	return c.TLS
 }
 
 func NewLDAPAuth(c *LDAPAuthConfig) (*LDAPAuth, error) {
-	if c.TLS == "" && strings.HasSuffix(c.Addr, ":636") {
-		c.TLS = "always"
+	la := &LDAPAuth{
+		config:  c,
+		limiter: newConcurrencyLimiter(&c.ConcurrencyLimit, "ldap"),
+	}
+	la.connect = func(addr string) (ldap.Client, error) {
+		l, err := la.ldapConnection(addr)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	la.pool = newLDAPPool(la.dial, c.PoolSize, c.PoolIdleTimeout)
+	if c.GroupSearch != nil && c.GroupSearch.Filter != "" {
+		t, err := template.New("filter").Parse(c.GroupSearch.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group search filter: %s", err)
+		}
+		la.groupFilter = t
 	}
-	return &LDAPAuth{
-		config: c,
-	}, nil
+	return la, nil
 }
 
 //How to authenticate user, please refer to https://github.com/go-ldap/ldap/blob/master/example_test.go#L166
@@ -64,17 +207,80 @@ func (la *LDAPAuth) Authenticate(account string, password api.PasswordString) (b
 	if account == "" || password == "" {
 		return false, nil, api.NoMatch
 	}
-	l, err := la.ldapConnection()
-	if err != nil {
+	if err := la.limiter.acquire(); err != nil {
 		return false, nil, err
 	}
-	defer l.Close()
+	defer la.limiter.release()
+	start := time.Now()
+	backoff := la.config.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		result, labels, err := la.authenticateOnce(account, password)
+		if !isTransientLDAPError(err) || attempt >= la.config.RetryAttempts ||
+			(la.config.RetryMaxElapsed > 0 && time.Since(start)+backoff > la.config.RetryMaxElapsed) {
+			return result, labels, err
+		}
+		glog.V(2).Infof("LDAP request for %s failed (%s), retrying in %s (attempt %d of %d)",
+			account, err, backoff, attempt+1, la.config.RetryAttempts)
+		atomic.AddUint64(&ldapRetries, 1)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > la.config.MaxRetryBackoff {
+			backoff = la.config.MaxRetryBackoff
+		}
+	}
+}
+
+// isTransientLDAPError returns true for connection-level errors, which may go away if the request
+// is retried. Errors returned by the server, invalid credentials in particular, are not transient.
+func isTransientLDAPError(err error) bool {
+	if err == nil || ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false
+	}
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// authenticateOnce makes a single attempt, possibly over several connections if pooled ones turn out to be broken.
+func (la *LDAPAuth) authenticateOnce(account string, password api.PasswordString) (bool, api.Labels, error) {
+	newConns := 0
+	for {
+		l, reused, err := la.pool.get()
+		if err != nil {
+			return false, nil, err
+		}
+		if !reused {
+			newConns++
+		}
+		addr := ldapServerAddr(l)
+		result, labels, err := la.authenticate(l, account, password)
+		switch {
+		case err != nil && err != api.NoMatch && err != api.PasswordExpired:
+			// State of the connection is unknown, do not reuse it.
+			la.pool.discard(l)
+			if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+				la.servers.setFailed(addr, true)
+				// Idle connection may have been dropped by the server or the server went down, try another one.
+				if reused || newConns < len(la.config.serverAddrs()) {
+					glog.V(2).Infof("LDAP connection to %s failed (%s), reconnecting", addr, err)
+					continue
+				}
+			}
+		case result && la.config.BindDN == "":
+			// There is no read-only user to rebind as, connection remains bound as the user.
+			la.pool.discard(l)
+		default:
+			la.pool.put(l)
+		}
+		glog.V(2).Infof("LDAP request for %s served by %s", account, addr)
+		return result, labels, err
+	}
+}
 
+func (la *LDAPAuth) authenticate(l ldap.Client, account string, password api.PasswordString) (bool, api.Labels, error) {
 	// First bind with a read only user, to prevent the following search won't perform any write action
 	if bindErr := la.bindReadOnlyUser(l); bindErr != nil {
 		return false, nil, bindErr
 	}
 
+	username := account
 	account = la.escapeAccountInput(account)
 
 	filter := la.getFilter(account)
@@ -83,6 +289,10 @@ func (la *LDAPAuth) Authenticate(account string, password api.PasswordString) (b
 	if labelsConfigErr != nil {
 		return false, nil, labelsConfigErr
 	}
+	gs := la.config.GroupSearch
+	if gs != nil && gs.MemberAttribute != "" {
+		labelAttributes = append(labelAttributes, gs.MemberAttribute)
+	}
 
 	accountEntryDN, entryAttrMap, uSearchErr := la.ldapSearch(l, &la.config.Base, &filter, &labelAttributes)
 	if uSearchErr != nil {
@@ -93,12 +303,20 @@ func (la *LDAPAuth) Authenticate(account string, password api.PasswordString) (b
 	}
 
 	// Bind as the user to verify their password
+	var policy *ldapPasswordPolicy
 	if len(accountEntryDN) > 0 {
-		err := l.Bind(accountEntryDN, string(password))
+		var err error
+		policy, err = la.bindUser(l, accountEntryDN, password)
+		if policy != nil && policy.mustChange {
+			// Servers may or may not fail the bind in this case, either way the password cannot be used.
+			return false, nil, policy.check(accountEntryDN, nil)
+		}
 		if err != nil {
 			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				glog.V(2).Infof("Bind as %s failed: invalid credentials", accountEntryDN)
 				return false, nil, nil
 			}
+			glog.Errorf("Bind as %s failed (not an authentication error): %s", accountEntryDN, err)
 			return false, nil, err
 		}
 	}
@@ -107,16 +325,32 @@ func (la *LDAPAuth) Authenticate(account string, password api.PasswordString) (b
 		return false, nil, bindErr
 	}
 
+	var groups []string
+	if gs != nil {
+		// Label mapping may modify attribute values, so this is done first.
+		var err error
+		groups, err = la.getGroups(l, username, accountEntryDN, entryAttrMap[gs.MemberAttribute])
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
 	// Extract labels from the attribute values
 	labels, labelsExtractErr := la.getLabelsFromMap(entryAttrMap)
 	if labelsExtractErr != nil {
 		return false, nil, labelsExtractErr
 	}
+	if gs != nil {
+		labels[gs.Label] = append(labels[gs.Label], groups...)
+	}
+	if policy != nil {
+		policy.check(accountEntryDN, labels)
+	}
 
 	return true, labels, nil
 }
 
-func (la *LDAPAuth) bindReadOnlyUser(l *ldap.Conn) error {
+func (la *LDAPAuth) bindReadOnlyUser(l ldap.Client) error {
 	if la.config.BindDN != "" {
 		password, err := ioutil.ReadFile(la.config.BindPasswordFile)
 		if err != nil {
@@ -126,12 +360,27 @@ func (la *LDAPAuth) bindReadOnlyUser(l *ldap.Conn) error {
 		glog.V(2).Infof("Bind read-only user (DN = %s)", la.config.BindDN)
 		err = l.Bind(la.config.BindDN, password_str)
 		if err != nil {
+			glog.Errorf("Bind as read-only user %s failed: %s", la.config.BindDN, err)
 			return err
 		}
 	}
 	return nil
 }
 
+// HealthCheck connects to the server and binds as the read-only user, if one is configured.
+func (la *LDAPAuth) HealthCheck() error {
+	l, _, err := la.pool.get()
+	if err != nil {
+		return err
+	}
+	if err := la.bindReadOnlyUser(l); err != nil {
+		la.pool.discard(l)
+		return err
+	}
+	la.pool.put(l)
+	return nil
+}
+
 //To prevent LDAP injection, some characters must be escaped for searching
 //e.g. char '\' will be replaced by hex '\5c'
 //Filter meta chars are choosen based on filter complier code
@@ -153,13 +402,14 @@ func (la *LDAPAuth) escapeAccountInput(account string) string {
 	return r.Replace(account)
 }
 
-func (la *LDAPAuth) ldapConnection() (*ldap.Conn, error) {
+func (la *LDAPAuth) ldapConnection(addr string) (*ldap.Conn, error) {
 	var l *ldap.Conn
 	var err error
+	tlsMode := la.config.tlsMode(addr)
 
 	tlsConfig := &tls.Config{InsecureSkipVerify: true}
 	if !la.config.InsecureTLSSkipVerify {
-		addr := strings.Split(la.config.Addr, ":")
+		host := strings.Split(addr, ":")
 		if la.config.CACertificate != "" {
 			pool := x509.NewCertPool()
 			pem, err := ioutil.ReadFile(la.config.CACertificate)
@@ -170,24 +420,29 @@ func (la *LDAPAuth) ldapConnection() (*ldap.Conn, error) {
 			if !ok {
 				return nil, fmt.Errorf("Error loading CA File: Couldn't parse PEM in: %s", la.config.CACertificate)
 			}
-			tlsConfig = &tls.Config{InsecureSkipVerify: false, ServerName: addr[0], RootCAs: pool}
+			tlsConfig = &tls.Config{InsecureSkipVerify: false, ServerName: host[0], RootCAs: pool}
 		} else {
-			tlsConfig = &tls.Config{InsecureSkipVerify: false, ServerName: addr[0]}
+			tlsConfig = &tls.Config{InsecureSkipVerify: false, ServerName: host[0]}
 		}
 	}
 
-	if la.config.TLS == "" || la.config.TLS == "none" || la.config.TLS == "starttls" {
-		glog.V(2).Infof("Dial: starting...%s", la.config.Addr)
-		l, err = ldap.Dial("tcp", fmt.Sprintf("%s", la.config.Addr))
-		if err == nil && la.config.TLS == "starttls" {
+	if tlsMode == "" || tlsMode == "none" || tlsMode == "starttls" {
+		glog.V(2).Infof("Dial: starting...%s", addr)
+		l, err = ldap.Dial("tcp", addr)
+		if err == nil && tlsMode == "starttls" {
 			glog.V(2).Infof("StartTLS...")
 			if tlserr := l.StartTLS(tlsConfig); tlserr != nil {
+				glog.Errorf("StartTLS with %s failed (TLS handshake error): %s", addr, tlserr)
+				l.Close()
 				return nil, tlserr
 			}
 		}
-	} else if la.config.TLS == "always" {
-		glog.V(2).Infof("DialTLS: starting...%s", la.config.Addr)
-		l, err = ldap.DialTLS("tcp", fmt.Sprintf("%s", la.config.Addr), tlsConfig)
+	} else if tlsMode == "always" {
+		glog.V(2).Infof("DialTLS: starting...%s", addr)
+		l, err = ldap.DialTLS("tcp", addr, tlsConfig)
+		if err != nil {
+			glog.Errorf("TLS connection to %s failed: %s", addr, err)
+		}
 	}
 	if err != nil {
 		return nil, err
@@ -203,7 +458,7 @@ func (la *LDAPAuth) getFilter(account string) string {
 
 //ldap search and return required attributes' value from searched entries
 //default return entry's DN value if you leave attrs array empty
-func (la *LDAPAuth) ldapSearch(l *ldap.Conn, baseDN *string, filter *string, attrs *[]string) (string, map[string][]string, error) {
+func (la *LDAPAuth) ldapSearch(l ldap.Client, baseDN *string, filter *string, attrs *[]string) (string, map[string][]string, error) {
 	if l == nil {
 		return "", nil, fmt.Errorf("No ldap connection!")
 	}
@@ -234,6 +489,14 @@ func (la *LDAPAuth) ldapSearch(l *ldap.Conn, baseDN *string, filter *string, att
 		} else {
 			for _, attr := range *attrs {
 				values := entry.GetAttributeValues(attr)
+				if len(values) == 0 {
+					// Attribute names are case-insensitive.
+					for _, ea := range entry.Attributes {
+						if strings.EqualFold(ea.Name, attr) {
+							values = ea.Values
+						}
+					}
+				}
 				glog.V(2).Infof("Entry %s = %s", attr, strings.Join(values, "\n"))
 				attributes[attr] = values
 			}
@@ -253,6 +516,9 @@ func (la *LDAPAuth) getLabelAttributes() ([]string, error) {
 		labelAttributes[i] = mapping.Attribute
 		i++
 	}
+	for attr := range la.config.AttributeLabels {
+		labelAttributes = append(labelAttributes, attr)
+	}
 	return labelAttributes, nil
 }
 
@@ -275,12 +541,17 @@ func (la *LDAPAuth) getLabelsFromMap(attrMap map[string][]string) (map[string][]
 			labels[key] = mappingValues
 		}
 	}
+	for attr, key := range la.config.AttributeLabels {
+		if values := attrMap[attr]; len(values) > 0 {
+			labels[key] = append(labels[key], values...)
+		}
+	}
 	return labels, nil
 }
 
 func (la *LDAPAuth) getCNFromDN(dn string) string {
 	parsedDN, err := ldap.ParseDN(dn)
-	if err != nil || len(parsedDN.RDNs) > 0 {
+	if err == nil && len(parsedDN.RDNs) > 0 {
 		for _, rdn := range parsedDN.RDNs {
 			for _, rdnAttr := range rdn.Attributes {
 				if strings.ToUpper(rdnAttr.Type) == "CN" {
@@ -295,6 +566,7 @@ func (la *LDAPAuth) getCNFromDN(dn string) string {
 }
 
 func (la *LDAPAuth) Stop() {
+	la.pool.close()
 }
 
 func (la *LDAPAuth) Name() string {
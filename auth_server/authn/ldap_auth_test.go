@@ -0,0 +1,264 @@
+package authn
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestLDAPGroupSearch(t *testing.T) {
+	cases := []struct {
+		gs       LDAPGroupSearchConfig
+		groups   []string
+		searches int
+	}{
+		{LDAPGroupSearchConfig{MemberAttribute: "memberOf"}, []string{"dev", "ops"}, 1},
+		{LDAPGroupSearchConfig{Base: "ou=groups", Filter: "(member={{.UserDN}})"}, []string{"dev", "qa"}, 2},
+		{LDAPGroupSearchConfig{MemberAttribute: "memberOf", Base: "ou=groups", Filter: "(member={{.UserDN}})"}, []string{"dev", "ops", "qa"}, 2},
+		{LDAPGroupSearchConfig{Base: "ou=groups", Filter: "(member=uid={{.Username}})", Label: "teams"}, []string{"dev", "qa"}, 2},
+	}
+	for i, c := range cases {
+		s := &fakeLDAPServer{}
+		la := newFakeLDAPAuth(t, s, &c.gs)
+		ok, labels, err := la.Authenticate("alice", "secret")
+		if !ok || err != nil {
+			t.Fatalf("%d: expected success, got %t %v", i, ok, err)
+		}
+		if !reflect.DeepEqual(labels[c.gs.Label], c.groups) {
+			t.Errorf("%d: expected groups %s, got %s", i, c.groups, labels)
+		}
+		if s.conns[0].searches != c.searches {
+			t.Errorf("%d: expected %d searches, got %d", i, c.searches, s.conns[0].searches)
+		}
+	}
+}
+
+func TestLDAPGroupCache(t *testing.T) {
+	s := &fakeLDAPServer{}
+	la := newFakeLDAPAuth(t, s, &LDAPGroupSearchConfig{Base: "ou=groups", Filter: "(member={{.UserDN}})", CacheTTL: time.Hour})
+	for i := 0; i < 3; i++ {
+		ok, labels, err := la.Authenticate("alice", "secret")
+		if !ok || err != nil || len(labels["groups"]) != 2 {
+			t.Fatalf("%d: expected success with 2 groups, got %t %s %v", i, ok, labels, err)
+		}
+	}
+	// One user search per request, one group search.
+	if s.conns[0].searches != 4 {
+		t.Errorf("expected group search results to be cached, got %d searches", s.conns[0].searches)
+	}
+}
+
+func TestLDAPNestedGroups(t *testing.T) {
+	// dev and qa are in engineering, which is in staff along with ops. staff is in everyone and,
+	// making a cycle, in engineering.
+	parents := map[string][]string{
+		"cn=dev,ou=groups":         {"cn=engineering,ou=groups"},
+		"cn=qa,ou=groups":          {"cn=engineering,ou=groups"},
+		"cn=ops,ou=groups":         {"cn=staff,ou=groups"},
+		"cn=engineering,ou=groups": {"cn=staff,ou=groups"},
+		"cn=staff,ou=groups":       {"cn=everyone,ou=groups", "cn=engineering,ou=groups"},
+	}
+	cases := []struct {
+		gs       LDAPGroupSearchConfig
+		groups   []string
+		searches int
+	}{
+		// Levels: [dev ops] -> [engineering staff] -> [everyone] -> none.
+		{LDAPGroupSearchConfig{MemberAttribute: "memberOf", Base: "ou=groups", NestedGroups: true},
+			[]string{"dev", "ops", "engineering", "staff", "everyone"}, 4},
+		{LDAPGroupSearchConfig{MemberAttribute: "memberOf", Base: "ou=groups", NestedGroups: true, MaxGroupDepth: 1},
+			[]string{"dev", "ops", "engineering", "staff"}, 2},
+		{LDAPGroupSearchConfig{Base: "ou=groups", Filter: "(member={{.UserDN}})", NestedGroups: true, MaxGroupDepth: 2},
+			[]string{"dev", "qa", "engineering", "staff"}, 4},
+		{LDAPGroupSearchConfig{MemberAttribute: "memberOf", Base: "ou=groups", NestedGroups: true, InChain: true},
+			[]string{"dev", "ops", "qa", "engineering", "staff", "everyone"}, 2},
+	}
+	for i, c := range cases {
+		s := &fakeLDAPServer{groupParents: parents}
+		c.gs.CacheTTL = time.Hour
+		la := newFakeLDAPAuth(t, s, &c.gs)
+		for j := 0; j < 2; j++ {
+			ok, labels, err := la.Authenticate("alice", "secret")
+			if !ok || err != nil {
+				t.Fatalf("%d: expected success, got %t %v", i, ok, err)
+			}
+			if !reflect.DeepEqual(labels["groups"], c.groups) {
+				t.Errorf("%d: expected groups %s, got %s", i, c.groups, labels)
+			}
+		}
+		// The second time, only the user is searched for, the resolved groups are cached.
+		if s.conns[0].searches != c.searches+1 {
+			t.Errorf("%d: expected %d searches, got %d", i, c.searches+1, s.conns[0].searches)
+		}
+	}
+
+	for _, gs := range []LDAPGroupSearchConfig{
+		{MemberAttribute: "memberOf", NestedGroups: true},
+		{MemberAttribute: "memberOf", Base: "ou=groups", MaxGroupDepth: 3},
+		{MemberAttribute: "memberOf", Base: "ou=groups", InChain: true},
+		{MemberAttribute: "memberOf", Base: "ou=groups", NestedGroups: true, MaxGroupDepth: -1},
+	} {
+		if err := gs.Validate("ldap_auth.group_search"); err == nil {
+			t.Errorf("expected %+v to be rejected", gs)
+		}
+	}
+}
+
+func TestLDAPFailover(t *testing.T) {
+	servers := map[string]*fakeLDAPServer{"dc1:389": {}, "dc2:389": {}}
+	la := newFakeLDAPAuth(t, servers["dc1:389"], nil)
+	la.config.Addr = ""
+	la.config.Addrs = []string{"dc1:389", "dc2:389"}
+	la.connect = func(addr string) (ldap.Client, error) {
+		return servers[addr].dial()
+	}
+	// Pool is not used, so that every request makes a new connection.
+	la.pool = newLDAPPool(la.dial, 0, 0)
+	auth := func(expected string) {
+		t.Helper()
+		before := len(servers[expected].conns)
+		if ok, _, err := la.Authenticate("alice", "secret"); !ok || err != nil {
+			t.Fatalf("expected success, got %t %v", ok, err)
+		}
+		if len(servers[expected].conns) != before+1 {
+			t.Fatalf("expected request to be served by %s", expected)
+		}
+	}
+
+	auth("dc1:389")
+	servers["dc1:389"].down = true
+	auth("dc2:389")
+	// Once failed, dc1 is not tried again until server_retry_interval passes.
+	servers["dc1:389"].down = false
+	auth("dc2:389")
+	la.config.ServerRetryInterval = time.Nanosecond
+	auth("dc1:389")
+
+	// Authentication failures do not cause failover.
+	if ok, _, err := la.Authenticate("alice", "wrong"); ok || err != nil {
+		t.Fatalf("expected wrong password, got %t %v", ok, err)
+	}
+	if n := len(servers["dc2:389"].conns); n != 2 {
+		t.Errorf("expected dc2 to not be used for a wrong password, got %d connections", n)
+	}
+}
+
+func TestLDAPAttributeLabels(t *testing.T) {
+	s := &fakeLDAPServer{}
+	la := newFakeLDAPAuth(t, s, nil)
+	la.config.AttributeLabels = map[string]string{"department": "dept", "EmployeeType": "employee_type", "mail": "email"}
+	ok, labels, err := la.Authenticate("alice", "secret")
+	if !ok || err != nil {
+		t.Fatalf("expected success, got %t %v", ok, err)
+	}
+	expected := api.Labels{"dept": {"R&D"}, "employee_type": {"contractor", "remote"}}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+
+	for _, al := range []map[string]string{{"": "dept"}, {"department": ""}, {"department": "title"}} {
+		c := &LDAPAuthConfig{Addr: "ldap.example.com:389", LabelMaps: map[string]LabelMap{"title": {Attribute: "title"}}, AttributeLabels: al}
+		if err := c.Validate("ldap_auth"); err == nil {
+			t.Errorf("expected attribute_labels %v to be rejected", al)
+		}
+	}
+}
+
+func TestLDAPPasswordPolicy(t *testing.T) {
+	s := &fakeLDAPServer{}
+	la := newFakeLDAPAuth(t, s, nil)
+	la.config.PasswordPolicy = true
+	policy := func(expire, grace int64, code int8) []ldap.Control {
+		c := ldap.NewControlBeheraPasswordPolicy()
+		c.Expire, c.Grace, c.Error = expire, grace, code
+		if code >= 0 {
+			c.ErrorString = ldap.BeheraPasswordPolicyErrorMap[code]
+		}
+		return []ldap.Control{c}
+	}
+	invalidCredentials := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+
+	for _, tc := range []struct {
+		name     string
+		controls []ldap.Control
+		bindErr  error
+		result   bool
+		err      error
+		labels   api.Labels
+	}{
+		{name: "no policy", result: true, labels: api.Labels{}},
+		{name: "no warnings", controls: policy(-1, -1, -1), result: true, labels: api.Labels{}},
+		{name: "expiring", controls: policy(3600, -1, -1), result: true,
+			labels: api.Labels{"password_expires_in": {"3600"}}},
+		{name: "grace", controls: policy(-1, 2, -1), result: true,
+			labels: api.Labels{"password_grace_logins": {"2"}}},
+		{name: "expired", controls: policy(-1, -1, ldap.BeheraPasswordExpired), bindErr: invalidCredentials,
+			err: api.PasswordExpired},
+		{name: "reset", controls: policy(-1, -1, ldap.BeheraChangeAfterReset), err: api.PasswordExpired},
+		{name: "locked", controls: policy(-1, -1, ldap.BeheraAccountLocked), bindErr: invalidCredentials},
+		{name: "must change", controls: []ldap.Control{&ldap.ControlVChuPasswordMustChange{MustChange: true}},
+			err: api.PasswordExpired},
+		{name: "netscape expiring", controls: []ldap.Control{&ldap.ControlVChuPasswordWarning{Expire: 60}}, result: true,
+			labels: api.Labels{"password_expires_in": {"60"}}},
+	} {
+		s.bindControls, s.bindErr = tc.controls, tc.bindErr
+		result, labels, err := la.Authenticate("alice", "secret")
+		if result != tc.result || err != tc.err || tc.result && !reflect.DeepEqual(labels, tc.labels) {
+			t.Errorf("%s: expected %t %v %v, got %t %v %v", tc.name, tc.result, tc.labels, tc.err, result, labels, err)
+		}
+	}
+	// Wrong passwords remain wrong.
+	s.bindControls, s.bindErr = nil, nil
+	if result, _, err := la.Authenticate("alice", "wrong"); result || err != nil {
+		t.Errorf("expected wrong password to be rejected, got %t %v", result, err)
+	}
+	// Expired passwords are not a reason to drop the connection.
+	if len(s.conns) != 1 {
+		t.Errorf("expected the connection to be reused, got %d", len(s.conns))
+	}
+}
+
+func TestLDAPValidateStartTLS(t *testing.T) {
+	for _, tc := range []struct {
+		tls   string
+		addrs []string
+		err   string
+		mode  string
+	}{
+		{tls: "always", err: "start_tls cannot be used with implicit TLS"},
+		{addrs: []string{"dc1.example.com:389", "dc2.example.com:636"}, err: "start_tls cannot be used with implicit TLS"},
+		{tls: "none", err: "start_tls cannot be used with tls: none"},
+		{mode: "starttls"},
+		{tls: "starttls", mode: "starttls"},
+		{addrs: []string{"dc1.example.com:389", "dc2.example.com:3268"}, mode: "starttls"},
+	} {
+		c := &LDAPAuthConfig{
+			Addr:             "ldap.example.com:389",
+			Addrs:            tc.addrs,
+			TLS:              tc.tls,
+			StartTLS:         true,
+			Filter:           "(uid=${account})",
+			BindDN:           "cn=reader",
+			BindPasswordFile: "/dev/null",
+		}
+		if len(tc.addrs) > 0 {
+			c.Addr = ""
+		}
+		err := c.Validate("ldap_auth")
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("tls %q, addrs %q: expected error %q, got %v", tc.tls, tc.addrs, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || c.TLS != tc.mode {
+			t.Errorf("tls %q, addrs %q: expected tls %q, got %q %v", tc.tls, tc.addrs, tc.mode, c.TLS, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/go-ldap/ldap"
+)
+
+type LDAPGroupSearchConfig struct {
+	// Attribute of the user entry that lists DNs of the groups the user is a member of, e.g. memberOf.
+	MemberAttribute string `yaml:"member_attribute,omitempty"`
+	// Search for group entries in addition to (or instead of) the member attribute.
+	// Filter is a template, {{.Username}} and {{.UserDN}} are expanded (escaped).
+	Base   string `yaml:"base,omitempty"`
+	Filter string `yaml:"filter,omitempty"`
+	// Attribute of group entries to use as the group name. Default is cn.
+	NameAttribute string `yaml:"name_attribute,omitempty"`
+	// Label to put the group names in. Default is groups.
+	Label string `yaml:"label,omitempty"`
+	// How long to cache the groups of a user for. Zero disables caching.
+	CacheTTL time.Duration `yaml:"cache_ttl,omitempty"`
+	// Also add the groups that the user's groups are members of, directly or not. Parent groups are
+	// searched for under base by group_member_attribute (default member), one level at a time, up to
+	// max_group_depth levels above the user's groups (default 10), so membership cycles do no harm.
+	NestedGroups         bool   `yaml:"nested_groups,omitempty"`
+	MaxGroupDepth        int    `yaml:"max_group_depth,omitempty"`
+	GroupMemberAttribute string `yaml:"group_member_attribute,omitempty"`
+	// Active Directory only: resolve nested groups with a single search that uses the
+	// LDAP_MATCHING_RULE_IN_CHAIN matching rule, instead of searching level by level.
+	InChain bool `yaml:"in_chain,omitempty"`
+}
+
+const (
+	defaultLDAPMaxGroupDepth = 10
+	// LDAP_MATCHING_RULE_IN_CHAIN, matches the entries that reference the DN through a chain of entries.
+	ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+)
+
+func (c *LDAPGroupSearchConfig) Validate(configKey string) error {
+	if c.MemberAttribute == "" && c.Filter == "" {
+		return fmt.Errorf("%s: either member_attribute or filter is required", configKey)
+	}
+	if c.Filter != "" {
+		if c.Base == "" {
+			return fmt.Errorf("%s.base is required", configKey)
+		}
+		if _, err := template.New("filter").Parse(c.Filter); err != nil {
+			return fmt.Errorf("%s.filter is invalid: %s", configKey, err)
+		}
+	}
+	if c.NameAttribute == "" {
+		c.NameAttribute = "cn"
+	}
+	if c.Label == "" {
+		c.Label = "groups"
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("%s.cache_ttl must not be negative", configKey)
+	}
+	if !c.NestedGroups {
+		if c.MaxGroupDepth != 0 || c.GroupMemberAttribute != "" || c.InChain {
+			return fmt.Errorf("%s: max_group_depth, group_member_attribute and in_chain require nested_groups", configKey)
+		}
+		return nil
+	}
+	if c.Base == "" {
+		return fmt.Errorf("%s.base is required for nested_groups", configKey)
+	}
+	if c.MaxGroupDepth < 0 {
+		return fmt.Errorf("%s.max_group_depth must not be negative", configKey)
+	}
+	if c.MaxGroupDepth == 0 {
+		c.MaxGroupDepth = defaultLDAPMaxGroupDepth
+	}
+	if c.GroupMemberAttribute == "" {
+		c.GroupMemberAttribute = "member"
+	}
+	return nil
+}
+
+type ldapGroupFilterVars struct {
+	Username string
+	UserDN   string
+}
+
+type cachedGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+type ldapGroupCache struct {
+	lock    sync.Mutex
+	entries map[string]cachedGroups
+}
+
+func (gc *ldapGroupCache) get(userDN string) ([]string, bool) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	e, ok := gc.entries[userDN]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.groups, true
+}
+
+func (gc *ldapGroupCache) put(userDN string, groups []string, ttl time.Duration) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	now := time.Now()
+	if gc.entries == nil {
+		gc.entries = make(map[string]cachedGroups)
+	}
+	for dn, e := range gc.entries {
+		if now.After(e.expires) {
+			delete(gc.entries, dn)
+		}
+	}
+	gc.entries[userDN] = cachedGroups{groups: groups, expires: now.Add(ttl)}
+}
+
+// getGroups returns names of the groups the user is a member of.
+// memberValues are the values of the member attribute of the user entry, if one is configured.
+func (la *LDAPAuth) getGroups(l ldap.Client, username, userDN string, memberValues []string) ([]string, error) {
+	gs := la.config.GroupSearch
+	if gs.CacheTTL > 0 {
+		if groups, ok := la.groupCache.get(userDN); ok {
+			glog.V(2).Infof("Groups of %s (cached): %s", userDN, groups)
+			return groups, nil
+		}
+	}
+	groups := []string{}
+	seen := map[string]bool{}
+	add := func(g string) {
+		if !seen[g] {
+			seen[g] = true
+			groups = append(groups, g)
+		}
+	}
+	// DNs of the groups, for looking up their parents.
+	groupDNs := append([]string(nil), memberValues...)
+	for _, dn := range memberValues {
+		add(la.getCNFromDN(dn))
+	}
+	if gs.Filter != "" {
+		filter, err := la.getGroupFilter(username, userDN)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := la.searchGroups(l, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			groupDNs = append(groupDNs, entry.DN)
+			for _, name := range entry.GetAttributeValues(gs.NameAttribute) {
+				add(name)
+			}
+		}
+	}
+	if gs.NestedGroups {
+		if err := la.addParentGroups(l, userDN, groupDNs, add); err != nil {
+			return nil, err
+		}
+	}
+	glog.V(2).Infof("Groups of %s: %s", userDN, groups)
+	if gs.CacheTTL > 0 {
+		la.groupCache.put(userDN, groups, gs.CacheTTL)
+	}
+	return groups, nil
+}
+
+// searchGroups returns the group entries under group_search.base that match the filter.
+func (la *LDAPAuth) searchGroups(l ldap.Client, filter string) ([]*ldap.Entry, error) {
+	gs := la.config.GroupSearch
+	glog.V(2).Infof("Searching groups...baseDN:%s, filter:%s", gs.Base, filter)
+	sr, err := l.Search(ldap.NewSearchRequest(
+		gs.Base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{gs.NameAttribute},
+		nil))
+	if err != nil {
+		return nil, err
+	}
+	return sr.Entries, nil
+}
+
+// addParentGroups adds the groups that the groups with groupDNs are members of, directly or not.
+func (la *LDAPAuth) addParentGroups(l ldap.Client, userDN string, groupDNs []string, add func(string)) error {
+	gs := la.config.GroupSearch
+	if gs.InChain {
+		// All the groups of the user, including the direct ones, which are already there.
+		entries, err := la.searchGroups(l, fmt.Sprintf("(%s:%s:=%s)", gs.GroupMemberAttribute, ldapMatchingRuleInChain, ldap.EscapeFilter(userDN)))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			for _, name := range entry.GetAttributeValues(gs.NameAttribute) {
+				add(name)
+			}
+		}
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, dn := range groupDNs {
+		seen[strings.ToLower(dn)] = true
+	}
+	for depth := 0; len(groupDNs) > 0; depth++ {
+		if depth == gs.MaxGroupDepth {
+			glog.V(1).Infof("Not looking up parents of groups of %s nested deeper than %d levels: %s", userDN, depth, groupDNs)
+			break
+		}
+		// Parents of all the groups of this level at once.
+		var filter strings.Builder
+		for _, dn := range groupDNs {
+			fmt.Fprintf(&filter, "(%s=%s)", gs.GroupMemberAttribute, ldap.EscapeFilter(dn))
+		}
+		f := filter.String()
+		if len(groupDNs) > 1 {
+			f = "(|" + f + ")"
+		}
+		entries, err := la.searchGroups(l, f)
+		if err != nil {
+			return err
+		}
+		groupDNs = nil
+		for _, entry := range entries {
+			if key := strings.ToLower(entry.DN); !seen[key] {
+				seen[key] = true
+				groupDNs = append(groupDNs, entry.DN)
+				for _, name := range entry.GetAttributeValues(gs.NameAttribute) {
+					add(name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (la *LDAPAuth) getGroupFilter(username, userDN string) (string, error) {
+	var buf bytes.Buffer
+	err := la.groupFilter.Execute(&buf, ldapGroupFilterVars{
+		Username: ldap.EscapeFilter(username),
+		UserDN:   ldap.EscapeFilter(userDN),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to expand group search filter: %s", err)
+	}
+	return buf.String(), nil
+}
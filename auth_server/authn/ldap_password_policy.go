@@ -0,0 +1,117 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"strconv"
+
+	"github.com/cesanta/glog"
+	"github.com/go-ldap/ldap"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// Labels added when the server warns that the password is about to expire or has expired,
+// but some grace logins remain.
+const (
+	ldapPasswordExpiresInLabel = "password_expires_in"
+	ldapGraceLoginsLeftLabel   = "password_grace_logins"
+)
+
+// ldapPasswordPolicy is the state of the user's password reported by the server in response
+// to a bind, see https://tools.ietf.org/html/draft-behera-ldap-password-policy-10.
+type ldapPasswordPolicy struct {
+	// Seconds until the password expires, -1 if not reported.
+	expiresIn int64
+	// Logins remaining with the expired password, -1 if not reported.
+	graceLogins int64
+	// Password has to be changed before the account can be used: it has expired or has been reset.
+	mustChange bool
+	// Description of the error reported by the server, if any.
+	err string
+}
+
+// bindUser binds as the user, requesting the password policy control if ldap_auth.password_policy is set.
+func (la *LDAPAuth) bindUser(l ldap.Client, dn string, password api.PasswordString) (_ *ldapPasswordPolicy, err error) {
+	start := StartBackendCall()
+	defer func() {
+		outcome := BackendOutcome(err)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			outcome = BackendFailure
+		}
+		ObserveBackendCall("ldap", "bind", start, outcome)
+	}()
+	if !la.config.PasswordPolicy {
+		return nil, l.Bind(dn, string(password))
+	}
+	res, err := l.SimpleBind(&ldap.SimpleBindRequest{
+		Username: dn,
+		Password: string(password),
+		Controls: []ldap.Control{ldap.NewControlBeheraPasswordPolicy()},
+	})
+	if res == nil {
+		return nil, err
+	}
+	return parseLDAPPasswordPolicy(res.Controls), err
+}
+
+// parseLDAPPasswordPolicy extracts the password state from the response controls. Both the Behera draft
+// (OpenLDAP ppolicy) and the older Netscape controls (389 Directory Server) are understood.
+func parseLDAPPasswordPolicy(controls []ldap.Control) *ldapPasswordPolicy {
+	pp := &ldapPasswordPolicy{expiresIn: -1, graceLogins: -1}
+	for _, c := range controls {
+		switch c := c.(type) {
+		case *ldap.ControlBeheraPasswordPolicy:
+			pp.expiresIn, pp.graceLogins = c.Expire, c.Grace
+			switch c.Error {
+			case -1:
+			case ldap.BeheraPasswordExpired, ldap.BeheraChangeAfterReset:
+				pp.mustChange, pp.err = true, c.ErrorString
+			default:
+				pp.err = c.ErrorString
+			}
+		case *ldap.ControlVChuPasswordMustChange:
+			if c.MustChange {
+				pp.mustChange, pp.err = true, "Password must be changed"
+			}
+		case *ldap.ControlVChuPasswordWarning:
+			pp.expiresIn = c.Expire
+		}
+	}
+	return pp
+}
+
+// check returns api.PasswordExpired if the password has to be changed before it can be used
+// and logs the warnings, which are also added to the labels.
+func (pp *ldapPasswordPolicy) check(dn string, labels api.Labels) error {
+	if pp.mustChange {
+		glog.Warningf("Bind as %s: %s", dn, pp.err)
+		return api.PasswordExpired
+	}
+	if pp.err != "" {
+		glog.Warningf("Bind as %s: password policy error: %s", dn, pp.err)
+	}
+	if pp.graceLogins >= 0 {
+		glog.Warningf("Password of %s has expired, %d grace logins remaining", dn, pp.graceLogins)
+		labels[ldapGraceLoginsLeftLabel] = []string{strconv.FormatInt(pp.graceLogins, 10)}
+	}
+	if pp.expiresIn >= 0 {
+		glog.Infof("Password of %s expires in %d seconds", dn, pp.expiresIn)
+		labels[ldapPasswordExpiresInLabel] = []string{strconv.FormatInt(pp.expiresIn, 10)}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap"
+)
+
+// ldapPool keeps up to size idle connections for reuse.
+// When there are no idle connections, a new one is dialed, so the number of
+// connections in use at any given time is not limited (see max_concurrent for that).
+type ldapPool struct {
+	dial        func() (ldap.Client, error)
+	size        int
+	idleTimeout time.Duration
+
+	lock   sync.Mutex
+	idle   []idleConn
+	closed bool
+}
+
+type idleConn struct {
+	conn  ldap.Client
+	since time.Time
+}
+
+func newLDAPPool(dial func() (ldap.Client, error), size int, idleTimeout time.Duration) *ldapPool {
+	return &ldapPool{dial: dial, size: size, idleTimeout: idleTimeout}
+}
+
+// get returns an idle connection if there is one, or dials a new one. Connections must be
+// returned with put or, if they can't be reused, discard. reused is set if the connection
+// has been used before.
+func (p *ldapPool) get() (conn ldap.Client, reused bool, err error) {
+	p.lock.Lock()
+	p.expire()
+	if n := len(p.idle); n > 0 {
+		conn = p.idle[n-1].conn
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return conn, true, nil
+	}
+	p.lock.Unlock()
+	conn, err = p.dial()
+	return conn, false, err
+}
+
+// put returns a healthy connection to the pool. If the pool is full, the connection is closed.
+func (p *ldapPool) put(conn ldap.Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.expire()
+	if p.closed || len(p.idle) >= p.size {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+}
+
+// discard closes a connection that can't be reused.
+func (p *ldapPool) discard(conn ldap.Client) {
+	conn.Close()
+}
+
+// expire closes connections that have been idle for longer than idleTimeout.
+// Must be called with lock held.
+func (p *ldapPool) expire() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	// Connections are appended as they are returned, so the oldest ones are first.
+	n := 0
+	for n < len(p.idle) && time.Since(p.idle[n].since) > p.idleTimeout {
+		p.idle[n].conn.Close()
+		n++
+	}
+	p.idle = p.idle[n:]
+}
+
+func (p *ldapPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, ic := range p.idle {
+		ic.conn.Close()
+	}
+	p.idle = nil
+	p.closed = true
+}
@@ -0,0 +1,288 @@
+package authn
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeLDAPConn implements just enough of ldap.Client to authenticate user "alice" with password "secret"
+// and look up her groups.
+type fakeLDAPConn struct {
+	ldap.Client
+	server   *fakeLDAPServer
+	broken   bool
+	closed   bool
+	searches int
+}
+
+func (c *fakeLDAPConn) networkError() error {
+	return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+}
+
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	if c.broken {
+		return c.networkError()
+	}
+	if username == "uid=alice" && password != "secret" {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+// SimpleBind is Bind that responds with the server's bindControls and fails with its bindErr, if set.
+func (c *fakeLDAPConn) SimpleBind(br *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+	if len(br.Controls) != 1 || br.Controls[0].GetControlType() != ldap.ControlTypeBeheraPasswordPolicy {
+		return nil, errors.New("expected password policy control")
+	}
+	err := c.Bind(br.Username, br.Password)
+	if c.server.bindErr != nil {
+		err = c.server.bindErr
+	}
+	return &ldap.SimpleBindResult{Controls: c.server.bindControls}, err
+}
+
+func (c *fakeLDAPConn) Search(sr *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.broken {
+		return nil, c.networkError()
+	}
+	c.searches++
+	switch sr.Filter {
+	case "(uid=alice)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=alice", map[string][]string{
+			"memberOf":     {"cn=dev,ou=groups", "cn=ops,ou=groups"},
+			"department":   {"R&D"},
+			"employeeType": {"contractor", "remote"},
+		})}}, nil
+	case "(member=uid=alice)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{
+			ldap.NewEntry("cn=dev,ou=groups", map[string][]string{"cn": {"dev"}}),
+			ldap.NewEntry("cn=qa,ou=groups", map[string][]string{"cn": {"qa"}}),
+		}}, nil
+	case "(member:" + ldapMatchingRuleInChain + ":=uid=alice)":
+		// All the groups alice is a member of, directly or not.
+		dns := []string{"cn=dev,ou=groups", "cn=ops,ou=groups", "cn=qa,ou=groups"}
+		seen := map[string]bool{}
+		var entries []*ldap.Entry
+		for len(dns) > 0 {
+			dn := dns[0]
+			dns = dns[1:]
+			if !seen[dn] {
+				seen[dn] = true
+				entries = append(entries, fakeGroupEntry(dn))
+				dns = append(dns, c.server.groupParents[dn]...)
+			}
+		}
+		return &ldap.SearchResult{Entries: entries}, nil
+	}
+	// Parent groups of the listed ones, (member=dn) or (|(member=dn1)(member=dn2)...).
+	var entries []*ldap.Entry
+	for _, m := range regexp.MustCompile(`\(member=([^()]+)\)`).FindAllStringSubmatch(sr.Filter, -1) {
+		for _, dn := range c.server.groupParents[m[1]] {
+			entries = append(entries, fakeGroupEntry(dn))
+		}
+	}
+	return &ldap.SearchResult{Entries: entries}, nil
+}
+
+// fakeGroupEntry returns the entry of the group with the DN cn=<name>,ou=groups.
+func fakeGroupEntry(dn string) *ldap.Entry {
+	name := strings.TrimPrefix(strings.Split(dn, ",")[0], "cn=")
+	return ldap.NewEntry(dn, map[string][]string{"cn": {name}})
+}
+
+func (c *fakeLDAPConn) Close() {
+	c.closed = true
+}
+
+type fakeLDAPServer struct {
+	conns []*fakeLDAPConn
+	down  bool
+	// Number of dials to fail before coming up.
+	failDials int
+	// Response to binds with the password policy control.
+	bindControls []ldap.Control
+	bindErr      error
+	// Groups that groups are members of, by DN.
+	groupParents map[string][]string
+}
+
+func (s *fakeLDAPServer) connect(addr string) (ldap.Client, error) {
+	return s.dial()
+}
+
+func (s *fakeLDAPServer) dial() (ldap.Client, error) {
+	if s.failDials > 0 {
+		s.failDials--
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+	}
+	if s.down {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+	}
+	c := &fakeLDAPConn{server: s}
+	s.conns = append(s.conns, c)
+	return c, nil
+}
+
+func newFakeLDAPAuth(t *testing.T, s *fakeLDAPServer, gs *LDAPGroupSearchConfig) *LDAPAuth {
+	c := &LDAPAuthConfig{
+		Addr:             "ldap.example.com:389",
+		Filter:           "(uid=${account})",
+		BindDN:           "cn=reader",
+		BindPasswordFile: "/dev/null",
+		GroupSearch:      gs,
+	}
+	if err := c.Validate("ldap_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	la, err := NewLDAPAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create LDAPAuth: %s", err)
+	}
+	la.connect = s.connect
+	return la
+}
+
+func TestLDAPPoolReusesConnections(t *testing.T) {
+	s := &fakeLDAPServer{}
+	la := newFakeLDAPAuth(t, s, nil)
+	defer la.Stop()
+	for i := 0; i < 3; i++ {
+		if ok, _, err := la.Authenticate("alice", "secret"); !ok || err != nil {
+			t.Fatalf("%d: expected success, got %t %v", i, ok, err)
+		}
+	}
+	if ok, _, err := la.Authenticate("alice", "wrong"); ok || err != nil {
+		t.Fatalf("expected wrong password, got %t %v", ok, err)
+	}
+	if _, _, err := la.Authenticate("bob", "secret"); err != api.NoMatch {
+		t.Fatalf("expected NoMatch, got %v", err)
+	}
+	if len(s.conns) != 1 {
+		t.Errorf("expected 1 connection, got %d", len(s.conns))
+	}
+}
+
+func TestLDAPPoolRecoversFromFailures(t *testing.T) {
+	s := &fakeLDAPServer{}
+	la := newFakeLDAPAuth(t, s, nil)
+	defer la.Stop()
+	if ok, _, err := la.Authenticate("alice", "secret"); !ok || err != nil {
+		t.Fatalf("expected success, got %t %v", ok, err)
+	}
+
+	// Pooled connection is dropped, it should be replaced transparently.
+	s.conns[0].broken = true
+	if ok, _, err := la.Authenticate("alice", "secret"); !ok || err != nil {
+		t.Fatalf("expected success after connection failure, got %t %v", ok, err)
+	}
+	if len(s.conns) != 2 || !s.conns[0].closed {
+		t.Fatalf("expected broken connection to be closed and replaced, got %d connections", len(s.conns))
+	}
+
+	// Server goes down, errors are reported until it comes back.
+	s.conns[1].broken = true
+	s.down = true
+	if _, _, err := la.Authenticate("alice", "secret"); err == nil {
+		t.Fatalf("expected an error while the server is down")
+	}
+	if !s.conns[1].closed {
+		t.Errorf("expected broken connection to be closed")
+	}
+	s.down = false
+	if ok, _, err := la.Authenticate("alice", "secret"); !ok || err != nil {
+		t.Fatalf("expected success after server recovery, got %t %v", ok, err)
+	}
+	if len(s.conns) != 3 || s.conns[2].closed {
+		t.Errorf("expected a new connection to be kept in the pool, got %d connections", len(s.conns))
+	}
+}
+
+func TestLDAPPoolSize(t *testing.T) {
+	s := &fakeLDAPServer{}
+	p := newLDAPPool(s.dial, 2, 0)
+	// Connections in use are not limited, only idle ones.
+	var conns []ldap.Client
+	for i := 0; i < 3; i++ {
+		c, reused, err := p.get()
+		if err != nil || reused {
+			t.Fatalf("%d: expected a new connection, got %t %v", i, reused, err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		p.put(c)
+	}
+	if !s.conns[2].closed || s.conns[0].closed || s.conns[1].closed {
+		t.Errorf("expected only the connection over the pool size to be closed")
+	}
+	p.close()
+	if !s.conns[0].closed || !s.conns[1].closed {
+		t.Errorf("expected idle connections to be closed")
+	}
+	// One idle connection is kept by default.
+	la := newFakeLDAPAuth(t, s, nil)
+	defer la.Stop()
+	if la.config.PoolSize != 1 {
+		t.Errorf("expected pool_size to default to 1, got %d", la.config.PoolSize)
+	}
+}
+
+func TestLDAPRetry(t *testing.T) {
+	s := &fakeLDAPServer{failDials: 1}
+	la := newFakeLDAPAuth(t, s, nil)
+	defer la.Stop()
+	// Default is a single attempt.
+	if _, _, err := la.Authenticate("alice", "secret"); err == nil {
+		t.Fatalf("expected an error without retries")
+	}
+
+	la.config.RetryAttempts = 3
+	la.config.RetryBackoff = time.Millisecond
+	s.failDials = 2
+	retries := LDAPRetries()
+	if ok, _, err := la.Authenticate("alice", "secret"); !ok || err != nil {
+		t.Fatalf("expected success after retries, got %t %v", ok, err)
+	}
+	if n := LDAPRetries() - retries; n != 2 {
+		t.Errorf("expected 2 retries, got %d", n)
+	}
+
+	// Invalid credentials are not retried.
+	retries = LDAPRetries()
+	if ok, _, err := la.Authenticate("alice", "wrong"); ok || err != nil {
+		t.Fatalf("expected wrong password, got %t %v", ok, err)
+	}
+	if n := LDAPRetries() - retries; n != 0 {
+		t.Errorf("expected no retries for invalid credentials, got %d", n)
+	}
+
+	// Attempts are limited by both their number and elapsed time.
+	for _, c := range s.conns {
+		c.broken = true
+	}
+	s.down = true
+	retries = LDAPRetries()
+	if _, _, err := la.Authenticate("alice", "secret"); err == nil {
+		t.Fatalf("expected an error while the server is down")
+	}
+	if n := LDAPRetries() - retries; n != 2 {
+		t.Errorf("expected 2 retries, got %d", n)
+	}
+	la.config.RetryAttempts = 100
+	la.config.RetryBackoff = 10 * time.Millisecond
+	la.config.RetryMaxElapsed = 25 * time.Millisecond
+	retries = LDAPRetries()
+	if _, _, err := la.Authenticate("alice", "secret"); err == nil {
+		t.Fatalf("expected an error while the server is down")
+	}
+	if n := LDAPRetries() - retries; n != 1 {
+		t.Errorf("expected 1 retry within retry_max_elapsed, got %d", n)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/go-ldap/ldap"
+)
+
+// ldapServers keeps track of LDAP servers that failed recently.
+type ldapServers struct {
+	lock     sync.Mutex
+	failedAt map[string]time.Time
+}
+
+func (s *ldapServers) setFailed(addr string, failed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !failed {
+		delete(s.failedAt, addr)
+		return
+	}
+	if s.failedAt == nil {
+		s.failedAt = make(map[string]time.Time)
+	}
+	s.failedAt[addr] = time.Now()
+}
+
+// order returns servers that are believed to be up, in the order they are configured,
+// followed by the ones that failed less than retryInterval ago.
+func (s *ldapServers) order(addrs []string, retryInterval time.Duration) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var up, down []string
+	for _, addr := range addrs {
+		if t, ok := s.failedAt[addr]; ok && time.Since(t) < retryInterval {
+			down = append(down, addr)
+		} else {
+			up = append(up, addr)
+		}
+	}
+	return append(up, down...)
+}
+
+// ldapServerConn is a connection to a particular server.
+type ldapServerConn struct {
+	ldap.Client
+	addr string
+}
+
+func ldapServerAddr(l ldap.Client) string {
+	if sc, ok := l.(*ldapServerConn); ok {
+		return sc.addr
+	}
+	return ""
+}
+
+// dial connects to the first server that is believed to be up.
+// Failed servers are tried again after server_retry_interval, or when none of the others can be reached.
+func (la *LDAPAuth) dial() (ldap.Client, error) {
+	var err error
+	for _, addr := range la.servers.order(la.config.serverAddrs(), la.config.ServerRetryInterval) {
+		var l ldap.Client
+		l, err = la.connect(addr)
+		if err == nil {
+			la.servers.setFailed(addr, false)
+			glog.V(2).Infof("Connected to LDAP server %s", addr)
+			return &ldapServerConn{Client: l, addr: addr}, nil
+		}
+		glog.Warningf("Failed to connect to LDAP server %s: %s", addr, err)
+		la.servers.setFailed(addr, true)
+	}
+	return nil, err
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cesanta/glog"
+)
+
+// MembershipCacheConfig enables caching of organization and team membership lookups, by user.
+// Membership changes, including removal from the organization, take effect up to TTL later,
+// or TTL plus StaleGrace if the upstream API is failing.
+type MembershipCacheConfig struct {
+	// How long lookup results are reused.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// If a lookup fails, e.g. due to rate limiting, an expired entry is used for up to this long
+	// after its expiration. Default is 0, i.e. lookup errors fail authentication.
+	StaleGrace time.Duration `yaml:"stale_grace,omitempty"`
+}
+
+func (c *MembershipCacheConfig) Validate(configKey string) error {
+	if c.TTL <= 0 {
+		return fmt.Errorf("%s.ttl must be positive", configKey)
+	}
+	if c.StaleGrace < 0 {
+		return fmt.Errorf("%s.stale_grace must not be negative", configKey)
+	}
+	return nil
+}
+
+// Number of membership cache lookups, by backend and result, exported as a metric by the server.
+var membershipCacheStats = map[string]map[string]*uint64{
+	"github": {"hit": new(uint64), "miss": new(uint64), "stale": new(uint64)},
+	"google": {"hit": new(uint64), "miss": new(uint64), "stale": new(uint64)},
+	"okta":   {"hit": new(uint64), "miss": new(uint64), "stale": new(uint64)},
+}
+
+// MembershipCacheLookups returns the number of membership cache lookups of the backend (github, google, okta)
+// with the result: hit, miss (including expired entries) or stale (expired entry used after a failed lookup).
+func MembershipCacheLookups(backend, result string) uint64 {
+	return atomic.LoadUint64(membershipCacheStats[backend][result])
+}
+
+// membershipDeniedError is returned by lookups if the user is not a member, as opposed to
+// the lookup failing. Stale entries are never used in this case.
+type membershipDeniedError struct {
+	error
+}
+
+type cachedMembership struct {
+	teams   []string
+	fetched time.Time
+}
+
+type membershipCache struct {
+	config  *MembershipCacheConfig
+	backend string
+
+	lock    sync.Mutex
+	entries map[string]cachedMembership
+}
+
+// newMembershipCache returns nil if c is nil, in which case lookups are not cached.
+func newMembershipCache(c *MembershipCacheConfig, backend string) *membershipCache {
+	if c == nil {
+		return nil
+	}
+	return &membershipCache{config: c, backend: backend, entries: make(map[string]cachedMembership)}
+}
+
+func (mc *membershipCache) count(result string) {
+	atomic.AddUint64(membershipCacheStats[mc.backend][result], 1)
+}
+
+// get returns the cached teams of the user or, if there is no fresh entry, calls lookup and caches its result.
+func (mc *membershipCache) get(user string, lookup func() ([]string, error)) ([]string, error) {
+	if mc == nil {
+		return lookup()
+	}
+	now := time.Now()
+	mc.lock.Lock()
+	e, ok := mc.entries[user]
+	mc.lock.Unlock()
+	if ok && now.Sub(e.fetched) < mc.config.TTL {
+		mc.count("hit")
+		glog.V(2).Infof("Membership of %s (cached): %s", user, e.teams)
+		return e.teams, nil
+	}
+	mc.count("miss")
+	teams, err := lookup()
+	if err == nil {
+		mc.put(user, teams)
+		return teams, nil
+	}
+	if _, denied := err.(membershipDeniedError); denied {
+		mc.forget(user)
+		return nil, err
+	}
+	if ok && now.Sub(e.fetched) < mc.config.TTL+mc.config.StaleGrace {
+		mc.count("stale")
+		glog.Warningf("Membership lookup for %s failed, using cached result from %s: %s", user, e.fetched.Format(time.RFC3339), err)
+		return e.teams, nil
+	}
+	return nil, err
+}
+
+func (mc *membershipCache) put(user string, teams []string) {
+	if mc == nil {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	now := time.Now()
+	for u, e := range mc.entries {
+		if now.Sub(e.fetched) >= mc.config.TTL+mc.config.StaleGrace {
+			delete(mc.entries, u)
+		}
+	}
+	mc.entries[user] = cachedMembership{teams: teams, fetched: now}
+}
+
+func (mc *membershipCache) forget(user string) {
+	if mc == nil {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	delete(mc.entries, user)
+}
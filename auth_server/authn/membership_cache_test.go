@@ -0,0 +1,77 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMembershipCache(t *testing.T) {
+	mc := newMembershipCache(&MembershipCacheConfig{TTL: time.Minute, StaleGrace: time.Hour}, "github")
+	lookups := 0
+	var lookupErr error
+	lookup := func() ([]string, error) {
+		lookups++
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return []string{"devs"}, nil
+	}
+	age := func(user string, d time.Duration) {
+		e := mc.entries[user]
+		e.fetched = e.fetched.Add(-d)
+		mc.entries[user] = e
+	}
+	hits := MembershipCacheLookups("github", "hit")
+	stale := MembershipCacheLookups("github", "stale")
+
+	for i := 0; i < 2; i++ {
+		if teams, err := mc.get("alice", lookup); err != nil || !reflect.DeepEqual(teams, []string{"devs"}) {
+			t.Fatalf("%d: unexpected result %v %v", i, teams, err)
+		}
+	}
+	if lookups != 1 || MembershipCacheLookups("github", "hit") != hits+1 {
+		t.Errorf("expected 1 lookup and 1 hit, got %d lookups", lookups)
+	}
+
+	// Expired entry is refreshed.
+	age("alice", 2*time.Minute)
+	mc.get("alice", lookup)
+	if lookups != 2 {
+		t.Errorf("expected expired entry to be refreshed, got %d lookups", lookups)
+	}
+
+	// Lookup errors are served from stale entries within the grace period, but not after it.
+	lookupErr = errors.New("rate limited")
+	age("alice", 30*time.Minute)
+	if teams, err := mc.get("alice", lookup); err != nil || len(teams) != 1 || MembershipCacheLookups("github", "stale") != stale+1 {
+		t.Errorf("expected stale entry to be used, got %v %v", teams, err)
+	}
+	age("alice", 2*time.Hour)
+	if _, err := mc.get("alice", lookup); err != lookupErr {
+		t.Errorf("expected lookup error after the grace period, got %v", err)
+	}
+
+	// Denials are never served from the cache.
+	lookupErr = nil
+	mc.get("bob", lookup)
+	age("bob", 2*time.Minute)
+	lookupErr = membershipDeniedError{fmt.Errorf("not a member")}
+	if _, err := mc.get("bob", lookup); err != lookupErr {
+		t.Errorf("expected denial, got %v", err)
+	}
+	if _, found := mc.entries["bob"]; found {
+		t.Errorf("expected entry of denied user to be removed")
+	}
+
+	// Without a config, every call is a lookup.
+	var nc *membershipCache
+	lookupErr, lookups = nil, 0
+	nc.get("alice", lookup)
+	nc.get("alice", lookup)
+	if lookups != 2 {
+		t.Errorf("expected no caching, got %d lookups", lookups)
+	}
+}
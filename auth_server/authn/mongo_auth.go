@@ -17,13 +17,9 @@
 package authn
 
 import (
-	"errors"
 	"fmt"
-	"io"
-	"time"
 
 	"github.com/cesanta/glog"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
@@ -34,18 +30,26 @@ import (
 type MongoAuthConfig struct {
 	MongoConfig *mgo_session.Config `yaml:"dial_info,omitempty"`
 	Collection  string              `yaml:"collection,omitempty"`
+	// Algorithm of password hashes that cannot be identified by their prefix, bcrypt by default.
+	PasswordHash string `yaml:"password_hash,omitempty"`
+	// Limits the number of queries in progress at the same time.
+	ConcurrencyLimit `yaml:",inline"`
+	// If set, the ID (_id) of the user's document is added as a label with this key.
+	IDLabel string `yaml:"id_label,omitempty"`
 }
 
 type MongoAuth struct {
 	config     *MongoAuthConfig
 	session    *mgo.Session
+	limiter    *concurrencyLimiter
 	Collection string `yaml:"collection,omitempty"`
 }
 
 type authUserEntry struct {
-	Username *string    `yaml:"username,omitempty" json:"username,omitempty"`
-	Password *string    `yaml:"password,omitempty" json:"password,omitempty"`
-	Labels   api.Labels `yaml:"labels,omitempty" json:"labels,omitempty"`
+	ID       interface{} `bson:"_id,omitempty" yaml:"-" json:"-"`
+	Username *string     `yaml:"username,omitempty" json:"username,omitempty"`
+	Password *string     `yaml:"password,omitempty" json:"password,omitempty"`
+	Labels   api.Labels  `yaml:"labels,omitempty" json:"labels,omitempty"`
 }
 
 func NewMongoAuth(c *MongoAuthConfig) (*MongoAuth, error) {
@@ -82,21 +86,22 @@ func NewMongoAuth(c *MongoAuthConfig) (*MongoAuth, error) {
 	return &MongoAuth{
 		config:  c,
 		session: session,
+		limiter: newConcurrencyLimiter(&c.ConcurrencyLimit, "mongo"),
 	}, nil
 }
 
 func (mauth *MongoAuth) Authenticate(account string, password api.PasswordString) (bool, api.Labels, error) {
-	for true {
-		result, labels, err := mauth.authenticate(account, password)
-		if err == io.EOF {
-			glog.Warningf("EOF error received from Mongo. Retrying connection")
-			time.Sleep(time.Second)
-			continue
-		}
-		return result, labels, err
+	if err := mauth.limiter.acquire(); err != nil {
+		return false, nil, err
 	}
-
-	return false, nil, errors.New("Unable to communicate with Mongo.")
+	defer mauth.limiter.release()
+	var result bool
+	var labels api.Labels
+	err := mauth.config.MongoConfig.Retry(mauth.session, func() (err error) {
+		result, labels, err = mauth.authenticate(account, password)
+		return err
+	})
+	return result, labels, err
 }
 
 func (mauth *MongoAuth) authenticate(account string, password api.PasswordString) (bool, api.Labels, error) {
@@ -110,24 +115,47 @@ func (mauth *MongoAuth) authenticate(account string, password api.PasswordString
 		account, mauth.config.MongoConfig.DialInfo.Database, mauth.config.Collection)
 	var dbUserRecord authUserEntry
 	collection := tmp_session.DB(mauth.config.MongoConfig.DialInfo.Database).C(mauth.config.Collection)
+	start := StartBackendCall()
 	err := collection.Find(bson.M{"username": account}).One(&dbUserRecord)
 
 	// If we connect and get no results we return a NoMatch so auth can fall-through
 	if err == mgo.ErrNotFound {
+		ObserveBackendCall("mongo", "query", start, BackendFailure)
 		return false, nil, api.NoMatch
-	} else if err != nil {
+	}
+	ObserveBackendCall("mongo", "query", start, BackendOutcome(err))
+	if err != nil {
 		return false, nil, err
 	}
 
 	// Validate db password against passed password
 	if dbUserRecord.Password != nil {
-		if bcrypt.CompareHashAndPassword([]byte(*dbUserRecord.Password), []byte(password)) != nil {
+		ok, err := comparePassword(*dbUserRecord.Password, password, mauth.config.PasswordHash)
+		if err != nil {
+			return false, nil, fmt.Errorf("cannot verify password of user %q: %s", account, err)
+		}
+		if !ok {
 			return false, nil, nil
 		}
 	}
 
 	// Auth success
-	return true, dbUserRecord.Labels, nil
+	labels := dbUserRecord.Labels
+	if mauth.config.IDLabel != "" && dbUserRecord.ID != nil {
+		if labels == nil {
+			labels = api.Labels{}
+		}
+		labels[mauth.config.IDLabel] = []string{mongoIDString(dbUserRecord.ID)}
+	}
+	return true, labels, nil
+}
+
+// mongoIDString returns the user's document ID as a string, ObjectIDs in hex.
+func mongoIDString(id interface{}) string {
+	if oid, ok := id.(bson.ObjectId); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
 }
 
 // Validate ensures that any custom config options
@@ -142,8 +170,11 @@ func (c *MongoAuthConfig) Validate(configKey string) error {
 	if c.Collection == "" {
 		return fmt.Errorf("%s.collection is required", configKey)
 	}
+	if err := ValidatePasswordHash(configKey+".password_hash", c.PasswordHash); err != nil {
+		return err
+	}
 
-	return nil
+	return c.ConcurrencyLimit.Validate(configKey)
 }
 
 func (ma *MongoAuth) Stop() {
@@ -153,6 +184,13 @@ func (ma *MongoAuth) Stop() {
 	}
 }
 
+// HealthCheck pings the database.
+func (ma *MongoAuth) HealthCheck() error {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	return tmp_session.Ping()
+}
+
 func (ga *MongoAuth) Name() string {
 	return "MongoDB"
 }
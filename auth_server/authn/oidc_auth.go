@@ -0,0 +1,382 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/coreos/go-oidc"
+	"github.com/dchest/uniuri"
+	"golang.org/x/oauth2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const oidcStateCookie = "docker_auth_oidc_state"
+
+type OIDCAuthConfig struct {
+	// Issuer URL, discovery document is fetched from ${issuer}/.well-known/openid-configuration.
+	Issuer             string        `yaml:"issuer,omitempty"`
+	ClientId           string        `yaml:"client_id,omitempty"`
+	ClientSecret       string        `yaml:"client_secret,omitempty"`
+	ClientSecretFile   string        `yaml:"client_secret_file,omitempty"`
+	ClientSecretSource *SecretSource `yaml:"client_secret_source,omitempty"`
+	RedirectURL        string        `yaml:"redirect_url,omitempty"`
+	Scopes             []string      `yaml:"scopes,omitempty"`
+	// ID token claim to use as account name.
+	UserClaim string `yaml:"user_claim,omitempty"`
+	// If set, values of this ID token claim are put into the "groups" label.
+	GroupsClaim      string        `yaml:"groups_claim,omitempty"`
+	TokenDB          string        `yaml:"token_db,omitempty"`
+	HTTPTimeout      time.Duration `yaml:"http_timeout,omitempty"`
+	DiscoveryRefresh time.Duration `yaml:"discovery_refresh_interval,omitempty"`
+	RegistryUrl      string        `yaml:"registry_url,omitempty"`
+	// Token DB in Redis, instead of token_db.
+	RedisTokenDB *RedisTokenDBConfig `yaml:"redis_token_db,omitempty"`
+}
+
+// Validate checks the config and sets defaults. The client secret must have been resolved.
+func (c *OIDCAuthConfig) Validate(configKey string) error {
+	if c.Issuer == "" || c.ClientId == "" {
+		return fmt.Errorf("%s.{issuer,client_id} are required", configKey)
+	}
+	if c.ClientSecret == "" || c.RedirectURL == "" || (c.TokenDB == "" && c.RedisTokenDB == nil) {
+		return fmt.Errorf("%s.{client_secret,redirect_url,token_db} are required", configKey)
+	}
+	hasOpenID := false
+	for _, s := range c.Scopes {
+		if s == "openid" {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		c.Scopes = append([]string{"openid"}, c.Scopes...)
+	}
+	if c.UserClaim == "" {
+		c.UserClaim = "preferred_username"
+	}
+	if c.HTTPTimeout <= 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	if c.DiscoveryRefresh <= 0 {
+		c.DiscoveryRefresh = 1 * time.Hour
+	}
+	return nil
+}
+
+type OIDCAuth struct {
+	config     *OIDCAuthConfig
+	db         TokenDB
+	client     *http.Client
+	tmplResult *template.Template
+	// Client secret, reloaded when client_secret_file changes.
+	secret *watchedSecret
+
+	lock            sync.RWMutex
+	provider        *oidc.Provider
+	providerFetched time.Time
+}
+
+func NewOIDCAuth(c *OIDCAuthConfig) (*OIDCAuth, error) {
+	db, dbName, err := openTokenDB(c.TokenDB, c.RedisTokenDB, "oidc")
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("OIDC auth token DB at %s", dbName)
+	oa := &OIDCAuth{
+		config:     c,
+		db:         db,
+		client:     &http.Client{Timeout: c.HTTPTimeout},
+		tmplResult: template.Must(template.New("oidc_auth_result").Parse(string(MustAsset("data/oidc_auth_result.tmpl")))),
+	}
+	if _, err := oa.getProvider(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	oa.secret = newWatchedSecret("oidc_auth.client_secret", c.ClientSecret, c.ClientSecretFile, c.ClientSecretSource)
+	return oa, nil
+}
+
+func (oa *OIDCAuth) context() context.Context {
+	return oidc.ClientContext(context.Background(), oa.client)
+}
+
+// getProvider returns the provider, re-fetching the discovery document if it is older
+// than the configured refresh interval. If re-fetching fails, the cached copy is used.
+func (oa *OIDCAuth) getProvider() (*oidc.Provider, error) {
+	oa.lock.RLock()
+	p, fetched := oa.provider, oa.providerFetched
+	oa.lock.RUnlock()
+	if p != nil && time.Since(fetched) < oa.config.DiscoveryRefresh {
+		return p, nil
+	}
+	glog.V(2).Infof("Fetching OIDC discovery document for %s", oa.config.Issuer)
+	np, err := oidc.NewProvider(oa.context(), oa.config.Issuer)
+	if err != nil {
+		if p != nil {
+			glog.Warningf("Failed to refresh OIDC discovery document, using cached copy: %s", err)
+			return p, nil
+		}
+		return nil, fmt.Errorf("OIDC discovery for %s failed: %s", oa.config.Issuer, err)
+	}
+	oa.lock.Lock()
+	oa.provider, oa.providerFetched = np, time.Now()
+	oa.lock.Unlock()
+	return np, nil
+}
+
+func (oa *OIDCAuth) oauth2Config(p *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oa.config.ClientId,
+		ClientSecret: oa.secret.get(),
+		RedirectURL:  oa.config.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       oa.config.Scopes,
+	}
+}
+
+func (oa *OIDCAuth) DoOIDCAuth(rw http.ResponseWriter, req *http.Request) {
+	code := req.URL.Query().Get("code")
+
+	if code != "" {
+		oa.doOIDCAuthCreateToken(rw, req, code)
+	} else if errStr := req.URL.Query().Get("error"); errStr != "" {
+		http.Error(rw, fmt.Sprintf("Authentication failed: %s %s", errStr, req.URL.Query().Get("error_description")), http.StatusUnauthorized)
+	} else if req.Method == "GET" {
+		oa.doOIDCAuthRedirect(rw, req)
+	}
+}
+
+// doOIDCAuthRedirect sends the user to the provider's authorization endpoint.
+// A random state is stored in a cookie to protect the callback against CSRF.
+func (oa *OIDCAuth) doOIDCAuthRedirect(rw http.ResponseWriter, req *http.Request) {
+	p, err := oa.getProvider()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Error talking to OIDC auth backend: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	state := uniuri.New()
+	http.SetCookie(rw, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+	})
+	http.Redirect(rw, req, oa.oauth2Config(p).AuthCodeURL(state), http.StatusFound)
+}
+
+func (oa *OIDCAuth) doOIDCAuthCreateToken(rw http.ResponseWriter, req *http.Request, code string) {
+	stateCookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || stateCookie.Value == "" || stateCookie.Value != req.URL.Query().Get("state") {
+		http.Error(rw, "Invalid state, please try signing in again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{Name: oidcStateCookie, MaxAge: -1})
+
+	p, err := oa.getProvider()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Error talking to OIDC auth backend: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	tok, err := oa.oauth2Config(p).Exchange(oa.context(), code)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get token: %s", err), http.StatusBadRequest)
+		return
+	}
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok {
+		http.Error(rw, "No ID token in the token response", http.StatusInternalServerError)
+		return
+	}
+	user, labels, expiry, err := oa.verifyIDToken(p, rawIDToken)
+	if err != nil {
+		glog.Errorf("Newly-acquired ID token is invalid: %s", err)
+		http.Error(rw, "Newly-acquired ID token is invalid", http.StatusInternalServerError)
+		return
+	}
+
+	glog.Infof("New OIDC auth token for %s (exp %s)", user, tok.Expiry)
+
+	v := &TokenDBValue{
+		TokenType:    tok.TokenType,
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		ValidUntil:   tok.Expiry,
+		Labels:       labels,
+	}
+	if v.ValidUntil.IsZero() {
+		v.ValidUntil = expiry
+	}
+	dp, err := oa.db.StoreToken(user, v, true)
+	if err != nil {
+		glog.Errorf("Failed to record server token: %s", err)
+		http.Error(rw, "Failed to record server token", http.StatusInternalServerError)
+		return
+	}
+
+	if err := oa.tmplResult.Execute(rw, struct {
+		Issuer, Username, Password, RegistryUrl string
+	}{Issuer: oa.config.Issuer,
+		Username:    user,
+		Password:    dp,
+		RegistryUrl: oa.config.RegistryUrl}); err != nil {
+		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// verifyIDToken checks signature (against provider's JWKS), issuer, audience and expiration
+// of the ID token and returns the account name, labels and expiration time taken from it.
+func (oa *OIDCAuth) verifyIDToken(p *oidc.Provider, rawIDToken string) (string, api.Labels, time.Time, error) {
+	idToken, err := p.Verifier(&oidc.Config{ClientID: oa.config.ClientId}).Verify(oa.context(), rawIDToken)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("could not parse claims: %s", err)
+	}
+	glog.V(2).Infof("ID token claims: %+v", claims)
+	user, _ := claims[oa.config.UserClaim].(string)
+	if user == "" {
+		return "", nil, time.Time{}, fmt.Errorf("no %q claim in ID token", oa.config.UserClaim)
+	}
+	labels := api.Labels{}
+	if oa.config.GroupsClaim != "" {
+		switch groups := claims[oa.config.GroupsClaim].(type) {
+		case string:
+			labels["groups"] = []string{groups}
+		case []interface{}:
+			for _, g := range groups {
+				if gs, ok := g.(string); ok {
+					labels["groups"] = append(labels["groups"], gs)
+				}
+			}
+		}
+	}
+	return user, labels, idToken.Expiry, nil
+}
+
+// refreshServerToken obtains a new access token using the stored refresh token.
+// If the provider returns a new ID token, labels are updated from it.
+func (oa *OIDCAuth) refreshServerToken(user string) (*TokenDBValue, error) {
+	v, err := oa.db.GetValue(user)
+	if err != nil || v == nil {
+		if err == nil {
+			err = errors.New("no db value, please sign out and sign in again")
+		}
+		return nil, err
+	}
+	if v.RefreshToken == "" {
+		return nil, errors.New("token expired and cannot be refreshed, please sign in again")
+	}
+	p, err := oa.getProvider()
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Refreshing token for %s", user)
+	ts := oa.oauth2Config(p).TokenSource(oa.context(), &oauth2.Token{RefreshToken: v.RefreshToken})
+	tok, err := ts.Token()
+	if err != nil {
+		glog.Warningf("Failed to refresh token for %q: %s", user, err)
+		return nil, fmt.Errorf("failed to refresh token: %s", err)
+	}
+	v.TokenType, v.AccessToken, v.ValidUntil = tok.TokenType, tok.AccessToken, tok.Expiry
+	if tok.RefreshToken != "" {
+		v.RefreshToken = tok.RefreshToken
+	}
+	if rawIDToken, ok := tok.Extra("id_token").(string); ok {
+		tokenUser, labels, expiry, err := oa.verifyIDToken(p, rawIDToken)
+		if err != nil {
+			return nil, fmt.Errorf("refreshed ID token is invalid: %s", err)
+		}
+		if tokenUser != user {
+			glog.Errorf("token for wrong user: expected %s, found %s", user, tokenUser)
+			return nil, fmt.Errorf("found token for wrong user")
+		}
+		v.Labels = labels
+		if v.ValidUntil.IsZero() {
+			v.ValidUntil = expiry
+		}
+	}
+	if v.ValidUntil.IsZero() {
+		return nil, errors.New("refreshed token has no expiration time")
+	}
+	if _, err = oa.db.StoreToken(user, v, false); err != nil {
+		glog.Errorf("Failed to record refreshed token: %s", err)
+		return nil, fmt.Errorf("failed to record refreshed token: %s", err)
+	}
+	glog.Infof("Refreshed OIDC auth token for %s (exp %s)", user, v.ValidUntil)
+	return v, nil
+}
+
+func (oa *OIDCAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	err := oa.db.ValidateToken(user, password)
+	if err == ExpiredToken {
+		v, err := oa.refreshServerToken(user)
+		if err != nil {
+			return false, nil, err
+		}
+		return true, v.Labels, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	v, err := oa.db.GetValue(user)
+	if err != nil || v == nil {
+		if err == nil {
+			err = errors.New("no db value, please sign out and sign in again")
+		}
+		return false, nil, err
+	}
+	return true, v.Labels, nil
+}
+
+// AuthenticateAccessToken accepts ID tokens of the issuer for the client, e.g. obtained by a credential helper.
+func (oa *OIDCAuth) AuthenticateAccessToken(token string) (string, bool, api.Labels, error) {
+	if !looksLikeJWT(token) || strings.TrimSuffix(unverifiedIssuer(token), "/") != strings.TrimSuffix(oa.config.Issuer, "/") {
+		return "", false, nil, api.NoMatch
+	}
+	p, err := oa.getProvider()
+	if err != nil {
+		return "", false, nil, err
+	}
+	user, labels, _, err := oa.verifyIDToken(p, token)
+	if err != nil {
+		glog.Warningf("OIDC ID token rejected: %s", err)
+		return "", false, nil, nil
+	}
+	return user, true, labels, nil
+}
+
+func (oa *OIDCAuth) Stop() {
+	oa.secret.Stop()
+	oa.db.Close()
+	glog.Info("Token DB closed")
+}
+
+func (oa *OIDCAuth) Name() string {
+	return "OIDC"
+}
@@ -0,0 +1,249 @@
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// fakeOIDCProvider serves discovery, JWKS and token endpoints. Code "code1" is exchanged for idToken.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	lock        sync.Mutex
+	discoveries int
+	down        bool
+	idToken     string
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeOIDCProvider{key: key}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			f.discoveries++
+			if f.down {
+				http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"issuer":                 f.URL,
+				"authorization_endpoint": f.URL + "/authorize",
+				"token_endpoint":         f.URL + "/token",
+				"jwks_uri":               f.URL + "/keys",
+			})
+		case "/keys":
+			json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "k1", Algorithm: "RS256", Use: "sig"},
+			}})
+		case "/token":
+			if req.FormValue("code") != "code1" {
+				http.Error(rw, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"access_token": "access1", "token_type": "Bearer", "refresh_token": "refresh1",
+				"expires_in": 3600, "id_token": f.idToken,
+			})
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	return f
+}
+
+type oidcTestClaims struct {
+	jwt.Claims
+	PreferredUsername string      `json:"preferred_username,omitempty"`
+	Email             string      `json:"email,omitempty"`
+	Groups            interface{} `json:"groups,omitempty"`
+}
+
+func (f *fakeOIDCProvider) sign(t *testing.T, key *rsa.PrivateKey, c oidcTestClaims) string {
+	s, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.Signed(s).Claims(c).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func newTestOIDCAuth(t *testing.T, f *fakeOIDCProvider, dir string, c *OIDCAuthConfig) *OIDCAuth {
+	c.Issuer, c.ClientId, c.ClientSecret = f.URL, "registry", "secret"
+	c.RedirectURL, c.TokenDB = "https://auth.example.com/oidc_auth", filepath.Join(dir, "tokens.ldb")
+	if err := c.Validate("oidc_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	oa, err := NewOIDCAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create OIDCAuth: %s", err)
+	}
+	return oa
+}
+
+func TestOIDCAuth(t *testing.T) {
+	f := newFakeOIDCProvider(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "oidc_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &OIDCAuthConfig{GroupsClaim: "groups"}
+	oa := newTestOIDCAuth(t, f, dir, c)
+	defer oa.Stop()
+	if c.UserClaim != "preferred_username" || !reflect.DeepEqual(c.Scopes, []string{"openid"}) {
+		t.Errorf("expected default user claim and scopes, got %q %q", c.UserClaim, c.Scopes)
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	valid := oidcTestClaims{
+		Claims: jwt.Claims{
+			Issuer:   f.URL,
+			Audience: jwt.Audience{"registry"},
+			Subject:  "1234",
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		PreferredUsername: "alice",
+		Email:             "alice@example.com",
+		Groups:            []string{"dev", "ops"},
+	}
+	user, ok, labels, err := oa.AuthenticateAccessToken(f.sign(t, f.key, valid))
+	if err != nil || !ok || user != "alice" || !reflect.DeepEqual(labels["groups"], []string{"dev", "ops"}) {
+		t.Errorf("expected alice in dev and ops, got %q %t %v %v", user, ok, labels, err)
+	}
+	// A single group can be a string.
+	single := valid
+	single.Groups = "dev"
+	if _, ok, labels, err := oa.AuthenticateAccessToken(f.sign(t, f.key, single)); !ok || err != nil || !reflect.DeepEqual(labels["groups"], []string{"dev"}) {
+		t.Errorf("expected a single group, got %t %v %v", ok, labels, err)
+	}
+	expired, wrongAud, noUser := valid, valid, valid
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	wrongAud.Audience = jwt.Audience{"other"}
+	noUser.PreferredUsername = ""
+	for name, tok := range map[string]string{
+		"expired":        f.sign(t, f.key, expired),
+		"wrong audience": f.sign(t, f.key, wrongAud),
+		"no user claim":  f.sign(t, f.key, noUser),
+		"wrong key":      f.sign(t, otherKey, valid),
+	} {
+		if _, ok, _, err := oa.AuthenticateAccessToken(tok); ok || err != nil {
+			t.Errorf("%s: expected token to be rejected, got %t %v", name, ok, err)
+		}
+	}
+
+	// Another claim can be used as account name.
+	oa.config.UserClaim = "email"
+	if user, ok, _, _ := oa.AuthenticateAccessToken(f.sign(t, f.key, valid)); !ok || user != "alice@example.com" {
+		t.Errorf("expected email as account name, got %q %t", user, ok)
+	}
+	oa.config.UserClaim = "preferred_username"
+
+	// Sign in: redirect to the provider, then the callback with the code.
+	rw := httptest.NewRecorder()
+	oa.DoOIDCAuth(rw, httptest.NewRequest("GET", "/oidc_auth", nil))
+	loc, _ := url.Parse(rw.Header().Get("Location"))
+	cookies := rw.Result().Cookies()
+	if rw.Code != http.StatusFound || !strings.HasPrefix(loc.String(), f.URL+"/authorize") || len(cookies) != 1 {
+		t.Fatalf("expected redirect to the provider with a state cookie, got %d %s %v", rw.Code, loc, cookies)
+	}
+	state := loc.Query().Get("state")
+	if state == "" || cookies[0].Value != state {
+		t.Fatalf("expected state %q in the cookie, got %v", state, cookies[0])
+	}
+	callback := func(state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oidc_auth?code=code1&state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		oa.DoOIDCAuth(rw, req)
+		return rw
+	}
+	f.idToken = f.sign(t, f.key, valid)
+	for name, rw := range map[string]*httptest.ResponseRecorder{
+		"wrong state": callback("forged", cookies[0]),
+		"no cookie":   callback(state, nil),
+	} {
+		if rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "Invalid state") {
+			t.Errorf("%s: expected callback to be rejected, got %d %s", name, rw.Code, rw.Body.String())
+		}
+	}
+	if v, _ := oa.db.GetValue("alice"); v != nil {
+		t.Fatalf("expected no token to be stored for rejected callbacks")
+	}
+	if rw := callback(state, cookies[0]); rw.Code != http.StatusOK {
+		t.Fatalf("expected callback to succeed, got %d %s", rw.Code, rw.Body.String())
+	}
+	v, err := oa.db.GetValue("alice")
+	if err != nil || v == nil || v.AccessToken != "access1" || v.RefreshToken != "refresh1" || !reflect.DeepEqual(v.Labels["groups"], []string{"dev", "ops"}) {
+		t.Errorf("expected token of alice with groups to be stored, got %+v %v", v, err)
+	}
+}
+
+func TestOIDCDiscoveryRefresh(t *testing.T) {
+	f := newFakeOIDCProvider(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "oidc_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oa := newTestOIDCAuth(t, f, dir, &OIDCAuthConfig{DiscoveryRefresh: 100 * time.Millisecond})
+	defer oa.Stop()
+	discoveries := func() int {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.discoveries
+	}
+	if n := discoveries(); n != 1 {
+		t.Fatalf("expected discovery when created, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := oa.getProvider(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := discoveries(); n != 1 {
+		t.Errorf("expected the cached discovery document to be used, got %d fetches", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err := oa.getProvider(); err != nil || discoveries() != 2 {
+		t.Errorf("expected discovery document to be refreshed, got %d fetches, %v", discoveries(), err)
+	}
+
+	// If refreshing fails, the cached copy is used.
+	f.lock.Lock()
+	f.down = true
+	f.lock.Unlock()
+	time.Sleep(150 * time.Millisecond)
+	if p, err := oa.getProvider(); err != nil || p == nil || discoveries() != 3 {
+		t.Errorf("expected the cached copy to be used, got %v, %d fetches", err, discoveries())
+	}
+}
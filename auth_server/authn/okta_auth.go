@@ -0,0 +1,318 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// Used if rate limit headers of a 429 response are missing or can't be parsed.
+const oktaDefaultBackoff = 30 * time.Second
+
+var oktaLinkNextRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+type OktaAuthConfig struct {
+	// URL of the Okta organization, e.g. https://example.okta.com.
+	OrgURL string `yaml:"org_url,omitempty"`
+	// API token used to look up groups of users. It needs read access to users and groups.
+	APIToken     string `yaml:"api_token,omitempty"`
+	APITokenFile string `yaml:"api_token_file,omitempty"`
+	// Caching of group membership, by user. Default TTL is 5 minutes.
+	GroupCache  *MembershipCacheConfig `yaml:"group_cache,omitempty"`
+	HTTPTimeout time.Duration          `yaml:"http_timeout,omitempty"`
+}
+
+func (c *OktaAuthConfig) Validate(configKey string) error {
+	u, err := url.Parse(c.OrgURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%s.org_url must be an https URL, got %q", configKey, c.OrgURL)
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		// A common mistake is to use the URL of an authorization server, e.g. .../oauth2/default.
+		return fmt.Errorf("%s.org_url must be the URL of the organization, without a path, got %q", configKey, c.OrgURL)
+	}
+	c.OrgURL = strings.TrimSuffix(c.OrgURL, "/")
+	if c.APIToken != "" && c.APITokenFile != "" {
+		return fmt.Errorf("%s.api_token and api_token_file are mutually exclusive", configKey)
+	}
+	if c.APITokenFile != "" {
+		token, err := (&SecretSource{Type: "file", Path: c.APITokenFile}).Resolve()
+		if err != nil {
+			return fmt.Errorf("%s.api_token_file: %s", configKey, err)
+		}
+		c.APIToken = token
+	}
+	if c.APIToken == "" {
+		return fmt.Errorf("%s.api_token or api_token_file is required", configKey)
+	}
+	if c.GroupCache == nil {
+		c.GroupCache = &MembershipCacheConfig{TTL: 5 * time.Minute}
+	}
+	if err := c.GroupCache.Validate(configKey + ".group_cache"); err != nil {
+		return err
+	}
+	if c.HTTPTimeout < 0 {
+		return fmt.Errorf("%s.http_timeout must not be negative", configKey)
+	}
+	if c.HTTPTimeout == 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	return nil
+}
+
+// OktaAuth checks user names and passwords with the Okta authentication API and returns
+// the names of groups of the user in the "groups" label.
+type OktaAuth struct {
+	config *OktaAuthConfig
+	client *http.Client
+	groups *membershipCache
+
+	// Requests to an API are not made until this time after Okta said its rate limit
+	// was exhausted, by API (authn, users).
+	lock         sync.Mutex
+	blockedUntil map[string]time.Time
+}
+
+// oktaAuthnResponse is the response of the primary authentication API.
+type oktaAuthnResponse struct {
+	Status   string `json:"status"`
+	Embedded struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"_embedded"`
+}
+
+type oktaGroup struct {
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
+}
+
+type oktaError struct {
+	ErrorCode    string `json:"errorCode"`
+	ErrorSummary string `json:"errorSummary"`
+}
+
+// NewOktaAuth checks the API token, unless Okta is unreachable.
+func NewOktaAuth(c *OktaAuthConfig) (*OktaAuth, error) {
+	return newOktaAuth(c, &http.Client{Timeout: c.HTTPTimeout})
+}
+
+func newOktaAuth(c *OktaAuthConfig, client *http.Client) (*OktaAuth, error) {
+	oa := &OktaAuth{
+		config:       c,
+		client:       client,
+		groups:       newMembershipCache(c.GroupCache, "okta"),
+		blockedUntil: map[string]time.Time{},
+	}
+	if err := oa.checkAPIToken(); err != nil {
+		return nil, err
+	}
+	glog.Infof("Okta auth for %s", c.OrgURL)
+	return oa, nil
+}
+
+func (oa *OktaAuth) checkAPIToken() error {
+	resp, err := oa.do("users", "GET", oa.config.OrgURL+"/api/v1/users/me", nil)
+	if err != nil {
+		// Not fatal, the service may become reachable later.
+		glog.Warningf("Failed to check Okta API token: %s", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("okta_auth.api_token was rejected by %s: %s", oa.config.OrgURL, oktaErrorSummary(resp))
+	}
+	glog.Warningf("Failed to check Okta API token: %s", oktaErrorSummary(resp))
+	return nil
+}
+
+// do sends a request to one of the APIs, unless its rate limit is exhausted, and keeps track of the rate limit.
+// Only the users API gets the API token.
+func (oa *OktaAuth) do(apiName, method, url string, body interface{}) (*http.Response, error) {
+	oa.lock.Lock()
+	until := oa.blockedUntil[apiName]
+	oa.lock.Unlock()
+	if time.Now().Before(until) {
+		return nil, fmt.Errorf("Okta %s API rate limit exceeded, retrying after %s", apiName, until.Format(time.RFC3339))
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiName == "users" {
+		req.Header.Set("Authorization", "SSWS "+oa.config.APIToken)
+	}
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	oa.trackRateLimit(apiName, resp)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		oa.lock.Lock()
+		until := oa.blockedUntil[apiName]
+		oa.lock.Unlock()
+		return nil, fmt.Errorf("Okta %s API rate limit exceeded, retrying after %s", apiName, until.Format(time.RFC3339))
+	}
+	return resp, nil
+}
+
+// trackRateLimit stops requests to the API until the reset time of its rate limit
+// if the response says that it has been exhausted.
+func (oa *OktaAuth) trackRateLimit(apiName string, resp *http.Response) {
+	remaining := resp.Header.Get("X-Rate-Limit-Remaining")
+	if resp.StatusCode != http.StatusTooManyRequests && remaining != "0" {
+		return
+	}
+	until := time.Now().Add(oktaDefaultBackoff)
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-Rate-Limit-Reset"), 10, 64); err == nil {
+		until = time.Unix(reset, 0)
+	}
+	oa.lock.Lock()
+	defer oa.lock.Unlock()
+	if until.After(oa.blockedUntil[apiName]) {
+		oa.blockedUntil[apiName] = until
+		glog.Warningf("Okta %s API rate limit exhausted, backing off until %s", apiName, until.Format(time.RFC3339))
+	}
+}
+
+func oktaErrorSummary(resp *http.Response) string {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var oe oktaError
+	if err := json.Unmarshal(body, &oe); err != nil || oe.ErrorCode == "" {
+		return resp.Status
+	}
+	return fmt.Sprintf("%s (%s: %s)", resp.Status, oe.ErrorCode, oe.ErrorSummary)
+}
+
+func (oa *OktaAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	if user == "" || password == "" {
+		return false, nil, api.NoMatch
+	}
+	resp, err := oa.do("authn", "POST", oa.config.OrgURL+"/api/v1/authn", map[string]string{"username": user, "password": string(password)})
+	if err != nil {
+		return false, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return false, nil, nil
+	default:
+		return false, nil, fmt.Errorf("Okta authentication failed: %s", oktaErrorSummary(resp))
+	}
+	var ar oktaAuthnResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return false, nil, fmt.Errorf("failed to parse Okta authentication response: %s", err)
+	}
+	if ar.Status != "SUCCESS" {
+		// E.g. MFA_REQUIRED, LOCKED_OUT, PASSWORD_EXPIRED. None of them can be completed here.
+		glog.Warningf("Okta authentication of %s rejected: status %s", user, ar.Status)
+		return false, nil, nil
+	}
+	if ar.Embedded.User.ID == "" {
+		return false, nil, fmt.Errorf("Okta authentication response has no user ID")
+	}
+	groups, err := oa.groups.get(ar.Embedded.User.ID, func() ([]string, error) {
+		return oa.fetchGroups(ar.Embedded.User.ID)
+	})
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to get Okta groups of %s: %s", user, err)
+	}
+	labels := api.Labels{}
+	if len(groups) > 0 {
+		labels["groups"] = groups
+	}
+	return true, labels, nil
+}
+
+// fetchGroups returns the names of all the groups of the user, following pagination links.
+func (oa *OktaAuth) fetchGroups(userID string) ([]string, error) {
+	var names []string
+	next := fmt.Sprintf("%s/api/v1/users/%s/groups?limit=200", oa.config.OrgURL, url.PathEscape(userID))
+	for next != "" {
+		resp, err := oa.do("users", "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			summary := oktaErrorSummary(resp)
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s", summary)
+		}
+		var groups []oktaGroup
+		err = json.NewDecoder(resp.Body).Decode(&groups)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse groups: %s", err)
+		}
+		for _, g := range groups {
+			names = append(names, g.Profile.Name)
+		}
+		next = ""
+		for _, link := range resp.Header["Link"] {
+			if m := oktaLinkNextRegex.FindStringSubmatch(link); m != nil {
+				next = m[1]
+			}
+		}
+		if next != "" && !strings.HasPrefix(next, oa.config.OrgURL+"/") {
+			// Never send the API token elsewhere.
+			return nil, fmt.Errorf("unexpected pagination link %s", next)
+		}
+	}
+	glog.V(2).Infof("Okta groups of %s: %s", userID, names)
+	return names, nil
+}
+
+func (oa *OktaAuth) Stop() {
+}
+
+func (oa *OktaAuth) Name() string {
+	return "Okta"
+}
@@ -0,0 +1,130 @@
+package authn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestOktaAuthConfig(t *testing.T) {
+	for _, c := range []OktaAuthConfig{
+		{APIToken: "t"},
+		{OrgURL: "http://example.okta.com", APIToken: "t"},
+		{OrgURL: "https://example.okta.com/oauth2/default", APIToken: "t"},
+		{OrgURL: "https://example.okta.com"},
+		{OrgURL: "https://example.okta.com", APIToken: "t", APITokenFile: "/dev/null"},
+		{OrgURL: "https://example.okta.com", APIToken: "t", GroupCache: &MembershipCacheConfig{}},
+	} {
+		if err := c.Validate("okta_auth"); err == nil {
+			t.Errorf("%+v: expected to fail", c)
+		}
+	}
+	c := &OktaAuthConfig{OrgURL: "https://example.okta.com/", APIToken: "t"}
+	if err := c.Validate("okta_auth"); err != nil || c.OrgURL != "https://example.okta.com" || c.GroupCache.TTL != 5*time.Minute {
+		t.Errorf("expected valid config with defaults, got %+v %v", c, err)
+	}
+}
+
+// fakeOkta implements the parts of the Okta API used by OktaAuth.
+type fakeOkta struct {
+	url         string
+	groupCalls  int
+	rateLimited bool
+	authnCalls  int
+}
+
+func (fo *fakeOkta) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/api/v1/authn" && req.Header.Get("Authorization") != "SSWS secret" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(rw, `{"errorCode": "E0000011", "errorSummary": "Invalid token provided"}`)
+		return
+	}
+	switch req.URL.Path {
+	case "/api/v1/users/me":
+		fmt.Fprint(rw, `{"id": "00uadmin"}`)
+	case "/api/v1/authn":
+		fo.authnCalls++
+		if fo.rateLimited {
+			rw.Header().Set("X-Rate-Limit-Remaining", "0")
+			rw.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		var creds struct{ Username, Password string }
+		json.NewDecoder(req.Body).Decode(&creds)
+		switch {
+		case creds.Username == "alice" && creds.Password == "s3cr3t":
+			fmt.Fprint(rw, `{"status": "SUCCESS", "_embedded": {"user": {"id": "00ualice"}}}`)
+		case creds.Username == "bob" && creds.Password == "s3cr3t":
+			fmt.Fprint(rw, `{"status": "MFA_REQUIRED", "_embedded": {"user": {"id": "00ubob"}}}`)
+		default:
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(rw, `{"errorCode": "E0000004", "errorSummary": "Authentication failed"}`)
+		}
+	case "/api/v1/users/00ualice/groups":
+		fo.groupCalls++
+		if req.URL.Query().Get("after") == "" {
+			rw.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/users/00ualice/groups?limit=200>; rel="self"`, fo.url))
+			rw.Header().Add("Link", fmt.Sprintf(`<%s/api/v1/users/00ualice/groups?after=g2&limit=200>; rel="next"`, fo.url))
+			fmt.Fprint(rw, `[{"profile": {"name": "Everyone"}}, {"profile": {"name": "devs"}}]`)
+		} else {
+			fmt.Fprint(rw, `[{"profile": {"name": "ops"}}]`)
+		}
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestOktaAuth(t *testing.T) {
+	fo := &fakeOkta{}
+	ts := httptest.NewTLSServer(fo)
+	defer ts.Close()
+	fo.url = ts.URL
+
+	c := &OktaAuthConfig{OrgURL: ts.URL, APIToken: "wrong"}
+	if err := c.Validate("okta_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	if _, err := newOktaAuth(c, ts.Client()); err == nil {
+		t.Errorf("expected rejected API token to be an error")
+	}
+	c.APIToken = "secret"
+	oa, err := newOktaAuth(c, ts.Client())
+	if err != nil {
+		t.Fatalf("failed to create OktaAuth: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ok, labels, err := oa.Authenticate("alice", "s3cr3t")
+		if !ok || err != nil || !reflect.DeepEqual(labels, api.Labels{"groups": {"Everyone", "devs", "ops"}}) {
+			t.Errorf("%d: expected alice to be authenticated with groups, got %t %v %v", i, ok, labels, err)
+		}
+	}
+	if fo.groupCalls != 2 {
+		t.Errorf("expected groups to be fetched once (2 pages), got %d calls", fo.groupCalls)
+	}
+	for user, password := range map[string]api.PasswordString{"alice": "wrong", "bob": "s3cr3t"} {
+		if ok, _, err := oa.Authenticate(user, password); ok || err != nil {
+			t.Errorf("%s: expected to be denied, got %t %v", user, ok, err)
+		}
+	}
+
+	// After a 429, no requests are made until the reset time.
+	fo.rateLimited = true
+	calls := fo.authnCalls
+	for i := 0; i < 3; i++ {
+		if ok, _, err := oa.Authenticate("alice", "s3cr3t"); ok || err == nil {
+			t.Errorf("%d: expected rate limit error, got %t %v", i, ok, err)
+		}
+	}
+	if fo.authnCalls != calls+1 {
+		t.Errorf("expected to back off after being rate limited, got %d calls", fo.authnCalls-calls)
+	}
+}
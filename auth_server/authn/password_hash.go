@@ -0,0 +1,178 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// Supported password hash algorithms.
+//
+// bcrypt hashes are in the usual $2a$/$2b$/$2y$ format.
+// scrypt hashes are $scrypt$ln=<log2(N)>,r=<r>,p=<p>$<salt>$<hash>.
+// argon2id hashes are $argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<threads>$<salt>$<hash>.
+// Salt and hash are unpadded base64.
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashScrypt   = "scrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// ValidatePasswordHash checks the password hash algorithm setting. Empty means bcrypt.
+func ValidatePasswordHash(configKey, algo string) error {
+	switch algo {
+	case "", PasswordHashBcrypt, PasswordHashScrypt, PasswordHashArgon2id:
+		return nil
+	}
+	return fmt.Errorf("%s must be one of %s, %s or %s, got %q",
+		configKey, PasswordHashBcrypt, PasswordHashScrypt, PasswordHashArgon2id, algo)
+}
+
+// hashAlgorithm determines the algorithm of the hash from its prefix.
+// Hashes without a recognized prefix are assumed to be of the default algorithm,
+// for scrypt and argon2id that is the encoded form with the algorithm identifier omitted.
+// The returned hash always has the prefix.
+func hashAlgorithm(hash, defaultAlgo string) (string, string) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return PasswordHashBcrypt, hash
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return PasswordHashScrypt, hash
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return PasswordHashArgon2id, hash
+	}
+	switch defaultAlgo {
+	case PasswordHashScrypt, PasswordHashArgon2id:
+		return defaultAlgo, "$" + defaultAlgo + "$" + strings.TrimPrefix(hash, "$")
+	}
+	return PasswordHashBcrypt, hash
+}
+
+// comparePassword checks password against the hash. Mismatch is reported as false with no error,
+// a hash that cannot be used for verification results in an error.
+func comparePassword(hash string, password api.PasswordString, defaultAlgo string) (bool, error) {
+	algo, hash := hashAlgorithm(hash, defaultAlgo)
+	switch algo {
+	case PasswordHashScrypt:
+		return compareScrypt(hash, []byte(password))
+	case PasswordHashArgon2id:
+		return compareArgon2id(hash, []byte(password))
+	}
+	switch err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err {
+	case nil:
+		return true, nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid bcrypt hash: %s", err)
+	}
+}
+
+// splitHash splits $<algo>$[<version>$]<params>$<salt>$<hash> into parameters, salt and hash.
+func splitHash(algo, hash string, withVersion bool) (map[string]int, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(hash, "$"+algo+"$"), "$")
+	if withVersion {
+		if len(parts) == 0 || !strings.HasPrefix(parts[0], "v=") {
+			return nil, nil, nil, fmt.Errorf("invalid %s hash: no version", algo)
+		}
+		if parts[0] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, nil, nil, fmt.Errorf("unsupported %s version %s", algo, parts[0][2:])
+		}
+		parts = parts[1:]
+	}
+	if len(parts) != 3 {
+		return nil, nil, nil, fmt.Errorf("invalid %s hash: expected parameters, salt and hash", algo)
+	}
+	params := map[string]int{}
+	for _, kv := range strings.Split(parts[0], ",") {
+		kvp := strings.SplitN(kv, "=", 2)
+		if len(kvp) != 2 {
+			return nil, nil, nil, fmt.Errorf("invalid %s hash parameter %q", algo, kv)
+		}
+		v, err := strconv.Atoi(kvp[1])
+		if err != nil || v <= 0 {
+			return nil, nil, nil, fmt.Errorf("invalid %s hash parameter %q", algo, kv)
+		}
+		params[kvp[0]] = v
+	}
+	salt, err := decodeHashBase64(parts[1])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid %s salt: %s", algo, err)
+	}
+	key, err := decodeHashBase64(parts[2])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("invalid %s hash value", algo)
+	}
+	return params, salt, key, nil
+}
+
+// decodeHashBase64 decodes unpadded base64, also accepting the "." for "+" variant produced by passlib.
+func decodeHashBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.Replace(strings.TrimRight(s, "="), ".", "+", -1))
+}
+
+func requireParams(algo string, params map[string]int, names ...string) error {
+	for _, n := range names {
+		if _, ok := params[n]; !ok {
+			return fmt.Errorf("invalid %s hash: missing parameter %s", algo, n)
+		}
+	}
+	return nil
+}
+
+func compareScrypt(hash string, password []byte) (bool, error) {
+	params, salt, key, err := splitHash(PasswordHashScrypt, hash, false)
+	if err != nil {
+		return false, err
+	}
+	if err := requireParams(PasswordHashScrypt, params, "ln", "r", "p"); err != nil {
+		return false, err
+	}
+	if params["ln"] > 30 {
+		return false, fmt.Errorf("invalid scrypt hash: ln=%d is too large", params["ln"])
+	}
+	dk, err := scrypt.Key(password, salt, 1<<uint(params["ln"]), params["r"], params["p"], len(key))
+	if err != nil {
+		return false, fmt.Errorf("invalid scrypt hash: %s", err)
+	}
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
+
+func compareArgon2id(hash string, password []byte) (bool, error) {
+	params, salt, key, err := splitHash(PasswordHashArgon2id, hash, true)
+	if err != nil {
+		return false, err
+	}
+	if err := requireParams(PasswordHashArgon2id, params, "m", "t", "p"); err != nil {
+		return false, err
+	}
+	if params["p"] > 255 {
+		return false, fmt.Errorf("invalid argon2id hash: p=%d is too large", params["p"])
+	}
+	dk := argon2.IDKey(password, salt, uint32(params["t"]), uint32(params["m"]), uint8(params["p"]), uint32(len(key)))
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
@@ -0,0 +1,90 @@
+package authn
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestComparePassword(t *testing.T) {
+	b64 := base64.RawStdEncoding.EncodeToString
+	salt := []byte("0123456789abcdef")
+	bh, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	sk, _ := scrypt.Key([]byte("secret"), salt, 1<<4, 8, 1, 32)
+	scryptParams := fmt.Sprintf("ln=4,r=8,p=1$%s$%s", b64(salt), b64(sk))
+	ak := argon2.IDKey([]byte("secret"), salt, 1, 64, 1, 32)
+	argon2Params := fmt.Sprintf("v=19$m=64,t=1,p=1$%s$%s", b64(salt), b64(ak))
+
+	cases := []struct {
+		hash        string
+		defaultAlgo string
+		ok          bool
+		err         bool
+	}{
+		{string(bh), "", true, false},
+		{string(bh), PasswordHashScrypt, true, false},
+		{"$scrypt$" + scryptParams, "", true, false},
+		{"$argon2id$" + argon2Params, "", true, false},
+		// Algorithm identifier can be omitted if it is the default.
+		{scryptParams, PasswordHashScrypt, true, false},
+		{argon2Params, PasswordHashArgon2id, true, false},
+		{scryptParams, "", false, true},
+		// Invalid hashes.
+		{"plaintext", "", false, true},
+		{"$argon2i$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA", "", false, true},
+		{"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA", "", false, true},
+		{"$argon2id$m=64,t=1,p=1$c2FsdA$aGFzaA", "", false, true},
+		{"$scrypt$ln=4,r=8$c2FsdA$aGFzaA", "", false, true},
+		{"$scrypt$ln=4,r=8,p=x$c2FsdA$aGFzaA", "", false, true},
+		{"$scrypt$ln=4,r=8,p=1$c2FsdA$", "", false, true},
+		{"$scrypt$ln=4,r=8,p=1$c2FsdA", "", false, true},
+		{"$scrypt$ln=4,r=8,p=1$!!!$aGFzaA", "", false, true},
+	}
+	for i, c := range cases {
+		ok, err := comparePassword(c.hash, "secret", c.defaultAlgo)
+		if ok != c.ok || (err != nil) != c.err {
+			t.Errorf("%d: %q: expected %t (error: %t), got %t, %v", i, c.hash, c.ok, c.err, ok, err)
+		}
+		if c.ok {
+			if ok, err := comparePassword(c.hash, api.PasswordString("wrong"), c.defaultAlgo); ok || err != nil {
+				t.Errorf("%d: %q: expected wrong password to be rejected, got %t, %v", i, c.hash, ok, err)
+			}
+		}
+	}
+}
+
+func TestStaticMixedHashes(t *testing.T) {
+	salt := []byte("saltsaltsaltsalt")
+	sk, _ := scrypt.Key([]byte("secret"), salt, 1<<4, 8, 1, 32)
+	bh, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	sh := api.PasswordString(fmt.Sprintf("$scrypt$ln=4,r=8,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sk)))
+	bhs := api.PasswordString(bh)
+	junk := api.PasswordString("junk")
+	users := map[string]*Requirements{
+		"old":    {Password: &sh},
+		"new":    {Password: &bhs},
+		"broken": {Password: &junk},
+	}
+	if err := ValidateUsers(map[string]*Requirements{"new": users["new"]}, bcrypt.MinCost+1, ""); err == nil {
+		t.Errorf("expected bcrypt cost to be checked")
+	}
+	if err := ValidateUsers(map[string]*Requirements{"old": users["old"]}, bcrypt.MinCost+1, ""); err != nil {
+		t.Errorf("expected scrypt hash not to be checked for bcrypt cost: %s", err)
+	}
+	sua := NewStaticUserAuth(users, "")
+	for _, user := range []string{"old", "new"} {
+		if ok, _, err := sua.Authenticate(user, "secret"); !ok || err != nil {
+			t.Errorf("expected %s to be authenticated, got %t, %v", user, ok, err)
+		}
+	}
+	if ok, _, err := sua.Authenticate("broken", "secret"); ok || err == nil {
+		t.Errorf("expected an error for an unsupported hash, got %t, %v", ok, err)
+	}
+}
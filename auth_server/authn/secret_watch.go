@@ -0,0 +1,85 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+)
+
+// Interval of checks of watched secret files, in addition to change notifications, which are
+// missed in some cases, e.g. when the file is replaced through a symlink as with Kubernetes secrets.
+var secretReloadInterval = time.Minute
+
+// watchedSecret is a client secret that is reloaded when its file changes, so that it can be rotated
+// without a restart. If the file can't be read or is empty, the current secret remains in effect.
+type watchedSecret struct {
+	name string
+	path string
+	stop chan struct{}
+
+	lock   sync.RWMutex
+	secret string
+}
+
+// newWatchedSecret returns the client secret resolved from the config, watching its file if it was
+// read from one, i.e. client_secret_file or a file client_secret_source. name is used in logs.
+func newWatchedSecret(name, secret, file string, source *SecretSource) *watchedSecret {
+	ws := &watchedSecret{name: name, path: file, secret: secret}
+	if ws.path == "" && source != nil && source.Type == "file" {
+		ws.path = source.Path
+	}
+	if ws.path != "" {
+		ws.stop = make(chan struct{})
+		go ws.watch()
+	}
+	return ws
+}
+
+func (ws *watchedSecret) get() string {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+	return ws.secret
+}
+
+// reload re-reads the file and swaps the secret if it has changed. The secret itself is never logged.
+func (ws *watchedSecret) reload() {
+	secret, err := (&SecretSource{Type: "file", Path: ws.path}).Resolve()
+	if err != nil {
+		glog.Errorf("Failed to reload %s (current secret remains in effect): %s", ws.name, err)
+		return
+	}
+	ws.lock.Lock()
+	changed := secret != ws.secret
+	ws.secret = secret
+	ws.lock.Unlock()
+	if changed {
+		glog.Infof("Rotated %s, new secret read from %s", ws.name, ws.path)
+	}
+}
+
+func (ws *watchedSecret) watch() {
+	watchFile(ws.path, secretReloadInterval, ws.stop, ws.reload)
+}
+
+func (ws *watchedSecret) Stop() {
+	if ws.stop != nil {
+		close(ws.stop)
+	}
+}
@@ -0,0 +1,109 @@
+package authn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor polls until cond is true or a few seconds pass.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestWatchedSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := secretReloadInterval
+	secretReloadInterval = 50 * time.Millisecond
+	defer func() { secretReloadInterval = saved }()
+
+	file := filepath.Join(dir, "client_secret")
+	ioutil.WriteFile(file, []byte("old-secret\n"), 0600)
+	ws := newWatchedSecret("test", "old-secret", file, nil)
+	defer ws.Stop()
+
+	ioutil.WriteFile(file, []byte("new-secret\n"), 0600)
+	if !waitFor(func() bool { return ws.get() == "new-secret" }) {
+		t.Fatalf("expected new secret, got %q", ws.get())
+	}
+	// Invalid contents are ignored.
+	ioutil.WriteFile(file, []byte(" \n"), 0600)
+	time.Sleep(200 * time.Millisecond)
+	if s := ws.get(); s != "new-secret" {
+		t.Errorf("expected empty file to be ignored, got %q", s)
+	}
+	os.Remove(file)
+	time.Sleep(200 * time.Millisecond)
+	if s := ws.get(); s != "new-secret" {
+		t.Errorf("expected missing file to be ignored, got %q", s)
+	}
+	// A file that is recreated is picked up.
+	ioutil.WriteFile(file, []byte("newer-secret"), 0600)
+	if !waitFor(func() bool { return ws.get() == "newer-secret" }) {
+		t.Errorf("expected secret from recreated file, got %q", ws.get())
+	}
+
+	if s := newWatchedSecret("test", "inline", "", nil); s.get() != "inline" {
+		t.Errorf("expected inline secret, got %q", s.get())
+	}
+}
+
+func TestGitHubClientSecretRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := secretReloadInterval
+	secretReloadInterval = 50 * time.Millisecond
+	defer func() { secretReloadInterval = saved }()
+
+	// The app token API authenticates the app with the current secret.
+	validSecret := "secret1"
+	gh := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if id, secret, _ := req.BasicAuth(); id != "app" || secret != validSecret {
+			http.Error(rw, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(rw, `{"user": {"login": "alice"}}`)
+	}))
+	defer gh.Close()
+
+	secretFile := filepath.Join(dir, "client_secret")
+	ioutil.WriteFile(secretFile, []byte("secret1\n"), 0600)
+	c := &GitHubAuthConfig{
+		ClientId: "app", ClientSecret: "secret1", ClientSecretFile: secretFile,
+		TokenDB: filepath.Join(dir, "tokens.ldb"), GithubApiUri: gh.URL,
+	}
+	gha, err := NewGitHubAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err)
+	}
+	defer gha.Stop()
+	if user, err := gha.checkAppToken("token"); err != nil || user != "alice" {
+		t.Fatalf("expected token of alice, got %q %v", user, err)
+	}
+
+	validSecret = "secret2"
+	if _, err := gha.checkAppToken("token"); err == nil {
+		t.Fatalf("expected the old secret to be rejected")
+	}
+	ioutil.WriteFile(secretFile, []byte("secret2\n"), 0600)
+	if !waitFor(func() bool { _, err := gha.checkAppToken("token"); return err == nil }) {
+		t.Errorf("expected the new secret to be used")
+	}
+}
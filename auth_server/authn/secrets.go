@@ -0,0 +1,158 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// SecretSource specifies where to get a secret from.
+type SecretSource struct {
+	// file, env or vault.
+	Type string `yaml:"type,omitempty"`
+	// Path of the file, name of the environment variable or Vault KV path,
+	// e.g. secret/data/docker_auth for KV version 2.
+	Path string `yaml:"path,omitempty"`
+	// Vault only: field of the secret, "value" by default.
+	Key string `yaml:"key,omitempty"`
+}
+
+// secretResolver retrieves secrets of a particular type of source.
+// Secrets must never be included in errors.
+type secretResolver interface {
+	resolve(s *SecretSource) (string, error)
+}
+
+var secretResolvers = map[string]secretResolver{
+	"file":  fileSecretResolver{},
+	"env":   envSecretResolver{},
+	"vault": &vaultSecretResolver{getenv: os.Getenv, client: &http.Client{Timeout: 10 * time.Second}},
+}
+
+// Resolve returns the secret, with leading and trailing whitespace removed.
+func (s *SecretSource) Resolve() (string, error) {
+	r, ok := secretResolvers[s.Type]
+	if !ok {
+		return "", fmt.Errorf("unknown secret source type %q, must be file, env or vault", s.Type)
+	}
+	if s.Path == "" {
+		return "", fmt.Errorf("secret source path is required")
+	}
+	secret, err := r.resolve(s)
+	if err != nil {
+		return "", err
+	}
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return "", fmt.Errorf("secret from %s %s is empty", s.Type, s.Path)
+	}
+	return secret, nil
+}
+
+// ResolveClientSecret determines the client secret from the client_secret, client_secret_file
+// and client_secret_source settings. The file and the source are mutually exclusive and take precedence
+// over the inline secret. Result is empty if none are set.
+func ResolveClientSecret(secret, file string, source *SecretSource) (string, error) {
+	switch {
+	case file != "" && source != nil:
+		return "", fmt.Errorf("client_secret_file and client_secret_source are mutually exclusive")
+	case file != "":
+		source = &SecretSource{Type: "file", Path: file}
+	case source == nil:
+		return secret, nil
+	}
+	return source.Resolve()
+}
+
+type fileSecretResolver struct{}
+
+func (fileSecretResolver) resolve(s *SecretSource) (string, error) {
+	contents, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %s", s.Path, err)
+	}
+	return string(contents), nil
+}
+
+type envSecretResolver struct{}
+
+func (envSecretResolver) resolve(s *SecretSource) (string, error) {
+	v, ok := os.LookupEnv(s.Path)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", s.Path)
+	}
+	return v, nil
+}
+
+// vaultSecretResolver reads secrets from HashiCorp Vault KV secrets engine, version 1 or 2.
+// Server address and token are taken from VAULT_ADDR and VAULT_TOKEN, VAULT_NAMESPACE is optional.
+type vaultSecretResolver struct {
+	getenv func(string) string
+	client *http.Client
+}
+
+func (vr *vaultSecretResolver) resolve(s *SecretSource) (string, error) {
+	addr, token := vr.getenv("VAULT_ADDR"), vr.getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set to read secrets from Vault")
+	}
+	key := s.Key
+	if key == "" {
+		key = "value"
+	}
+	url := strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(s.Path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid Vault URL %s: %s", url, err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := vr.getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := vr.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s from Vault: %s", s.Path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not read %s from Vault: status %d", s.Path, resp.StatusCode)
+	}
+	var vresp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vresp); err != nil {
+		return "", fmt.Errorf("invalid response from Vault for %s: %s", s.Path, err)
+	}
+	data := vresp.Data
+	// KV version 2 has the secret nested, along with its metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	v, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no string field %q", s.Path, key)
+	}
+	return v, nil
+}
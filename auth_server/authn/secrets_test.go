@@ -0,0 +1,91 @@
+package authn
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResolveClientSecret(t *testing.T) {
+	f, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+	os.Setenv("DOCKER_AUTH_TEST_SECRET", "from-env")
+	defer os.Unsetenv("DOCKER_AUTH_TEST_SECRET")
+
+	cases := []struct {
+		secret, file string
+		source       *SecretSource
+		expected     string
+		err          bool
+	}{
+		{"inline", "", nil, "inline", false},
+		{"inline", f.Name(), nil, "from-file", false},
+		{"", "", &SecretSource{Type: "file", Path: f.Name()}, "from-file", false},
+		{"", "", &SecretSource{Type: "env", Path: "DOCKER_AUTH_TEST_SECRET"}, "from-env", false},
+		{"", "", &SecretSource{Type: "env", Path: "DOCKER_AUTH_TEST_NO_SUCH_SECRET"}, "", true},
+		{"", "", &SecretSource{Type: "keychain", Path: "foo"}, "", true},
+		{"", "", &SecretSource{Type: "file"}, "", true},
+		{"", f.Name(), &SecretSource{Type: "env", Path: "DOCKER_AUTH_TEST_SECRET"}, "", true},
+	}
+	for i, c := range cases {
+		secret, err := ResolveClientSecret(c.secret, c.file, c.source)
+		if secret != c.expected || (err != nil) != c.err {
+			t.Errorf("%d: expected %q (error: %t), got %q, %v", i, c.expected, c.err, secret, err)
+		}
+	}
+}
+
+func TestVaultSecretResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/docker_auth":
+			w.Write([]byte(`{"data": {"data": {"value": "kv2", "github": "gh"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/docker_auth":
+			w.Write([]byte(`{"data": {"value": "kv1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	env := map[string]string{"VAULT_ADDR": srv.URL, "VAULT_TOKEN": "s.token"}
+	vr := &vaultSecretResolver{getenv: func(k string) string { return env[k] }, client: srv.Client()}
+
+	cases := []struct {
+		source   SecretSource
+		expected string
+	}{
+		{SecretSource{Type: "vault", Path: "secret/data/docker_auth"}, "kv2"},
+		{SecretSource{Type: "vault", Path: "secret/data/docker_auth", Key: "github"}, "gh"},
+		{SecretSource{Type: "vault", Path: "/kv/docker_auth"}, "kv1"},
+		{SecretSource{Type: "vault", Path: "secret/data/docker_auth", Key: "google"}, ""},
+		{SecretSource{Type: "vault", Path: "secret/data/other"}, ""},
+	}
+	for i, c := range cases {
+		secret, err := vr.resolve(&c.source)
+		if secret != c.expected || (err != nil) != (c.expected == "") {
+			t.Errorf("%d: expected %q, got %q, %v", i, c.expected, secret, err)
+		}
+	}
+
+	env["VAULT_TOKEN"] = "s.wrong"
+	_, err := vr.resolve(&SecretSource{Type: "vault", Path: "secret/data/docker_auth"})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected a permission error, got %v", err)
+	}
+	delete(env, "VAULT_TOKEN")
+	if _, err := vr.resolve(&SecretSource{Type: "vault", Path: "secret/data/docker_auth"}); err == nil {
+		t.Errorf("expected an error with no token")
+	}
+}
@@ -17,8 +17,16 @@
 package authn
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
 	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
 
 	"github.com/cesanta/docker_auth/auth_server/api"
 )
@@ -26,10 +34,38 @@ import (
 type Requirements struct {
 	Password *api.PasswordString `yaml:"password,omitempty" json:"password,omitempty"`
 	Labels   api.Labels          `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// If set, a TOTP code generated with this base32-encoded secret must follow the password, see SplitTOTPCode.
+	TOTPSecret string `yaml:"totp_secret,omitempty" json:"totp_secret,omitempty"`
+}
+
+// UsersFileConfig specifies an external file with the static user map,
+// in the same format as the users section of the config.
+type UsersFileConfig struct {
+	Path string `yaml:"path,omitempty"`
+	// The file is reloaded when it changes. In addition, it can be checked
+	// periodically, for cases when change notifications are not reliable.
+	ReloadInterval time.Duration `yaml:"reload_interval,omitempty"`
+}
+
+func (c *UsersFileConfig) Validate(configKey string) error {
+	if c.Path == "" {
+		return fmt.Errorf("%s.path is required", configKey)
+	}
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("%s.reload_interval must not be negative", configKey)
+	}
+	return nil
 }
 
 type staticUsersAuth struct {
+	lock  sync.RWMutex
 	users map[string]*Requirements
+
+	passwordHash  string
+	file          *UsersFileConfig
+	minBcryptCost int
+	contents      []byte
+	stop          chan struct{}
 }
 
 func (r Requirements) String() string {
@@ -38,29 +74,156 @@ func (r Requirements) String() string {
 		pm := api.PasswordString("***")
 		r.Password = &pm
 	}
+	if r.TOTPSecret != "" {
+		r.TOTPSecret = "***"
+	}
 	b, _ := json.Marshal(r)
 	r.Password = p
 	return string(b)
 }
 
-func NewStaticUserAuth(users map[string]*Requirements) *staticUsersAuth {
-	return &staticUsersAuth{users: users}
+// ValidateUsers checks that TOTP secrets are valid and that bcrypt password hashes are valid and have
+// at least the specified cost. Zero cost disables the check. Hashes of other algorithms are not checked.
+func ValidateUsers(users map[string]*Requirements, minBcryptCost int, passwordHash string) error {
+	for user, reqs := range users {
+		if reqs == nil {
+			continue
+		}
+		if reqs.TOTPSecret != "" {
+			if err := ValidateTOTPSecret(reqs.TOTPSecret); err != nil {
+				return fmt.Errorf("invalid TOTP secret for user %q: %s", user, err)
+			}
+		}
+		if minBcryptCost == 0 || reqs.Password == nil {
+			continue
+		}
+		if algo, _ := hashAlgorithm(string(*reqs.Password), passwordHash); algo != PasswordHashBcrypt {
+			continue
+		}
+		cost, err := bcrypt.Cost([]byte(*reqs.Password))
+		if err != nil {
+			return fmt.Errorf("invalid password hash for user %q: %s", user, err)
+		}
+		if cost < minBcryptCost {
+			glog.Warningf("Password hash for user %q has cost %d, below users_bcrypt_cost (%d)", user, cost, minBcryptCost)
+			return fmt.Errorf("password hash for user %q has cost %d, users_bcrypt_cost requires at least %d", user, cost, minBcryptCost)
+		}
+	}
+	return nil
+}
+
+func parseUsers(contents []byte, minBcryptCost int, passwordHash string) (map[string]*Requirements, error) {
+	if len(bytes.TrimSpace(contents)) == 0 {
+		// Most likely caught in the middle of a write. Use {} for an empty user map.
+		return nil, fmt.Errorf("file is empty")
+	}
+	users := map[string]*Requirements{}
+	if err := yaml.Unmarshal(contents, &users); err != nil {
+		return nil, err
+	}
+	if err := ValidateUsers(users, minBcryptCost, passwordHash); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// LoadUsersFile reads and validates the user map from a file.
+func LoadUsersFile(path string, minBcryptCost int, passwordHash string) (map[string]*Requirements, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", path, err)
+	}
+	users, err := parseUsers(contents, minBcryptCost, passwordHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %s", path, err)
+	}
+	return users, nil
+}
+
+// NewStaticUserAuth creates a static authenticator. passwordHash is the algorithm of password hashes
+// that cannot be identified by their prefix, bcrypt if empty.
+func NewStaticUserAuth(users map[string]*Requirements, passwordHash string) *staticUsersAuth {
+	return &staticUsersAuth{users: users, passwordHash: passwordHash}
+}
+
+// NewStaticUsersFileAuth creates a static authenticator with users loaded from a file.
+// The file is watched for changes and reloaded. If the new contents are invalid,
+// the previous set of users remains in effect.
+func NewStaticUsersFileAuth(c *UsersFileConfig, minBcryptCost int, passwordHash string) (*staticUsersAuth, error) {
+	sua := &staticUsersAuth{file: c, minBcryptCost: minBcryptCost, passwordHash: passwordHash, stop: make(chan struct{})}
+	if _, err := sua.reload(); err != nil {
+		return nil, err
+	}
+	glog.Infof("Loaded %d users from %s", len(sua.users), c.Path)
+	go sua.watch()
+	return sua, nil
+}
+
+// reload re-reads the users file and swaps the user map if the contents have changed.
+func (sua *staticUsersAuth) reload() (bool, error) {
+	contents, err := ioutil.ReadFile(sua.file.Path)
+	if err != nil {
+		return false, fmt.Errorf("could not read %s: %s", sua.file.Path, err)
+	}
+	if sua.contents != nil && bytes.Equal(contents, sua.contents) {
+		return false, nil
+	}
+	users, err := parseUsers(contents, sua.minBcryptCost, sua.passwordHash)
+	if err != nil {
+		return false, fmt.Errorf("invalid users file %s: %s", sua.file.Path, err)
+	}
+	sua.lock.Lock()
+	sua.users, sua.contents = users, contents
+	sua.lock.Unlock()
+	return true, nil
+}
+
+func (sua *staticUsersAuth) maybeReload() {
+	changed, err := sua.reload()
+	if err != nil {
+		glog.Errorf("Failed to reload users (previous set remains in effect): %s", err)
+	} else if changed {
+		glog.Infof("Reloaded %d users from %s", len(sua.users), sua.file.Path)
+	}
+}
+
+func (sua *staticUsersAuth) watch() {
+	watchFile(sua.file.Path, sua.file.ReloadInterval, sua.stop, sua.maybeReload)
 }
 
 func (sua *staticUsersAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	sua.lock.RLock()
 	reqs := sua.users[user]
+	sua.lock.RUnlock()
 	if reqs == nil {
 		return false, nil, api.NoMatch
 	}
+	var code string
+	if reqs.TOTPSecret != "" {
+		password, code = SplitTOTPCode(password)
+	}
 	if reqs.Password != nil {
-		if bcrypt.CompareHashAndPassword([]byte(*reqs.Password), []byte(password)) != nil {
+		ok, err := comparePassword(string(*reqs.Password), password, sua.passwordHash)
+		if err != nil {
+			return false, nil, fmt.Errorf("cannot verify password of user %q: %s", user, err)
+		}
+		if !ok {
 			return false, nil, nil
 		}
 	}
+	if reqs.TOTPSecret != "" {
+		key, _ := decodeTOTPSecret(reqs.TOTPSecret) // Validated when loaded.
+		if !verifyTOTPCode(key, code, time.Now(), defaultTOTPSkew) {
+			return false, nil, api.WrongTOTP
+		}
+	}
 	return true, reqs.Labels, nil
 }
 
 func (sua *staticUsersAuth) Stop() {
+	if sua.stop != nil {
+		close(sua.stop)
+	}
 }
 
 func (sua *staticUsersAuth) Name() string {
@@ -0,0 +1,71 @@
+package authn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStaticUsersFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yml")
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	write := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	authenticated := func(sua *staticUsersAuth, user string) bool {
+		result, _, _ := sua.Authenticate(user, "secret")
+		return result
+	}
+
+	write(`alice: {password: "` + string(hash) + `"}`)
+	sua, err := NewStaticUsersFileAuth(&UsersFileConfig{Path: path, ReloadInterval: 10 * time.Millisecond}, 0, "")
+	if err != nil {
+		t.Fatalf("failed to load users: %s", err)
+	}
+	defer sua.Stop()
+	if !authenticated(sua, "alice") || authenticated(sua, "bob") {
+		t.Fatalf("expected only alice to be authenticated")
+	}
+
+	write(`{alice: {password: "` + string(hash) + `"}, bob: {password: "` + string(hash) + `"}}`)
+	for deadline := time.Now().Add(5 * time.Second); !authenticated(sua, "bob"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("new user was not picked up")
+		}
+	}
+
+	// Invalid contents are ignored.
+	write(`alice: [`)
+	time.Sleep(100 * time.Millisecond)
+	if !authenticated(sua, "alice") || !authenticated(sua, "bob") {
+		t.Errorf("expected previous users to remain in effect")
+	}
+}
+
+func TestLoadUsersFileBcryptCost(t *testing.T) {
+	f, err := ioutil.TempFile("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	f.WriteString(`alice: {password: "` + string(hash) + `"}`)
+	f.Close()
+	if _, err := LoadUsersFile(f.Name(), bcrypt.MinCost, ""); err != nil {
+		t.Errorf("expected cost %d to be accepted: %s", bcrypt.MinCost, err)
+	}
+	if _, err := LoadUsersFile(f.Name(), bcrypt.MinCost+1, ""); err == nil {
+		t.Errorf("expected cost %d to be rejected", bcrypt.MinCost)
+	}
+}
@@ -72,6 +72,19 @@ type TokenDBValue struct {
 	// Generated at the time of token creation, stored here as a BCrypt hash.
 	DockerPassword string     `json:"docker_password,omitempty"`
 	Labels         api.Labels `json:"labels,omitempty"`
+	// Account the token belongs to, if it is not the key (see token.refresh).
+	Account string `json:"account,omitempty"`
+}
+
+// openTokenDB opens the token DB of an OAuth backend: in Redis if redis is set, otherwise
+// the LevelDB in file. Also returns a description of the DB for logging.
+func openTokenDB(file string, redis *RedisTokenDBConfig, backend string) (TokenDB, string, error) {
+	if redis != nil {
+		db, err := NewRedisTokenDB(redis, "docker_auth:"+backend+":")
+		return db, "Redis: " + redis.Addr, err
+	}
+	db, err := NewTokenDB(file)
+	return db, file, err
 }
 
 // NewTokenDB returns a new TokenDB structure
@@ -16,8 +16,16 @@
 package authn
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -25,43 +33,224 @@ import (
 	"github.com/dchest/uniuri"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 
 	"github.com/cesanta/docker_auth/auth_server/api"
 )
 
+const (
+	defaultGCSRetries         = 3
+	defaultGCSRetryBackoff    = 200 * time.Millisecond
+	defaultGCSMaxRetryBackoff = 5 * time.Second
+	defaultGCSTimeout         = 10 * time.Second
+	defaultGCSMaxIdleConns    = 10
+)
+
+// GCSLatencyBuckets are the upper bounds, in seconds, of the buckets of GCS call latencies.
+var GCSLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Latencies of GCS calls by operation and number of retried calls, exported as metrics by the server.
+var (
+	gcsLatency = map[string]*latencyHistogram{"get": {}, "store": {}, "delete": {}}
+	gcsRetries uint64
+)
+
+// GCSTokenDBLatency returns the number and total duration in seconds of GCS calls of the operation
+// (get, store, delete), including retries, and the cumulative counts by upper bound of GCSLatencyBuckets.
+func GCSTokenDBLatency(op string) (uint64, float64, map[float64]uint64) {
+	return gcsLatency[op].snapshot()
+}
+
+// GCSTokenDBRetries returns the number of GCS calls that were retried after transient errors.
+func GCSTokenDBRetries() uint64 {
+	return atomic.LoadUint64(&gcsRetries)
+}
+
+func (c *GitHubGCSStoreConfig) Validate(configKey string) error {
+	if c.Retries == nil {
+		retries := defaultGCSRetries
+		c.Retries = &retries
+	}
+	if *c.Retries < 0 || c.RetryBackoff < 0 || c.MaxRetryBackoff < 0 || c.Timeout < 0 || c.MaxIdleConns < 0 || c.CacheTTL < 0 {
+		return fmt.Errorf("%s: retries, retry_backoff, max_retry_backoff, timeout, max_idle_conns and cache_ttl must not be negative", configKey)
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultGCSRetryBackoff
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = defaultGCSMaxRetryBackoff
+	}
+	if c.MaxRetryBackoff < c.RetryBackoff {
+		return fmt.Errorf("%s.max_retry_backoff must not be less than retry_backoff", configKey)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultGCSTimeout
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = defaultGCSMaxIdleConns
+	}
+	return nil
+}
+
 // NewGCSTokenDB return a new TokenDB structure which uses Google Cloud Storage as backend. The
 // created DB uses file-per-user strategy and stores credentials independently for each user.
+// The config must have been validated.
 //
 // Note: it's not recomanded bucket to be shared with other apps or services
-func NewGCSTokenDB(bucket, clientSecretFile string) (TokenDB, error) {
-	gcs, err := storage.NewClient(context.Background(), option.WithServiceAccountFile(clientSecretFile))
-	return &gcsTokenDB{gcs, bucket}, err
+func NewGCSTokenDB(c *GitHubGCSStoreConfig) (TokenDB, error) {
+	ctx := context.Background()
+	data, err := ioutil.ReadFile(c.ClientSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read GCS client secret file: %s", err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, storage.ScopeReadWrite)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GCS client secret file %s: %s", c.ClientSecretFile, err)
+	}
+	// Connections are kept open between operations, instead of being set up for every token.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = c.MaxIdleConns
+	transport.MaxIdleConnsPerHost = c.MaxIdleConns
+	client := &http.Client{Transport: &oauth2.Transport{Source: creds.TokenSource, Base: transport}}
+	gcs, err := storage.NewClient(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+	return newGCSTokenDB(c, gcs), nil
+}
+
+func newGCSTokenDB(c *GitHubGCSStoreConfig, gcs *storage.Client) *gcsTokenDB {
+	// Retries are done by gcsTokenDB, so that they can be configured and counted.
+	gcs.SetRetry(storage.WithPolicy(storage.RetryNever))
+	return &gcsTokenDB{gcs: gcs, bucket: c.Bucket, config: c, cache: map[string]*gcsCacheEntry{}}
 }
 
 type gcsTokenDB struct {
 	gcs    *storage.Client
 	bucket string
+	config *GitHubGCSStoreConfig
+
+	// Values read recently, by user, if cache_ttl is set. gen is incremented when a value is
+	// stored or deleted, so that reads in progress at the time don't put stale values in the cache.
+	lock  sync.Mutex
+	cache map[string]*gcsCacheEntry
+	gen   uint64
+}
+
+type gcsCacheEntry struct {
+	value   TokenDBValue
+	expires time.Time
+}
+
+// gcsRetryable returns whether the error is transient: rate limiting, server errors, timeouts and
+// network errors. Missing objects and other client errors are not.
+func gcsRetryable(err error) bool {
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return false
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+// do runs the operation with a timeout, retrying it with backoff after transient errors.
+func (db *gcsTokenDB) do(op string, f func(ctx context.Context) error) error {
+	backoff := db.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), db.config.Timeout)
+		start := time.Now()
+		err := f(ctx)
+		cancel()
+		gcsLatency[op].observe(time.Since(start))
+		if err == storage.ErrObjectNotExist {
+			ObserveBackendCall("gcs", op, start, BackendFailure)
+		} else {
+			ObserveBackendCall("gcs", op, start, BackendOutcome(err))
+		}
+		if err == nil || attempt >= *db.config.Retries || !gcsRetryable(err) {
+			return err
+		}
+		atomic.AddUint64(&gcsRetries, 1)
+		glog.V(2).Infof("GCS %s failed, retrying in %s: %s", op, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > db.config.MaxRetryBackoff {
+			backoff = db.config.MaxRetryBackoff
+		}
+	}
+}
+
+// cached returns a copy of the cached value of the user, if there is one, and the current generation.
+func (db *gcsTokenDB) cached(user string) (*TokenDBValue, uint64) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if e := db.cache[user]; e != nil {
+		if time.Now().Before(e.expires) {
+			v := e.value
+			return &v, db.gen
+		}
+		delete(db.cache, user)
+	}
+	return nil, db.gen
+}
+
+func (db *gcsTokenDB) putCache(user string, v *TokenDBValue, gen uint64) {
+	if db.config.CacheTTL <= 0 {
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if gen == db.gen {
+		db.cache[user] = &gcsCacheEntry{value: *v, expires: time.Now().Add(db.config.CacheTTL)}
+	}
+}
+
+func (db *gcsTokenDB) invalidate(user string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.cache, user)
+	db.gen++
 }
 
 // GetValue gets token value associated with the provided user. Each user
 // in the bucket is having it's own file for tokens and it's recomanded bucket
 // to not be shared with other apps
 func (db *gcsTokenDB) GetValue(user string) (*TokenDBValue, error) {
-	rd, err := db.gcs.Bucket(db.bucket).Object(user).NewReader(context.Background())
+	v, gen := db.cached(user)
+	if v != nil {
+		return v, nil
+	}
+	var data []byte
+	err := db.do("get", func(ctx context.Context) error {
+		rd, err := db.gcs.Bucket(db.bucket).Object(user).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+		data, err = ioutil.ReadAll(rd)
+		return err
+	})
 	if err == storage.ErrObjectNotExist {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("could not retrieved token for user '%s' due: %v", user, err)
 	}
-	defer rd.Close()
 
 	var dbv TokenDBValue
-	if err := json.NewDecoder(rd).Decode(&dbv); err != nil {
+	if err := json.Unmarshal(data, &dbv); err != nil {
 		glog.Errorf("bad DB value for %q: %v", user, err)
 		return nil, fmt.Errorf("could not read token for user '%s' due: %v", user, err)
 	}
+	db.putCache(user, &dbv, gen)
 
 	return &dbv, nil
 }
@@ -75,14 +264,24 @@ func (db *gcsTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bo
 		v.DockerPassword = string(dph)
 	}
 
-	wr := db.gcs.Bucket(db.bucket).Object(user).NewWriter(context.Background())
-
-	if err := json.NewEncoder(wr).Encode(v); err != nil {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to set token data for %s due: %v", user, err)
+	}
+	db.invalidate(user)
+	defer db.invalidate(user)
+	err = db.do("store", func(ctx context.Context) error {
+		wr := db.gcs.Bucket(db.bucket).Object(user).NewWriter(ctx)
+		if _, err := io.Copy(wr, bytes.NewReader(data)); err != nil {
+			wr.Close()
+			return err
+		}
+		return wr.Close()
+	})
+	if err != nil {
 		glog.Errorf("failed to set token data for %s: %s", user, err)
 		return "", fmt.Errorf("failed to set token data for %s due: %v", user, err)
 	}
-
-	err = wr.Close()
 	return
 }
 
@@ -109,15 +308,18 @@ func (db *gcsTokenDB) ValidateToken(user string, password api.PasswordString) er
 
 // DeleteToken deletes the GCS file that is associated with the provided user.
 func (db *gcsTokenDB) DeleteToken(user string) error {
-	ctx := context.Background()
-	err := db.gcs.Bucket(db.bucket).Object(user).Delete(ctx)
+	db.invalidate(user)
+	defer db.invalidate(user)
+	err := db.do("delete", func(ctx context.Context) error {
+		return db.gcs.Bucket(db.bucket).Object(user).Delete(ctx)
+	})
 	if err == storage.ErrObjectNotExist {
 		return nil
 	}
 	return err
 }
 
-// Close is a nop operation for this db
+// Close closes the GCS client and its idle connections.
 func (db *gcsTokenDB) Close() error {
-	return nil
+	return db.gcs.Close()
 }
@@ -0,0 +1,187 @@
+package authn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// fakeGCS serves objects of a bucket, failing the first failures requests with 503.
+type fakeGCS struct {
+	lock     sync.Mutex
+	objects  map[string]string
+	failures int
+	requests int
+}
+
+func (f *fakeGCS) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+	if f.failures > 0 {
+		f.failures--
+		http.Error(rw, `{"error": {"code": 503, "message": "backend error"}}`, http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case req.Method == "GET" && strings.HasPrefix(req.URL.Path, "/tokens/"):
+		data, ok := f.objects[strings.TrimPrefix(req.URL.Path, "/tokens/")]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		fmt.Fprint(rw, data)
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/b/tokens/o"):
+		name, data, err := parseMultipartUpload(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = data
+		fmt.Fprintf(rw, `{"bucket": "tokens", "name": %q}`, name)
+	case req.Method == "DELETE" && strings.Contains(req.URL.Path, "/b/tokens/o/"):
+		name := req.URL.Path[strings.Index(req.URL.Path, "/b/tokens/o/")+len("/b/tokens/o/"):]
+		if _, ok := f.objects[name]; !ok {
+			http.Error(rw, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		delete(f.objects, name)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// parseMultipartUpload returns the name and content of an object uploaded with uploadType=multipart.
+func parseMultipartUpload(req *http.Request) (string, string, error) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return "", "", err
+	}
+	mr := multipart.NewReader(req.Body, params["boundary"])
+	var meta struct {
+		Name string `json:"name"`
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", "", err
+	}
+	if err := json.NewDecoder(part).Decode(&meta); err != nil {
+		return "", "", err
+	}
+	if part, err = mr.NextPart(); err != nil {
+		return "", "", err
+	}
+	data, err := ioutil.ReadAll(part)
+	return meta.Name, string(data), err
+}
+
+func newTestGCSTokenDB(t *testing.T, f *fakeGCS, c *GitHubGCSStoreConfig) *gcsTokenDB {
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	c.Bucket = "tokens"
+	if err := c.Validate("gcs_token_db"); err != nil {
+		t.Fatal(err)
+	}
+	gcs, err := storage.NewClient(context.Background(), option.WithEndpoint(ts.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newGCSTokenDB(c, gcs)
+}
+
+func TestGCSRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{storage.ErrObjectNotExist, false},
+		{&googleapi.Error{Code: 404}, false},
+		{&googleapi.Error{Code: 403}, false},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{fmt.Errorf("upload: %w", &googleapi.Error{Code: 500}), true},
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("bad object name"), false},
+	}
+	for _, c := range cases {
+		if r := gcsRetryable(c.err); r != c.retryable {
+			t.Errorf("%v: expected retryable %t, got %t", c.err, c.retryable, r)
+		}
+	}
+}
+
+func TestGCSTokenDB(t *testing.T) {
+	f := &fakeGCS{objects: map[string]string{"alice": `{"token_type": "Bearer", "access_token": "alice-token"}`}}
+	db := newTestGCSTokenDB(t, f, &GitHubGCSStoreConfig{RetryBackoff: time.Millisecond, CacheTTL: time.Minute})
+
+	f.failures = 2
+	retries := GCSTokenDBRetries()
+	count, _, _ := GCSTokenDBLatency("get")
+	v, err := db.GetValue("alice")
+	if err != nil || v == nil || v.AccessToken != "alice-token" {
+		t.Fatalf("expected token of alice after retries, got %+v %v", v, err)
+	}
+	if n := GCSTokenDBRetries() - retries; n != 2 {
+		t.Errorf("expected 2 retries, got %d", n)
+	}
+	if n, _, buckets := GCSTokenDBLatency("get"); n-count != 3 || buckets[10] != n {
+		t.Errorf("expected 3 more calls in the latency histogram, got %d (%v)", n-count, buckets)
+	}
+
+	// Cached.
+	requests := f.requests
+	if v, err := db.GetValue("alice"); err != nil || v == nil || v.AccessToken != "alice-token" || f.requests != requests {
+		t.Errorf("expected cached token of alice, got %+v %v (%d requests)", v, err, f.requests-requests)
+	}
+
+	// Missing objects are not retried.
+	requests = f.requests
+	if v, err := db.GetValue("bob"); err != nil || v != nil || f.requests != requests+1 {
+		t.Errorf("expected no token for bob, got %+v %v (%d requests)", v, err, f.requests-requests)
+	}
+
+	// Stored values replace cached ones.
+	if _, err := db.StoreToken("alice", &TokenDBValue{TokenType: "Bearer", AccessToken: "new-token"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetValue("alice"); err != nil || v == nil || v.AccessToken != "new-token" {
+		t.Errorf("expected new token of alice, got %+v %v", v, err)
+	}
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetValue("alice"); err != nil || v != nil {
+		t.Errorf("expected token of alice to be deleted, got %+v %v", v, err)
+	}
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Errorf("expected deleting a missing token to succeed, got %v", err)
+	}
+
+	// Retries are limited.
+	f.failures = 10
+	if _, err := db.GetValue("carol"); err == nil {
+		t.Errorf("expected an error after retries")
+	}
+	f.failures = 0
+	retries = GCSTokenDBRetries()
+	noRetries := 0
+	db = newTestGCSTokenDB(t, f, &GitHubGCSStoreConfig{Retries: &noRetries})
+	f.failures = 1
+	if _, err := db.GetValue("carol"); err == nil || GCSTokenDBRetries() != retries {
+		t.Errorf("expected an error without retries, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/dchest/uniuri"
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// RedisTokenDBConfig configures a token DB in Redis, which can be shared by multiple replicas of the server.
+type RedisTokenDBConfig struct {
+	// Address of the server, host:port.
+	Addr     string `yaml:"addr,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Alternatively, a file containing the password.
+	PasswordFile string `yaml:"password_file,omitempty"`
+	// Database number.
+	DB  int  `yaml:"db,omitempty"`
+	TLS bool `yaml:"tls,omitempty"`
+	// Prefix of keys, default is docker_auth:<backend>:, e.g. docker_auth:github:.
+	KeyPrefix string `yaml:"key_prefix,omitempty"`
+	// Entries are removed this long after the token they hold has expired, unless it is refreshed
+	// before that. Default is 7 days.
+	ExpiryGrace time.Duration `yaml:"expiry_grace,omitempty"`
+	// Timeout of connecting and of requests, default is 5s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Maximum number of idle connections, default is 10.
+	MaxIdle int `yaml:"max_idle,omitempty"`
+}
+
+const (
+	defaultRedisTokenDBExpiryGrace = 7 * 24 * time.Hour
+	defaultRedisTokenDBTimeout     = 5 * time.Second
+)
+
+func (c *RedisTokenDBConfig) Validate(configKey string) error {
+	if c.Addr == "" {
+		return fmt.Errorf("%s.addr is required", configKey)
+	}
+	password, err := ResolveClientSecret(c.Password, c.PasswordFile, nil)
+	if err != nil {
+		return fmt.Errorf("%s.password: %s", configKey, err)
+	}
+	c.Password = password
+	if c.DB < 0 || c.ExpiryGrace < 0 || c.Timeout < 0 || c.MaxIdle < 0 {
+		return fmt.Errorf("%s.{db,expiry_grace,timeout,max_idle} must not be negative", configKey)
+	}
+	if c.ExpiryGrace == 0 {
+		c.ExpiryGrace = defaultRedisTokenDBExpiryGrace
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultRedisTokenDBTimeout
+	}
+	if c.MaxIdle == 0 {
+		c.MaxIdle = 10
+	}
+	return nil
+}
+
+type redisTokenDB struct {
+	config *RedisTokenDBConfig
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisTokenDB returns a TokenDB in Redis. Keys are prefixed with the configured
+// prefix or, if there is none, with defaultPrefix.
+func NewRedisTokenDB(c *RedisTokenDBConfig, defaultPrefix string) (TokenDB, error) {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(c.Timeout),
+		redis.DialReadTimeout(c.Timeout),
+		redis.DialWriteTimeout(c.Timeout),
+		redis.DialDatabase(c.DB),
+		redis.DialUseTLS(c.TLS),
+	}
+	if c.Password != "" {
+		opts = append(opts, redis.DialPassword(c.Password))
+	}
+	db := &redisTokenDB{
+		config: c,
+		pool: &redis.Pool{
+			Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", c.Addr, opts...) },
+			MaxIdle:     c.MaxIdle,
+			IdleTimeout: 5 * time.Minute,
+		},
+		prefix: c.KeyPrefix,
+	}
+	if db.prefix == "" {
+		db.prefix = defaultPrefix
+	}
+	// Not fatal, the server may become reachable later.
+	if err := db.ping(); err != nil {
+		glog.Warningf("Redis token DB at %s is not reachable: %s", c.Addr, err)
+	}
+	return db, nil
+}
+
+func (db *redisTokenDB) key(user string) string {
+	return db.prefix + tokenDBPrefix + user
+}
+
+func (db *redisTokenDB) ping() error {
+	conn := db.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (db *redisTokenDB) GetValue(user string) (*TokenDBValue, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", db.key(user)))
+	switch {
+	case err == redis.ErrNil:
+		return nil, nil
+	case err != nil:
+		glog.Errorf("error accessing token db: %s", err)
+		return nil, fmt.Errorf("error accessing token db: %s", err)
+	}
+	var dbv TokenDBValue
+	if err := json.Unmarshal(data, &dbv); err != nil {
+		glog.Errorf("bad DB value for %q (%q): %s", user, string(data), err)
+		return nil, fmt.Errorf("bad DB value due: %v", err)
+	}
+	return &dbv, nil
+}
+
+// ttl returns how long the entry is kept: until the token expires, plus the grace period,
+// so that it can still be refreshed.
+func (db *redisTokenDB) ttl(v *TokenDBValue) time.Duration {
+	if v.ValidUntil.IsZero() {
+		return 0
+	}
+	ttl := time.Until(v.ValidUntil) + db.config.ExpiryGrace
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+func (db *redisTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bool) (dp string, err error) {
+	if updatePassword {
+		dp = uniuri.New()
+		dph, _ := bcrypt.GenerateFromPassword([]byte(dp), bcrypt.DefaultCost)
+		v.DockerPassword = string(dph)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	conn := db.pool.Get()
+	defer conn.Close()
+	args := []interface{}{db.key(user), data}
+	if ttl := db.ttl(v); ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+	if _, err := conn.Do("SET", args...); err != nil {
+		glog.Errorf("failed to set token data for %s: %s", user, err)
+		return "", fmt.Errorf("failed to set token data for %s: %s", user, err)
+	}
+	glog.V(2).Infof("Server tokens for %s: %s", user, string(data))
+	return dp, nil
+}
+
+func (db *redisTokenDB) ValidateToken(user string, password api.PasswordString) error {
+	dbv, err := db.GetValue(user)
+	if err != nil {
+		return err
+	}
+	if dbv == nil {
+		return api.NoMatch
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbv.DockerPassword), []byte(password)) != nil {
+		return api.WrongPass
+	}
+	if time.Now().After(dbv.ValidUntil) {
+		return ExpiredToken
+	}
+	return nil
+}
+
+func (db *redisTokenDB) DeleteToken(user string) error {
+	glog.V(1).Infof("deleting token for %s", user)
+	conn := db.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("DEL", db.key(user)); err != nil {
+		return fmt.Errorf("failed to delete %s: %s", user, err)
+	}
+	return nil
+}
+
+// HealthCheck pings the server.
+func (db *redisTokenDB) HealthCheck() error {
+	return db.ping()
+}
+
+func (db *redisTokenDB) Close() error {
+	return db.pool.Close()
+}
@@ -0,0 +1,197 @@
+package authn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeRedis implements the commands used by redisTokenDB.
+type fakeRedis struct {
+	l net.Listener
+
+	lock   sync.Mutex
+	values map[string]string
+	ttls   map[string]time.Duration
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{l: l, values: map[string]string{}, ttls: map[string]time.Duration{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		fr.lock.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "GET":
+			if v, ok := fr.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case "SET":
+			fr.values[args[1]] = args[2]
+			delete(fr.ttls, args[1])
+			if len(args) == 5 && args[3] == "PX" {
+				ms, _ := strconv.Atoi(args[4])
+				fr.ttls[args[1]] = time.Duration(ms) * time.Millisecond
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case "DEL":
+			_, found := fr.values[args[1]]
+			delete(fr.values, args[1])
+			if found {
+				fmt.Fprint(conn, ":1\r\n")
+			} else {
+				fmt.Fprint(conn, ":0\r\n")
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command %s\r\n", args[0])
+		}
+		fr.lock.Unlock()
+	}
+}
+
+func TestRedisTokenDB(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.l.Close()
+	c := &RedisTokenDBConfig{Addr: fr.l.Addr().String(), DB: 2, ExpiryGrace: time.Hour}
+	if err := c.Validate("github_auth.redis_token_db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewRedisTokenDB(c, "docker_auth:github:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if v, err := db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("expected no value, got %v %v", v, err)
+	}
+	validUntil := time.Now().Add(time.Hour)
+	dp, err := db.StoreToken("alice", &TokenDBValue{AccessToken: "at", ValidUntil: validUntil, Labels: api.Labels{"teams": {"devs"}}}, true)
+	if err != nil || dp == "" {
+		t.Fatalf("failed to store token: %q %v", dp, err)
+	}
+	v, err := db.GetValue("alice")
+	if err != nil || v == nil || v.AccessToken != "at" || v.Labels["teams"][0] != "devs" {
+		t.Fatalf("unexpected value %+v %v", v, err)
+	}
+	// Kept for the grace period after the token expires.
+	if ttl := fr.ttls["docker_auth:github:t:alice"]; ttl < 2*time.Hour-time.Minute || ttl > 2*time.Hour {
+		t.Errorf("expected entry to expire in 2h, got %s", ttl)
+	}
+
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != nil {
+		t.Errorf("expected password to be valid, got %v", err)
+	}
+	if err := db.ValidateToken("alice", "wrong"); err != api.WrongPass {
+		t.Errorf("expected wrong password, got %v", err)
+	}
+	if err := db.ValidateToken("bob", "whatever"); err != api.NoMatch {
+		t.Errorf("expected no match for unknown user, got %v", err)
+	}
+	v.ValidUntil = time.Now().Add(-time.Minute)
+	if _, err := db.StoreToken("alice", v, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != ExpiredToken {
+		t.Errorf("expected token to be expired, got %v", err)
+	}
+
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("expected value to be deleted, got %v %v", v, err)
+	}
+
+	// Errors of the server are returned, not treated as missing values.
+	fr.l.Close()
+	db2, _ := NewRedisTokenDB(c, "docker_auth:github:")
+	defer db2.Close()
+	if _, err := db2.GetValue("alice"); err == nil {
+		t.Errorf("expected error if the server is unreachable")
+	}
+}
+
+func TestOpenTokenDB(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.l.Close()
+	c := &RedisTokenDBConfig{Addr: fr.l.Addr().String()}
+	if err := c.Validate("gitlab_auth.redis_token_db"); err != nil {
+		t.Fatal(err)
+	}
+	db, name, err := openTokenDB("", c, "gitlab")
+	if err != nil || name != "Redis: "+c.Addr {
+		t.Fatalf("expected Redis token DB, got %q %v", name, err)
+	}
+	defer db.Close()
+	if _, err := db.StoreToken("alice", &TokenDBValue{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := fr.values["docker_auth:gitlab:t:alice"]; !found {
+		t.Errorf("expected key with backend prefix, got %v", fr.values)
+	}
+	if ttl, found := fr.ttls["docker_auth:gitlab:t:alice"]; found {
+		t.Errorf("expected no expiry without valid_until, got %s", ttl)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+	   https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// TOTP codes are as generated by common authenticator apps: RFC 6238 with HMAC-SHA1,
+// 6 digits and 30 second time steps.
+const (
+	totpDigits      = 6
+	totpPeriod      = 30
+	defaultTOTPSkew = 1
+)
+
+// TOTPConfig requires a TOTP code in addition to the password from the listed accounts,
+// regardless of the backend that authenticates them. See SplitTOTPCode for how the code is passed.
+type TOTPConfig struct {
+	// Base32-encoded secrets, by account.
+	Secrets map[string]string `yaml:"secrets,omitempty"`
+	// Alternatively, a YAML file with the secrets map.
+	SecretsFile string `yaml:"secrets_file,omitempty"`
+	// Codes of up to this many time steps before or after the current one are accepted, default is 1.
+	Skew int `yaml:"skew,omitempty"`
+
+	keys map[string][]byte
+}
+
+func (c *TOTPConfig) Validate(configKey string) error {
+	if (len(c.Secrets) == 0) == (c.SecretsFile == "") {
+		return fmt.Errorf("%s: exactly one of secrets and secrets_file must be set", configKey)
+	}
+	if c.SecretsFile != "" {
+		contents, err := ioutil.ReadFile(c.SecretsFile)
+		if err != nil {
+			return fmt.Errorf("could not read %s.secrets_file: %s", configKey, err)
+		}
+		if err := yaml.Unmarshal(contents, &c.Secrets); err != nil {
+			return fmt.Errorf("invalid %s.secrets_file %s: %s", configKey, c.SecretsFile, err)
+		}
+	}
+	c.keys = make(map[string][]byte, len(c.Secrets))
+	for account, secret := range c.Secrets {
+		key, err := decodeTOTPSecret(secret)
+		if err != nil {
+			return fmt.Errorf("%s: invalid secret for %q: %s", configKey, account, err)
+		}
+		c.keys[account] = key
+	}
+	if c.Skew < 0 {
+		return fmt.Errorf("%s.skew must not be negative", configKey)
+	}
+	if c.Skew == 0 {
+		c.Skew = defaultTOTPSkew
+	}
+	return nil
+}
+
+// Required returns true if the account has a TOTP secret.
+func (c *TOTPConfig) Required(account string) bool {
+	_, ok := c.keys[account]
+	return ok
+}
+
+// Verify checks the code of an account that has a TOTP secret.
+func (c *TOTPConfig) Verify(account, code string) bool {
+	return verifyTOTPCode(c.keys[account], code, time.Now(), c.Skew)
+}
+
+// ValidateTOTPSecret checks that the secret is valid base32.
+func ValidateTOTPSecret(secret string) error {
+	_, err := decodeTOTPSecret(secret)
+	return err
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.Replace(strings.TrimSpace(secret), " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("not a valid base32 string")
+	}
+	if len(key) < 10 {
+		return nil, fmt.Errorf("must be at least 80 bits long")
+	}
+	return key, nil
+}
+
+// SplitTOTPCode splits the password given as "<password>:<code>" into the password and the code.
+// Docker clients only send a user name and a password, so this is the only way to pass the code.
+// If the password does not end with a colon and 6 digits, the code is empty.
+func SplitTOTPCode(password api.PasswordString) (api.PasswordString, string) {
+	i := strings.LastIndex(string(password), ":")
+	if i < 0 || len(password)-i-1 != totpDigits {
+		return password, ""
+	}
+	code := string(password[i+1:])
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return password, ""
+		}
+	}
+	return password[:i], code
+}
+
+// TOTPCode returns the code for the secret at time t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, uint64(t.Unix()/totpPeriod)), nil
+}
+
+// totpCode computes the code for the time step, as specified in RFC 4226.
+func totpCode(key []byte, step uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+func verifyTOTPCode(key []byte, code string, t time.Time, skew int) bool {
+	if len(key) == 0 || len(code) != totpDigits {
+		return false
+	}
+	step := t.Unix() / totpPeriod
+	ok := false
+	for i := -skew; i <= skew; i++ {
+		// No early return, so that timing does not reveal which step matched.
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(step+int64(i)))), []byte(code)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
@@ -0,0 +1,106 @@
+package authn
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// Base32 of the RFC 6238 test key "12345678901234567890".
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, last 6 digits.
+	cases := []struct {
+		t    int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	}
+	for _, c := range cases {
+		if code, err := TOTPCode(testTOTPSecret, time.Unix(c.t, 0)); err != nil || code != c.code {
+			t.Errorf("%d: expected %s, got %s %v", c.t, c.code, code, err)
+		}
+	}
+	key, _ := decodeTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	now := time.Unix(1111111109, 0)
+	for _, c := range []struct {
+		t  time.Time
+		ok bool
+	}{
+		{now, true},
+		{now.Add(-30 * time.Second), true},
+		{now.Add(30 * time.Second), true},
+		{now.Add(-90 * time.Second), false},
+	} {
+		if ok := verifyTOTPCode(key, "081804", c.t, 1); ok != c.ok {
+			t.Errorf("%s: expected %t, got %t", c.t.Sub(now), c.ok, ok)
+		}
+	}
+	for _, s := range []string{"not base32!", "GEZDGNBV"} {
+		if err := ValidateTOTPSecret(s); err == nil {
+			t.Errorf("%s: expected secret to be rejected", s)
+		}
+	}
+}
+
+func TestSplitTOTPCode(t *testing.T) {
+	cases := []struct {
+		in, password, code string
+	}{
+		{"secret:123456", "secret", "123456"},
+		{"se:cret:123456", "se:cret", "123456"},
+		{"secret", "secret", ""},
+		{"secret:12345", "secret:12345", ""},
+		{"secret:12345a", "secret:12345a", ""},
+		{":123456", "", "123456"},
+	}
+	for _, c := range cases {
+		if password, code := SplitTOTPCode(api.PasswordString(c.in)); string(password) != c.password || code != c.code {
+			t.Errorf("%s: expected %q %q, got %q %q", c.in, c.password, c.code, password, code)
+		}
+	}
+}
+
+func TestStaticUsersTOTP(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	users := map[string]*Requirements{"admin": {Password: &pw, TOTPSecret: testTOTPSecret}}
+	if err := ValidateUsers(users, 0, ""); err != nil {
+		t.Fatalf("invalid users: %s", err)
+	}
+	sua := NewStaticUserAuth(users, "")
+	code, _ := TOTPCode(testTOTPSecret, time.Now())
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	cases := []struct {
+		password string
+		result   bool
+		err      error
+	}{
+		{"secret:" + code, true, nil},
+		{"wrong:" + code, false, nil},
+		{"secret:" + wrong, false, api.WrongTOTP},
+		{"secret", false, api.WrongTOTP},
+	}
+	for _, c := range cases {
+		if result, _, err := sua.Authenticate("admin", api.PasswordString(c.password)); result != c.result || err != c.err {
+			t.Errorf("%s: expected %t %v, got %t %v", c.password, c.result, c.err, result, err)
+		}
+	}
+	if s := users["admin"].String(); s != `{"password":"***","totp_secret":"***"}` {
+		t.Errorf("expected secrets to be masked, got %s", s)
+	}
+	users["admin"].TOTPSecret = "foo"
+	if err := ValidateUsers(users, 0, ""); err == nil {
+		t.Errorf("expected invalid TOTP secret to be rejected")
+	}
+}
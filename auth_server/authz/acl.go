@@ -3,15 +3,19 @@ package authz
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"path"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/cesanta/glog"
 	"github.com/schwarmco/go-cartesian-product"
+	"gopkg.in/mgo.v2/bson"
 
 	"github.com/cesanta/docker_auth/auth_server/api"
 )
@@ -22,31 +26,168 @@ type ACLEntry struct {
 	Match   *MatchConditions `yaml:"match"`
 	Actions *[]string        `yaml:"actions,flow"`
 	Comment *string          `yaml:"comment,omitempty"`
+	// Expiration overrides token expiration (in seconds) if this entry grants any actions.
+	Expiration int64 `yaml:"expiration,omitempty" json:"expiration,omitempty"`
+	// Claims are added to the token if this entry grants any actions, see ExpandClaims.
+	Claims map[string]string `yaml:"claims,omitempty" json:"claims,omitempty"`
+	// Entries with higher priority are evaluated first, entries with the same priority in ACL order.
+	// Default is 0, negative values put entries after the ones without priority.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+	// Deny makes the entry deny its actions instead of allowing them. They are removed from
+	// the request for the entries evaluated after this one, which decide the remaining actions.
+	Deny bool `yaml:"deny,omitempty" json:"deny,omitempty"`
+	// AllowWildcardName opts the entry into matching requests for wildcard names, e.g. repository:*:*,
+	// when authz.deny_wildcard_resource is enabled. Other entries don't match them.
+	AllowWildcardName bool `yaml:"allow_wildcard_name,omitempty" json:"allow_wildcard_name,omitempty"`
+	// Sample restricts the entry to this percentage (0-100) of accounts, for gradual rollout of a rule.
+	// Whether an account is in the sample is decided by its hash, see sampleBucket.
+	Sample *float64 `yaml:"sample,omitempty" json:"sample,omitempty"`
 }
 
 type MatchConditions struct {
 	Account *string           `yaml:"account,omitempty" json:"account,omitempty"`
 	Type    *string           `yaml:"type,omitempty" json:"type,omitempty"`
 	Name    *string           `yaml:"name,omitempty" json:"name,omitempty"`
-	IP      *string           `yaml:"ip,omitempty" json:"ip,omitempty"`
+	IP      IPPatterns        `yaml:"ip,omitempty" json:"ip,omitempty"`
 	Service *string           `yaml:"service,omitempty" json:"service,omitempty"`
 	Labels  map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// Class of the resource, e.g. plugin for repository(plugin) scopes, matched exactly.
+	// Empty matches scopes without a class, unset matches any class. See KnownResourceClasses.
+	Class *string `yaml:"class,omitempty" json:"class,omitempty"`
+	// Time restricts the entry to a time window, see TimeWindow.
+	Time *TimeWindow `yaml:"time,omitempty" json:"time,omitempty"`
+	// Patterns that values of named capture groups of the name regex must match, by group name.
+	// They can use variables, e.g. {user: "${account}"} for name "/^(?P<user>[^/]+)/.+$/".
+	Captures map[string]string `yaml:"captures,omitempty" json:"captures,omitempty"`
+}
+
+// IPPatterns is a list of IP addresses or CIDR ranges. In the config it can be
+// specified either as a single string or as a list of strings.
+type IPPatterns []string
+
+func (ipp *IPPatterns) unmarshal(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*ipp = IPPatterns{s}
+		return nil
+	}
+	var l []string
+	if err := unmarshal(&l); err != nil {
+		return fmt.Errorf("ip must be a string or a list of strings")
+	}
+	*ipp = IPPatterns(l)
+	return nil
+}
+
+func (ipp *IPPatterns) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return ipp.unmarshal(unmarshal)
+}
+
+func (ipp *IPPatterns) UnmarshalJSON(data []byte) error {
+	return ipp.unmarshal(func(v interface{}) error { return json.Unmarshal(data, v) })
+}
+
+func (ipp *IPPatterns) SetBSON(raw bson.Raw) error {
+	return ipp.unmarshal(raw.Unmarshal)
 }
 
 type aclAuthorizer struct {
 	acl ACL
+	// Indices of the entries in evaluation order, see evaluationOrder.
+	order []int
+	union bool
+}
+
+// Patterns are regular expressions if surrounded by slashes, shell wildcard patterns otherwise.
+// Regular expressions are not anchored, e.g. /svc-/ matches any string containing svc-.
+func isRegexPattern(p string) bool {
+	return len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/'
+}
+
+// Regular expressions of ACL patterns, compiled when the ACL is validated. Patterns that contain
+// variables are compiled on every match, after substitution.
+var regexCache = struct {
+	sync.RWMutex
+	m map[string]*regexp.Regexp
+}{m: map[string]*regexp.Regexp{}}
+
+// Upper bound of the cache size, in case ACLs are reloaded from a database many times.
+const maxRegexCacheSize = 10000
+
+func compileRegex(expr string, cache bool) (*regexp.Regexp, error) {
+	regexCache.RLock()
+	re, found := regexCache.m[expr]
+	regexCache.RUnlock()
+	if found {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil || !cache {
+		return re, err
+	}
+	regexCache.Lock()
+	if len(regexCache.m) >= maxRegexCacheSize {
+		regexCache.m = map[string]*regexp.Regexp{}
+	}
+	regexCache.m[expr] = re
+	regexCache.Unlock()
+	return re, nil
 }
 
 func validatePattern(p string) error {
-	if len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/' {
-		_, err := regexp.Compile(p[1 : len(p)-1])
+	if isRegexPattern(p) {
+		_, err := compileRegex(p[1:len(p)-1], true)
 		if err != nil {
 			return fmt.Errorf("invalid regex pattern: %s", err)
 		}
+	} else if _, err := matchWildcard(p, ""); err != nil {
+		return fmt.Errorf("invalid wildcard pattern: %s", err)
 	}
 	return nil
 }
 
+var errDoubleStarSegment = fmt.Errorf("** must be a whole path segment, e.g. team/** or team/**/image")
+
+// matchWildcard matches s against a wildcard pattern. The syntax is that of path.Match:
+// * and ? do not match /, so * only matches within a path segment. In addition, ** matches
+// across segments: a/**/b and **/b match zero or more segments in between or before,
+// a trailing a/** matches one or more segments, i.e. everything under a but not a itself.
+func matchWildcard(p, s string) (bool, error) {
+	if !strings.Contains(p, "**") {
+		return path.Match(p, s)
+	}
+	ps := strings.Split(p, "/")
+	for _, seg := range ps {
+		if seg != "**" && strings.Contains(seg, "**") {
+			return false, errDoubleStarSegment
+		}
+	}
+	return matchSegments(ps, strings.Split(s, "/"))
+}
+
+func matchSegments(ps, ss []string) (bool, error) {
+	for ; len(ps) > 0; ps, ss = ps[1:], ss[1:] {
+		if ps[0] == "**" {
+			if len(ps) == 1 {
+				return len(ss) > 0, nil
+			}
+			for i := 0; i <= len(ss); i++ {
+				if matched, err := matchSegments(ps[1:], ss[i:]); matched || err != nil {
+					return matched, err
+				}
+			}
+			return false, nil
+		}
+		if len(ss) == 0 {
+			return false, nil
+		}
+		if matched, err := path.Match(ps[0], ss[0]); !matched || err != nil {
+			return false, err
+		}
+	}
+	return len(ss) == 0, nil
+}
+
 func parseIPPattern(ipp string) (*net.IPNet, error) {
 	ipnet := net.IPNet{}
 	ipnet.IP = net.ParseIP(ipp)
@@ -66,26 +207,72 @@ func parseIPPattern(ipp string) (*net.IPNet, error) {
 	}
 }
 
+// KnownResourceClasses are the resource classes that clients request, as in repository(plugin).
+var KnownResourceClasses = []string{"plugin"}
+
+func validateClass(class string) error {
+	if class == "" {
+		return nil
+	}
+	for _, c := range KnownResourceClasses {
+		if class == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown resource class %q, must be empty or one of %s", class, strings.Join(KnownResourceClasses, ", "))
+}
+
 func validateMatchConditions(mc *MatchConditions) error {
-	for _, p := range []*string{mc.Account, mc.Type, mc.Name, mc.Service} {
-		if p == nil {
+	patterns := []struct {
+		key string
+		p   *string
+	}{{"account", mc.Account}, {"type", mc.Type}, {"name", mc.Name}, {"service", mc.Service}}
+	for _, kp := range patterns {
+		if kp.p == nil {
 			continue
 		}
-		err := validatePattern(*p)
+		err := validatePattern(*kp.p)
 		if err != nil {
-			return fmt.Errorf("invalid pattern %q: %s", *p, err)
+			return api.NewConfigError(fmt.Errorf("invalid pattern %q: %s", *kp.p, err), kp.key)
+		}
+	}
+	if mc.Class != nil {
+		if err := validateClass(*mc.Class); err != nil {
+			return api.NewConfigError(err, "class")
 		}
 	}
-	if mc.IP != nil {
-		_, err := parseIPPattern(*mc.IP)
+	if mc.IP != nil && len(mc.IP) == 0 {
+		return api.NewConfigError(fmt.Errorf("empty list of IP patterns"), "ip")
+	}
+	for i, ipp := range mc.IP {
+		_, err := parseIPPattern(ipp)
 		if err != nil {
-			return fmt.Errorf("invalid IP pattern: %s", err)
+			return api.NewConfigError(fmt.Errorf("invalid IP pattern: %s", err), "ip", i)
 		}
 	}
 	for k, v := range mc.Labels {
 		err := validatePattern(v)
 		if err != nil {
-			return fmt.Errorf("invalid match pattern %q for label %s: %s", v, k, err)
+			return api.NewConfigError(fmt.Errorf("invalid match pattern %q for label %s: %s", v, k, err), "labels", k)
+		}
+	}
+	if mc.Time != nil {
+		if err := mc.Time.validate(); err != nil {
+			return api.NewConfigError(fmt.Errorf("invalid time window: %s", err), "time")
+		}
+	}
+	if len(mc.Captures) > 0 {
+		if mc.Name == nil || !isRegexPattern(*mc.Name) {
+			return api.NewConfigError(fmt.Errorf("captures require name to be a regex"), "captures")
+		}
+		re, _ := compileRegex((*mc.Name)[1:len(*mc.Name)-1], true) // Validated above.
+		for group, p := range mc.Captures {
+			if re.SubexpIndex(group) < 0 {
+				return api.NewConfigError(fmt.Errorf("name regex has no capture group named %q", group), "captures", group)
+			}
+			if err := validatePattern(p); err != nil {
+				return api.NewConfigError(fmt.Errorf("invalid pattern %q for capture group %s: %s", p, group, err), "captures", group)
+			}
 		}
 	}
 	return nil
@@ -95,39 +282,331 @@ func ValidateACL(acl ACL) error {
 	for i, e := range acl {
 		err := validateMatchConditions(e.Match)
 		if err != nil {
-			return fmt.Errorf("entry %d, invalid match conditions: %s", i, err)
+			return api.WrapConfigError(err, fmt.Sprintf("entry %d, invalid match conditions", i), i, "match")
+		}
+		if e.Expiration < 0 {
+			return api.NewConfigError(fmt.Errorf("entry %d, expiration must not be negative, got %d", i, e.Expiration), i, "expiration")
+		}
+		if err := api.ValidateClaimNames(e.Claims); err != nil {
+			return api.WrapConfigError(err, fmt.Sprintf("entry %d, invalid claims", i), i, "claims")
+		}
+		if e.Sample != nil && (*e.Sample < 0 || *e.Sample > 100) {
+			return api.NewConfigError(fmt.Errorf("entry %d, sample must be between 0 and 100, got %g", i, *e.Sample), i, "sample")
+		}
+		if e.Deny {
+			if e.Actions == nil || len(*e.Actions) == 0 {
+				return api.NewConfigError(fmt.Errorf("entry %d, deny entries must list the actions they deny", i), i, "actions")
+			}
+			if e.Expiration != 0 || len(e.Claims) > 0 {
+				return api.NewConfigError(fmt.Errorf("entry %d, deny entries cannot set expiration or claims", i), i, "deny")
+			}
 		}
 	}
+	for _, c := range conflictingEntries(acl) {
+		glog.Warningf("ACL entries %d and %d have the same match conditions but allow different actions, entry %d is evaluated first", c[0], c[1], c[0])
+	}
+	return nil
+}
+
+// evaluationOrder returns the indices of the entries in the order they are evaluated:
+// by descending priority, entries with the same priority in ACL order.
+func evaluationOrder(acl ACL) []int {
+	order := make([]int, len(acl))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return acl[order[a]].Priority > acl[order[b]].Priority })
+	return order
+}
+
+// conflictingEntries returns pairs of entries that have identical match conditions, but allow different
+// actions, in evaluation order. Except in union mode, the second entry of a pair never decides a request.
+// Deny and sampled entries are not considered, they are meant to overlap with the entries they make
+// exceptions to or are rolled out to replace.
+func conflictingEntries(acl ACL) [][2]int {
+	var conflicts [][2]int
+	order := evaluationOrder(acl)
+	for a, i := range order {
+		for _, j := range order[a+1:] {
+			if acl[i].Deny || acl[j].Deny || acl[i].Sample != nil || acl[j].Sample != nil || acl[i].Actions == nil || acl[j].Actions == nil || !reflect.DeepEqual(acl[i].Match, acl[j].Match) {
+				continue
+			}
+			if !makeSet(*acl[i].Actions).Equal(makeSet(*acl[j].Actions)) {
+				conflicts = append(conflicts, [2]int{i, j})
+			}
+		}
+	}
+	return conflicts
+}
+
+// How entries of an ACL are combined to decide a request.
+const (
+	// The first entry that matches the request decides it, later entries are not considered.
+	ACLModeFirstMatch = "first_match"
+	// All the entries that match the request are considered and the union of the actions
+	// they allow is granted, so e.g. one entry can allow pull and another one push.
+	ACLModeUnion = "union"
+)
+
+// ValidateACLMode checks the ACL mode at configKey, setting the default (first_match) if it is empty.
+func ValidateACLMode(configKey string, mode *string) error {
+	switch *mode {
+	case "":
+		*mode = ACLModeFirstMatch
+	case ACLModeFirstMatch, ACLModeUnion:
+	default:
+		return fmt.Errorf("%s must be %s or %s, got %q", configKey, ACLModeFirstMatch, ACLModeUnion, *mode)
+	}
 	return nil
 }
 
 // NewACLAuthorizer Creates a new static authorizer with ACL that have been read from the config file
 func NewACLAuthorizer(acl ACL) (api.Authorizer, error) {
+	return NewACLAuthorizerWithMode(acl, ACLModeFirstMatch)
+}
+
+// NewACLAuthorizerWithMode is like NewACLAuthorizer, with entries combined according to mode.
+func NewACLAuthorizerWithMode(acl ACL, mode string) (api.Authorizer, error) {
 	if err := ValidateACL(acl); err != nil {
 		return nil, err
 	}
-	glog.V(1).Infof("Created ACL Authorizer with %d entries", len(acl))
-	return &aclAuthorizer{acl: acl}, nil
+	glog.V(1).Infof("Created ACL Authorizer with %d entries (%s)", len(acl), mode)
+	return &aclAuthorizer{acl: acl, order: evaluationOrder(acl), union: mode == ACLModeUnion}, nil
 }
 
 func (aa *aclAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
-	for _, e := range aa.acl {
-		matched := e.Matches(ai)
-		if matched {
-			glog.V(2).Infof("%s matched %s (Comment: %s)", ai, e, e.Comment)
-			if len(*e.Actions) == 1 && (*e.Actions)[0] == "*" {
-				return ai.Actions, nil
+	d, err := aa.AuthorizeDetailed(ai)
+	if err != nil {
+		return nil, err
+	}
+	return d.Actions, nil
+}
+
+func (aa *aclAuthorizer) AuthorizeDetailed(ai *api.AuthRequestInfo) (*api.AuthzDecision, error) {
+	return evaluateACL(aa.acl, aa.order, ai, aa.union)
+}
+
+// evaluateACL decides the request with the entries with the given indices (all, if nil),
+// in order, see ACLModeFirstMatch and ACLModeUnion. A matching deny entry removes the actions
+// it denies from the request for the entries after it, see ACLEntry.Deny.
+func evaluateACL(acl ACL, indices []int, ai *api.AuthRequestInfo, union bool) (*api.AuthzDecision, error) {
+	var matched []int
+	var decisions []*api.AuthzDecision
+	var denials, rules []string
+	requested := ai
+	n := len(indices)
+	if indices == nil {
+		n = len(acl)
+	}
+	for k := 0; k < n; k++ {
+		i := k
+		if indices != nil {
+			i = indices[k]
+		}
+		if !acl[i].Matches(ai) {
+			continue
+		}
+		if acl[i].Deny {
+			denied := acl[i].deniedActions(ai)
+			if len(denied) == 0 {
+				continue
 			}
-			return StringSetIntersection(ai.Actions, *e.Actions), nil
+			glog.V(2).Infof("%s matched deny entry %s", ai, acl[i])
+			denials = append(denials, fmt.Sprintf("%s denies %s", acl[i].describe(i), strings.Join(denied, ",")))
+			rules = append(rules, acl[i].describe(i))
+			remaining := *ai
+			remaining.Actions = nil
+			deniedSet := makeSet(denied)
+			for _, a := range ai.Actions {
+				if !deniedSet.Contains(a) {
+					remaining.Actions = append(remaining.Actions, a)
+				}
+			}
+			ai = &remaining
+			if len(ai.Actions) == 0 {
+				break
+			}
+			continue
+		}
+		d := acl[i].decision(i, ai)
+		rules = append(rules, acl[i].describe(i))
+		if !union {
+			d.Rules = rules
+			return withDenials(d, denials, requested), nil
+		}
+		matched = append(matched, i)
+		decisions = append(decisions, d)
+	}
+	var d *api.AuthzDecision
+	switch len(matched) {
+	case 0:
+		if len(denials) == 0 {
+			return nil, api.NoMatch
+		}
+		d = &api.AuthzDecision{Actions: []string{}}
+	case 1:
+		d = decisions[0]
+	default:
+		d = unionDecision(acl, matched, decisions, requested)
+	}
+	d.Rules = rules
+	return withDenials(d, denials, requested), nil
+}
+
+// withDenials adds the reasons why actions were denied by deny entries to the decision,
+// unless it allows all the requested actions anyway.
+func withDenials(d *api.AuthzDecision, denials []string, requested *api.AuthRequestInfo) *api.AuthzDecision {
+	if len(denials) == 0 || len(d.Actions) == len(requested.Actions) {
+		return d
+	}
+	if d.Reason != "" {
+		denials = append(denials, d.Reason)
+	}
+	d.Reason = strings.Join(denials, "; ")
+	return d
+}
+
+// unionDecision combines the decisions of the matched entries: the result allows the actions that any
+// of them allow, with the shortest expiration and the claims of the entries that allow any actions.
+// Claims of earlier entries take precedence.
+func unionDecision(acl ACL, matched []int, decisions []*api.AuthzDecision, ai *api.AuthRequestInfo) *api.AuthzDecision {
+	result := &api.AuthzDecision{}
+	allowed := map[string]bool{}
+	var entries []string
+	for k, i := range matched {
+		d := decisions[k]
+		entries = append(entries, acl[i].describe(i))
+		if len(d.Actions) == 0 {
+			continue
+		}
+		for _, a := range d.Actions {
+			allowed[a] = true
+		}
+		if d.Expiration > 0 && (result.Expiration == 0 || d.Expiration < result.Expiration) {
+			result.Expiration = d.Expiration
+		}
+		for k, v := range d.Claims {
+			if result.Claims == nil {
+				result.Claims = map[string]interface{}{}
+			}
+			if _, found := result.Claims[k]; !found {
+				result.Claims[k] = v
+			}
+		}
+	}
+	for _, a := range ai.Actions {
+		if allowed[a] {
+			result.Actions = append(result.Actions, a)
+		}
+	}
+	switch {
+	case len(result.Actions) == 0:
+		result.Reason = fmt.Sprintf("%s allow none of the requested actions", strings.Join(entries, ", "))
+	case len(result.Actions) < len(ai.Actions):
+		result.Reason = fmt.Sprintf("%s allow only %s", strings.Join(entries, ", "), strings.Join(result.Actions, ","))
+	}
+	return result
+}
+
+func (aa *aclAuthorizer) ExplainNoMatch(ai *api.AuthRequestInfo) string {
+	return explainNoMatch(aa.acl, aa.order, ai)
+}
+
+// deniedActions returns the requested actions that the deny entry denies.
+func (e *ACLEntry) deniedActions(ai *api.AuthRequestInfo) []string {
+	if len(*e.Actions) == 1 && (*e.Actions)[0] == "*" {
+		return ai.Actions
+	}
+	return StringSetIntersection(ai.Actions, expandActions(*e.Actions, ai.Labels))
+}
+
+// decision returns the decision of the i-th entry for the request it matched.
+func (e *ACLEntry) decision(i int, ai *api.AuthRequestInfo) *api.AuthzDecision {
+	if e.Comment != nil {
+		glog.V(2).Infof("%s matched %s (Comment: %s)", ai, e, *e.Comment)
+	} else {
+		glog.V(2).Infof("%s matched %s", ai, e)
+	}
+	d := &api.AuthzDecision{Expiration: e.Expiration}
+	if len(*e.Actions) == 1 && (*e.Actions)[0] == "*" {
+		d.Actions = ai.Actions
+	} else {
+		d.Actions = StringSetIntersection(ai.Actions, expandActions(*e.Actions, ai.Labels))
+	}
+	if len(d.Actions) > 0 && len(e.Claims) > 0 {
+		d.Claims = ExpandClaims(e.Claims, ai)
+	}
+	switch {
+	case len(d.Actions) == 0:
+		d.Reason = fmt.Sprintf("%s allows none of the requested actions", e.describe(i))
+	case len(d.Actions) < len(ai.Actions):
+		d.Reason = fmt.Sprintf("%s allows only %s", e.describe(i), strings.Join(d.Actions, ","))
+	}
+	return d
+}
+
+var labelVarRegex = regexp.MustCompile(`\$\{labels:(.+?)\}`)
+
+// expandActions substitutes ${labels:<LABEL>} references in actions. An action that references
+// a label with multiple values expands to one action per value, one that references a label
+// the user does not have expands to none.
+func expandActions(actions []string, labels api.Labels) []string {
+	var result []string
+	for _, a := range actions {
+		expanded := []string{a}
+		for _, m := range labelVarRegex.FindAllStringSubmatch(a, -1) {
+			var next []string
+			for _, e := range expanded {
+				for _, v := range labels[m[1]] {
+					next = append(next, strings.Replace(e, m[0], v, -1))
+				}
+			}
+			expanded = next
+		}
+		result = append(result, expanded...)
+	}
+	return result
+}
+
+// describe identifies the i-th entry in explanations.
+func (e *ACLEntry) describe(i int) string {
+	if e.Comment != nil && *e.Comment != "" {
+		return fmt.Sprintf("ACL entry %d (%s)", i, *e.Comment)
+	}
+	return fmt.Sprintf("ACL entry %d", i)
+}
+
+// explainNoMatch finds the entry that came closest to matching the request, i.e. the one with
+// the least conditions not met, out of the entries with the given indices (all, if nil).
+func explainNoMatch(acl ACL, indices []int, ai *api.AuthRequestInfo) string {
+	if indices == nil {
+		for i := range acl {
+			indices = append(indices, i)
+		}
+	}
+	closest, closestFailed := -1, []string(nil)
+	for _, i := range indices {
+		failed := acl[i].Match.failedConditions(ai, true)
+		if ai.StrictWildcardName && !acl[i].AllowWildcardName {
+			failed = append(failed, "allow_wildcard_name")
 		}
+		if closest < 0 || len(failed) < len(closestFailed) {
+			closest, closestFailed = i, failed
+		}
+	}
+	if closest < 0 {
+		return "no ACL entries apply"
 	}
-	return nil, api.NoMatch
+	return fmt.Sprintf("no ACL entry matched, closest was %s, which did not match on %s",
+		acl[closest].describe(closest), strings.Join(closestFailed, ", "))
 }
 
 func (aa *aclAuthorizer) Stop() {
 	// Nothing to do.
 }
 
+func (aa *aclAuthorizer) HonorsStrictWildcardName() {}
+
 func (aa *aclAuthorizer) Name() string {
 	return "static ACL"
 }
@@ -144,14 +623,16 @@ func matchString(pp *string, s string, vars []string) bool {
 		return true
 	}
 	p := strings.NewReplacer(vars...).Replace(*pp)
+	if labelVarRegex.MatchString(p) {
+		// The user does not have the label, see matchStringWithLabelPermutations.
+		return false
+	}
 
-	var matched bool
-	var err error
-	if len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/' {
-		matched, err = regexp.Match(p[1:len(p)-1], []byte(s))
-	} else {
-		matched, err = path.Match(p, s)
+	if isRegexPattern(p) {
+		re, err := compileRegex(p[1:len(p)-1], false)
+		return err == nil && re.MatchString(s)
 	}
+	matched, err := matchWildcard(p, s)
 	return err == nil && matched
 }
 
@@ -191,18 +672,23 @@ func matchStringWithLabelPermutations(pp *string, s string, vars []string, label
 	return matched
 }
 
-func matchIP(ipp *string, ip net.IP) bool {
-	if ipp == nil {
+func matchIP(ipps IPPatterns, ip net.IP) bool {
+	if ipps == nil {
 		return true
 	}
 	if ip == nil {
 		return false
 	}
-	ipnet, err := parseIPPattern(*ipp)
-	if err != nil { // Can't happen, it supposed to have been validated
-		glog.Fatalf("Invalid IP pattern: %s", *ipp)
+	for _, ipp := range ipps {
+		ipnet, err := parseIPPattern(ipp)
+		if err != nil { // Can't happen, it supposed to have been validated
+			glog.Fatalf("Invalid IP pattern: %s", ipp)
+		}
+		if ipnet.Contains(ip) {
+			return true
+		}
 	}
-	return ipnet.Contains(ip)
+	return false
 }
 
 func matchLabels(ml map[string]string, rl api.Labels, vars []string) bool {
@@ -222,7 +708,9 @@ func matchLabels(ml map[string]string, rl api.Labels, vars []string) bool {
 	return true
 }
 
-var captureGroupRegex = regexp.MustCompile(`\$\{(.+?):(\d+)\}`)
+// References to capture groups of the account, type, name and service regexes, by number or name,
+// e.g. ${name:1} or ${name:user}.
+var captureGroupRegex = regexp.MustCompile(`\$\{(account|type|name|service):(\w+)\}`)
 
 func getField(i interface{}, name string) (string, bool) {
 	s := reflect.Indirect(reflect.ValueOf(i))
@@ -234,6 +722,12 @@ func getField(i interface{}, name string) (string, bool) {
 }
 
 func (mc *MatchConditions) Matches(ai *api.AuthRequestInfo) bool {
+	return len(mc.failedConditions(ai, false)) == 0
+}
+
+// failedConditions returns names of the conditions that the request does not meet.
+// Unless all is set, evaluation stops at the first one.
+func (mc *MatchConditions) failedConditions(ai *api.AuthRequestInfo, all bool) []string {
 	vars := []string{
 		"${account}", regexp.QuoteMeta(ai.Account),
 		"${type}", regexp.QuoteMeta(ai.Type),
@@ -244,16 +738,15 @@ func (mc *MatchConditions) Matches(ai *api.AuthRequestInfo) bool {
 		field, _ := getField(mc, x)
 		for _, found := range captureGroupRegex.FindAllStringSubmatch(field, -1) {
 			key := strings.Title(found[1])
-			index, _ := strconv.Atoi(found[2])
 			field, has := getField(mc, key)
 			if !has {
 				glog.Errorf("No field in '%s' in MatchConditions", key)
 				continue
 			}
-			if len(field) < 2 || field[0] != '/' || field[len(field)-1] != '/' {
+			if !isRegexPattern(field) {
 				continue
 			}
-			regex, err := regexp.Compile(field[1 : len(field)-1])
+			regex, err := compileRegex(field[1:len(field)-1], false)
 			if err != nil {
 				glog.Errorf("Invalid regex in '%s' of MatchConditions", key)
 				continue
@@ -264,6 +757,10 @@ func (mc *MatchConditions) Matches(ai *api.AuthRequestInfo) bool {
 				continue
 			}
 			text := regex.FindStringSubmatch(info)
+			index, err := strconv.Atoi(found[2])
+			if err != nil {
+				index = regex.SubexpIndex(found[2])
+			}
 			if index < 1 || index > len(text)-1 {
 				glog.Errorf("%s: Capture group index out of range", key)
 				continue
@@ -275,18 +772,83 @@ func (mc *MatchConditions) Matches(ai *api.AuthRequestInfo) bool {
 	for label, labelValues := range ai.Labels {
 		var labelSet []string
 		for _, lv := range labelValues {
-			labelSet = append(labelSet, lv)
+			// Values are matched literally, like other variables.
+			labelSet = append(labelSet, regexp.QuoteMeta(lv))
 		}
 		labelMap[fmt.Sprintf("${labels:%s}", label)] = labelSet
 	}
-	return matchStringWithLabelPermutations(mc.Account, ai.Account, vars, &labelMap) &&
-		matchStringWithLabelPermutations(mc.Type, ai.Type, vars, &labelMap) &&
-		matchStringWithLabelPermutations(mc.Name, ai.Name, vars, &labelMap) &&
-		matchStringWithLabelPermutations(mc.Service, ai.Service, vars, &labelMap) &&
-		matchIP(mc.IP, ai.IP) &&
-		matchLabels(mc.Labels, ai.Labels, vars)
+	conditions := []struct {
+		name    string
+		matches func() bool
+	}{
+		{"account", func() bool { return matchStringWithLabelPermutations(mc.Account, ai.Account, vars, &labelMap) }},
+		{"type", func() bool { return matchStringWithLabelPermutations(mc.Type, ai.Type, vars, &labelMap) }},
+		{"class", func() bool { return mc.Class == nil || *mc.Class == ai.Class }},
+		{"name", func() bool { return matchStringWithLabelPermutations(mc.Name, ai.Name, vars, &labelMap) }},
+		{"service", func() bool { return matchStringWithLabelPermutations(mc.Service, ai.Service, vars, &labelMap) }},
+		{"ip", func() bool { return matchIP(mc.IP, ai.IP) }},
+		{"labels", func() bool { return matchLabels(mc.Labels, ai.Labels, vars) }},
+		{"time", func() bool { return matchTime(mc.Time, ai) }},
+		{"captures", func() bool { return mc.matchCaptures(ai, vars, &labelMap) }},
+	}
+	var failed []string
+	for _, c := range conditions {
+		if !c.matches() {
+			if !all {
+				return []string{c.name}
+			}
+			failed = append(failed, c.name)
+		}
+	}
+	return failed
+}
+
+// matchCaptures checks the values of the named groups captured by the name regex against their patterns.
+func (mc *MatchConditions) matchCaptures(ai *api.AuthRequestInfo, vars []string, labelMap *map[string][]string) bool {
+	if len(mc.Captures) == 0 {
+		return true
+	}
+	if mc.Name == nil {
+		return false
+	}
+	p := strings.NewReplacer(vars...).Replace(*mc.Name)
+	if !isRegexPattern(p) {
+		return false
+	}
+	re, err := compileRegex(p[1:len(p)-1], false)
+	if err != nil {
+		return false
+	}
+	text := re.FindStringSubmatch(ai.Name)
+	if text == nil {
+		return false
+	}
+	for group, pattern := range mc.Captures {
+		pattern := pattern
+		i := re.SubexpIndex(group)
+		if i < 0 || !matchStringWithLabelPermutations(&pattern, text[i], vars, labelMap) {
+			return false
+		}
+	}
+	return true
 }
 
 func (e *ACLEntry) Matches(ai *api.AuthRequestInfo) bool {
+	if ai.StrictWildcardName && !e.AllowWildcardName {
+		return false
+	}
+	if e.Sample != nil && float64(sampleBucket(ai.Account)) >= *e.Sample*100 {
+		return false
+	}
 	return e.Match.Matches(ai)
 }
+
+// sampleBucket returns the bucket (0-9999) of the account for ACLEntry.Sample: FNV-1a hash of the
+// account name, modulo 10000. An account is in the sample if its bucket is below sample * 100.
+// The bucket does not depend on the entry, so raising the percentage only adds accounts,
+// and accounts in the sample of an entry are also in the samples of entries with higher ones.
+func sampleBucket(account string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(account))
+	return h.Sum32() % 10000
+}
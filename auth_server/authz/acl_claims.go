@@ -0,0 +1,39 @@
+package authz
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+var claimVarRegex = regexp.MustCompile(`\$\{(account|type|name|service|labels:([^}]+))\}`)
+
+// ExpandClaims substitutes ${account}, ${type}, ${name}, ${service} and ${labels:<label>}
+// in the claim values. If the value consists of a single label reference, the claim is a list
+// of the label's values. Otherwise multiple label values are joined with commas.
+func ExpandClaims(claims map[string]string, ai *api.AuthRequestInfo) map[string]interface{} {
+	result := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		if m := claimVarRegex.FindStringSubmatch(value); m != nil && m[0] == value && m[2] != "" {
+			result[name] = append([]string{}, ai.Labels[m[2]]...)
+			continue
+		}
+		// Single pass, so that substituted values are not expanded again.
+		result[name] = claimVarRegex.ReplaceAllStringFunc(value, func(v string) string {
+			m := claimVarRegex.FindStringSubmatch(v)
+			switch m[1] {
+			case "account":
+				return ai.Account
+			case "type":
+				return ai.Type
+			case "name":
+				return ai.Name
+			case "service":
+				return ai.Service
+			}
+			return strings.Join(ai.Labels[m[2]], ",")
+		})
+	}
+	return result
+}
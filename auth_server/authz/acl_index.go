@@ -0,0 +1,100 @@
+package authz
+
+import (
+	"strings"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// indexedACLAuthorizer evaluates the same way as the static ACL authorizer, but entries
+// that match a literal account name are indexed by it, so only the entries that can possibly
+// match the account are evaluated. The rest (patterns, regexps, variables and no account at all)
+// are evaluated for every request, in their evaluation order relative to the indexed ones.
+type indexedACLAuthorizer struct {
+	acl ACL
+	// Indices of entries matching a literal account, by account, and of all other entries.
+	// Both are in evaluation order, see evaluationOrder.
+	byAccount map[string][]int
+	other     []int
+	// Position of each entry in evaluation order.
+	rank  []int
+	union bool
+}
+
+// isLiteral returns true if the pattern only matches the string itself.
+func isLiteral(p string) bool {
+	if isRegexPattern(p) {
+		return false
+	}
+	return !strings.ContainsAny(p, `*?[\$`)
+}
+
+// NewIndexedACLAuthorizer creates a static authorizer that is faster than the one created by
+// NewACLAuthorizer for large ACLs with many entries for specific accounts.
+func NewIndexedACLAuthorizer(acl ACL) (api.Authorizer, error) {
+	return NewIndexedACLAuthorizerWithMode(acl, ACLModeFirstMatch)
+}
+
+// NewIndexedACLAuthorizerWithMode is like NewIndexedACLAuthorizer, with entries combined according to mode.
+func NewIndexedACLAuthorizerWithMode(acl ACL, mode string) (api.Authorizer, error) {
+	if err := ValidateACL(acl); err != nil {
+		return nil, err
+	}
+	ia := &indexedACLAuthorizer{acl: acl, byAccount: map[string][]int{}, rank: make([]int, len(acl)), union: mode == ACLModeUnion}
+	for r, i := range evaluationOrder(acl) {
+		ia.rank[i] = r
+		e := acl[i]
+		if e.Match.Account != nil && isLiteral(*e.Match.Account) {
+			ia.byAccount[*e.Match.Account] = append(ia.byAccount[*e.Match.Account], i)
+		} else {
+			ia.other = append(ia.other, i)
+		}
+	}
+	glog.V(1).Infof("Created indexed ACL Authorizer with %d entries (%d accounts, %d unindexed entries)",
+		len(acl), len(ia.byAccount), len(ia.other))
+	return ia, nil
+}
+
+func (ia *indexedACLAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	d, err := ia.AuthorizeDetailed(ai)
+	if err != nil {
+		return nil, err
+	}
+	return d.Actions, nil
+}
+
+func (ia *indexedACLAuthorizer) AuthorizeDetailed(ai *api.AuthRequestInfo) (*api.AuthzDecision, error) {
+	return evaluateACL(ia.acl, ia.candidates(ai.Account), ai, ia.union)
+}
+
+// ExplainNoMatch only considers the entries that could match the account.
+func (ia *indexedACLAuthorizer) ExplainNoMatch(ai *api.AuthRequestInfo) string {
+	return explainNoMatch(ia.acl, ia.candidates(ai.Account), ai)
+}
+
+// candidates returns indices of the entries that can match the account, in evaluation order.
+func (ia *indexedACLAuthorizer) candidates(account string) []int {
+	// Both lists are in evaluation order, merge them.
+	indexed, other := ia.byAccount[account], ia.other
+	result := make([]int, 0, len(indexed)+len(other))
+	for len(indexed) > 0 || len(other) > 0 {
+		if len(other) == 0 || (len(indexed) > 0 && ia.rank[indexed[0]] < ia.rank[other[0]]) {
+			result, indexed = append(result, indexed[0]), indexed[1:]
+		} else {
+			result, other = append(result, other[0]), other[1:]
+		}
+	}
+	return result
+}
+
+func (ia *indexedACLAuthorizer) Stop() {
+	// Nothing to do.
+}
+
+func (ia *indexedACLAuthorizer) HonorsStrictWildcardName() {}
+
+func (ia *indexedACLAuthorizer) Name() string {
+	return "static ACL"
+}
@@ -3,8 +3,8 @@ package authz
 import (
 	"errors"
 	"fmt"
-	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cesanta/glog"
@@ -26,8 +26,22 @@ type ACLMongoConfig struct {
 	MongoConfig *mgo_session.Config `yaml:"dial_info,omitempty"`
 	Collection  string              `yaml:"collection,omitempty"`
 	CacheTTL    time.Duration       `yaml:"cache_ttl,omitempty"`
+	// How the ACL is loaded and evaluated: full (default) or indexed.
+	// In the indexed mode, entries are streamed from the collection without comments
+	// and indexed by account, see NewIndexedACLAuthorizer.
+	QueryMode string `yaml:"query_mode,omitempty"`
+	// Apply changes to the collection as they happen, using a change stream, instead of
+	// reloading it every cache_ttl. Requires a replica set, otherwise reloads continue.
+	Watch bool `yaml:"watch,omitempty"`
+	// How entries are combined: first_match (default) or union, see ACLModeUnion.
+	ACLMode string `yaml:"acl_mode,omitempty"`
 }
 
+const (
+	ACLMongoQueryModeFull    = "full"
+	ACLMongoQueryModeIndexed = "indexed"
+)
+
 type aclMongoAuthorizer struct {
 	lastCacheUpdate  time.Time
 	lock             sync.RWMutex
@@ -37,6 +51,11 @@ type aclMongoAuthorizer struct {
 	updateTicker     *time.Ticker
 	Collection       string        `yaml:"collection,omitempty"`
 	CacheTTL         time.Duration `yaml:"cache_ttl,omitempty"`
+	// Closed by Stop, and by the watcher when it exits.
+	stop      chan struct{}
+	watchDone chan struct{}
+	// Set while the change stream is working, periodic reloads are skipped then.
+	watching int32
 }
 
 // NewACLMongoAuthorizer creates a new ACL MongoDB authorizer
@@ -51,6 +70,7 @@ func NewACLMongoAuthorizer(c *ACLMongoConfig) (api.Authorizer, error) {
 		config:       c,
 		session:      session,
 		updateTicker: time.NewTicker(c.CacheTTL),
+		stop:         make(chan struct{}),
 	}
 
 	// Initially fetch the ACL from MongoDB
@@ -59,6 +79,13 @@ func NewACLMongoAuthorizer(c *ACLMongoConfig) (api.Authorizer, error) {
 	}
 
 	go authorizer.continuouslyUpdateACLCache()
+	if c.Watch {
+		authorizer.watchDone = make(chan struct{})
+		go func() {
+			defer close(authorizer.watchDone)
+			authorizer.watch()
+		}()
+	}
 
 	return authorizer, nil
 }
@@ -75,6 +102,27 @@ func (ma *aclMongoAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, erro
 	return ma.staticAuthorizer.Authorize(ai)
 }
 
+func (ma *aclMongoAuthorizer) AuthorizeDetailed(ai *api.AuthRequestInfo) (*api.AuthzDecision, error) {
+	ma.lock.RLock()
+	defer ma.lock.RUnlock()
+
+	// Test if authorizer has been initialized
+	if ma.staticAuthorizer == nil {
+		return nil, fmt.Errorf("MongoDB authorizer is not ready")
+	}
+
+	return ma.staticAuthorizer.(api.DetailedAuthorizer).AuthorizeDetailed(ai)
+}
+
+func (ma *aclMongoAuthorizer) ExplainNoMatch(ai *api.AuthRequestInfo) string {
+	ma.lock.RLock()
+	defer ma.lock.RUnlock()
+	if ma.staticAuthorizer == nil {
+		return ""
+	}
+	return ma.staticAuthorizer.(api.Explainer).ExplainNoMatch(ai)
+}
+
 // Validate ensures that any custom config options
 // in a Config are set correctly.
 func (c *ACLMongoConfig) Validate(configKey string) error {
@@ -90,13 +138,31 @@ func (c *ACLMongoConfig) Validate(configKey string) error {
 	if c.CacheTTL < 0 {
 		return fmt.Errorf("%s.cache_ttl is required (e.g. \"1m\" for 1 minute)", configKey)
 	}
+	switch c.QueryMode {
+	case "":
+		c.QueryMode = ACLMongoQueryModeFull
+	case ACLMongoQueryModeFull, ACLMongoQueryModeIndexed:
+	default:
+		return fmt.Errorf("%s.query_mode must be %s or %s, got %q", configKey, ACLMongoQueryModeFull, ACLMongoQueryModeIndexed, c.QueryMode)
+	}
+	if err := ValidateACLMode(configKey+".acl_mode", &c.ACLMode); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 func (ma *aclMongoAuthorizer) Stop() {
-	// This causes the background go routine which updates the ACL to stop
+	// This causes the background go routines which update the ACL to stop
 	ma.updateTicker.Stop()
+	close(ma.stop)
+	if ma.watchDone != nil {
+		select {
+		case <-ma.watchDone:
+		case <-time.After(10 * mongoACLWatchAwait):
+			glog.Warningf("MongoDB ACL watcher did not stop in time")
+		}
+	}
 
 	// Close connection to MongoDB database (if any)
 	if ma.session != nil {
@@ -104,6 +170,15 @@ func (ma *aclMongoAuthorizer) Stop() {
 	}
 }
 
+// HealthCheck pings the database.
+func (ma *aclMongoAuthorizer) HealthCheck() error {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	return tmp_session.Ping()
+}
+
+func (ma *aclMongoAuthorizer) HonorsStrictWildcardName() {}
+
 func (ma *aclMongoAuthorizer) Name() string {
 	return "MongoDB ACL"
 }
@@ -114,24 +189,22 @@ func (ma *aclMongoAuthorizer) Name() string {
 // to minimize duplication of code and maximize reuse of existing code.
 func (ma *aclMongoAuthorizer) continuouslyUpdateACLCache() {
 	var tick time.Time
-	for ; true; tick = <-ma.updateTicker.C {
-		aclAge := time.Now().Sub(ma.lastCacheUpdate)
-		glog.V(2).Infof("Updating ACL at %s (ACL age: %s. CacheTTL: %s)", tick, aclAge, ma.config.CacheTTL)
-
-		for true {
-			err := ma.updateACLCache()
-			if err == nil {
-				break
-			} else if err == io.EOF {
-				glog.Warningf("EOF error received from Mongo. Retrying connection")
-				time.Sleep(time.Second)
-				continue
-			} else {
+	for {
+		if atomic.LoadInt32(&ma.watching) == 0 {
+			aclAge := time.Now().Sub(ma.lastCacheUpdate)
+			glog.V(2).Infof("Updating ACL at %s (ACL age: %s. CacheTTL: %s)", tick, aclAge, ma.config.CacheTTL)
+
+			if err := ma.config.MongoConfig.Retry(ma.session, ma.updateACLCache); err != nil {
 				glog.Errorf("Failed to update ACL. ERROR: %s", err)
 				glog.Warningf("Using stale ACL (Age: %s, TTL: %s)", aclAge, ma.config.CacheTTL)
-				break
 			}
 		}
+		// Stopping the ticker does not close its channel, so wait for stop as well.
+		select {
+		case <-ma.stop:
+			return
+		case tick = <-ma.updateTicker.C:
+		}
 	}
 }
 
@@ -163,26 +236,34 @@ func (ma *aclMongoAuthorizer) updateACLCache() error {
 		return err
 	}
 
-	// Get all ACLs that have the required key
-	if err := collection.Find(bson.M{}).Sort("seq").All(&newACL); err != nil {
-		return err
-	}
+	var retACL ACL
+	var newStaticAuthorizer api.Authorizer
+	var err error
+	if ma.config.QueryMode == ACLMongoQueryModeIndexed {
+		if retACL, err = loadMongoACL(collection); err != nil {
+			return err
+		}
+		newStaticAuthorizer, err = NewIndexedACLAuthorizerWithMode(retACL, ma.config.ACLMode)
+	} else {
+		// Get all ACLs that have the required key
+		if err := collection.Find(bson.M{}).Sort("seq").All(&newACL); err != nil {
+			return err
+		}
 
-	glog.V(2).Infof("Number of new ACL entries from MongoDB: %d", len(newACL))
+		glog.V(2).Infof("Number of new ACL entries from MongoDB: %d", len(newACL))
 
-	// It is possible that the top document in the collection exists with a nil Seq.
-	// if that's true we pull it out of the slice and complain about it.
-	if len(newACL) > 0 && newACL[0].Seq == nil {
-		topACL := newACL[0]
-		return errors.New(fmt.Sprintf("Seq not set for ACL entry: %+v", topACL))
-	}
+		// It is possible that the top document in the collection exists with a nil Seq.
+		// if that's true we pull it out of the slice and complain about it.
+		if len(newACL) > 0 && newACL[0].Seq == nil {
+			topACL := newACL[0]
+			return errors.New(fmt.Sprintf("Seq not set for ACL entry: %+v", topACL))
+		}
 
-	var retACL ACL
-	for _, e := range newACL {
-		retACL = append(retACL, e.ACLEntry)
+		for _, e := range newACL {
+			retACL = append(retACL, e.ACLEntry)
+		}
+		newStaticAuthorizer, err = NewACLAuthorizerWithMode(retACL, ma.config.ACLMode)
 	}
-
-	newStaticAuthorizer, err := NewACLAuthorizer(retACL)
 	if err != nil {
 		return err
 	}
@@ -196,3 +277,24 @@ func (ma *aclMongoAuthorizer) updateACLCache() error {
 	glog.V(1).Infof("Installed new ACL from MongoDB (%d entries)", len(retACL))
 	return nil
 }
+
+// loadMongoACL streams the ACL from the collection, so that only one document
+// is decoded at a time. Comments are not loaded.
+func loadMongoACL(collection *mgo.Collection) (ACL, error) {
+	var acl ACL
+	iter := collection.Find(bson.M{}).Select(bson.M{"_id": 0, "comment": 0}).Sort("seq").Iter()
+	var e MongoACLEntry
+	for iter.Next(&e) {
+		if e.Seq == nil {
+			iter.Close()
+			return nil, fmt.Errorf("Seq not set for ACL entry: %+v", e)
+		}
+		acl = append(acl, e.ACLEntry)
+		e = MongoACLEntry{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Number of new ACL entries from MongoDB: %d", len(acl))
+	return acl, nil
+}
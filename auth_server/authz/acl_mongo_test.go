@@ -0,0 +1,87 @@
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func rawDoc(t *testing.T, doc interface{}) bson.Raw {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("failed to marshal %v: %s", doc, err)
+	}
+	return bson.Raw{Kind: 0x03, Data: data}
+}
+
+func TestMongoACLEntries(t *testing.T) {
+	entries := mongoACLEntries{}
+	entries.put(rawDoc(t, bson.M{"_id": 1, "seq": 20, "match": bson.M{"account": "bob"}, "actions": []string{"pull"}}))
+	entries.put(rawDoc(t, bson.M{"_id": 2, "seq": 10, "match": bson.M{"account": "alice"}, "actions": []string{"*"}, "comment": "admin"}))
+	// Malformed documents are left out.
+	entries.put(rawDoc(t, bson.M{"_id": 3, "match": bson.M{"account": "eve"}, "actions": []string{"*"}}))
+	entries.put(rawDoc(t, bson.M{"_id": 4, "seq": 30, "match": bson.M{"account": "/(/"}, "actions": []string{"*"}}))
+	entries.put(rawDoc(t, bson.M{"_id": 5, "seq": "x", "match": bson.M{}}))
+
+	acl := entries.acl(true)
+	if len(acl) != 2 || *acl[0].Match.Account != "alice" || *acl[1].Match.Account != "bob" || acl[0].Comment == nil {
+		t.Fatalf("unexpected ACL %v", acl)
+	}
+	if acl := entries.acl(false); acl[0].Comment != nil {
+		t.Errorf("expected comments to be left out")
+	}
+
+	event := func(op string, id int, doc interface{}) *mongoChangeEvent {
+		ev := &mongoChangeEvent{OperationType: op}
+		ev.DocumentKey.ID = id
+		if doc != nil {
+			ev.FullDocument = rawDoc(t, doc)
+		}
+		return ev
+	}
+	// An update that makes an entry invalid removes it.
+	entries.apply(event("update", 1, bson.M{"_id": 1, "match": bson.M{"account": "bob"}}))
+	entries.apply(event("insert", 6, bson.M{"_id": 6, "seq": 5, "match": bson.M{"account": "carol"}, "actions": []string{"push"}}))
+	entries.apply(event("delete", 2, nil))
+	entries.apply(event("insert", 7, bson.M{"_id": 7, "seq": 7, "match": bson.M{"account": "dave"}, "actions": []string{"*"}}))
+	entries.apply(event("replace", 7, bson.M{"_id": 7, "seq": "x", "match": "dave"}))
+	acl = entries.acl(true)
+	if len(acl) != 1 || *acl[0].Match.Account != "carol" {
+		t.Fatalf("unexpected ACL after changes %v", acl)
+	}
+	entries.apply(event("replace", 6, bson.M{"_id": 6, "seq": 5, "match": bson.M{"account": "carol"}, "actions": []string{"pull"}}))
+	a, err := NewACLAuthorizer(entries.acl(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions, err := a.Authorize(&api.AuthRequestInfo{Account: "carol", Actions: []string{"pull", "push"}}); err != nil || len(actions) != 1 || actions[0] != "pull" {
+		t.Errorf("expected replaced entry to be used, got %v %v", actions, err)
+	}
+	if entries.apply(event("invalidate", 0, nil)) {
+		t.Errorf("expected invalidate to require a reload")
+	}
+}
+
+func TestMongoACLUpdaterStops(t *testing.T) {
+	// While watching, the updater does not contact MongoDB.
+	ma := &aclMongoAuthorizer{
+		config:       &ACLMongoConfig{CacheTTL: time.Hour},
+		updateTicker: time.NewTicker(time.Hour),
+		stop:         make(chan struct{}),
+		watching:     1,
+	}
+	done := make(chan struct{})
+	go func() {
+		ma.continuouslyUpdateACLCache()
+		close(done)
+	}()
+	ma.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the updater to exit when stopped")
+	}
+}
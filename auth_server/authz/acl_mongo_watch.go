@@ -0,0 +1,290 @@
+package authz
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cesanta/glog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const (
+	// How long each getMore waits for changes. The watcher checks whether it has been stopped in between.
+	mongoACLWatchAwait = time.Second
+	// Delays between attempts to reopen the change stream after errors.
+	mongoACLWatchMinBackoff = time.Second
+	mongoACLWatchMaxBackoff = time.Minute
+)
+
+// mongoACLDocument is an ACL entry as stored in the collection, with its id.
+type mongoACLDocument struct {
+	ID            interface{} `bson:"_id"`
+	MongoACLEntry `bson:",inline"`
+}
+
+// mongoChangeEvent is a change stream event, see https://docs.mongodb.com/manual/reference/change-events/.
+type mongoChangeEvent struct {
+	ResumeToken   bson.Raw `bson:"_id"`
+	OperationType string   `bson:"operationType"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument bson.Raw `bson:"fullDocument"`
+}
+
+// mongoCursorReply is the reply of the aggregate and getMore commands.
+type mongoCursorReply struct {
+	Cursor struct {
+		ID         int64      `bson:"id"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+// mongoACLEntries is the ACL kept in memory while watching, by document id.
+// Documents that are not valid entries are left out, so that they don't break the rest of the ACL.
+type mongoACLEntries map[string]MongoACLEntry
+
+func mongoDocumentKey(id interface{}) string {
+	return fmt.Sprintf("%T:%v", id, id)
+}
+
+// decodeMongoACLEntry decodes and validates the document of an entry.
+func decodeMongoACLEntry(raw bson.Raw) (string, MongoACLEntry, error) {
+	var id struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := raw.Unmarshal(&id); err != nil {
+		return "", MongoACLEntry{}, fmt.Errorf("failed to decode ACL entry: %s", err)
+	}
+	key := mongoDocumentKey(id.ID)
+	var doc mongoACLDocument
+	if err := raw.Unmarshal(&doc); err != nil {
+		return key, MongoACLEntry{}, fmt.Errorf("failed to decode ACL entry %v: %s", id.ID, err)
+	}
+	if doc.Seq == nil {
+		return key, MongoACLEntry{}, fmt.Errorf("seq not set for ACL entry %v", doc.ID)
+	}
+	if doc.Match == nil {
+		return key, MongoACLEntry{}, fmt.Errorf("match not set for ACL entry %v", doc.ID)
+	}
+	if err := ValidateACL(ACL{doc.ACLEntry}); err != nil {
+		return key, MongoACLEntry{}, fmt.Errorf("invalid ACL entry %v: %s", doc.ID, err)
+	}
+	return key, doc.MongoACLEntry, nil
+}
+
+// put adds the decoded document, or removes the entry if the document is not valid.
+func (me mongoACLEntries) put(raw bson.Raw) {
+	key, e, err := decodeMongoACLEntry(raw)
+	if err != nil {
+		glog.Errorf("Ignoring MongoDB ACL document: %s", err)
+		if key != "" {
+			delete(me, key)
+		}
+		return
+	}
+	me[key] = e
+}
+
+// apply applies a change event. Returns false if the entries need to be reloaded.
+func (me mongoACLEntries) apply(ev *mongoChangeEvent) bool {
+	switch ev.OperationType {
+	case "insert", "update", "replace":
+		if ev.FullDocument.Kind == 0 || ev.FullDocument.Kind == 0x0A {
+			// Deleted before the update was looked up.
+			delete(me, mongoDocumentKey(ev.DocumentKey.ID))
+		} else {
+			me.put(ev.FullDocument)
+		}
+	case "delete":
+		delete(me, mongoDocumentKey(ev.DocumentKey.ID))
+	case "drop", "rename", "dropDatabase", "invalidate":
+		return false
+	}
+	return true
+}
+
+// acl returns the entries ordered by seq.
+func (me mongoACLEntries) acl(withComments bool) ACL {
+	entries := make([]MongoACLEntry, 0, len(me))
+	for _, e := range me {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return *entries[i].Seq < *entries[j].Seq })
+	acl := make(ACL, len(entries))
+	for i, e := range entries {
+		acl[i] = e.ACLEntry
+		if !withComments {
+			acl[i].Comment = nil
+		}
+	}
+	return acl
+}
+
+// loadMongoACLEntries loads all the documents of the collection, skipping invalid ones.
+func loadMongoACLEntries(collection *mgo.Collection) (mongoACLEntries, error) {
+	entries := mongoACLEntries{}
+	iter := collection.Find(bson.M{}).Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		entries.put(raw)
+		raw = bson.Raw{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// install creates an authorizer for the entries and makes it current.
+func (ma *aclMongoAuthorizer) install(entries mongoACLEntries) error {
+	acl := entries.acl(ma.config.QueryMode != ACLMongoQueryModeIndexed)
+	var a api.Authorizer
+	var err error
+	if ma.config.QueryMode == ACLMongoQueryModeIndexed {
+		a, err = NewIndexedACLAuthorizerWithMode(acl, ma.config.ACLMode)
+	} else {
+		a, err = NewACLAuthorizerWithMode(acl, ma.config.ACLMode)
+	}
+	if err != nil {
+		return err
+	}
+	ma.lock.Lock()
+	ma.lastCacheUpdate = time.Now()
+	ma.staticAuthorizer = a
+	ma.lock.Unlock()
+	glog.V(1).Infof("Installed new ACL from MongoDB change stream (%d entries)", len(acl))
+	return nil
+}
+
+func (ma *aclMongoAuthorizer) stopped() bool {
+	select {
+	case <-ma.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// watch keeps the ACL up to date with a change stream of the collection. While it is working,
+// periodic reloads are skipped. If change streams are not supported, e.g. the server is not
+// a replica set, it returns and periodic reloads continue.
+func (ma *aclMongoAuthorizer) watch() {
+	var resumeToken bson.Raw
+	var entries mongoACLEntries
+	backoff := mongoACLWatchMinBackoff
+	everOpened := false
+	for !ma.stopped() {
+		opened, err := ma.watchOnce(&resumeToken, &entries)
+		atomic.StoreInt32(&ma.watching, 0)
+		if ma.stopped() {
+			return
+		}
+		if !opened && !everOpened {
+			glog.Warningf("MongoDB ACL change stream is not available, reloading every %s instead: %s", ma.config.CacheTTL, err)
+			return
+		}
+		if opened {
+			everOpened = true
+			backoff = mongoACLWatchMinBackoff
+		} else if resumeToken.Kind != 0 {
+			// The stream cannot be resumed, e.g. the token is no longer in the oplog. Start over.
+			glog.Warningf("Failed to resume MongoDB ACL change stream, reloading: %s", err)
+			resumeToken = bson.Raw{}
+			continue
+		}
+		glog.Errorf("MongoDB ACL change stream failed, reopening in %s: %s", backoff, err)
+		select {
+		case <-ma.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > mongoACLWatchMaxBackoff {
+			backoff = mongoACLWatchMaxBackoff
+		}
+	}
+}
+
+// watchOnce opens the change stream, resuming after the token if there is one, and applies events
+// to the entries until an error occurs or the watcher is stopped. Without a token, the entries are
+// reloaded once the stream is open, so that no changes are missed. Returns whether the stream was opened.
+func (ma *aclMongoAuthorizer) watchOnce(resumeToken *bson.Raw, entries *mongoACLEntries) (bool, error) {
+	session := ma.session.Copy()
+	defer session.Close()
+	db := session.DB(ma.config.MongoConfig.DialInfo.Database)
+
+	cs := bson.D{{Name: "fullDocument", Value: "updateLookup"}}
+	if resumeToken.Kind != 0 {
+		cs = append(cs, bson.DocElem{Name: "resumeAfter", Value: *resumeToken})
+	}
+	var reply mongoCursorReply
+	err := db.Run(bson.D{
+		{Name: "aggregate", Value: ma.config.Collection},
+		{Name: "pipeline", Value: []bson.M{{"$changeStream": cs}}},
+		{Name: "cursor", Value: bson.M{}},
+	}, &reply)
+	if err != nil {
+		return false, err
+	}
+	cursorID := reply.Cursor.ID
+	defer func() {
+		if cursorID != 0 {
+			db.Run(bson.D{{Name: "killCursors", Value: ma.config.Collection}, {Name: "cursors", Value: []int64{cursorID}}}, nil)
+		}
+	}()
+
+	if resumeToken.Kind == 0 || *entries == nil {
+		if *entries, err = loadMongoACLEntries(db.C(ma.config.Collection)); err != nil {
+			return true, err
+		}
+		if err := ma.install(*entries); err != nil {
+			return true, err
+		}
+	}
+	atomic.StoreInt32(&ma.watching, 1)
+	glog.Infof("Watching MongoDB ACL collection %s for changes", ma.config.Collection)
+
+	batch := reply.Cursor.FirstBatch
+	for {
+		if len(batch) > 0 {
+			for _, raw := range batch {
+				var ev mongoChangeEvent
+				if err := raw.Unmarshal(&ev); err != nil {
+					glog.Errorf("Ignoring malformed MongoDB change event: %s", err)
+					continue
+				}
+				*resumeToken = ev.ResumeToken
+				if !entries.apply(&ev) {
+					*resumeToken = bson.Raw{}
+					return true, fmt.Errorf("collection %s: %s", ma.config.Collection, ev.OperationType)
+				}
+			}
+			if err := ma.install(*entries); err != nil {
+				return true, err
+			}
+		}
+		if ma.stopped() {
+			return true, nil
+		}
+		if cursorID == 0 {
+			return true, fmt.Errorf("change stream closed by the server")
+		}
+		reply = mongoCursorReply{}
+		err := db.Run(bson.D{
+			{Name: "getMore", Value: cursorID},
+			{Name: "collection", Value: ma.config.Collection},
+			{Name: "maxTimeMS", Value: int64(mongoACLWatchAwait / time.Millisecond)},
+		}, &reply)
+		if err != nil {
+			return true, err
+		}
+		cursorID = reply.Cursor.ID
+		batch = reply.Cursor.NextBatch
+	}
+}
@@ -0,0 +1,175 @@
+package authz
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeSQLDriver is an in-memory database/sql driver that returns the rows of the table named by the DSN
+// for any query, and records the queries.
+type fakeSQLDriver struct {
+	lock    sync.Mutex
+	tables  map[string][][]driver.Value
+	queries []string
+}
+
+var testSQLDriver = &fakeSQLDriver{tables: map[string][][]driver.Value{}}
+
+func init() {
+	sql.Register("acltest", testSQLDriver)
+}
+
+func (d *fakeSQLDriver) setRows(dsn string, rows [][]driver.Value) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.tables[dsn] = rows
+}
+
+func (d *fakeSQLDriver) Open(dsn string) (driver.Conn, error) {
+	return &fakeSQLConn{d: d, dsn: dsn}, nil
+}
+
+type fakeSQLConn struct {
+	d   *fakeSQLDriver
+	dsn string
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{c: c, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeSQLStmt struct {
+	c     *fakeSQLConn
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.d.lock.Lock()
+	defer s.c.d.lock.Unlock()
+	s.c.d.queries = append(s.c.d.queries, s.query)
+	rows, ok := s.c.d.tables[s.c.dsn]
+	if !ok {
+		return nil, errors.New("no such table")
+	}
+	return &fakeSQLRows{rows: rows}, nil
+}
+
+type fakeSQLRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	if len(r.rows) > 0 && len(r.rows[0]) != 3 {
+		return make([]string, len(r.rows[0]))
+	}
+	return []string{"match_conditions", "actions", "comment"}
+}
+
+func (r *fakeSQLRows) Close() error { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestACLSQLValidation(t *testing.T) {
+	cases := []struct {
+		c   ACLSQLConfig
+		err string
+	}{
+		{ACLSQLConfig{Driver: "acltest", DSN: "x"}, ""},
+		{ACLSQLConfig{Driver: "postgres", DSN: "x", Query: "SELECT 1"}, ""},
+		{ACLSQLConfig{Driver: "mysql", DSN: "x", Table: "db.acl"}, ""},
+		{ACLSQLConfig{Driver: "sqlserver", DSN: "x"}, "driver must be postgres or mysql"},
+		{ACLSQLConfig{Driver: "postgres"}, "exactly one of dsn and dsn_file"},
+		{ACLSQLConfig{Driver: "postgres", DSN: "x", Table: "acl", Query: "SELECT 1"}, "mutually exclusive"},
+		{ACLSQLConfig{Driver: "postgres", DSN: "x", Table: "acl; DROP TABLE acl"}, "match_conditions TEXT NOT NULL"},
+		{ACLSQLConfig{Driver: "postgres", DSN: "x", QueryMode: "foo"}, "query_mode"},
+	}
+	for i, c := range cases {
+		err := c.c.Validate("acl_sql")
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%d: expected error %q, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestACLSQL(t *testing.T) {
+	testSQLDriver.setRows("acl1", [][]driver.Value{
+		{`{"account": "admin"}`, `["*"]`, "Admin can do anything"},
+		{`{"account": "/.+/", "name": "${account}/*"}`, `["pull", "push"]`, nil},
+		{`{}`, `["pull"]`, nil},
+	})
+	c := &ACLSQLConfig{Driver: "acltest", DSN: "acl1", Table: "docker_acl"}
+	if err := c.Validate("acl_sql"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	a, err := NewACLSQLAuthorizer(c)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	defer a.Stop()
+	if q := testSQLDriver.queries[len(testSQLDriver.queries)-1]; q != "SELECT match_conditions, actions, comment FROM docker_acl ORDER BY seq" {
+		t.Errorf("unexpected query: %s", q)
+	}
+	cases := []struct {
+		account, name string
+		actions       []string
+	}{
+		{"admin", "foo", []string{"pull", "push"}},
+		{"alice", "alice/app", []string{"pull", "push"}},
+		{"alice", "bob/app", []string{"pull"}},
+	}
+	for i, c := range cases {
+		actions, err := a.Authorize(&api.AuthRequestInfo{Account: c.account, Type: "repository", Name: c.name, Actions: []string{"pull", "push"}})
+		if err != nil || !reflect.DeepEqual(actions, c.actions) {
+			t.Errorf("%d: expected %v, got %v %v", i, c.actions, actions, err)
+		}
+	}
+
+	// Invalid ACL is rejected and the previous one remains in effect.
+	sa := a.(*aclSQLAuthorizer)
+	testSQLDriver.setRows("acl1", [][]driver.Value{{`{"account": "admin"`, `["*"]`, nil}})
+	if err := sa.updateACL(); err == nil || !strings.Contains(err.Error(), "match_conditions must be a JSON object") {
+		t.Errorf("expected invalid match_conditions to be rejected, got %v", err)
+	}
+	testSQLDriver.setRows("acl1", [][]driver.Value{{`{"account": "admin"}`, `["*"]`, nil, 1}})
+	if err := sa.updateACL(); err == nil || !strings.Contains(err.Error(), "must return 3 columns") {
+		t.Errorf("expected wrong columns to be rejected, got %v", err)
+	}
+	if actions, err := a.Authorize(&api.AuthRequestInfo{Account: "alice", Name: "bob/app", Actions: []string{"pull"}}); err != nil || len(actions) != 1 {
+		t.Errorf("expected previous ACL to remain in effect, got %v %v", actions, err)
+	}
+
+	// Changes take effect on reload.
+	testSQLDriver.setRows("acl1", [][]driver.Value{{`{"account": "admin"}`, `["*"]`, nil}})
+	if err := sa.updateACL(); err != nil {
+		t.Fatalf("failed to update ACL: %s", err)
+	}
+	if _, err := a.Authorize(&api.AuthRequestInfo{Account: "alice", Name: "bob/app", Actions: []string{"pull"}}); err != api.NoMatch {
+		t.Errorf("expected no match after reload, got %v", err)
+	}
+}
@@ -2,7 +2,13 @@ package authz
 
 import (
 	"net"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
 
 	"github.com/cesanta/docker_auth/auth_server/api"
 )
@@ -11,6 +17,10 @@ func sp(s string) *string {
 	return &s
 }
 
+func ipp(s ...string) IPPatterns {
+	return IPPatterns(s)
+}
+
 func TestValidation(t *testing.T) {
 	cases := []struct {
 		mc MatchConditions
@@ -30,32 +40,67 @@ func TestValidation(t *testing.T) {
 		{MatchConditions{Service: sp("foo")}, true},
 		{MatchConditions{Service: sp("foo?*")}, true},
 		{MatchConditions{Service: sp("/foo.*/")}, true},
-		{MatchConditions{IP: sp("192.168.0.1")}, true},
-		{MatchConditions{IP: sp("192.168.0.0/16")}, true},
-		{MatchConditions{IP: sp("2001:db8::1")}, true},
-		{MatchConditions{IP: sp("2001:db8::/48")}, true},
+		{MatchConditions{IP: ipp("192.168.0.1")}, true},
+		{MatchConditions{IP: ipp("192.168.0.0/16")}, true},
+		{MatchConditions{IP: ipp("2001:db8::1")}, true},
+		{MatchConditions{IP: ipp("2001:db8::/48")}, true},
+		{MatchConditions{IP: ipp("10.0.0.0/8", "192.168.0.0/16", "2001:db8::/48")}, true},
 		{MatchConditions{Labels: map[string]string{"foo": "bar"}}, true},
+		{MatchConditions{Class: sp("plugin")}, true},
+		{MatchConditions{Class: sp("")}, true},
+		{MatchConditions{Time: &TimeWindow{}}, true},
+		{MatchConditions{Time: &TimeWindow{Days: []string{"mon-fri", "Sun"}, Hours: []string{"9-12", "13-24"}, Timezone: "Europe/Dublin"}}, true},
 		// Invalid stuff
 		{MatchConditions{Account: sp("/foo?*/")}, false},
+		{MatchConditions{Class: sp("plugins")}, false},
+		{MatchConditions{Class: sp("*")}, false},
 		{MatchConditions{Type: sp("/foo?*/")}, false},
 		{MatchConditions{Name: sp("/foo?*/")}, false},
 		{MatchConditions{Service: sp("/foo?*/")}, false},
-		{MatchConditions{IP: sp("192.168.0.1/100")}, false},
-		{MatchConditions{IP: sp("192.168.0.*")}, false},
-		{MatchConditions{IP: sp("foo")}, false},
-		{MatchConditions{IP: sp("2001:db8::/222")}, false},
+		{MatchConditions{Account: sp("svc-[")}, false},
+		{MatchConditions{Name: sp("[a-")}, false},
+		{MatchConditions{Name: sp("team/**/image")}, true},
+		{MatchConditions{Name: sp("team/**")}, true},
+		{MatchConditions{Name: sp("team/**image")}, false},
+		{MatchConditions{Name: sp("team/x/a**")}, false},
+		{MatchConditions{Account: sp("**-ci")}, false},
+		{MatchConditions{IP: ipp("192.168.0.1/100")}, false},
+		{MatchConditions{IP: ipp("192.168.0.*")}, false},
+		{MatchConditions{IP: ipp("foo")}, false},
+		{MatchConditions{IP: ipp("2001:db8::/222")}, false},
+		{MatchConditions{IP: ipp("10.0.0.0/8", "192.168.0.0/33")}, false},
+		{MatchConditions{IP: IPPatterns{}}, false},
 		{MatchConditions{Labels: map[string]string{"foo": "/bar?*/"}}, false},
+		{MatchConditions{Time: &TimeWindow{Timezone: "Mars/Olympus_Mons"}}, false},
+		{MatchConditions{Time: &TimeWindow{Days: []string{"monday"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Hours: []string{"9"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Hours: []string{"9-25"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Hours: []string{"18-9"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Hours: []string{"9am-5pm"}}}, false},
 	}
 	for i, c := range cases {
 		result := validateMatchConditions(&c.mc)
 		if c.ok && result != nil {
-			t.Errorf("%d: %q: expected to pass, got %s", i, c.mc, result)
+			t.Errorf("%d: %+v: expected to pass, got %s", i, c.mc, result)
 		} else if !c.ok && result == nil {
-			t.Errorf("%d: %q: expected to fail, but it passed", i, c.mc)
+			t.Errorf("%d: %+v: expected to fail, but it passed", i, c.mc)
 		}
 	}
 }
 
+func TestValidationPath(t *testing.T) {
+	all := []string{"*"}
+	acl := ACL{
+		{Match: &MatchConditions{}, Actions: &all},
+		{Match: &MatchConditions{IP: ipp("10.0.0.0/8", "foo")}, Actions: &all},
+	}
+	err := ValidateACL(acl)
+	ce, ok := err.(*api.ConfigError)
+	if !ok || !reflect.DeepEqual(ce.Path, []interface{}{1, "match", "ip", 1}) {
+		t.Errorf("expected error with path of the IP pattern, got %#v", err)
+	}
+}
+
 func TestMatching(t *testing.T) {
 	ai1 := api.AuthRequestInfo{Account: "foo", Type: "bar", Name: "baz", Service: "notary"}
 	ai2 := api.AuthRequestInfo{Account: "foo", Type: "bar", Name: "baz", Service: "notary",
@@ -77,28 +122,68 @@ func TestMatching(t *testing.T) {
 		{MatchConditions{Account: sp("foo"), Type: sp("baz")}, ai1, false},
 		{MatchConditions{Account: sp("fo?"), Type: sp("b*"), Name: sp("/z$/")}, ai1, true},
 		{MatchConditions{Account: sp("fo?"), Type: sp("b*"), Name: sp("/^z/")}, ai1, false},
+		// Account matching: literal, wildcard and regex. Regexes are not anchored.
+		{MatchConditions{Account: sp("svc")}, api.AuthRequestInfo{Account: "svc-ci"}, false},
+		{MatchConditions{Account: sp("svc-*")}, api.AuthRequestInfo{Account: "svc-ci"}, true},
+		{MatchConditions{Account: sp("svc-*")}, api.AuthRequestInfo{Account: "my-svc-ci"}, false},
+		{MatchConditions{Account: sp("svc-??")}, api.AuthRequestInfo{Account: "svc-ci"}, true},
+		{MatchConditions{Account: sp("/^svc-.*/")}, api.AuthRequestInfo{Account: "svc-ci"}, true},
+		{MatchConditions{Account: sp("/^svc-.*/")}, api.AuthRequestInfo{Account: "my-svc-ci"}, false},
+		{MatchConditions{Account: sp("/svc-/")}, api.AuthRequestInfo{Account: "my-svc-ci"}, true},
+		{MatchConditions{Account: sp("/^svc-[a-z]+$/")}, api.AuthRequestInfo{Account: "svc-ci-1"}, false},
+		// Class matching: unset matches any class, empty only scopes without one.
+		{MatchConditions{Type: sp("repository")}, api.AuthRequestInfo{Type: "repository", Class: "plugin"}, true},
+		{MatchConditions{Type: sp("repository"), Class: sp("plugin")}, api.AuthRequestInfo{Type: "repository", Class: "plugin"}, true},
+		{MatchConditions{Type: sp("repository"), Class: sp("plugin")}, api.AuthRequestInfo{Type: "repository"}, false},
+		{MatchConditions{Type: sp("repository"), Class: sp("")}, api.AuthRequestInfo{Type: "repository"}, true},
+		{MatchConditions{Type: sp("repository"), Class: sp("")}, api.AuthRequestInfo{Type: "repository", Class: "plugin"}, false},
 		{MatchConditions{Name: sp("${account}")}, api.AuthRequestInfo{Account: "foo", Name: "foo"}, true}, // Var subst
 		{MatchConditions{Name: sp("/${account}_.*/")}, api.AuthRequestInfo{Account: "foo", Name: "foo_x"}, true},
 		{MatchConditions{Name: sp("/${account}_.*/")}, api.AuthRequestInfo{Account: ".*", Name: "foo_x"}, false}, // Quoting
 		{MatchConditions{Account: sp(`/^(.+)@test\.com$/`), Name: sp(`${account:1}/*`)}, api.AuthRequestInfo{Account: "john.smith@test.com", Name: "john.smith/test"}, true},
 		{MatchConditions{Account: sp(`/^(.+)@test\.com$/`), Name: sp(`${account:3}/*`)}, api.AuthRequestInfo{Account: "john.smith@test.com", Name: "john.smith/test"}, false},
 		{MatchConditions{Account: sp(`/^(.+)@(.+?).test\.com$/`), Name: sp(`${account:1}-${account:2}/*`)}, api.AuthRequestInfo{Account: "john.smith@it.test.com", Name: "john.smith-it/test"}, true},
+		// Name matching with nested paths: * and ? match within a segment, ** across segments.
+		{MatchConditions{Name: sp("team/*")}, api.AuthRequestInfo{Name: "team/image"}, true},
+		{MatchConditions{Name: sp("team/*")}, api.AuthRequestInfo{Name: "team/project/image"}, false},
+		{MatchConditions{Name: sp("team/*/*")}, api.AuthRequestInfo{Name: "team/project/image"}, true},
+		{MatchConditions{Name: sp("team/*/image")}, api.AuthRequestInfo{Name: "team/project/image"}, true},
+		{MatchConditions{Name: sp("team/*/image")}, api.AuthRequestInfo{Name: "team/a/b/image"}, false},
+		{MatchConditions{Name: sp("team/proj-??/*")}, api.AuthRequestInfo{Name: "team/proj-01/image"}, true},
+		{MatchConditions{Name: sp("team/**")}, api.AuthRequestInfo{Name: "team/image"}, true},
+		{MatchConditions{Name: sp("team/**")}, api.AuthRequestInfo{Name: "team/a/b/c/d/image"}, true},
+		{MatchConditions{Name: sp("team/**")}, api.AuthRequestInfo{Name: "team"}, false},
+		{MatchConditions{Name: sp("team/**")}, api.AuthRequestInfo{Name: "teams/image"}, false},
+		{MatchConditions{Name: sp("team/**/image")}, api.AuthRequestInfo{Name: "team/image"}, true},
+		{MatchConditions{Name: sp("team/**/image")}, api.AuthRequestInfo{Name: "team/a/b/c/image"}, true},
+		{MatchConditions{Name: sp("team/**/image")}, api.AuthRequestInfo{Name: "team/a/b/c/image2"}, false},
+		{MatchConditions{Name: sp("team/**/*-cache")}, api.AuthRequestInfo{Name: "team/a/b/build-cache"}, true},
+		{MatchConditions{Name: sp("**/image")}, api.AuthRequestInfo{Name: "image"}, true},
+		{MatchConditions{Name: sp("**/image")}, api.AuthRequestInfo{Name: "a/b/c/image"}, true},
+		{MatchConditions{Name: sp("**")}, api.AuthRequestInfo{Name: "a/b/c/image"}, true},
+		{MatchConditions{Name: sp("team/**/b/**")}, api.AuthRequestInfo{Name: "team/a/b/c/d"}, true},
+		{MatchConditions{Name: sp("team/**/b/**")}, api.AuthRequestInfo{Name: "team/a/c/d"}, false},
+		{MatchConditions{Name: sp("${account}/**")}, api.AuthRequestInfo{Account: "foo", Name: "foo/a/b"}, true},
 		{MatchConditions{Service: sp("notary"), Type: sp("bar")}, ai1, true},
 		{MatchConditions{Service: sp("notary"), Type: sp("baz")}, ai1, false},
 		{MatchConditions{Service: sp("notary1"), Type: sp("bar")}, ai1, false},
 		// IP matching
-		{MatchConditions{IP: sp("127.0.0.1")}, api.AuthRequestInfo{IP: nil}, false},
-		{MatchConditions{IP: sp("127.0.0.1")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
-		{MatchConditions{IP: sp("127.0.0.1")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, false},
-		{MatchConditions{IP: sp("127.0.0.2")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, false},
-		{MatchConditions{IP: sp("127.0.0.0/8")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
-		{MatchConditions{IP: sp("127.0.0.0/8")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, true},
-		{MatchConditions{IP: sp("2001:db8::1")}, api.AuthRequestInfo{IP: nil}, false},
-		{MatchConditions{IP: sp("2001:db8::1")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
-		{MatchConditions{IP: sp("2001:db8::1")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, false},
-		{MatchConditions{IP: sp("2001:db8::2")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, false},
-		{MatchConditions{IP: sp("2001:db8::/48")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
-		{MatchConditions{IP: sp("2001:db8::/48")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, true},
+		{MatchConditions{IP: ipp("127.0.0.1")}, api.AuthRequestInfo{IP: nil}, false},
+		{MatchConditions{IP: ipp("127.0.0.1")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
+		{MatchConditions{IP: ipp("127.0.0.1")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, false},
+		{MatchConditions{IP: ipp("127.0.0.2")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, false},
+		{MatchConditions{IP: ipp("127.0.0.0/8")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
+		{MatchConditions{IP: ipp("127.0.0.0/8")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, true},
+		{MatchConditions{IP: ipp("2001:db8::1")}, api.AuthRequestInfo{IP: nil}, false},
+		{MatchConditions{IP: ipp("2001:db8::1")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
+		{MatchConditions{IP: ipp("2001:db8::1")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, false},
+		{MatchConditions{IP: ipp("2001:db8::2")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, false},
+		{MatchConditions{IP: ipp("2001:db8::/48")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
+		{MatchConditions{IP: ipp("2001:db8::/48")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, true},
+		{MatchConditions{IP: ipp("10.0.0.0/8", "2001:db8::/48")}, api.AuthRequestInfo{IP: net.IPv4(10, 1, 2, 3)}, true},
+		{MatchConditions{IP: ipp("10.0.0.0/8", "2001:db8::/48")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
+		{MatchConditions{IP: ipp("10.0.0.0/8", "2001:db8::/48")}, api.AuthRequestInfo{IP: net.IPv4(192, 168, 0, 1)}, false},
+		{MatchConditions{IP: ipp("10.0.0.0/8"), Account: sp("foo")}, api.AuthRequestInfo{Account: "bar", IP: net.IPv4(10, 0, 0, 1)}, false},
 		// Label matching
 		{MatchConditions{Labels: map[string]string{"foo": "bar"}}, ai1, false},
 		{MatchConditions{Labels: map[string]string{"foo": "bar"}}, ai2, false},
@@ -108,15 +193,20 @@ func TestMatching(t *testing.T) {
 		{MatchConditions{Labels: map[string]string{"group": "a*"}}, ai2, true},
 		{MatchConditions{Labels: map[string]string{"group": "/(admins|VIP)/"}}, ai2, true},
 		// // Label placeholder matching
-		{MatchConditions{Name: sp("${labels:group}/*")}, ai1, false},                 // no labels
-		{MatchConditions{Name: sp("${labels:noexist}/*")}, ai2, false},               // wrong labels
-		{MatchConditions{Name: sp("${labels:group}/*")}, ai3, true},                  // match label
-		{MatchConditions{Name: sp("${labels:noexist}/*")}, ai3, false},               // missing label
-		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai4, true},  // multiple label match success
-		{MatchConditions{Name: sp("${labels:group}/${labels:noexist}")}, ai4, false}, // multiple label match fail
-		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai4, true},  // multiple label match success
-		{MatchConditions{Name: sp("${labels:group}/${labels:noexist}")}, ai4, false}, // multiple label match fail wrong label
-		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai5, false}, // multiple label match fail. right label, wrong value
+		{MatchConditions{Name: sp("${labels:group}/*")}, ai1, false},                                                  // no labels
+		{MatchConditions{Name: sp("${labels:noexist}/*")}, ai2, false},                                                // wrong labels
+		{MatchConditions{Name: sp("${labels:group}/*")}, ai3, true},                                                   // match label
+		{MatchConditions{Name: sp("${labels:noexist}/*")}, ai3, false},                                                // missing label
+		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai4, true},                                   // multiple label match success
+		{MatchConditions{Name: sp("${labels:group}/${labels:noexist}")}, ai4, false},                                  // multiple label match fail
+		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai4, true},                                   // multiple label match success
+		{MatchConditions{Name: sp("${labels:group}/${labels:noexist}")}, ai4, false},                                  // multiple label match fail wrong label
+		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai5, false},                                  // multiple label match fail. right label, wrong value
+		{MatchConditions{Name: sp("/^${labels:group}/.+$/")}, ai3, true},                                              // regex match label
+		{MatchConditions{Name: sp("/^${labels:noexist}/.+$/")}, ai3, false},                                           // regex missing label
+		{MatchConditions{Name: sp("${labels:noexist}/*")}, api.AuthRequestInfo{Name: "${labels:noexist}/foo"}, false}, // unexpanded placeholder
+		{MatchConditions{Name: sp("${labels:group}/*")}, api.AuthRequestInfo{Name: "admins/foo",
+			Labels: map[string][]string{"group": []string{"*"}}}, false}, // label values are quoted
 	}
 	for i, c := range cases {
 		if result := c.mc.Matches(&c.ai); result != c.matches {
@@ -124,3 +214,578 @@ func TestMatching(t *testing.T) {
 		}
 	}
 }
+
+func TestIPPatternsUnmarshal(t *testing.T) {
+	cases := []struct {
+		in  string
+		out IPPatterns
+		ok  bool
+	}{
+		{`{}`, nil, true},
+		{`{ip: 10.0.0.0/8}`, ipp("10.0.0.0/8"), true},
+		{`{ip: [10.0.0.0/8, "::1"]}`, ipp("10.0.0.0/8", "::1"), true},
+		{`{ip: {foo: bar}}`, nil, false},
+	}
+	for i, c := range cases {
+		var mc MatchConditions
+		err := yaml.Unmarshal([]byte(c.in), &mc)
+		if c.ok != (err == nil) || !reflect.DeepEqual(mc.IP, c.out) {
+			t.Errorf("%d: %s: expected %v (ok = %t), got %v, %v", i, c.in, c.out, c.ok, mc.IP, err)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	tw := &TimeWindow{Days: []string{"mon-fri"}, Hours: []string{"9-17"}, Timezone: "America/New_York"}
+	if err := tw.validate(); err != nil {
+		t.Fatalf("failed to validate: %s", err)
+	}
+	cases := []struct {
+		t       string
+		matches bool
+	}{
+		{"2019-07-01T13:00:00Z", true},  // Mon 09:00 EDT
+		{"2019-07-01T12:59:59Z", false}, // Mon 08:59 EDT
+		{"2019-07-01T21:00:00Z", false}, // Mon 17:00 EDT
+		{"2019-12-02T14:00:00Z", true},  // Mon 09:00 EST
+		{"2019-12-02T13:30:00Z", false}, // Mon 08:30 EST
+		{"2019-07-06T15:00:00Z", false}, // Sat 11:00 EDT
+		{"2019-07-06T02:00:00Z", false}, // Fri 22:00 EDT, but Sat in UTC
+	}
+	for i, c := range cases {
+		ts, _ := time.Parse(time.RFC3339, c.t)
+		if result := tw.contains(ts); result != c.matches {
+			t.Errorf("%d: %s: expected %t, got %t", i, c.t, c.matches, result)
+		}
+	}
+
+	tw = &TimeWindow{Days: []string{"fri-mon"}}
+	if err := tw.validate(); err != nil {
+		t.Fatalf("failed to validate: %s", err)
+	}
+	for wd, expected := range []bool{true, true, false, false, false, true, true} {
+		if tw.days[wd] != expected {
+			t.Errorf("fri-mon: %s: expected %t", time.Weekday(wd), expected)
+		}
+	}
+}
+
+func TestTimeWindowMatching(t *testing.T) {
+	all := []string{"*"}
+	pull := []string{"pull"}
+	acl := ACL{
+		{Match: &MatchConditions{Time: &TimeWindow{Days: []string{"mon-fri"}, Hours: []string{"9-17"}}}, Actions: &all},
+		{Match: &MatchConditions{}, Actions: &pull},
+	}
+	aa, err := NewACLAuthorizer(acl)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	defer func() { now = time.Now }()
+	for _, c := range []struct {
+		t       string
+		actions []string
+	}{
+		{"2019-07-01T10:00:00Z", []string{"pull", "push"}},
+		{"2019-07-01T20:00:00Z", []string{"pull"}},
+		{"2019-07-06T10:00:00Z", []string{"pull"}},
+	} {
+		ts, _ := time.Parse(time.RFC3339, c.t)
+		now = func() time.Time { return ts }
+		actions, err := aa.Authorize(&api.AuthRequestInfo{Type: "repository", Name: "foo", Actions: []string{"pull", "push"}})
+		if err != nil || !reflect.DeepEqual(actions, c.actions) {
+			t.Errorf("%s: expected %v, got %v, %v", c.t, c.actions, actions, err)
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	all := []string{"*"}
+	pull := []string{"pull"}
+	if err := ValidateACL(ACL{{Match: &MatchConditions{}, Actions: &all, Expiration: -1}}); err == nil {
+		t.Errorf("negative expiration: expected to fail, but it passed")
+	}
+	acl := ACL{
+		{Match: &MatchConditions{Account: sp("pusher")}, Actions: &all, Expiration: 60},
+		{Match: &MatchConditions{}, Actions: &pull},
+	}
+	aa, err := NewACLAuthorizer(acl)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	cases := []struct {
+		ai         api.AuthRequestInfo
+		expiration int64
+	}{
+		{api.AuthRequestInfo{Account: "pusher", Actions: []string{"pull", "push"}}, 60},
+		{api.AuthRequestInfo{Account: "puller", Actions: []string{"pull"}}, 0},
+	}
+	for i, c := range cases {
+		d, err := aa.(api.DetailedAuthorizer).AuthorizeDetailed(&c.ai)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+		} else if d.Expiration != c.expiration {
+			t.Errorf("%d: expected expiration %d, got %d", i, c.expiration, d.Expiration)
+		}
+	}
+}
+
+func TestClaims(t *testing.T) {
+	all := []string{"*"}
+	push := []string{"push"}
+	for _, rc := range []string{"sub", "exp", "access"} {
+		if err := ValidateACL(ACL{{Match: &MatchConditions{}, Actions: &all, Claims: map[string]string{rc: "x"}}}); err == nil {
+			t.Errorf("%s: expected reserved claim to be rejected", rc)
+		}
+	}
+	acl := ACL{
+		{Match: &MatchConditions{Name: sp("private/*")}, Actions: &push, Claims: map[string]string{"role": "pusher"}},
+		{Match: &MatchConditions{}, Actions: &all, Claims: map[string]string{
+			"tenant": "${labels:tenant}",
+			"groups": "${labels:group}",
+			"who":    "${account} (${labels:group}) on ${service}",
+		}},
+	}
+	aa, err := NewACLAuthorizer(acl)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	ai := &api.AuthRequestInfo{Account: "alice", Name: "foo", Service: "registry", Actions: []string{"pull"},
+		Labels: api.Labels{"tenant": {"acme"}, "group": {"dev", "ops"}}}
+	d, err := aa.(api.DetailedAuthorizer).AuthorizeDetailed(ai)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]interface{}{
+		"tenant": []string{"acme"},
+		"groups": []string{"dev", "ops"},
+		"who":    "alice (dev,ops) on registry",
+	}
+	if !reflect.DeepEqual(d.Claims, expected) {
+		t.Errorf("expected claims %v, got %v", expected, d.Claims)
+	}
+	// No claims if no actions are granted.
+	ai.Name = "private/foo"
+	if d, err = aa.(api.DetailedAuthorizer).AuthorizeDetailed(ai); err != nil || d.Claims != nil {
+		t.Errorf("expected no claims, got %v, %v", d, err)
+	}
+	// Substituted values are not expanded again.
+	ai.Account = "${service}"
+	if c := ExpandClaims(map[string]string{"who": "${account}"}, ai); c["who"] != "${service}" {
+		t.Errorf("expected account to be substituted as is, got %v", c["who"])
+	}
+}
+
+func TestIndexedACL(t *testing.T) {
+	all := []string{"*"}
+	pull := []string{"pull"}
+	none := []string{}
+	acl := ACL{
+		{Match: &MatchConditions{Account: sp("admin")}, Actions: &all},
+		{Match: &MatchConditions{Name: sp("public/*")}, Actions: &pull},
+		{Match: &MatchConditions{Account: sp("alice"), Name: sp("secret")}, Actions: &none},
+		{Match: &MatchConditions{Account: sp("/.+/"), Name: sp("${account}/*")}, Actions: &all},
+		{Match: &MatchConditions{Account: sp("alice")}, Actions: &pull},
+		{Match: &MatchConditions{Account: sp("bot-*")}, Actions: &pull},
+		{Match: &MatchConditions{Account: sp("alice"), Name: sp("late")}, Actions: &all},
+	}
+	full, err := NewACLAuthorizer(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := NewIndexedACLAuthorizer(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range []string{"admin", "alice", "bob", "bot-1", ""} {
+		for _, name := range []string{"public/foo", "secret", "alice/foo", "late", "other"} {
+			ai := &api.AuthRequestInfo{Account: account, Type: "repository", Name: name, Actions: []string{"pull", "push"}}
+			fa, ferr := full.Authorize(ai)
+			ia, ierr := indexed.Authorize(ai)
+			if !reflect.DeepEqual(fa, ia) || ferr != ierr {
+				t.Errorf("%s %s: full: %v %v, indexed: %v %v", account, name, fa, ferr, ia, ierr)
+			}
+		}
+	}
+}
+
+// largeACL generates an ACL with entries for n accounts, followed by a few common ones.
+func largeACL(n int) ACL {
+	pull := []string{"pull"}
+	all := []string{"*"}
+	var acl ACL
+	for i := 0; i < n; i++ {
+		account := "user" + strconv.Itoa(i)
+		acl = append(acl,
+			ACLEntry{Match: &MatchConditions{Account: sp(account), Name: sp(account + "/*")}, Actions: &all},
+			ACLEntry{Match: &MatchConditions{Account: sp(account), Name: sp("shared/*")}, Actions: &pull})
+	}
+	return append(acl,
+		ACLEntry{Match: &MatchConditions{Name: sp("public/*")}, Actions: &pull},
+		ACLEntry{Match: &MatchConditions{Account: sp("/.+/"), Name: sp("${account}/*")}, Actions: &all})
+}
+
+func benchmarkACL(b *testing.B, newAuthorizer func(ACL) (api.Authorizer, error)) {
+	const n = 20000
+	a, err := newAuthorizer(largeACL(n))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ai := &api.AuthRequestInfo{Account: "user" + strconv.Itoa(i%n), Type: "repository", Name: "public/foo", Actions: []string{"pull"}}
+		if actions, err := a.Authorize(ai); err != nil || len(actions) != 1 {
+			b.Fatalf("unexpected result: %v %v", actions, err)
+		}
+	}
+}
+
+func BenchmarkACLFull(b *testing.B) {
+	benchmarkACL(b, NewACLAuthorizer)
+}
+
+func BenchmarkACLIndexed(b *testing.B) {
+	benchmarkACL(b, NewIndexedACLAuthorizer)
+}
+
+func TestDenyReason(t *testing.T) {
+	pull := []string{"pull"}
+	acl := ACL{
+		{Match: &MatchConditions{Account: sp("alice"), Name: sp("alice/*")}, Actions: &pull, Comment: sp("own repos")},
+		{Match: &MatchConditions{Account: sp("bob"), Type: sp("repository"), Name: sp("bob/*")}, Actions: &pull},
+	}
+	for _, newAuthorizer := range []func(ACL) (api.Authorizer, error){NewACLAuthorizer, NewIndexedACLAuthorizer} {
+		a, err := newAuthorizer(acl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ai := &api.AuthRequestInfo{Account: "alice", Type: "repository", Name: "alice/foo", Actions: []string{"pull", "push"}}
+		d, err := a.(api.DetailedAuthorizer).AuthorizeDetailed(ai)
+		if err != nil || d.Reason != "ACL entry 0 (own repos) allows only pull" {
+			t.Errorf("unexpected decision: %+v, %v", d, err)
+		}
+		ai = &api.AuthRequestInfo{Account: "bob", Type: "repository", Name: "foo", Actions: []string{"pull"}}
+		if _, err := a.Authorize(ai); err != api.NoMatch {
+			t.Fatalf("expected no match, got %v", err)
+		}
+		expected := "no ACL entry matched, closest was ACL entry 1, which did not match on name"
+		if e := a.(api.Explainer).ExplainNoMatch(ai); e != expected {
+			t.Errorf("expected %q, got %q", expected, e)
+		}
+	}
+}
+
+func TestLabelActions(t *testing.T) {
+	actions := []string{"pull", "${labels:actions}"}
+	acl := ACL{
+		{Match: &MatchConditions{Name: sp("${labels:team}/*")}, Actions: &actions},
+	}
+	aa, err := NewACLAuthorizer(acl)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	cases := []struct {
+		name    string
+		labels  api.Labels
+		actions []string
+		err     error
+	}{
+		{"dev/app", api.Labels{"team": {"dev"}, "actions": {"push"}}, []string{"pull", "push"}, nil},
+		// Multi-value labels: any of the teams, all of the actions.
+		{"ops/app", api.Labels{"team": {"dev", "ops"}, "actions": {"push", "delete"}}, []string{"delete", "pull", "push"}, nil},
+		{"qa/app", api.Labels{"team": {"dev", "ops"}}, nil, api.NoMatch},
+		// Missing labels: the entry does not match, or the action is not granted.
+		{"dev/app", nil, nil, api.NoMatch},
+		{"dev/app", api.Labels{"team": {"dev"}}, []string{"pull"}, nil},
+	}
+	for i, c := range cases {
+		ai := &api.AuthRequestInfo{Account: "alice", Type: "repository", Name: c.name,
+			Actions: []string{"pull", "push", "delete"}, Labels: c.labels}
+		result, err := aa.Authorize(ai)
+		if err != c.err || !reflect.DeepEqual(result, c.actions) {
+			t.Errorf("%d: expected %v %v, got %v %v", i, c.actions, c.err, result, err)
+		}
+	}
+}
+
+func TestValidateACLRegex(t *testing.T) {
+	all := []string{"*"}
+	err := ValidateACL(ACL{
+		{Match: &MatchConditions{Account: sp("svc-*")}, Actions: &all},
+		{Match: &MatchConditions{Account: sp("/^svc-(.*/")}, Actions: &all},
+	})
+	if err == nil || !strings.Contains(err.Error(), "entry 1") || !strings.Contains(err.Error(), "invalid regex pattern") {
+		t.Errorf("expected invalid regex in entry 1 to be reported, got %v", err)
+	}
+	if err := ValidateACL(ACL{{Match: &MatchConditions{Account: sp("/^svc-.*/")}, Actions: &all}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := regexCache.m["^svc-.*"]; !found {
+		t.Errorf("expected regex to be compiled on validation")
+	}
+}
+
+func TestUnionMode(t *testing.T) {
+	pull, push, del := []string{"pull"}, []string{"push"}, []string{"delete"}
+	acl := ACL{
+		{Match: &MatchConditions{Account: sp("alice"), Name: sp("foo")}, Actions: &push, Expiration: 300, Claims: map[string]string{"role": "pusher"}},
+		{Match: &MatchConditions{Labels: map[string]string{"group": "admins"}}, Actions: &del, Expiration: 60},
+		{Match: &MatchConditions{}, Actions: &pull, Claims: map[string]string{"role": "puller"}},
+	}
+	if err := ValidateACLMode("acl_mode", sp("all")); err == nil {
+		t.Errorf("expected unknown mode to be rejected")
+	}
+	first, _ := NewACLAuthorizer(acl)
+	union, _ := NewACLAuthorizerWithMode(acl, ACLModeUnion)
+	indexed, _ := NewIndexedACLAuthorizerWithMode(acl, ACLModeUnion)
+	all := []string{"pull", "push", "delete"}
+	cases := []struct {
+		ai                    api.AuthRequestInfo
+		firstMatch, unionMode []string
+	}{
+		{api.AuthRequestInfo{Account: "alice", Name: "foo", Actions: all}, push, []string{"pull", "push"}},
+		{api.AuthRequestInfo{Account: "alice", Name: "bar", Actions: all}, pull, pull},
+		{api.AuthRequestInfo{Account: "bob", Name: "foo", Actions: all, Labels: api.Labels{"group": {"admins"}}}, del, []string{"pull", "delete"}},
+		{api.AuthRequestInfo{Account: "alice", Name: "foo", Actions: all, Labels: api.Labels{"group": {"admins"}}}, push, all},
+	}
+	for i, c := range cases {
+		if actions, _ := first.Authorize(&c.ai); !reflect.DeepEqual(actions, c.firstMatch) {
+			t.Errorf("%d: expected %v in first_match mode, got %v", i, c.firstMatch, actions)
+		}
+		for name, a := range map[string]api.Authorizer{"union": union, "indexed union": indexed} {
+			if actions, _ := a.Authorize(&c.ai); !reflect.DeepEqual(actions, c.unionMode) {
+				t.Errorf("%d: expected %v in %s mode, got %v", i, c.unionMode, name, actions)
+			}
+		}
+	}
+
+	// Shortest expiration and claims of the earliest entry win.
+	d, err := union.(api.DetailedAuthorizer).AuthorizeDetailed(&cases[3].ai)
+	if err != nil || d.Expiration != 60 || d.Claims["role"] != "pusher" || d.Reason != "" {
+		t.Errorf("unexpected union decision %+v %v", d, err)
+	}
+	d, _ = union.(api.DetailedAuthorizer).AuthorizeDetailed(&cases[0].ai)
+	if d.Reason != "ACL entry 0, ACL entry 2 allow only pull,push" {
+		t.Errorf("unexpected reason %q", d.Reason)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	pull, all := []string{"pull"}, []string{"*"}
+	acl := ACL{
+		{Match: &MatchConditions{Account: sp("alice")}, Actions: &all},
+		{Match: &MatchConditions{Name: sp("prod/*")}, Actions: &pull, Priority: 10},
+		{Match: &MatchConditions{Account: sp("bob")}, Actions: &pull, Priority: -1},
+		{Match: &MatchConditions{Account: sp("bob")}, Actions: &all, Priority: -1},
+	}
+	if order := evaluationOrder(acl); !reflect.DeepEqual(order, []int{1, 0, 2, 3}) {
+		t.Errorf("unexpected evaluation order %v", order)
+	}
+	full, _ := NewACLAuthorizer(acl)
+	indexed, _ := NewIndexedACLAuthorizer(acl)
+	rw := []string{"pull", "push"}
+	cases := []struct {
+		ai       api.AuthRequestInfo
+		expected []string
+	}{
+		// Entry 1 is evaluated before entry 0 despite coming later.
+		{api.AuthRequestInfo{Account: "alice", Name: "prod/app", Actions: rw}, pull},
+		{api.AuthRequestInfo{Account: "alice", Name: "dev/app", Actions: rw}, rw},
+		// Same priority, ACL order decides.
+		{api.AuthRequestInfo{Account: "bob", Name: "dev/app", Actions: rw}, pull},
+	}
+	for i, c := range cases {
+		for name, a := range map[string]api.Authorizer{"full": full, "indexed": indexed} {
+			if actions, _ := a.Authorize(&c.ai); !reflect.DeepEqual(actions, c.expected) {
+				t.Errorf("%d: expected %v from %s ACL, got %v", i, c.expected, name, actions)
+			}
+		}
+	}
+	if conflicts := conflictingEntries(acl); !reflect.DeepEqual(conflicts, [][2]int{{2, 3}}) {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	pull, all := []string{"pull"}, []string{"*"}
+	acl := ACL{
+		{Match: &MatchConditions{Account: sp("admin")}, Actions: &all, Priority: 10},
+		{Match: &MatchConditions{Name: sp("secret/*")}, Actions: &all, Deny: true},
+		{Match: &MatchConditions{Labels: map[string]string{"group": "dev"}}, Actions: &pull},
+		{Match: &MatchConditions{}, Actions: &all},
+	}
+	for _, e := range []ACLEntry{
+		{Match: &MatchConditions{}, Actions: &[]string{}, Deny: true},
+		{Match: &MatchConditions{}, Actions: &pull, Deny: true, Expiration: 60},
+	} {
+		if err := ValidateACL(ACL{e}); err == nil {
+			t.Errorf("expected %s to be invalid", e)
+		}
+	}
+	rw := []string{"pull", "push"}
+	dev := api.Labels{"group": {"dev"}}
+	cases := []struct {
+		ai       api.AuthRequestInfo
+		expected []string
+		reason   string
+	}{
+		// The deny takes precedence over the broad allows after it, but not over the admin entry before it.
+		{api.AuthRequestInfo{Account: "alice", Name: "secret/keys", Actions: rw}, []string{}, "ACL entry 1 denies pull,push"},
+		{api.AuthRequestInfo{Account: "alice", Name: "public/app", Actions: rw}, rw, ""},
+		{api.AuthRequestInfo{Account: "bob", Name: "secret/keys", Actions: rw, Labels: dev}, []string{}, "ACL entry 1 denies pull,push"},
+		{api.AuthRequestInfo{Account: "bob", Name: "public/app", Actions: rw, Labels: dev}, pull, "ACL entry 2 allows only pull"},
+		{api.AuthRequestInfo{Account: "admin", Name: "secret/keys", Actions: rw}, rw, ""},
+	}
+	for mode, union := range map[string]bool{ACLModeFirstMatch: false, ACLModeUnion: true} {
+		full, _ := NewACLAuthorizerWithMode(acl, mode)
+		indexed, _ := NewIndexedACLAuthorizerWithMode(acl, mode)
+		for i, c := range cases {
+			if union && i == 3 {
+				// Entry 3 allows push as well.
+				c.expected, c.reason = rw, ""
+			}
+			for name, a := range map[string]api.Authorizer{"full": full, "indexed": indexed} {
+				d, err := a.(api.DetailedAuthorizer).AuthorizeDetailed(&c.ai)
+				if err != nil || !reflect.DeepEqual(d.Actions, c.expected) || d.Reason != c.reason {
+					t.Errorf("%d: expected %v (%q) from %s ACL in %s mode, got %+v, %v", i, c.expected, c.reason, name, mode, d, err)
+				}
+			}
+		}
+	}
+
+	// Only the denied actions are removed, later entries decide the rest.
+	push := []string{"push"}
+	acl = ACL{
+		{Match: &MatchConditions{Name: sp("secret/*")}, Actions: &push, Deny: true},
+		{Match: &MatchConditions{}, Actions: &all},
+	}
+	a, _ := NewACLAuthorizer(acl)
+	d, _ := a.(api.DetailedAuthorizer).AuthorizeDetailed(&api.AuthRequestInfo{Name: "secret/keys", Actions: rw})
+	if !reflect.DeepEqual(d.Actions, pull) || d.Reason != "ACL entry 0 denies push" {
+		t.Errorf("unexpected decision %+v", d)
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	own := &MatchConditions{Name: sp(`/^(?P<user>[^/]+)/.+$/`), Captures: map[string]string{"user": "${account}"}}
+	team := &MatchConditions{Name: sp(`/^teams/(?P<team>[^/]+)/.+$/`), Captures: map[string]string{"team": "${labels:team}"}}
+	cases := []struct {
+		mc      *MatchConditions
+		ai      api.AuthRequestInfo
+		matches bool
+	}{
+		{own, api.AuthRequestInfo{Account: "alice", Name: "alice/app"}, true},
+		{own, api.AuthRequestInfo{Account: "alice", Name: "alice/app/nested"}, true},
+		{own, api.AuthRequestInfo{Account: "alice", Name: "bob/app"}, false},
+		{own, api.AuthRequestInfo{Account: "alice", Name: "alice2/app"}, false},
+		{own, api.AuthRequestInfo{Account: "alice", Name: "app"}, false},
+		// Captured values are compared literally.
+		{own, api.AuthRequestInfo{Account: "a.ice", Name: "alice/app"}, false},
+		{own, api.AuthRequestInfo{Account: "a.ice", Name: "a.ice/app"}, true},
+		{team, api.AuthRequestInfo{Name: "teams/web/app", Labels: api.Labels{"team": {"db", "web"}}}, true},
+		{team, api.AuthRequestInfo{Name: "teams/ops/app", Labels: api.Labels{"team": {"db", "web"}}}, false},
+		{team, api.AuthRequestInfo{Name: "teams/web/app"}, false},
+		// Named groups can also be referenced in other patterns.
+		{&MatchConditions{Name: sp(`/^(?P<user>[^/]+)/.+$/`), Account: sp("${name:user}")}, api.AuthRequestInfo{Account: "alice", Name: "alice/app"}, true},
+		{&MatchConditions{Name: sp(`/^(?P<user>[^/]+)/.+$/`), Account: sp("${name:user}")}, api.AuthRequestInfo{Account: "alice", Name: "bob/app"}, false},
+	}
+	for i, c := range cases {
+		if err := validateMatchConditions(c.mc); err != nil {
+			t.Fatalf("%d: invalid match conditions: %s", i, err)
+		}
+		if m := c.mc.Matches(&c.ai); m != c.matches {
+			t.Errorf("%d: expected %+v to match %+v: %t, got %t", i, *c.mc, c.ai, c.matches, m)
+		}
+	}
+
+	for _, mc := range []*MatchConditions{
+		{Name: sp("*/app"), Captures: map[string]string{"user": "${account}"}},
+		{Captures: map[string]string{"user": "${account}"}},
+		{Name: sp(`/^(?P<user>[^/]+)/.+$/`), Captures: map[string]string{"owner": "${account}"}},
+		{Name: sp(`/^(?P<user>[^/]+)/.+$/`), Captures: map[string]string{"user": "/[/"}},
+	} {
+		if err := validateMatchConditions(mc); err == nil {
+			t.Errorf("expected %+v to be invalid", mc)
+		}
+	}
+
+	// An entry that lets users push only to their own repositories.
+	rw, pull := []string{"pull", "push"}, []string{"pull"}
+	acl := ACL{
+		{Match: own, Actions: &rw},
+		{Match: &MatchConditions{}, Actions: &pull},
+	}
+	for _, newAuthorizer := range []func(ACL) (api.Authorizer, error){NewACLAuthorizer, NewIndexedACLAuthorizer} {
+		a, err := newAuthorizer(acl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range map[string][]string{"alice/app": rw, "bob/app": pull} {
+			actions, err := a.Authorize(&api.AuthRequestInfo{Account: "alice", Type: "repository", Name: name, Actions: rw})
+			if err != nil || !reflect.DeepEqual(actions, expected) {
+				t.Errorf("%s: expected %v, got %v %v", name, expected, actions, err)
+			}
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	pull, rw := []string{"pull"}, []string{"pull", "push"}
+	sample := func(p float64) ACL {
+		return ACL{
+			{Match: &MatchConditions{Name: sp("app")}, Actions: &rw, Sample: &p},
+			{Match: &MatchConditions{Name: sp("app")}, Actions: &pull},
+		}
+	}
+	if conflicts := conflictingEntries(sample(30)); len(conflicts) != 0 {
+		t.Errorf("expected sampled entries not to conflict, got %v", conflicts)
+	}
+	sampled := func(acl ACL) map[string]bool {
+		full, _ := NewACLAuthorizer(acl)
+		indexed, _ := NewIndexedACLAuthorizer(acl)
+		result := map[string]bool{}
+		for i := 0; i < 1000; i++ {
+			account := "user" + strconv.Itoa(i)
+			ai := &api.AuthRequestInfo{Account: account, Type: "repository", Name: "app", Actions: rw}
+			actions, _ := full.Authorize(ai)
+			// Same account, same decision, whichever authorizer and however many times it is asked.
+			for j := 0; j < 3; j++ {
+				if again, _ := indexed.Authorize(ai); !reflect.DeepEqual(again, actions) {
+					t.Fatalf("%s: expected %v, got %v", account, actions, again)
+				}
+			}
+			result[account] = len(actions) == 2
+		}
+		return result
+	}
+	count := func(m map[string]bool) int {
+		n := 0
+		for _, in := range m {
+			if in {
+				n++
+			}
+		}
+		return n
+	}
+	s30, s60 := sampled(sample(30)), sampled(sample(60))
+	if n := count(s30); n < 250 || n > 350 {
+		t.Errorf("expected about 300 of 1000 accounts in the 30%% sample, got %d", n)
+	}
+	for account, in := range s30 {
+		if in && !s60[account] {
+			t.Errorf("%s: expected accounts in the 30%% sample to be in the 60%% sample", account)
+		}
+	}
+	if n := count(sampled(sample(0))); n != 0 {
+		t.Errorf("expected no accounts in the 0%% sample, got %d", n)
+	}
+	if n := count(sampled(sample(100))); n != 1000 {
+		t.Errorf("expected all accounts in the 100%% sample, got %d", n)
+	}
+
+	for _, p := range []float64{-1, 100.5} {
+		if err := ValidateACL(sample(p)); err == nil {
+			t.Errorf("expected sample %g to be rejected", p)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package authz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// TimeWindow restricts an ACL entry to certain days of week and hours of day.
+// Both are evaluated in the specified timezone, UTC if not set.
+type TimeWindow struct {
+	// Days of week, e.g. ["mon-fri"] or ["sat", "sun"]. Empty means every day.
+	Days []string `yaml:"days,omitempty" json:"days,omitempty"`
+	// Hour ranges, e.g. ["9-12", "13-18"]. Start hour is inclusive, end hour is not.
+	// Empty means all day.
+	Hours []string `yaml:"hours,omitempty" json:"hours,omitempty"`
+	// IANA timezone name, e.g. "Europe/Dublin".
+	Timezone string `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+
+	loc   *time.Location
+	days  [7]bool
+	hours [24]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	wd, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid day of week %q", s)
+	}
+	return wd, nil
+}
+
+func parseRange(s string, parse func(string) (int, error)) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	from, err := parse(strings.TrimSpace(parts[0]))
+	if err != nil || len(parts) == 1 {
+		return from, from, err
+	}
+	to, err := parse(strings.TrimSpace(parts[1]))
+	return from, to, err
+}
+
+func (tw *TimeWindow) validate() error {
+	tw.loc = time.UTC
+	if tw.Timezone != "" {
+		loc, err := time.LoadLocation(tw.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q: %s", tw.Timezone, err)
+		}
+		tw.loc = loc
+	}
+	tw.days = [7]bool{}
+	for _, d := range tw.Days {
+		from, to, err := parseRange(d, func(s string) (int, error) {
+			wd, err := parseWeekday(s)
+			return int(wd), err
+		})
+		if err != nil {
+			return err
+		}
+		// Ranges can wrap around the end of the week, e.g. "fri-mon".
+		for i := from; ; i = (i + 1) % 7 {
+			tw.days[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+	if len(tw.Days) == 0 {
+		for i := range tw.days {
+			tw.days[i] = true
+		}
+	}
+	tw.hours = [24]bool{}
+	for _, h := range tw.Hours {
+		from, to, err := parseRange(h, strconv.Atoi)
+		if err != nil || !strings.Contains(h, "-") {
+			return fmt.Errorf("invalid hour range %q, must be <from>-<to>", h)
+		}
+		if from < 0 || from > 23 || to < 1 || to > 24 || from >= to {
+			return fmt.Errorf("invalid hour range %q, must be within 0-24 and not empty", h)
+		}
+		for i := from; i < to; i++ {
+			tw.hours[i] = true
+		}
+	}
+	if len(tw.Hours) == 0 {
+		for i := range tw.hours {
+			tw.hours[i] = true
+		}
+	}
+	return nil
+}
+
+func (tw *TimeWindow) contains(t time.Time) bool {
+	t = t.In(tw.loc)
+	return tw.days[t.Weekday()] && tw.hours[t.Hour()]
+}
+
+// now is the request time, can be overridden in tests.
+var now = time.Now
+
+func matchTime(tw *TimeWindow, ai *api.AuthRequestInfo) bool {
+	if tw == nil {
+		return true
+	}
+	if !ai.Time.IsZero() {
+		return tw.contains(ai.Time)
+	}
+	return tw.contains(now())
+}
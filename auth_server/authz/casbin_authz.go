@@ -0,0 +1,111 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// CasbinAuthzConfig specifies Casbin model and policy files.
+// Requests are evaluated as (account, type, name, action) for each of the requested actions,
+// so the model's request definition must have four fields, e.g. "r = sub, typ, obj, act".
+type CasbinAuthzConfig struct {
+	ModelFile  string `yaml:"model_file,omitempty"`
+	PolicyFile string `yaml:"policy_file,omitempty"`
+	// If set, the policy is reloaded from the file periodically.
+	ReloadInterval time.Duration `yaml:"reload_interval,omitempty"`
+}
+
+func (c *CasbinAuthzConfig) Validate(configKey string) error {
+	if c.ModelFile == "" || c.PolicyFile == "" {
+		return fmt.Errorf("%s.{model_file,policy_file} are required", configKey)
+	}
+	for _, f := range []string{c.ModelFile, c.PolicyFile} {
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("%s: %s", configKey, err)
+		}
+	}
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("%s.reload_interval must not be negative", configKey)
+	}
+	return nil
+}
+
+type casbinAuthorizer struct {
+	config   *CasbinAuthzConfig
+	enforcer *casbin.SyncedEnforcer
+	stop     chan struct{}
+}
+
+// NewCasbinAuthorizer creates an authorizer that evaluates requests with a Casbin enforcer.
+func NewCasbinAuthorizer(c *CasbinAuthzConfig) (api.Authorizer, error) {
+	enforcer, err := casbin.NewSyncedEnforcer(c.ModelFile, c.PolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Casbin model and policy: %s", err)
+	}
+	glog.Infof("Casbin authorization, model %s, policy %s", c.ModelFile, c.PolicyFile)
+	ca := &casbinAuthorizer{config: c, enforcer: enforcer, stop: make(chan struct{})}
+	if c.ReloadInterval > 0 {
+		go ca.continuouslyReloadPolicy()
+	}
+	return ca, nil
+}
+
+func (ca *casbinAuthorizer) continuouslyReloadPolicy() {
+	ticker := time.NewTicker(ca.config.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// On error, the previous policy remains in effect.
+			if err := ca.enforcer.LoadPolicy(); err != nil {
+				glog.Errorf("Failed to reload Casbin policy from %s: %s", ca.config.PolicyFile, err)
+			}
+		case <-ca.stop:
+			return
+		}
+	}
+}
+
+func (ca *casbinAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	actions := []string{}
+	for _, action := range ai.Actions {
+		ok, err := ca.enforcer.Enforce(ai.Account, ai.Type, ai.Name, action)
+		if err != nil {
+			return nil, fmt.Errorf("Casbin enforcer failed: %s", err)
+		}
+		if ok {
+			actions = append(actions, action)
+		}
+	}
+	return actions, nil
+}
+
+func (ca *casbinAuthorizer) Stop() {
+	close(ca.stop)
+}
+
+func (ca *casbinAuthorizer) Name() string {
+	return "Casbin"
+}
@@ -0,0 +1,82 @@
+package authz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const testCasbinModel = `
+[request_definition]
+r = sub, typ, obj, act
+
+[policy_definition]
+p = sub, typ, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.typ == p.typ && keyMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")
+`
+
+func TestCasbinAuthz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casbin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &CasbinAuthzConfig{
+		ModelFile:      filepath.Join(dir, "model.conf"),
+		PolicyFile:     filepath.Join(dir, "policy.csv"),
+		ReloadInterval: 10 * time.Millisecond,
+	}
+	ioutil.WriteFile(c.ModelFile, []byte(testCasbinModel), 0644)
+	ioutil.WriteFile(c.PolicyFile, []byte(`
+p, alice, repository, alice/*, *
+p, bob, repository, library/*, pull
+`), 0644)
+	if err := c.Validate("casbin_authz"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	ca, err := NewCasbinAuthorizer(c)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	defer ca.Stop()
+
+	pullPush := []string{"pull", "push"}
+	cases := []struct {
+		account, name string
+		actions       []string
+	}{
+		{"alice", "alice/foo", pullPush},
+		{"alice", "alice/foo/bar", pullPush},
+		{"alice", "library/foo", []string{}},
+		{"bob", "library/foo", []string{"pull"}},
+		{"bob", "alice/foo", []string{}},
+		{"carol", "library/foo", []string{}},
+	}
+	for i, tc := range cases {
+		actions, err := ca.Authorize(&api.AuthRequestInfo{Account: tc.account, Type: "repository", Name: tc.name, Actions: pullPush})
+		if err != nil || !reflect.DeepEqual(actions, tc.actions) {
+			t.Errorf("%d: %s %s: expected %v, got %v, %v", i, tc.account, tc.name, tc.actions, actions, err)
+		}
+	}
+
+	ioutil.WriteFile(c.PolicyFile, []byte("p, carol, repository, library/*, pull\n"), 0644)
+	ai := &api.AuthRequestInfo{Account: "carol", Type: "repository", Name: "library/foo", Actions: pullPush}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if actions, _ := ca.Authorize(ai); len(actions) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("policy was not reloaded")
+		}
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/cesanta/glog"
 
@@ -31,6 +33,35 @@ import (
 type ExtAuthzConfig struct {
 	Command string   `yaml:"command"`
 	Args    []string `yaml:"args"`
+	// Number of times to retry the command if it could not be run or returned an error.
+	// Denials are never retried.
+	Retries int `yaml:"retries,omitempty"`
+	// Delay before the first retry, doubled for every next one up to maxExtAuthzRetryBackoff.
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+	// Overall time limit of the request: a retry is not attempted if it would start after it.
+	RetryDeadline time.Duration `yaml:"retry_deadline,omitempty"`
+	// What happens if the command fails, after retries, as opposed to denying the request:
+	// closed (default) denies the request, open allows those of the requested actions
+	// that are listed in fail_open_actions, default is pull.
+	FailMode        string   `yaml:"fail_mode,omitempty"`
+	FailOpenActions []string `yaml:"fail_open_actions,omitempty"`
+}
+
+const (
+	defaultExtAuthzRetryBackoff  = 100 * time.Millisecond
+	maxExtAuthzRetryBackoff      = 5 * time.Second
+	defaultExtAuthzRetryDeadline = 10 * time.Second
+
+	ExtAuthzFailClosed = "closed"
+	ExtAuthzFailOpen   = "open"
+)
+
+// Number of requests allowed by ext_authz in fail-open mode, exported as a metric by the server.
+var extAuthzFailOpen uint64
+
+// ExtAuthzFailOpenRequests returns the number of requests that ext_authz allowed because the command failed.
+func ExtAuthzFailOpenRequests() uint64 {
+	return atomic.LoadUint64(&extAuthzFailOpen)
 }
 
 type ExtAuthzStatus int
@@ -48,6 +79,34 @@ func (c *ExtAuthzConfig) Validate() error {
 	if _, err := exec.LookPath(c.Command); err != nil {
 		return fmt.Errorf("invalid command %q: %s", c.Command, err)
 	}
+	if c.Retries < 0 || c.RetryBackoff < 0 || c.RetryDeadline < 0 {
+		return fmt.Errorf("retries, retry_backoff and retry_deadline must not be negative")
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultExtAuthzRetryBackoff
+	}
+	if c.RetryDeadline == 0 {
+		c.RetryDeadline = defaultExtAuthzRetryDeadline
+	}
+	return validateFailMode(&c.FailMode, &c.FailOpenActions)
+}
+
+// validateFailMode checks fail_mode and fail_open_actions of external authorizers and sets the defaults.
+func validateFailMode(mode *string, openActions *[]string) error {
+	switch *mode {
+	case "":
+		*mode = ExtAuthzFailClosed
+	case ExtAuthzFailClosed, ExtAuthzFailOpen:
+	default:
+		return fmt.Errorf("fail_mode must be %s or %s, got %q", ExtAuthzFailClosed, ExtAuthzFailOpen, *mode)
+	}
+	if *mode == ExtAuthzFailOpen {
+		if *openActions == nil {
+			*openActions = []string{"pull"}
+		}
+	} else if len(*openActions) > 0 {
+		return fmt.Errorf("fail_open_actions requires fail_mode: %s", ExtAuthzFailOpen)
+	}
 	return nil
 }
 
@@ -57,15 +116,79 @@ type ExtAuthz struct {
 
 func NewExtAuthzAuthorizer(cfg *ExtAuthzConfig) *ExtAuthz {
 	glog.Infof("External authorization: %s %s", cfg.Command, strings.Join(cfg.Args, " "))
+	if cfg.FailMode == ExtAuthzFailOpen {
+		glog.Warningf("External authorization fails open: if the command fails, %s will be allowed", strings.Join(cfg.FailOpenActions, ","))
+	}
 	return &ExtAuthz{cfg: cfg}
 }
 
 func (ea *ExtAuthz) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	d, err := ea.AuthorizeDetailed(ai)
+	if err != nil {
+		return nil, err
+	}
+	return d.Actions, nil
+}
+
+// AuthorizeDetailed uses the output of the command, if any, as the reason of a denial.
+func (ea *ExtAuthz) AuthorizeDetailed(ai *api.AuthRequestInfo) (*api.AuthzDecision, error) {
 	aiMarshal, err := json.Marshal(ai)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to json.Marshal AuthRequestInfo: %s", err)
 	}
 
+	deadline := time.Now().Add(ea.cfg.RetryDeadline)
+	backoff := ea.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		es, et, output := ea.run(aiMarshal)
+		switch ExtAuthzStatus(es) {
+		case ExtAuthzAllowed:
+			return &api.AuthzDecision{Actions: ai.Actions}, nil
+		case ExtAuthzDenied:
+			return &api.AuthzDecision{Actions: []string{}, Reason: strings.TrimSpace(output)}, nil
+		}
+		if attempt > ea.cfg.Retries || time.Now().Add(backoff).After(deadline) {
+			glog.Errorf("Ext command error: %d %s", es, et)
+			if ea.cfg.FailMode == ExtAuthzFailOpen {
+				return ea.failOpen(ai, es), nil
+			}
+			if attempt > 1 {
+				return nil, fmt.Errorf("bad return code from command: %d (%d attempts)", es, attempt)
+			}
+			return nil, fmt.Errorf("bad return code from command: %d", es)
+		}
+		glog.V(2).Infof("Ext command error: %d %s, retrying in %s", es, et, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxExtAuthzRetryBackoff {
+			backoff = maxExtAuthzRetryBackoff
+		}
+	}
+}
+
+// failOpen allows the requested actions that are listed in fail_open_actions.
+func (ea *ExtAuthz) failOpen(ai *api.AuthRequestInfo, es int) *api.AuthzDecision {
+	actions := failOpenActions(ai.Actions, ea.cfg.FailOpenActions)
+	atomic.AddUint64(&extAuthzFailOpen, 1)
+	glog.Errorf("FAIL OPEN: ext_authz command failed (%d), allowing %s to %s %s:%s", es, strings.Join(actions, ","), ai.Account, ai.Type, ai.Name)
+	return &api.AuthzDecision{Actions: actions, Reason: "authorization backend failed", NoCache: true}
+}
+
+// failOpenActions returns those of the requested actions that are listed in fail_open_actions.
+func failOpenActions(requested, openActions []string) []string {
+	actions := []string{}
+	for _, a := range requested {
+		for _, fa := range openActions {
+			if a == fa || fa == "*" {
+				actions = append(actions, a)
+				break
+			}
+		}
+	}
+	return actions
+}
+
+// run runs the command once and returns its exit status, error output and output.
+func (ea *ExtAuthz) run(aiMarshal []byte) (int, string, string) {
 	cmd := exec.Command(ea.cfg.Command, ea.cfg.Args...)
 	cmd.Stdin = strings.NewReader(fmt.Sprintf("%s", aiMarshal))
 	output, err := cmd.Output()
@@ -81,16 +204,7 @@ func (ea *ExtAuthz) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
 		et = fmt.Sprintf("cmd run error: %s", err)
 	}
 	glog.V(2).Infof("%s %s -> %d %s", cmd.Path, cmd.Args, es, output)
-
-	switch ExtAuthzStatus(es) {
-	case ExtAuthzAllowed:
-		return ai.Actions, nil
-	case ExtAuthzDenied:
-		return []string{}, nil
-	default:
-		glog.Errorf("Ext command error: %d %s", es, et)
-	}
-	return nil, fmt.Errorf("bad return code from command: %d", es)
+	return es, et, string(output)
 }
 
 func (sua *ExtAuthz) Stop() {
@@ -0,0 +1,149 @@
+package authz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// flakyCommand returns a command that fails with the specified exit code the first n times
+// and then exits with the final code.
+func flakyCommand(t *testing.T, dir string, n, code, final int) *ExtAuthzConfig {
+	script := filepath.Join(dir, "authz.sh")
+	counter := filepath.Join(dir, "attempts")
+	os.Remove(counter)
+	contents := "#!/bin/sh\n" +
+		"echo x >> " + counter + "\n" +
+		"[ $(wc -l < " + counter + ") -gt " + strconv.Itoa(n) + " ] && exit " + strconv.Itoa(final) + "\n" +
+		"exit " + strconv.Itoa(code) + "\n"
+	if err := ioutil.WriteFile(script, []byte(contents), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return &ExtAuthzConfig{Command: script}
+}
+
+func attempts(dir string) int {
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "attempts"))
+	return len(b) / 2
+}
+
+func TestExtAuthzRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ext_authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ai := &api.AuthRequestInfo{Account: "alice", Type: "repository", Name: "foo", Actions: []string{"pull"}}
+	cases := []struct {
+		failures, code, final int
+		retries               int
+		allowed, err          bool
+		attempts              int
+	}{
+		// No retries by default.
+		{1, 2, 0, 0, false, true, 1},
+		{2, 2, 0, 3, true, false, 3},
+		{5, 2, 0, 2, false, true, 3},
+		// Denial is final.
+		{0, 0, 1, 3, false, false, 1},
+	}
+	for i, c := range cases {
+		cfg := flakyCommand(t, dir, c.failures, c.code, c.final)
+		cfg.Retries = c.retries
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.RetryBackoff = time.Millisecond
+		actions, err := NewExtAuthzAuthorizer(cfg).Authorize(ai)
+		if (len(actions) > 0) != c.allowed || (err != nil) != c.err {
+			t.Errorf("%d: expected allowed: %t, error: %t, got %v, %v", i, c.allowed, c.err, actions, err)
+		}
+		if n := attempts(dir); n != c.attempts {
+			t.Errorf("%d: expected %d attempts, got %d", i, c.attempts, n)
+		}
+	}
+
+	// No retries past the deadline.
+	cfg := flakyCommand(t, dir, 5, 2, 0)
+	cfg.Retries, cfg.RetryBackoff, cfg.RetryDeadline = 5, 50*time.Millisecond, 60*time.Millisecond
+	if _, err := NewExtAuthzAuthorizer(cfg).Authorize(ai); err == nil {
+		t.Errorf("expected an error")
+	}
+	if n := attempts(dir); n != 2 {
+		t.Errorf("expected 2 attempts before the deadline, got %d", n)
+	}
+}
+
+func TestExtAuthzDenyReason(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ext_authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "authz.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'foo is frozen'\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ExtAuthzConfig{Command: script}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ai := &api.AuthRequestInfo{Account: "alice", Type: "repository", Name: "foo", Actions: []string{"push"}}
+	d, err := NewExtAuthzAuthorizer(cfg).AuthorizeDetailed(ai)
+	if err != nil || len(d.Actions) != 0 || d.Reason != "foo is frozen" {
+		t.Errorf("expected denial with reason, got %+v, %v", d, err)
+	}
+}
+
+func TestExtAuthzFailMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ext_authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ai := &api.AuthRequestInfo{Account: "alice", Type: "repository", Name: "foo", Actions: []string{"pull", "push"}}
+
+	// Errors fail closed by default.
+	cfg := flakyCommand(t, dir, 10, 2, 0)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewExtAuthzAuthorizer(cfg).Authorize(ai); err == nil {
+		t.Errorf("expected an error in closed mode")
+	}
+
+	cfg.FailMode = ExtAuthzFailOpen
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	failOpen := ExtAuthzFailOpenRequests()
+	d, err := NewExtAuthzAuthorizer(cfg).AuthorizeDetailed(ai)
+	if err != nil || len(d.Actions) != 1 || d.Actions[0] != "pull" || !d.NoCache {
+		t.Errorf("expected pull to be allowed in open mode, got %+v %v", d, err)
+	}
+	if ExtAuthzFailOpenRequests() != failOpen+1 {
+		t.Errorf("expected fail-open request to be counted")
+	}
+
+	// Denials are not affected.
+	cfg = flakyCommand(t, dir, 0, 0, 1)
+	cfg.FailMode = ExtAuthzFailOpen
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if actions, err := NewExtAuthzAuthorizer(cfg).Authorize(ai); err != nil || len(actions) != 0 {
+		t.Errorf("expected denial in open mode, got %v %v", actions, err)
+	}
+
+	for _, bad := range []*ExtAuthzConfig{{FailMode: "ajar"}, {FailOpenActions: []string{"pull"}}} {
+		bad.Command = cfg.Command
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
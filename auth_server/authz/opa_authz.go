@@ -0,0 +1,228 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+type OPAAuthzConfig struct {
+	// Address of the OPA server, e.g. http://localhost:8181.
+	URL string `yaml:"url,omitempty"`
+	// Alternatively, Rego policy files (or directories) to evaluate in-process.
+	PolicyPaths []string `yaml:"policy_paths,omitempty"`
+	// Path of the decision in the data document, e.g. docker_auth/authz/allow.
+	// The decision must be either a boolean (all or none of the requested actions
+	// are allowed) or a list of allowed actions.
+	Query   string        `yaml:"query,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// What happens if OPA can't be reached or returns an invalid decision, as in ext_authz:
+	// closed (default) denies the request, open allows those of the requested actions
+	// that are listed in fail_open_actions, default is pull.
+	FailMode        string   `yaml:"fail_mode,omitempty"`
+	FailOpenActions []string `yaml:"fail_open_actions,omitempty"`
+}
+
+// Number of requests allowed by opa_authz in fail-open mode, exported as a metric by the server.
+var opaAuthzFailOpen uint64
+
+// OPAAuthzFailOpenRequests returns the number of requests that opa_authz allowed because the query failed.
+func OPAAuthzFailOpenRequests() uint64 {
+	return atomic.LoadUint64(&opaAuthzFailOpen)
+}
+
+func (c *OPAAuthzConfig) Validate(configKey string) error {
+	if (c.URL == "") == (len(c.PolicyPaths) == 0) {
+		return fmt.Errorf("%s: exactly one of url and policy_paths must be set", configKey)
+	}
+	if c.Query == "" {
+		return fmt.Errorf("%s.query is required", configKey)
+	}
+	c.Query = strings.Trim(c.Query, "/")
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if err := validateFailMode(&c.FailMode, &c.FailOpenActions); err != nil {
+		return fmt.Errorf("%s.%s", configKey, err)
+	}
+	return nil
+}
+
+// opaInput is the input document of the query.
+type opaInput struct {
+	Account string     `json:"account"`
+	Type    string     `json:"type"`
+	Class   string     `json:"class,omitempty"`
+	Name    string     `json:"name"`
+	Service string     `json:"service"`
+	IP      string     `json:"ip"`
+	Actions []string   `json:"actions"`
+	Labels  api.Labels `json:"labels"`
+}
+
+type opaAuthorizer struct {
+	config *OPAAuthzConfig
+	client *http.Client
+	query  *rego.PreparedEvalQuery
+}
+
+func NewOPAAuthorizer(c *OPAAuthzConfig) (api.Authorizer, error) {
+	oa := &opaAuthorizer{config: c}
+	if c.FailMode == ExtAuthzFailOpen {
+		glog.Warningf("OPA authorization fails open: if the query fails, %s will be allowed", strings.Join(c.FailOpenActions, ","))
+	}
+	if c.URL != "" {
+		oa.client = &http.Client{Timeout: c.Timeout}
+		glog.Infof("OPA authorization, %s/v1/data/%s", c.URL, c.Query)
+		return oa, nil
+	}
+	q := "data." + strings.Replace(c.Query, "/", ".", -1)
+	pq, err := rego.New(rego.Query(q), rego.Load(c.PolicyPaths, nil)).PrepareForEval(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OPA policy: %s", err)
+	}
+	oa.query = &pq
+	glog.Infof("OPA authorization, %s from %s", q, strings.Join(c.PolicyPaths, ", "))
+	return oa, nil
+}
+
+func (oa *opaAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	input := &opaInput{
+		Account: ai.Account,
+		Type:    ai.Type,
+		Class:   ai.Class,
+		Name:    ai.Name,
+		Service: ai.Service,
+		Actions: ai.Actions,
+		Labels:  ai.Labels,
+	}
+	if ai.IP != nil {
+		input.IP = ai.IP.String()
+	}
+	var result interface{}
+	var err error
+	if oa.query != nil {
+		result, err = oa.evalLocal(input)
+	} else {
+		result, err = oa.evalRemote(input)
+	}
+	if err == nil {
+		var actions []string
+		if actions, err = decisionActions(result, ai.Actions); err == nil {
+			return actions, nil
+		}
+	}
+	if oa.config.FailMode == ExtAuthzFailOpen {
+		actions := failOpenActions(ai.Actions, oa.config.FailOpenActions)
+		atomic.AddUint64(&opaAuthzFailOpen, 1)
+		glog.Errorf("FAIL OPEN: OPA query for %s failed, allowing %s: %s", ai, strings.Join(actions, ","), err)
+		return actions, nil
+	}
+	glog.Errorf("OPA query for %s failed, denying: %s", ai, err)
+	return []string{}, nil
+}
+
+func (oa *opaAuthorizer) evalLocal(input *opaInput) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oa.config.Timeout)
+	defer cancel()
+	rs, err := oa.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		// Undefined decision.
+		return nil, nil
+	}
+	return rs[0].Expressions[0].Value, nil
+}
+
+func (oa *opaAuthorizer) evalRemote(input *opaInput) (interface{}, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := oa.client.Post(fmt.Sprintf("%s/v1/data/%s", strings.TrimRight(oa.config.URL, "/"), oa.config.Query), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OPA returned %d: %s", resp.StatusCode, respBody)
+	}
+	var r struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return nil, fmt.Errorf("invalid OPA response %q: %s", respBody, err)
+	}
+	return r.Result, nil
+}
+
+// decisionActions interprets the decision and returns the allowed subset of the requested actions.
+func decisionActions(result interface{}, requested []string) ([]string, error) {
+	switch r := result.(type) {
+	case nil:
+		return []string{}, nil
+	case bool:
+		if r {
+			return requested, nil
+		}
+		return []string{}, nil
+	case []interface{}:
+		allowed := map[string]bool{}
+		for _, a := range r {
+			s, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid decision %v: must be a boolean or a list of strings", result)
+			}
+			allowed[s] = true
+		}
+		actions := []string{}
+		for _, a := range requested {
+			if allowed[a] || allowed["*"] {
+				actions = append(actions, a)
+			}
+		}
+		return actions, nil
+	default:
+		return nil, fmt.Errorf("invalid decision %v: must be a boolean or a list of strings", result)
+	}
+}
+
+func (oa *opaAuthorizer) Stop() {
+}
+
+func (oa *opaAuthorizer) Name() string {
+	return "OPA"
+}
@@ -0,0 +1,138 @@
+package authz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const testOPAPolicy = `
+package docker_auth.authz
+
+default allow = false
+
+allow {
+	input.account == "admin"
+}
+
+actions = ["pull"] {
+	input.labels.group[_] == "readers"
+}
+`
+
+func TestOPAAuthzLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "policy.rego")
+	ioutil.WriteFile(policy, []byte(testOPAPolicy), 0644)
+
+	pullPush := []string{"pull", "push"}
+	cases := []struct {
+		query   string
+		ai      api.AuthRequestInfo
+		actions []string
+	}{
+		{"docker_auth/authz/allow", api.AuthRequestInfo{Account: "admin", Actions: pullPush}, pullPush},
+		{"docker_auth/authz/allow", api.AuthRequestInfo{Account: "bob", Actions: pullPush}, []string{}},
+		{"docker_auth/authz/actions", api.AuthRequestInfo{Account: "bob", Actions: pullPush, Labels: api.Labels{"group": {"readers"}}}, []string{"pull"}},
+		// Undefined.
+		{"docker_auth/authz/actions", api.AuthRequestInfo{Account: "bob", Actions: pullPush}, []string{}},
+	}
+	for i, c := range cases {
+		oc := &OPAAuthzConfig{PolicyPaths: []string{policy}, Query: c.query}
+		if err := oc.Validate("opa_authz"); err != nil {
+			t.Fatalf("invalid config: %s", err)
+		}
+		oa, err := NewOPAAuthorizer(oc)
+		if err != nil {
+			t.Fatalf("failed to create authorizer: %s", err)
+		}
+		if actions, err := oa.Authorize(&c.ai); err != nil || !reflect.DeepEqual(actions, c.actions) {
+			t.Errorf("%d: expected %v, got %v, %v", i, c.actions, actions, err)
+		}
+	}
+}
+
+func TestOPAAuthzRemote(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/data/docker_auth/authz/actions" {
+			http.Error(rw, "not found", http.StatusNotFound)
+			return
+		}
+		var r struct {
+			Input opaInput `json:"input"`
+		}
+		json.NewDecoder(req.Body).Decode(&r)
+		if r.Input.IP == "10.0.0.1" {
+			rw.Write([]byte(`{"result": ["push", "delete"]}`))
+		} else {
+			rw.Write([]byte(`{"result": "yes"}`))
+		}
+	}))
+	defer s.Close()
+
+	pullPush := []string{"pull", "push"}
+	cases := []struct {
+		url, query  string
+		failMode    string
+		openActions []string
+		ip          net.IP
+		actions     []string
+	}{
+		{s.URL, "docker_auth/authz/actions", "", nil, net.IPv4(10, 0, 0, 1), []string{"push"}},
+		// Invalid decision.
+		{s.URL, "docker_auth/authz/actions", "", nil, net.IPv4(10, 0, 0, 2), []string{}},
+		{s.URL, "docker_auth/authz/actions", "open", nil, net.IPv4(10, 0, 0, 2), []string{"pull"}},
+		// Errors.
+		{s.URL, "/docker_auth/authz/allow/", "closed", nil, nil, []string{}},
+		{s.URL, "docker_auth/authz/allow", "open", []string{"*"}, nil, pullPush},
+		{"http://127.0.0.1:0", "docker_auth/authz/actions", "", nil, nil, []string{}},
+	}
+	for i, c := range cases {
+		oc := &OPAAuthzConfig{URL: c.url, Query: c.query, FailMode: c.failMode, FailOpenActions: c.openActions}
+		if err := oc.Validate("opa_authz"); err != nil {
+			t.Fatalf("invalid config: %s", err)
+		}
+		oa, _ := NewOPAAuthorizer(oc)
+		before := OPAAuthzFailOpenRequests()
+		if actions, err := oa.Authorize(&api.AuthRequestInfo{Account: "bob", IP: c.ip, Actions: pullPush}); err != nil || !reflect.DeepEqual(actions, c.actions) {
+			t.Errorf("%d: expected %v, got %v, %v", i, c.actions, actions, err)
+		}
+		if n := OPAAuthzFailOpenRequests() - before; (c.failMode == "open") != (n == 1) {
+			t.Errorf("%d: unexpected number of fail-open requests: %d", i, n)
+		}
+	}
+}
+
+func TestOPAFailModeValidation(t *testing.T) {
+	for _, c := range []struct {
+		failMode    string
+		openActions []string
+		err         string
+	}{
+		{"", nil, ""},
+		{"closed", nil, ""},
+		{"open", []string{"pull", "push"}, ""},
+		{"sometimes", nil, `opa_authz.fail_mode must be closed or open, got "sometimes"`},
+		{"closed", []string{"pull"}, "opa_authz.fail_open_actions requires fail_mode: open"},
+	} {
+		oc := &OPAAuthzConfig{URL: "http://localhost:8181", Query: "q", FailMode: c.failMode, FailOpenActions: c.openActions}
+		err := oc.Validate("opa_authz")
+		if c.err == "" && (err != nil || (oc.FailMode != "closed" && oc.FailMode != "open")) {
+			t.Errorf("%q: expected to be valid, got %v", c.failMode, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("%q: expected %q, got %v", c.failMode, c.err, err)
+		}
+	}
+}
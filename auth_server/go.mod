@@ -3,9 +3,12 @@ module github.com/cesanta/docker_auth/auth_server
 go 1.12
 
 require (
-	cloud.google.com/go v0.44.3
+	cloud.google.com/go v0.111.0
+	cloud.google.com/go/storage v1.30.1
 	github.com/a-urth/go-bindata v0.0.0-20180209162145-df38da164efc // indirect
+	github.com/casbin/casbin/v2 v2.31.0
 	github.com/cesanta/glog v0.0.0-20150527111657-22eb27a0ae19
+	github.com/coreos/go-oidc v2.1.0+incompatible
 	github.com/dchest/uniuri v0.0.0-20160212164326-8902c56451e9
 	github.com/deckarep/golang-set v1.7.1
 	github.com/docker/distribution v2.7.1+incompatible
@@ -14,15 +17,30 @@ require (
 	github.com/facebookgo/httpdown v0.0.0-20180706035922-5979d39b15c2
 	github.com/facebookgo/stats v0.0.0-20151006221625-1b76add642e4 // indirect
 	github.com/go-ldap/ldap v3.0.3+incompatible
+	github.com/go-sql-driver/mysql v1.4.1
+	github.com/gomodule/redigo v1.9.2
 	github.com/gorilla/mux v1.7.3 // indirect
+	github.com/hashicorp/golang-lru v0.5.1
+	github.com/lib/pq v1.2.0
+	github.com/open-policy-agent/opa v0.19.2
+	github.com/pquerna/cachecontrol v0.2.0 // indirect
+	github.com/prometheus/client_golang v1.1.0
 	github.com/schwarmco/go-cartesian-product v0.0.0-20180515110546-d5ee747a6dc9
 	github.com/sirupsen/logrus v1.4.2 // indirect
 	github.com/syndtr/goleveldb v1.0.0
-	golang.org/x/crypto v0.0.0-20190820162420-60c769a6c586
-	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
-	google.golang.org/api v0.9.0
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+	golang.org/x/crypto v0.16.0
+	golang.org/x/net v0.19.0
+	golang.org/x/oauth2 v0.15.0
+	golang.org/x/time v0.3.0
+	google.golang.org/api v0.149.0
 	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
 	gopkg.in/fsnotify.v1 v1.4.7
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
-	gopkg.in/yaml.v2 v2.2.2
+	gopkg.in/square/go-jose.v2 v2.6.0
+	gopkg.in/yaml.v2 v2.2.3
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -19,18 +19,23 @@
 package main // import "github.com/cesanta/docker_auth/auth_server"
 
 import (
+	"bufio"
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/cesanta/glog"
 	"github.com/facebookgo/httpdown"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
 	fsnotify "gopkg.in/fsnotify.v1"
 
 	"github.com/cesanta/docker_auth/auth_server/server"
@@ -38,9 +43,30 @@ import (
 
 type RestartableServer struct {
 	configFile string
+	config     *server.Config
 	hd         *httpdown.HTTP
 	authServer *server.AuthServer
 	hs         httpdown.Server
+	ms         httpdown.Server
+}
+
+func ServeMetrics(c *server.Config, hd *httpdown.HTTP) httpdown.Server {
+	mc := c.Server.Metrics
+	if mc == nil || mc.ListenAddress == "" {
+		return nil
+	}
+	path := mc.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, server.MetricsHandler())
+	s, err := hd.ListenAndServe(&http.Server{Addr: mc.ListenAddress, Handler: mux})
+	if err != nil {
+		glog.Exitf("Failed to set up metrics listener: %s", err)
+	}
+	glog.Infof("Serving metrics on %s%s", mc.ListenAddress, path)
+	return s
 }
 
 func ServeOnce(c *server.Config, cf string, hd *httpdown.HTTP) (*server.AuthServer, httpdown.Server) {
@@ -50,9 +76,7 @@ func ServeOnce(c *server.Config, cf string, hd *httpdown.HTTP) (*server.AuthServ
 		glog.Exitf("Failed to create auth server: %s", err)
 	}
 
-	tlsConfig := &tls.Config{
-		PreferServerCipherSuites: true,
-	}
+	tlsConfig := c.Server.BaseTLSConfig()
 	if c.Server.CertFile != "" || c.Server.KeyFile != "" {
 		// Check for partial configuration.
 		if c.Server.CertFile == "" || c.Server.KeyFile == "" {
@@ -81,9 +105,10 @@ func ServeOnce(c *server.Config, cf string, hd *httpdown.HTTP) (*server.AuthServ
 		tlsConfig = nil
 	}
 	hs := &http.Server{
-		Addr:      c.Server.ListenAddress,
-		Handler:   as,
-		TLSConfig: tlsConfig,
+		Addr:           c.Server.ListenAddress,
+		Handler:        as,
+		TLSConfig:      tlsConfig,
+		MaxHeaderBytes: c.Server.MaxHeaderBytes,
 	}
 
 	s, err := hd.ListenAndServe(hs)
@@ -95,7 +120,9 @@ func ServeOnce(c *server.Config, cf string, hd *httpdown.HTTP) (*server.AuthServ
 }
 
 func (rs *RestartableServer) Serve(c *server.Config) {
+	rs.config = c
 	rs.authServer, rs.hs = ServeOnce(c, rs.configFile, rs.hd)
+	rs.ms = ServeMetrics(c, rs.hd)
 	rs.WatchConfig()
 }
 
@@ -108,9 +135,17 @@ func (rs *RestartableServer) WatchConfig() {
 
 	stopSignals := make(chan os.Signal, 1)
 	signal.Notify(stopSignals, syscall.SIGTERM, syscall.SIGINT)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	reopenSignals := make(chan os.Signal, 1)
+	signal.Notify(reopenSignals, syscall.SIGUSR1)
 
-	err = w.Add(rs.configFile)
+	if !server.IsConfigURL(rs.configFile) {
+		err = w.Add(rs.configFile)
+	}
+	// Remote configs are only reloaded on SIGHUP.
 	watching, needRestart := (err == nil), false
+	rs.watchIncludes(w)
 	for {
 		select {
 		case <-time.After(1 * time.Second):
@@ -123,26 +158,52 @@ func (rs *RestartableServer) WatchConfig() {
 				}
 			} else if needRestart {
 				rs.MaybeRestart()
+				rs.watchIncludes(w)
 				needRestart = false
 			}
 		case ev := <-w.Events:
-			if ev.Op == fsnotify.Remove {
+			if ev.Name != rs.configFile {
+				// One of the included files, the config will fail to load if it was removed.
+				if ev.Op&(fsnotify.Write|fsnotify.Remove) != 0 {
+					needRestart = true
+				}
+			} else if ev.Op == fsnotify.Remove {
 				glog.Warningf("Config file disappeared, serving continues")
 				w.Remove(rs.configFile)
 				watching, needRestart = false, false
 			} else if ev.Op == fsnotify.Write {
 				needRestart = true
 			}
+		case <-reloadSignals:
+			rs.Reload()
+			rs.watchIncludes(w)
+		case <-reopenSignals:
+			glog.Infof("SIGUSR1 received, reopening logs")
+			rs.authServer.ReopenLogs()
 		case s := <-stopSignals:
 			signal.Stop(stopSignals)
 			glog.Infof("Signal: %s", s)
 			rs.hs.Stop()
+			rs.stopMetrics()
 			rs.authServer.Stop()
 			glog.Exitf("Exiting")
 		}
 	}
 }
 
+// watchIncludes adds watches for files included by the config file, so that changes of them
+// also cause a restart.
+func (rs *RestartableServer) watchIncludes(w *fsnotify.Watcher) {
+	for _, f := range rs.config.Files() {
+		if f == rs.configFile {
+			continue
+		}
+		if err := w.Add(f); err != nil {
+			glog.Warningf("Failed to set up watcher for included config file %s: %s", f, err)
+		}
+	}
+}
+
 func (rs *RestartableServer) MaybeRestart() {
 	glog.Infof("Validating new config")
 	c, err := server.LoadConfig(rs.configFile)
@@ -152,16 +213,135 @@ func (rs *RestartableServer) MaybeRestart() {
 	}
 	glog.Infof("Config ok, restarting server")
 	rs.hs.Stop()
+	rs.stopMetrics()
 	rs.authServer.Stop()
+	rs.config = c
 	rs.authServer, rs.hs = ServeOnce(c, rs.configFile, rs.hd)
+	rs.ms = ServeMetrics(c, rs.hd)
+}
+
+func (rs *RestartableServer) stopMetrics() {
+	if rs.ms != nil {
+		rs.ms.Stop()
+		rs.ms = nil
+	}
+}
+
+func metricsAddr(c *server.Config) string {
+	if c.Server.Metrics == nil {
+		return ""
+	}
+	return c.Server.Metrics.ListenAddress
 }
 
+// Reload applies new config to the running server without restarting the listener.
+// If the new config is invalid, the current one remains in effect.
+func (rs *RestartableServer) Reload() {
+	glog.Infof("SIGHUP received, reloading config")
+	c, err := server.ReloadConfig(rs.configFile, rs.config)
+	if err != nil {
+		glog.Errorf("Failed to reload config (current config remains in effect): %s", err)
+		return
+	}
+	if c.Server.ListenAddress != rs.config.Server.ListenAddress ||
+		c.Server.CertFile != rs.config.Server.CertFile || c.Server.KeyFile != rs.config.Server.KeyFile ||
+		c.Server.LetsEncrypt != rs.config.Server.LetsEncrypt || metricsAddr(c) != metricsAddr(rs.config) ||
+		c.Server.TLSMinVersion != rs.config.Server.TLSMinVersion || c.Server.ClientAuth != rs.config.Server.ClientAuth ||
+		strings.Join(c.Server.TLSCipherSuites, ",") != strings.Join(rs.config.Server.TLSCipherSuites, ",") {
+		glog.Warningf("Listener settings have changed, they will only take effect after restart")
+	}
+	if err := rs.authServer.Reload(c); err != nil {
+		glog.Errorf("Failed to apply new config (current config remains in effect): %s", err)
+		return
+	}
+	rs.config = c
+	glog.Infof("Config reloaded from %s (%d users, %d ACL static entries)", rs.configFile, len(c.Users), len(c.ACL))
+}
+
+// HashPassword reads a password from stdin and prints its BCrypt hash,
+// suitable for use in the static user map. If a config file is given,
+// users_bcrypt_cost from it is used, otherwise bcrypt.DefaultCost.
+func HashPassword(cf string) {
+	cost := bcrypt.DefaultCost
+	if cf != "" {
+		c, err := server.LoadConfig(cf)
+		if err != nil {
+			glog.Exitf("Failed to load config: %s", err)
+		}
+		if c.UsersBcryptCost != 0 {
+			cost = c.UsersBcryptCost
+		}
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		glog.Exitf("Failed to read password: %s", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		glog.Exitf("Password is empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		glog.Exitf("Failed to hash password: %s", err)
+	}
+	fmt.Println(string(hash))
+}
+
+// CheckConfig loads and validates the config file without starting the server
+// and exits with a non-zero status if it is invalid.
+// Backends are only connected to if checkBackends is set.
+func CheckConfig(cf string, checkBackends bool) {
+	if err := checkConfig(cf, checkBackends); err != nil {
+		glog.Exit(err)
+	}
+	fmt.Printf("Config %s is valid\n", cf)
+}
+
+func checkConfig(cf string, checkBackends bool) error {
+	if cf == "" {
+		return errors.New("config file not specified")
+	}
+	c, err := server.LoadConfig(cf)
+	if err != nil {
+		return fmt.Errorf("config check failed: %s", err)
+	}
+	if checkBackends {
+		as, err := server.NewAuthServer(c)
+		if err != nil {
+			return fmt.Errorf("backend check failed: %s", err)
+		}
+		err = as.CheckBackends()
+		as.Stop()
+		if err != nil {
+			return fmt.Errorf("backend check failed: %s", err)
+		}
+	}
+	return nil
+}
+
+var expandEnv = flag.Bool("config_env", true, "Expand environment variable references (${VAR}, ${VAR:-default}, $VAR) in the config file")
+var checkBackends = flag.Bool("check_backends", false, "With validate, also check that the backends are reachable")
+var configFetchTimeout = flag.Duration("config_fetch_timeout", server.ConfigFetchTimeout, "Timeout of fetching the config from an http(s) URL")
+var configAuthorizationFile = flag.String("config_authorization_file", "", "File with the value of the Authorization header to send when fetching the config from an http(s) URL")
+
 func main() {
 	flag.Parse()
+	server.ExpandEnv = *expandEnv
+	server.ConfigFetchTimeout, server.ConfigAuthorizationFile = *configFetchTimeout, *configAuthorizationFile
 	rand.Seed(time.Now().UnixNano())
 	glog.CopyStandardLogTo("INFO")
 
+	if flag.Arg(0) == "hash_password" {
+		HashPassword(flag.Arg(1))
+		return
+	}
+	if flag.Arg(0) == "validate" {
+		CheckConfig(flag.Arg(1), *checkBackends)
+		return
+	}
+
 	glog.Infof("docker_auth %s build %s", Version, BuildId)
+	server.Version, server.BuildID = Version, BuildId
 
 	cf := flag.Arg(0)
 	if cf == "" {
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, extra string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "token.pem"), filepath.Join(dir, "token.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	cf := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(cf, []byte(`server: {addr: ":0"}
+token: {issuer: test, expiration: 900, certificate: "`+certFile+`", key: "`+keyFile+`"}
+`+extra), 0600)
+	return cf
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := checkConfig("", false); err == nil {
+		t.Errorf("expected an error without a config file")
+	}
+	if err := checkConfig(writeConfig(t, dir, "users: {admin: {}}\nacl: [{match: {account: admin}, actions: ['*']}]\n"), false); err != nil {
+		t.Errorf("expected config to be valid, got %s", err)
+	}
+	err = checkConfig(writeConfig(t, dir, `users: {admin: {}}
+acl:
+  - match: {account: "admin"}
+    actions: ["*"]
+  - match: {account: "/[/"}
+    actions: ["pull"]
+`), false)
+	if err == nil || !strings.Contains(err.Error(), "invalid ACL") || !strings.Contains(err.Error(), "line 7") {
+		t.Errorf("expected invalid ACL at line 7, got %v", err)
+	}
+}
+
+func TestCheckConfigBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A server that closes connections right away, so the LDAP health check fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var conns int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			c.Close()
+		}
+	}()
+	passwordFile := filepath.Join(dir, "bind_password")
+	ioutil.WriteFile(passwordFile, []byte("secret"), 0600)
+	cf := writeConfig(t, dir, `ldap_auth:
+  addr: "`+l.Addr().String()+`"
+  tls: none
+  bind_dn: "cn=reader"
+  bind_password_file: "`+passwordFile+`"
+  base: "dc=example,dc=com"
+  filter: "(uid=${account})"
+acl: [{match: {account: admin}, actions: ['*']}]
+`)
+
+	if err := checkConfig(cf, false); err != nil {
+		t.Fatalf("expected config to be valid, got %s", err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 0 {
+		t.Errorf("expected backends not to be contacted, got %d connections", n)
+	}
+	if err := checkConfig(cf, true); err == nil || !strings.Contains(err.Error(), "backend check failed") {
+		t.Errorf("expected backend check to fail, got %v", err)
+	}
+	if n := atomic.LoadInt32(&conns); n == 0 {
+		t.Errorf("expected the LDAP server to be contacted")
+	}
+}
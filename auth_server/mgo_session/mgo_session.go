@@ -18,6 +18,7 @@ package mgo_session
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -33,6 +34,27 @@ type Config struct {
 	DialInfo     mgo.DialInfo `yaml:",inline"`
 	PasswordFile string       `yaml:"password_file,omitempty"`
 	EnableTLS    bool         `yaml:"enable_tls,omitempty"`
+	// TLS settings, implies enable_tls.
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+	// Database to authenticate against, if different from database.
+	AuthSource string `yaml:"auth_source,omitempty"`
+	// Name of the replica set to connect to.
+	ReplicaSet string `yaml:"replica_set,omitempty"`
+	// Timeout of operations, if different from timeout (that also applies to connecting).
+	SocketTimeout time.Duration `yaml:"socket_timeout,omitempty"`
+	// Delay before retrying an operation after the session has been refreshed due to a session error, see Retry.
+	ReconnectBackoff time.Duration `yaml:"reconnect_backoff,omitempty"`
+	// Whether to retry operations that failed due to session errors, default is true.
+	RetryReads *bool `yaml:"retry_reads,omitempty"`
+}
+
+type TLSConfig struct {
+	// CA certificates to verify the server certificate with. If not set, system CAs are used.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Client certificate and key, for x509 authentication.
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
 }
 
 // Validate ensures the most common fields inside the mgo.DialInfo portion of
@@ -48,13 +70,53 @@ func (c *Config) Validate(configKey string) error {
 	if c.DialInfo.Database == "" {
 		return fmt.Errorf("%s.dial_info.database is required", configKey)
 	}
+	if c.SocketTimeout < 0 {
+		return fmt.Errorf("%s.dial_info.socket_timeout must not be negative", configKey)
+	}
+	if c.ReconnectBackoff < 0 {
+		return fmt.Errorf("%s.dial_info.reconnect_backoff must not be negative", configKey)
+	}
+	if c.TLS != nil {
+		if c.TLS.CAFile != "" {
+			if _, err := ioutil.ReadFile(c.TLS.CAFile); err != nil {
+				return fmt.Errorf("%s.dial_info.tls.ca_file: %s", configKey, err)
+			}
+		}
+		if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+			return fmt.Errorf("%s.dial_info.tls: cert_file and key_file must be set together", configKey)
+		}
+	}
 	return nil
 }
 
-func New(c *Config) (*mgo.Session, error) {
-	// Attempt to create a MongoDB session which we can re-use when handling
-	// multiple requests. We can optionally read in the password from a file or directly from the config.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{}
+	if c.TLS == nil {
+		return tc, nil
+	}
+	tc.InsecureSkipVerify = c.TLS.InsecureSkipVerify
+	if c.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %s", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLS.CAFile)
+		}
+	}
+	if c.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
 
+// dialInfo returns DialInfo with all the settings applied.
+func (c *Config) dialInfo() (*mgo.DialInfo, error) {
 	// Read in the password (if any)
 	if c.PasswordFile != "" {
 		passBuf, err := ioutil.ReadFile(c.PasswordFile)
@@ -63,19 +125,44 @@ func New(c *Config) (*mgo.Session, error) {
 		}
 		c.DialInfo.Password = strings.TrimSpace(string(passBuf))
 	}
+	if c.AuthSource != "" {
+		c.DialInfo.Source = c.AuthSource
+	}
+	if c.ReplicaSet != "" {
+		c.DialInfo.ReplicaSetName = c.ReplicaSet
+	}
 
-	if c.EnableTLS {
+	if c.EnableTLS || c.TLS != nil {
+		tc, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
 		c.DialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
-			return tls.Dial("tcp", addr.String(), &tls.Config{})
+			return tls.Dial("tcp", addr.String(), tc)
 		}
 	}
+	return &c.DialInfo, nil
+}
+
+var dialWithInfo = mgo.DialWithInfo
+
+func New(c *Config) (*mgo.Session, error) {
+	// Attempt to create a MongoDB session which we can re-use when handling
+	// multiple requests. We can optionally read in the password from a file or directly from the config.
+	info, err := c.dialInfo()
+	if err != nil {
+		return nil, err
+	}
 
 	glog.V(2).Infof("Creating MongoDB session (operation timeout %s)", c.DialInfo.Timeout)
 
-	session, err := mgo.DialWithInfo(&c.DialInfo)
+	session, err := dialWithInfo(info)
 	if err != nil {
 		return nil, err
 	}
+	if c.SocketTimeout > 0 {
+		session.SetSocketTimeout(c.SocketTimeout)
+	}
 
 	return session, nil
 }
@@ -0,0 +1,152 @@
+package mgo_session
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestTLSDialInfo(t *testing.T) {
+	s := httptest.NewTLSServer(nil)
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "mgo_session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Server certificate doubles as the CA and the client certificate.
+	cert := s.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	c := &Config{
+		DialInfo:   mgo.DialInfo{Addrs: []string{s.Listener.Addr().String()}, Database: "docker_auth"},
+		TLS:        &TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+		AuthSource: "admin",
+		ReplicaSet: "rs0",
+	}
+	if err := c.Validate("mongo_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	var info *mgo.DialInfo
+	dialWithInfo = func(di *mgo.DialInfo) (*mgo.Session, error) {
+		info = di
+		return nil, errors.New("not dialing")
+	}
+	defer func() { dialWithInfo = mgo.DialWithInfo }()
+	New(c)
+
+	if info == nil || info.Source != "admin" || info.ReplicaSetName != "rs0" || info.Timeout != 10*time.Second || info.DialServer == nil {
+		t.Fatalf("unexpected dial info: %+v", info)
+	}
+	tc, err := c.tlsConfig()
+	if err != nil || tc.RootCAs == nil || len(tc.Certificates) != 1 || tc.InsecureSkipVerify {
+		t.Fatalf("unexpected TLS config: %+v, %v", tc, err)
+	}
+	// The server certificate is verified against the CA file.
+	conn, err := tls.Dial("tcp", s.Listener.Addr().String(), tc)
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %s", err)
+	}
+	conn.Close()
+}
+
+func TestTLSValidation(t *testing.T) {
+	cases := []struct {
+		tls *TLSConfig
+		ok  bool
+	}{
+		{nil, true},
+		{&TLSConfig{}, true},
+		{&TLSConfig{InsecureSkipVerify: true}, true},
+		{&TLSConfig{CAFile: "/nonexistent/ca.pem"}, false},
+		{&TLSConfig{CertFile: "cert.pem"}, false},
+	}
+	for i, tc := range cases {
+		c := &Config{DialInfo: mgo.DialInfo{Addrs: []string{"localhost"}, Database: "docker_auth"}, TLS: tc.tls}
+		if err := c.Validate("mongo_auth"); tc.ok != (err == nil) {
+			t.Errorf("%d: expected ok = %t, got %v", i, tc.ok, err)
+		}
+	}
+}
+
+// fakeSession fails operations with a session error from the time it is dropped until it is refreshed.
+type fakeSession struct {
+	dropped   bool
+	refreshes int
+}
+
+func (s *fakeSession) Refresh() {
+	s.refreshes++
+	s.dropped = false
+}
+
+func (s *fakeSession) query() error {
+	if s.dropped {
+		return io.EOF
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	c := &Config{DialInfo: mgo.DialInfo{Addrs: []string{"localhost"}, Database: "docker_auth"}, ReconnectBackoff: time.Millisecond}
+	if err := c.Validate("mongo_auth"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	s := &fakeSession{}
+	if err := c.Retry(s, s.query); err != nil || s.refreshes != 0 {
+		t.Fatalf("expected success without reconnecting, got %v, %d refreshes", err, s.refreshes)
+	}
+	// The request during which the session is dropped is retried after reconnecting.
+	s.dropped = true
+	if err := c.Retry(s, s.query); err != nil || s.refreshes != 1 {
+		t.Errorf("expected success after reconnecting, got %v, %d refreshes", err, s.refreshes)
+	}
+	// Without retries, that request fails, but the next one succeeds.
+	retry := false
+	c.RetryReads = &retry
+	s.dropped = true
+	if err := c.Retry(s, s.query); err != io.EOF {
+		t.Errorf("expected the request to fail, got %v", err)
+	}
+	if err := c.Retry(s, s.query); err != nil || s.refreshes != 2 {
+		t.Errorf("expected the next request to succeed, got %v, %d refreshes", err, s.refreshes)
+	}
+	// Other errors are returned as they are.
+	if err := c.Retry(s, func() error { return mgo.ErrNotFound }); err != mgo.ErrNotFound || s.refreshes != 2 {
+		t.Errorf("expected not found error without reconnecting, got %v, %d refreshes", err, s.refreshes)
+	}
+}
+
+func TestIsSessionError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		io.EOF:                          true,
+		errors.New("Closed explicitly"): true,
+		&mgo.QueryError{Code: 10107, Message: "not master"}:                   true,
+		&mgo.LastError{Code: 11602}:                                           true,
+		&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}: true,
+		mgo.ErrNotFound:                    false,
+		&mgo.QueryError{Code: 11000}:       false,
+		errors.New("E11000 duplicate key"): false,
+	} {
+		if IsSessionError(err) != expected {
+			t.Errorf("%v: expected %t", err, expected)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mgo_session
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	defaultReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff     = 5 * time.Second
+)
+
+// Codes of server errors that mean the node can't serve the request anymore, e.g. because
+// the primary stepped down during a failover, and another one should be used.
+var sessionErrorCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// IsSessionError returns true for errors that indicate that the session's connection is broken
+// or goes to a node that is no longer the primary. Such sessions need to be refreshed.
+func IsSessionError(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *mgo.QueryError:
+		return sessionErrorCodes[e.Code]
+	case *mgo.LastError:
+		return sessionErrorCodes[e.Code]
+	case net.Error:
+		return true
+	}
+	if err == io.EOF {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{"Closed explicitly", "no reachable servers", "not master", "connection reset"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresher is implemented by *mgo.Session.
+type Refresher interface {
+	Refresh()
+}
+
+func (c *Config) reconnectBackoff() time.Duration {
+	if c.ReconnectBackoff == 0 {
+		return defaultReconnectBackoff
+	}
+	return c.ReconnectBackoff
+}
+
+func (c *Config) retryReads() bool {
+	return c.RetryReads == nil || *c.RetryReads
+}
+
+// Retry calls op, which should use a copy of the session. If it fails with a session error,
+// the session is refreshed, so that the connection is re-established (to the new primary, if
+// there was a failover), and op is retried after reconnect_backoff, doubled after every attempt,
+// for as long as the dial timeout allows. If retry_reads is disabled, op is not retried, but
+// the session is still refreshed for the requests that follow.
+func (c *Config) Retry(s Refresher, op func() error) error {
+	start := time.Now()
+	backoff := c.reconnectBackoff()
+	for {
+		err := op()
+		if !IsSessionError(err) {
+			return err
+		}
+		s.Refresh()
+		if !c.retryReads() || time.Since(start)+backoff > c.DialInfo.Timeout {
+			glog.Warningf("MongoDB session error, reconnecting: %s", err)
+			return err
+		}
+		glog.Warningf("MongoDB session error, reconnecting and retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+)
+
+type AuditConfig struct {
+	// File to append audit records to.
+	File string `yaml:"file,omitempty"`
+	// Rotate the file once it reaches this size, keeping max_backups previous files (file.1, file.2, ...).
+	// If not set, the file is not rotated by the server, but it can be rotated externally:
+	// it is reopened on SIGUSR1.
+	MaxSizeMB  int `yaml:"max_size_mb,omitempty"`
+	MaxBackups int `yaml:"max_backups,omitempty"`
+	// Alternatively, send records to syslog: "local" or udp://host:port, tcp://host:port.
+	Syslog string `yaml:"syslog,omitempty"`
+	// Tag of the syslog messages, default is docker_auth.
+	SyslogTag string `yaml:"syslog_tag,omitempty"`
+}
+
+func (c *AuditConfig) validate() error {
+	if (c.File == "") == (c.Syslog == "") {
+		return fmt.Errorf("audit: exactly one of file and syslog must be set")
+	}
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("audit.{max_size_mb,max_backups} must not be negative")
+	}
+	if c.MaxSizeMB > 0 && c.MaxBackups == 0 {
+		c.MaxBackups = 5
+	}
+	if c.Syslog != "" && c.Syslog != "local" {
+		u, err := url.Parse(c.Syslog)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return fmt.Errorf("audit.syslog must be local or udp://host:port, tcp://host:port, got %q", c.Syslog)
+		}
+	}
+	if c.SyslogTag == "" {
+		c.SyslogTag = "docker_auth"
+	}
+	return nil
+}
+
+type auditRecord struct {
+	Time      string   `json:"time"`
+	RequestID string   `json:"request_id"`
+	Account   string   `json:"account"`
+	Backend   string   `json:"backend,omitempty"`
+	ClientIP  string   `json:"client_ip,omitempty"`
+	Service   string   `json:"service,omitempty"`
+	Scopes    []string `json:"scopes"`
+	Granted   []string `json:"granted"`
+	// allow (all requested actions were granted), partial, deny or error.
+	Decision string `json:"decision"`
+	Status   int    `json:"status"`
+}
+
+// auditLog writes audit records, one JSON object per line. Unlike the operational logs,
+// records are written regardless of the log settings and each one is synced to disk.
+type auditLog struct {
+	config *AuditConfig
+
+	lock   sync.Mutex
+	f      *os.File
+	size   int64
+	syslog *syslog.Writer
+}
+
+func newAuditLog(c *AuditConfig) (*auditLog, error) {
+	al := &auditLog{config: c}
+	if c.Syslog != "" {
+		network, addr := "", ""
+		if c.Syslog != "local" {
+			u, _ := url.Parse(c.Syslog)
+			network, addr = u.Scheme, u.Host
+		}
+		w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, c.SyslogTag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %s", err)
+		}
+		al.syslog = w
+		return al, nil
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *auditLog) open() error {
+	f, err := os.OpenFile(al.config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+	al.f, al.size = f, st.Size()
+	return nil
+}
+
+func (al *auditLog) rotate() error {
+	al.f.Close()
+	al.f = nil
+	for i := al.config.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.config.File, i), fmt.Sprintf("%s.%d", al.config.File, i+1))
+	}
+	if err := os.Rename(al.config.File, al.config.File+".1"); err != nil {
+		glog.Errorf("Failed to rotate audit log: %s", err)
+	}
+	return al.open()
+}
+
+// reopen reopens the file, to be used after it has been rotated externally.
+func (al *auditLog) reopen() {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.syslog != nil {
+		return
+	}
+	if al.f != nil {
+		al.f.Close()
+		al.f = nil
+	}
+	if err := al.open(); err != nil {
+		glog.Errorf("%s", err)
+	}
+}
+
+func (al *auditLog) write(r *auditRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Failed to marshal audit record: %s", err)
+		return
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.syslog != nil {
+		err = al.syslog.Info(string(line))
+	} else {
+		err = al.writeFile(append(line, '\n'))
+	}
+	if err != nil {
+		glog.Errorf("Failed to write audit record %s: %s", line, err)
+	}
+}
+
+func (al *auditLog) writeFile(line []byte) error {
+	if al.f != nil && al.config.MaxSizeMB > 0 && al.size+int64(len(line)) > int64(al.config.MaxSizeMB)<<20 {
+		if err := al.rotate(); err != nil {
+			return err
+		}
+	}
+	if al.f == nil {
+		// Failed to reopen previously, try again.
+		if err := al.open(); err != nil {
+			return err
+		}
+	}
+	n, err := al.f.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return al.f.Sync()
+}
+
+func (al *auditLog) close() {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.f != nil {
+		al.f.Close()
+		al.f = nil
+	}
+	if al.syslog != nil {
+		al.syslog.Close()
+	}
+}
+
+func auditDecision(ares []authzResult, status int) string {
+	if status >= 500 {
+		return "error"
+	}
+	if status != 200 {
+		return "deny"
+	}
+	requested, granted := 0, 0
+	for _, r := range ares {
+		requested += len(r.scope.Actions)
+		granted += len(r.autorizedActions)
+	}
+	switch {
+	case granted == requested:
+		return "allow"
+	case granted == 0:
+		return "deny"
+	default:
+		return "partial"
+	}
+}
+
+func newAuditRecord(id string, ar *authRequest, ares []authzResult, status int, start time.Time) *auditRecord {
+	r := &auditRecord{
+		Time:      start.UTC().Format(time.RFC3339Nano),
+		RequestID: id,
+		Scopes:    []string{},
+		Granted:   []string{},
+		Decision:  auditDecision(ares, status),
+		Status:    status,
+	}
+	if ar != nil {
+		r.Account = ar.Account
+		r.Backend = ar.authnBackend
+		r.ClientIP = ar.RemoteIP.String()
+		r.Service = ar.Service
+		for _, s := range ar.Scopes {
+			r.Scopes = append(r.Scopes, s.String())
+		}
+	}
+	for _, a := range ares {
+		if len(a.autorizedActions) > 0 {
+			r.Granted = append(r.Granted, authScope{Type: a.scope.Type, Class: a.scope.Class, Name: a.scope.Name, Actions: a.autorizedActions}.String())
+		}
+	}
+	return r
+}
+
+func (al *auditLog) record(id string, ar *authRequest, ares []authzResult, status int, start time.Time) {
+	al.write(newAuditRecord(id, ar, ares, status, start))
+}
@@ -0,0 +1,179 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const (
+	defaultAuthzCacheTTL     = 10 * time.Second
+	defaultAuthzCacheMaxSize = 10000
+)
+
+// AuthzCacheConfig enables caching of decisions made by the acl_mongo, acl_sql and ext_authz authorizers.
+type AuthzCacheConfig struct {
+	// How long decisions are cached for.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// Maximum number of cached decisions, least recently used ones are evicted first.
+	MaxSize int `yaml:"max_size,omitempty"`
+}
+
+func (c *AuthzCacheConfig) validate() error {
+	if c.TTL < 0 || c.MaxSize < 0 {
+		return fmt.Errorf("authz.cache.{ttl,max_size} must not be negative")
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultAuthzCacheTTL
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultAuthzCacheMaxSize
+	}
+	return nil
+}
+
+// authzCache is shared by all the cached authorizers of a server instance,
+// a new one is created when config is reloaded.
+type authzCache struct {
+	ttl     time.Duration
+	entries *lru.Cache
+}
+
+type authzCacheEntry struct {
+	decision *api.AuthzDecision
+	// The authorizer did not reach a decision, see api.NoMatch.
+	noMatch bool
+	expires time.Time
+}
+
+func newAuthzCache(c *AuthzCacheConfig) (*authzCache, error) {
+	entries, err := lru.New(c.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &authzCache{ttl: c.TTL, entries: entries}, nil
+}
+
+// authzCacheKey identifies the request. All the fields that authorizers can base their decision on
+// are included, so requests with the same key are expected to result in the same decision.
+func authzCacheKey(backend string, ai *api.AuthRequestInfo) string {
+	labels, _ := json.Marshal(ai.Labels) // Map keys are sorted.
+	lh := sha256.Sum256(labels)
+	return strings.Join([]string{
+		backend, ai.Account, hex.EncodeToString(lh[:]), ai.Type, ai.Class, ai.Name,
+		strings.Join(ai.Actions, ","), ai.Service, ai.IP.String(), strconv.FormatBool(ai.StrictWildcardName),
+	}, "\x00")
+}
+
+// wrap returns an authorizer that consults the cache before a.
+// The result implements HealthChecker if a does.
+func (ac *authzCache) wrap(a api.Authorizer) api.Authorizer {
+	if ac == nil {
+		return a
+	}
+	ca := &cachedAuthorizer{Authorizer: a, cache: ac}
+	if hc, ok := a.(api.HealthChecker); ok {
+		return &cachedHealthCheckedAuthorizer{ca, hc}
+	}
+	return ca
+}
+
+// honorsStrictWildcardName returns whether a, or the authorizer it caches, implements api.StrictWildcardAuthorizer.
+func honorsStrictWildcardName(a api.Authorizer) bool {
+	switch ca := a.(type) {
+	case *cachedAuthorizer:
+		a = ca.Authorizer
+	case *cachedHealthCheckedAuthorizer:
+		a = ca.Authorizer
+	}
+	_, ok := a.(api.StrictWildcardAuthorizer)
+	return ok
+}
+
+type cachedAuthorizer struct {
+	api.Authorizer
+	cache *authzCache
+}
+
+type cachedHealthCheckedAuthorizer struct {
+	*cachedAuthorizer
+	api.HealthChecker
+}
+
+func (ca *cachedAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	d, err := ca.AuthorizeDetailed(ai)
+	if err != nil {
+		return nil, err
+	}
+	return d.Actions, nil
+}
+
+func (ca *cachedAuthorizer) AuthorizeDetailed(ai *api.AuthRequestInfo) (*api.AuthzDecision, error) {
+	if !ai.Time.IsZero() {
+		// Evaluated at another time, the decision may be different from the one for now.
+		return authorize(ca.Authorizer, ai)
+	}
+	label := backendLabel(ca.Name())
+	key := authzCacheKey(ca.Name(), ai)
+	if v, ok := ca.cache.entries.Get(key); ok {
+		e := v.(*authzCacheEntry)
+		if time.Now().Before(e.expires) {
+			authzCacheRequests.WithLabelValues(label, "hit").Inc()
+			if e.noMatch {
+				return nil, api.NoMatch
+			}
+			return copyDecision(e.decision), nil
+		}
+		ca.cache.entries.Remove(key)
+	}
+	authzCacheRequests.WithLabelValues(label, "miss").Inc()
+	d, err := authorize(ca.Authorizer, ai)
+	switch {
+	case err == api.NoMatch:
+		ca.cache.entries.Add(key, &authzCacheEntry{noMatch: true, expires: time.Now().Add(ca.cache.ttl)})
+	case err != nil:
+		// Errors are never cached, the next request goes to the backend again.
+		return nil, err
+	case d.NoCache:
+	default:
+		ca.cache.entries.Add(key, &authzCacheEntry{decision: copyDecision(d), expires: time.Now().Add(ca.cache.ttl)})
+	}
+	return d, err
+}
+
+func (ca *cachedAuthorizer) ExplainNoMatch(ai *api.AuthRequestInfo) string {
+	if e, ok := ca.Authorizer.(api.Explainer); ok {
+		return e.ExplainNoMatch(ai)
+	}
+	return ""
+}
+
+func copyDecision(d *api.AuthzDecision) *api.AuthzDecision {
+	c := *d
+	c.Actions = append([]string(nil), d.Actions...)
+	return &c
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Version and BuildID of the binary, set by main.
+var (
+	Version = "unknown"
+	BuildID = "unknown"
+)
+
+// Access to the /version endpoint, see ServerConfig.VersionEndpoint.
+const (
+	versionAuthenticated = "authenticated"
+	versionPublic        = "public"
+	versionDisabled      = "disabled"
+)
+
+// Config keys whose values are left out of the config hash.
+var secretConfigKeyRegex = regexp.MustCompile(`(^|_)(password|secret|secrets|api_token|dsn)$`)
+
+// buildCommit returns the commit the binary was built from, which is part of the build ID, e.g.
+// 20190101-120000/master@0123abcd.
+func buildCommit(buildID string) string {
+	i := strings.LastIndex(buildID, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(buildID[i+1:], "+")
+}
+
+// redactSecrets replaces values of secret config keys in the parsed config.
+func redactSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			key := fmt.Sprint(k)
+			if secretConfigKeyRegex.MatchString(key) {
+				m[key] = "***"
+			} else {
+				m[key] = redactSecrets(e)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = redactSecrets(e)
+		}
+		return l
+	}
+	return v
+}
+
+// configHash returns a hash of the effective config, including defaults, without secrets,
+// so that replicas can be compared. Contents of files the config refers to are not included.
+func configHash(c *Config) (string, error) {
+	y, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	var parsed interface{}
+	if err := yaml.Unmarshal(y, &parsed); err != nil {
+		return "", err
+	}
+	// Keys of JSON objects are sorted, unlike those of YAML maps.
+	j, err := json.Marshal(redactSecrets(parsed))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// configLoaded records the hash of the config that is now in effect.
+func (as *AuthServer) configLoaded(c *Config) {
+	hash, err := configHash(c)
+	if err != nil {
+		glog.Errorf("Failed to compute config hash: %s", err)
+	}
+	as.configHash, as.configTime = hash, time.Now()
+	glog.Infof("Config hash: %s", hash)
+}
+
+type versionResponse struct {
+	Version      string    `json:"version"`
+	Build        string    `json:"build"`
+	Commit       string    `json:"commit,omitempty"`
+	ConfigHash   string    `json:"config_hash"`
+	ConfigLoaded time.Time `json:"config_loaded"`
+}
+
+func (as *AuthServer) doVersion(rw http.ResponseWriter, req *http.Request) {
+	if as.config.Server.VersionEndpoint != versionPublic {
+		ar, err := as.ParseRequest(req)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+			return
+		}
+		// Anonymous access does not count.
+		result, _, err := as.Authenticate(ar)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), http.StatusServiceUnavailable)
+			return
+		}
+		if !result || ar.Account == "" {
+			rw.Header().Set("WWW-Authenticate", as.config.Server.basicChallenge(as.config.Token.Issuer))
+			http.Error(rw, "Auth failed.", http.StatusUnauthorized)
+			return
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(versionResponse{
+		Version:      Version,
+		Build:        BuildID,
+		Commit:       buildCommit(BuildID),
+		ConfigHash:   as.configHash,
+		ConfigLoaded: as.configTime,
+	})
+}
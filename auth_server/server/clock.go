@@ -0,0 +1,106 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+)
+
+const defaultClockWarnBackwardJump = 5 * time.Second
+
+// ClockConfig sets how jumps of the system clock are handled. Token times (iat, nbf, exp) come from
+// the wall clock. If it goes back, e.g. when a suspended VM is resumed and its clock is stepped,
+// tokens are issued with times in the past. The newest time seen is kept, and going back from it
+// by more than warn_backward_jump (default 5s) is logged. If refuse_backward_jump is set, tokens are
+// not issued while the clock is behind by more than that, until it catches up or the server restarts.
+type ClockConfig struct {
+	WarnBackwardJump   time.Duration `yaml:"warn_backward_jump,omitempty"`
+	RefuseBackwardJump time.Duration `yaml:"refuse_backward_jump,omitempty"`
+}
+
+func (c *ClockConfig) validate() error {
+	if c.WarnBackwardJump < 0 || c.RefuseBackwardJump < 0 {
+		return fmt.Errorf("token.clock: warn_backward_jump and refuse_backward_jump must not be negative")
+	}
+	return nil
+}
+
+// clockError is returned when tokens are not issued because the clock is behind.
+type clockError string
+
+func (e clockError) Error() string {
+	return string(e)
+}
+
+type clockGuard struct {
+	warnJump, refuseJump time.Duration
+	now                  func() time.Time
+
+	lock sync.Mutex
+	// The newest wall clock time seen and whether going back from it has been logged.
+	newest time.Time
+	warned bool
+}
+
+// newClockGuard creates a guard with settings from c. The newest time seen by prev, if any, is kept.
+func newClockGuard(c *ClockConfig, prev *clockGuard) *clockGuard {
+	g := &clockGuard{warnJump: defaultClockWarnBackwardJump, now: time.Now}
+	if prev != nil {
+		prev.lock.Lock()
+		g.newest, g.warned = prev.newest, prev.warned
+		prev.lock.Unlock()
+	}
+	if c != nil {
+		if c.WarnBackwardJump > 0 {
+			g.warnJump = c.WarnBackwardJump
+		}
+		g.refuseJump = c.RefuseBackwardJump
+	}
+	return g
+}
+
+// observe returns the wall clock time, without the monotonic reading, and how far it is behind
+// the newest time seen.
+func (g *clockGuard) observe() (time.Time, time.Duration) {
+	now := g.now().Round(0)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !now.Before(g.newest) {
+		g.newest, g.warned = now, false
+		return now, 0
+	}
+	behind := g.newest.Sub(now)
+	if behind > g.warnJump && !g.warned {
+		glog.Warningf("System clock went back by %s (from %s to %s), tokens are issued with times in the past",
+			behind, g.newest.Format(time.RFC3339), now.Format(time.RFC3339))
+		g.warned = true
+	}
+	return now, behind
+}
+
+// tokenTime returns the time to issue a token at, or an error if the clock is too far behind.
+func (g *clockGuard) tokenTime() (time.Time, error) {
+	now, behind := g.observe()
+	if g.refuseJump > 0 && behind > g.refuseJump {
+		return now, clockError(fmt.Sprintf("system clock is %s behind, not issuing tokens until it catches up", behind))
+	}
+	return now, nil
+}
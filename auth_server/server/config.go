@@ -21,32 +21,70 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/cesanta/glog"
 	"github.com/docker/libtrust"
+	"golang.org/x/crypto/bcrypt"
 	yaml "gopkg.in/yaml.v2"
 
+	"github.com/cesanta/docker_auth/auth_server/api"
 	"github.com/cesanta/docker_auth/auth_server/authn"
 	"github.com/cesanta/docker_auth/auth_server/authz"
 )
 
 type Config struct {
-	Server      ServerConfig                   `yaml:"server"`
-	Token       TokenConfig                    `yaml:"token"`
-	Users       map[string]*authn.Requirements `yaml:"users,omitempty"`
-	GoogleAuth  *authn.GoogleAuthConfig        `yaml:"google_auth,omitempty"`
-	GitHubAuth  *authn.GitHubAuthConfig        `yaml:"github_auth,omitempty"`
-	LDAPAuth    *authn.LDAPAuthConfig          `yaml:"ldap_auth,omitempty"`
-	MongoAuth   *authn.MongoAuthConfig         `yaml:"mongo_auth,omitempty"`
-	ExtAuth     *authn.ExtAuthConfig           `yaml:"ext_auth,omitempty"`
-	PluginAuthn *authn.PluginAuthnConfig       `yaml:"plugin_authn,omitempty"`
-	ACL         authz.ACL                      `yaml:"acl,omitempty"`
-	ACLMongo    *authz.ACLMongoConfig          `yaml:"acl_mongo,omitempty"`
-	ExtAuthz    *authz.ExtAuthzConfig          `yaml:"ext_authz,omitempty"`
-	PluginAuthz *authz.PluginAuthzConfig       `yaml:"plugin_authz,omitempty"`
+	Server            ServerConfig                   `yaml:"server"`
+	Token             TokenConfig                    `yaml:"token"`
+	Users             map[string]*authn.Requirements `yaml:"users,omitempty"`
+	UsersFile         *authn.UsersFileConfig         `yaml:"users_file,omitempty"`
+	UsersBcryptCost   int                            `yaml:"users_bcrypt_cost,omitempty"`
+	UsersPasswordHash string                         `yaml:"users_password_hash,omitempty"`
+	HtpasswdAuth      *authn.HtpasswdAuthConfig      `yaml:"htpasswd_auth,omitempty"`
+	GoogleAuth        *authn.GoogleAuthConfig        `yaml:"google_auth,omitempty"`
+	GitHubAuth        *authn.GitHubAuthConfig        `yaml:"github_auth,omitempty"`
+	OIDCAuth          *authn.OIDCAuthConfig          `yaml:"oidc_auth,omitempty"`
+	GitLabAuth        *authn.GitLabAuthConfig        `yaml:"gitlab_auth,omitempty"`
+	LDAPAuth          *authn.LDAPAuthConfig          `yaml:"ldap_auth,omitempty"`
+	JWTAuth           *authn.JWTAuthConfig           `yaml:"jwt_auth,omitempty"`
+	AzureAuth         *authn.AzureAuthConfig         `yaml:"azure_auth,omitempty"`
+	CognitoAuth       *authn.CognitoAuthConfig       `yaml:"cognito_auth,omitempty"`
+	K8sSAAuth         *authn.K8sSAAuthConfig         `yaml:"k8s_sa_auth,omitempty"`
+	OktaAuth          *authn.OktaAuthConfig          `yaml:"okta_auth,omitempty"`
+	ClientCertAuth    *authn.ClientCertAuthConfig    `yaml:"client_cert_auth,omitempty"`
+	MongoAuth         *authn.MongoAuthConfig         `yaml:"mongo_auth,omitempty"`
+	ExtAuth           *authn.ExtAuthConfig           `yaml:"ext_auth,omitempty"`
+	PluginAuthn       *authn.PluginAuthnConfig       `yaml:"plugin_authn,omitempty"`
+	Lockout           *LockoutConfig                 `yaml:"lockout,omitempty"`
+	Audit             *AuditConfig                   `yaml:"audit,omitempty"`
+	Notifications     *NotificationsConfig           `yaml:"notifications,omitempty"`
+	ACL               authz.ACL                      `yaml:"acl,omitempty"`
+	ACLMode           string                         `yaml:"acl_mode,omitempty"`
+	ACLMongo          *authz.ACLMongoConfig          `yaml:"acl_mongo,omitempty"`
+	ACLSQL            *authz.ACLSQLConfig            `yaml:"acl_sql,omitempty"`
+	ExtAuthz          *authz.ExtAuthzConfig          `yaml:"ext_authz,omitempty"`
+	CasbinAuthz       *authz.CasbinAuthzConfig       `yaml:"casbin_authz,omitempty"`
+	OPAAuthz          *authz.OPAAuthzConfig          `yaml:"opa_authz,omitempty"`
+	PluginAuthz       *authz.PluginAuthzConfig       `yaml:"plugin_authz,omitempty"`
+	Authn             *AuthnConfig                   `yaml:"authn,omitempty"`
+	Authz             *AuthzConfig                   `yaml:"authz,omitempty"`
+	Tenants           map[string]*TenantConfig       `yaml:"tenants,omitempty"`
+
+	// The config file and the files it includes.
+	files []string
+	// Name of the tenant, if this is the config of one, see TenantConfig.
+	tenant string
+}
+
+// Files returns the names of the config file and the files it includes.
+func (c *Config) Files() []string {
+	return c.files
 }
 
 type ServerConfig struct {
@@ -57,9 +95,124 @@ type ServerConfig struct {
 	CertFile      string            `yaml:"certificate,omitempty"`
 	KeyFile       string            `yaml:"key,omitempty"`
 	LetsEncrypt   LetsEncryptConfig `yaml:"letsencrypt,omitempty"`
+	Metrics       *MetricsConfig    `yaml:"metrics,omitempty"`
+	RateLimit     *RateLimitConfig  `yaml:"rate_limit,omitempty"`
+	CORS          *CORSConfig       `yaml:"cors,omitempty"`
+	Tracing       *TracingConfig    `yaml:"tracing,omitempty"`
+	// Minimum TLS version ("1.0" - "1.3") and cipher suites (Go names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+	TLSMinVersion   string   `yaml:"tls_min_version,omitempty"`
+	TLSCipherSuites []string `yaml:"tls_cipher_suites,omitempty"`
+	// Whether to ask clients for certificates: none, verify_if_given or require. See client_cert_auth.
+	ClientAuth string `yaml:"client_auth,omitempty"`
+	// text (default) or json. In json mode, a structured entry is written to stdout for each token request.
+	LogFormat string `yaml:"log_format,omitempty"`
+	// Realm of the Basic challenge (WWW-Authenticate header) of 401 responses, default is token.issuer.
+	Realm *string `yaml:"realm,omitempty"`
+	// If set, added to the challenge as the service parameter.
+	Service string `yaml:"service,omitempty"`
+	// Limits on the size of requests, larger ones are rejected before any backend is consulted.
+	MaxHeaderBytes int `yaml:"max_header_bytes,omitempty"`
+	MaxURLLength   int `yaml:"max_url_length,omitempty"`
+	MaxBodyBytes   int `yaml:"max_body_bytes,omitempty"`
+	// Limits on the scopes of a token request.
+	MaxScopes      int `yaml:"max_scopes,omitempty"`
+	MaxScopeLength int `yaml:"max_scope_length,omitempty"`
+	// Check that backends can be reached when the server starts. If any can't, the server exits,
+	// or if backend_check_failure is warn, logs an error and starts anyway.
+	CheckBackendsOnStart bool          `yaml:"check_backends_on_start,omitempty"`
+	BackendCheckFailure  string        `yaml:"backend_check_failure,omitempty"`
+	BackendCheckTimeout  time.Duration `yaml:"backend_check_timeout,omitempty"`
+	// Client networks (CIDRs or addresses) that may use the server, and ones that may not, regardless
+	// of authentication. Other clients get 403 before the request is processed. denied_ips takes
+	// precedence. If allowed_ips is not set, all clients that are not denied are allowed.
+	AllowedIPs []string `yaml:"allowed_ips,omitempty"`
+	DeniedIPs  []string `yaml:"denied_ips,omitempty"`
+	// Whether /healthz, /readyz and metrics served on the main listener are exempt from allowed_ips
+	// and denied_ips, so that probes and scrapers from other networks work. Default is true.
+	IPFilterExemptHealth *bool `yaml:"ip_filter_exempt_health,omitempty"`
+	// Access to /version, which returns the build version and a hash of the config: authenticated (default),
+	// public or disabled.
+	VersionEndpoint string `yaml:"version_endpoint,omitempty"`
+	// Headers added to all responses of the main listener, e.g. Server or X-Content-Type-Options.
+	// If TLS is enabled, Strict-Transport-Security is max-age=31536000 unless set here, empty to not send it.
+	ResponseHeaders map[string]string `yaml:"response_headers,omitempty"`
 
-	publicKey  libtrust.PublicKey
-	privateKey libtrust.PrivateKey
+	keyPair         `yaml:"-"`
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	clientCAs       *x509.CertPool
+	allowedNets     []*net.IPNet
+	deniedNets      []*net.IPNet
+	responseHeaders http.Header
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Cipher suites that can be configured. TLS 1.3 suites are not configurable.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// realm returns the configured realm or def if there is none.
+func (sc *ServerConfig) realm(def string) string {
+	if sc.Realm != nil {
+		return *sc.Realm
+	}
+	return def
+}
+
+// basicChallenge returns the WWW-Authenticate header value of 401 responses.
+func (sc *ServerConfig) basicChallenge(defaultRealm string) string {
+	challenge := fmt.Sprintf(`Basic realm="%s"`, sc.realm(defaultRealm))
+	if sc.Service != "" {
+		challenge += fmt.Sprintf(`,service="%s"`, sc.Service)
+	}
+	return challenge
+}
+
+// BaseTLSConfig returns TLS settings for the listener, without certificates.
+func (sc *ServerConfig) BaseTLSConfig() *tls.Config {
+	tc := &tls.Config{
+		PreferServerCipherSuites: true,
+		MinVersion:               sc.tlsMinVersion,
+		CipherSuites:             sc.tlsCipherSuites,
+	}
+	switch sc.ClientAuth {
+	case "verify_if_given":
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+		tc.ClientCAs = sc.clientCAs
+	case "require":
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		tc.ClientCAs = sc.clientCAs
+	}
+	return tc
+}
+
+// keyPair is a certificate and key loaded from files, along with the modification
+// times of the files at the time of loading.
+type keyPair struct {
+	publicKey   libtrust.PublicKey
+	privateKey  libtrust.PrivateKey
+	certModTime time.Time
+	keyModTime  time.Time
 }
 
 type LetsEncryptConfig struct {
@@ -73,9 +226,243 @@ type TokenConfig struct {
 	CertFile   string `yaml:"certificate,omitempty"`
 	KeyFile    string `yaml:"key,omitempty"`
 	Expiration int64  `yaml:"expiration,omitempty"`
+	// Maximum lifetime (in seconds) of tokens of users whose lifetime is set by the token_ttl label
+	// from authentication. Longer values are clamped to it. Default is expiration.
+	MaxLabelTTL int64 `yaml:"max_label_ttl,omitempty"`
+	// If set, JWKS with token verification keys is served at this path.
+	JWKSPath string `yaml:"jwks_path,omitempty"`
+	// Token signing algorithm: RS256, ES256 or ES384. If not set, it is determined by the key.
+	SigningAlg string `yaml:"signing_alg,omitempty"`
+	// Issuing of refresh tokens, see RefreshConfig.
+	Refresh *RefreshConfig `yaml:"refresh,omitempty"`
+	// Revocation list of issued tokens, see RevocationConfig.
+	Revocation *RevocationConfig `yaml:"revocation,omitempty"`
+	// Additional claims to include in all tokens, same as claims of ACL entries.
+	ExtraClaims map[string]string `yaml:"extra_claims,omitempty"`
+	// Multiple token keys, for key rotation. Mutually exclusive with certificate and key.
+	Keys []*TokenKeyConfig `yaml:"keys,omitempty"`
+	// If set, tokens are only issued for these services and requests for other services are rejected,
+	// so that tokens cannot be used with registries they were not meant for.
+	AllowedServices []string `yaml:"allowed_services,omitempty"`
+	// Keys that tokens for specific services are signed with instead of the token key, by service.
+	// Only certificate, key and kid are used.
+	ServiceKeys map[string]*TokenKeyConfig `yaml:"service_keys,omitempty"`
+	// Issuer (iss) of tokens for specific services, instead of issuer, by service.
+	ServiceIssuers map[string]string `yaml:"service_issuers,omitempty"`
+	// Seconds by which nbf (not before) of tokens precedes the time of issuance, so that registries
+	// with clocks slightly behind accept them right away. Default is 10.
+	NotBeforeSkew *int64 `yaml:"nbf_skew,omitempty"`
+	// Seconds by which iat (issued at) is backdated, for registries that reject tokens issued in the future.
+	// Default is 0.
+	IssuedAtSkew int64 `yaml:"iat_skew,omitempty"`
+	// Limits of the number of entries in the access claim and of the size of the encoded token, in bytes.
+	// Requests for tokens that would exceed them are rejected. Not limited if not set.
+	MaxAccessEntries int `yaml:"max_access_entries,omitempty"`
+	MaxSize          int `yaml:"max_size,omitempty"`
+	// Actions to grant instead of "*", by resource type, for registries that reject the literal "*",
+	// e.g. repository: [pull, push, delete]. Keys can also be type(class), e.g. repository(plugin),
+	// which take precedence over the bare type for scopes of that class. Types that are not listed keep "*".
+	WildcardActions map[string][]string `yaml:"wildcard_actions,omitempty"`
+	// Label of the authenticated user whose value is used as the subject (sub) of tokens instead of
+	// the account name, e.g. a stable ID that does not change when the user is renamed.
+	SubjectClaim string `yaml:"subject_claim,omitempty"`
+	// Lifetime (in seconds) of tokens requested with offline_token=true by service accounts, instead of
+	// expiration. Service accounts are those listed in offline_accounts and users with the offline_label
+	// label. Other accounts requesting offline tokens get tokens with the normal expiration.
+	OfflineExpiration int64    `yaml:"offline_expiration,omitempty"`
+	OfflineAccounts   []string `yaml:"offline_accounts,omitempty"`
+	OfflineLabel      string   `yaml:"offline_label,omitempty"`
+	// Handling of system clock jumps, see ClockConfig.
+	Clock *ClockConfig `yaml:"clock,omitempty"`
+
+	// The active key and its ID.
+	keyPair `yaml:"-"`
+	kid     string
+}
 
-	publicKey  libtrust.PublicKey
-	privateKey libtrust.PrivateKey
+const (
+	defaultNotBeforeSkew int64 = 10
+	// Larger clock differences should rather be fixed than tolerated.
+	maxTokenSkew int64 = 600
+)
+
+func (tc *TokenConfig) notBeforeSkew() int64 {
+	if tc.NotBeforeSkew == nil {
+		return defaultNotBeforeSkew
+	}
+	return *tc.NotBeforeSkew
+}
+
+func (tc *TokenConfig) maxLabelTTL() int64 {
+	if tc.MaxLabelTTL == 0 {
+		return tc.Expiration
+	}
+	return tc.MaxLabelTTL
+}
+
+// TokenKeyConfig is one of the token keys. Tokens are signed with the active key,
+// the rest are only advertised in JWKS, so that tokens signed with them can still be verified.
+type TokenKeyConfig struct {
+	CertFile string `yaml:"certificate,omitempty"`
+	KeyFile  string `yaml:"key,omitempty"`
+	// Key ID, used as "kid" in token headers and JWKS. Default is derived from the key.
+	KeyID  string `yaml:"kid,omitempty"`
+	Active bool   `yaml:"active,omitempty"`
+	// Inactive keys are no longer advertised after this time (RFC 3339).
+	// It should be no earlier than the time the key was retired plus token expiration (offline_expiration, if set).
+	Expires time.Time `yaml:"expires,omitempty"`
+
+	keyPair `yaml:"-"`
+}
+
+// AuthnConfig contains settings that apply to authentication in general, regardless of the backend.
+type AuthnConfig struct {
+	// Normalization of account names, see NormalizeConfig.
+	Normalize *NormalizeConfig `yaml:"normalize,omitempty"`
+	// Second factor for some accounts, see authn.TOTPConfig.
+	TOTP *authn.TOTPConfig `yaml:"totp,omitempty"`
+	// Config keys of authentication methods, e.g. [users, ldap_auth], in the order in which they are tried.
+	// Methods that are not listed are tried after the listed ones, in the default order, see authnMethods.
+	Order []string `yaml:"order,omitempty"`
+	// Whether a method that recognizes the user but rejects the password ends the chain, by config key.
+	// Default is true. If false, the next method is tried and the user is denied only if none accepts.
+	Authoritative map[string]bool `yaml:"authoritative,omitempty"`
+	// Minimum response time of failed authentication, see ConstantTimeDenyConfig.
+	ConstantTimeDeny *ConstantTimeDenyConfig `yaml:"constant_time_deny,omitempty"`
+}
+
+// authnMethods returns config keys of the configured authentication methods, in the default order.
+// Methods that recognize credentials by their form (certificates, tokens) go first, followed by user
+// name based ones. Okta does not tell unknown users from wrong passwords, so it goes after them.
+func authnMethods(c *Config) []string {
+	var keys []string
+	for _, m := range []struct {
+		key        string
+		configured bool
+	}{
+		{"client_cert_auth", c.ClientCertAuth != nil},
+		{"jwt_auth", c.JWTAuth != nil},
+		{"azure_auth", c.AzureAuth != nil},
+		{"cognito_auth", c.CognitoAuth != nil},
+		{"k8s_sa_auth", c.K8sSAAuth != nil},
+		{"users", c.Users != nil},
+		{"users_file", c.UsersFile != nil},
+		{"htpasswd_auth", c.HtpasswdAuth != nil},
+		{"ext_auth", c.ExtAuth != nil},
+		{"google_auth", c.GoogleAuth != nil},
+		{"github_auth", c.GitHubAuth != nil},
+		{"oidc_auth", c.OIDCAuth != nil},
+		{"gitlab_auth", c.GitLabAuth != nil},
+		{"ldap_auth", c.LDAPAuth != nil},
+		{"mongo_auth", c.MongoAuth != nil},
+		{"okta_auth", c.OktaAuth != nil},
+		{"plugin_authn", c.PluginAuthn != nil},
+	} {
+		if m.configured {
+			keys = append(keys, m.key)
+		}
+	}
+	return keys
+}
+
+func (ac *AuthnConfig) validateOrder(configured []string) error {
+	isConfigured := map[string]bool{}
+	for _, key := range configured {
+		isConfigured[key] = true
+	}
+	seen := map[string]bool{}
+	for _, key := range ac.Order {
+		if !isConfigured[key] {
+			return fmt.Errorf("authn.order: %q is not a configured authentication method, configured are %s", key, strings.Join(configured, ", "))
+		}
+		if seen[key] {
+			return fmt.Errorf("authn.order: %q is listed more than once", key)
+		}
+		seen[key] = true
+	}
+	for key := range ac.Authoritative {
+		if !isConfigured[key] {
+			return fmt.Errorf("authn.authoritative: %q is not a configured authentication method, configured are %s", key, strings.Join(configured, ", "))
+		}
+	}
+	return nil
+}
+
+// AuthzConfig contains settings that apply to authorization in general, regardless of the backend.
+type AuthzConfig struct {
+	// Caching of authorization decisions, see AuthzCacheConfig.
+	Cache *AuthzCacheConfig `yaml:"cache,omitempty"`
+	// Return reasons of denials to clients, in the X-Docker-Auth-Deny-Reason header of token responses.
+	// Reasons are logged regardless.
+	Explain bool `yaml:"explain,omitempty"`
+	// Log requests that no rule matched, see UnmatchedLogConfig.
+	LogUnmatched *UnmatchedLogConfig `yaml:"log_unmatched,omitempty"`
+	// Requests for names with wildcards, e.g. repository:*:*, are only granted by ACL entries with
+	// allow_wildcard_name. Other authorizers (ext_authz, casbin_authz, opa_authz, plugin_authz) are
+	// not consulted for them.
+	DenyWildcardResource bool `yaml:"deny_wildcard_resource,omitempty"`
+	// Accounts allowed to use the /explain endpoint, which shows what another account would be granted.
+	// The endpoint is only served if this is set.
+	ExplainAdmins []string `yaml:"explain_admins,omitempty"`
+}
+
+// sign signs payload with the token key, returning the signature and the algorithm used.
+func (tc *TokenConfig) sign(payload string) ([]byte, string, error) {
+	return tc.signWith(tc.privateKey, payload)
+}
+
+func (tc *TokenConfig) signWith(prk libtrust.PrivateKey, payload string) ([]byte, string, error) {
+	// The algorithm is determined by the key: RS256 for RSA keys (libtrust uses SHA-256 if the hash
+	// is not set) and by the curve for EC keys. signing_alg is checked against it when the key is loaded.
+	return prk.Sign(strings.NewReader(payload), 0)
+}
+
+// keyID returns the ID of the key tokens are signed with.
+func (tc *TokenConfig) keyID() string {
+	if tc.kid != "" {
+		return tc.kid
+	}
+	return tc.publicKey.KeyID()
+}
+
+// allowsService returns true if tokens can be issued for the service.
+func (tc *TokenConfig) allowsService(service string) bool {
+	if len(tc.AllowedServices) == 0 {
+		return true
+	}
+	for _, s := range tc.AllowedServices {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// issuer returns the issuer of tokens for the service.
+func (tc *TokenConfig) issuer(service string) string {
+	if iss, ok := tc.ServiceIssuers[service]; ok {
+		return iss
+	}
+	return tc.Issuer
+}
+
+// signingKey returns the key that tokens for the service are signed with and its ID.
+func (tc *TokenConfig) signingKey(service string) (libtrust.PrivateKey, string) {
+	if k, ok := tc.ServiceKeys[service]; ok {
+		return k.privateKey, k.KeyID
+	}
+	return tc.privateKey, tc.keyID()
+}
+
+// validateRedisTokenDB validates redis_token_db of an OAuth backend, which replaces token_db.
+func validateRedisTokenDB(configKey, tokenDB string, rc *authn.RedisTokenDBConfig) error {
+	if rc == nil {
+		return nil
+	}
+	if tokenDB != "" {
+		return fmt.Errorf("%s.token_db and %s.redis_token_db are mutually exclusive", configKey, configKey)
+	}
+	return rc.Validate(configKey + ".redis_token_db")
 }
 
 func validate(c *Config) error {
@@ -85,6 +472,9 @@ func validate(c *Config) error {
 	if c.Server.PathPrefix != "" && !strings.HasPrefix(c.Server.PathPrefix, "/") {
 		return errors.New("server.path_prefix must be an absolute path")
 	}
+	if c.Server.Metrics != nil && !strings.HasPrefix(c.Server.Metrics.path(), "/") {
+		return errors.New("server.metrics.path must be an absolute path")
+	}
 
 	if c.Token.Issuer == "" {
 		return errors.New("token.issuer is required")
@@ -92,44 +482,375 @@ func validate(c *Config) error {
 	if c.Token.Expiration <= 0 {
 		return fmt.Errorf("expiration must be positive, got %d", c.Token.Expiration)
 	}
-	if c.Users == nil && c.ExtAuth == nil && c.GoogleAuth == nil && c.GitHubAuth == nil && c.LDAPAuth == nil && c.MongoAuth == nil && c.PluginAuthn == nil {
+	if c.Token.MaxLabelTTL < 0 {
+		return fmt.Errorf("token.max_label_ttl must not be negative, got %d", c.Token.MaxLabelTTL)
+	}
+	if c.Token.OfflineExpiration < 0 || (c.Token.OfflineExpiration > 0 && c.Token.OfflineExpiration < c.Token.Expiration) {
+		return fmt.Errorf("token.offline_expiration must not be shorter than expiration, got %d", c.Token.OfflineExpiration)
+	}
+	if c.Token.OfflineExpiration > 0 && len(c.Token.OfflineAccounts) == 0 && c.Token.OfflineLabel == "" {
+		return errors.New("token.offline_expiration requires offline_accounts or offline_label")
+	}
+	if c.Token.OfflineExpiration == 0 && (len(c.Token.OfflineAccounts) > 0 || c.Token.OfflineLabel != "") {
+		return errors.New("token.offline_accounts and offline_label require offline_expiration")
+	}
+	for _, a := range c.Token.OfflineAccounts {
+		if a == "" {
+			return errors.New("token.offline_accounts must not contain empty names")
+		}
+	}
+	if c.Token.Clock != nil {
+		if err := c.Token.Clock.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Token.MaxAccessEntries < 0 {
+		return fmt.Errorf("token.max_access_entries must not be negative, got %d", c.Token.MaxAccessEntries)
+	}
+	if c.Token.MaxSize < 0 {
+		return fmt.Errorf("token.max_size must not be negative, got %d", c.Token.MaxSize)
+	}
+	for t, actions := range c.Token.WildcardActions {
+		if t == "" || len(actions) == 0 {
+			return fmt.Errorf("token.wildcard_actions: resource types and their actions must not be empty")
+		}
+		if strings.ContainsAny(t, "()") && !resourceTypeRegex.MatchString(t) {
+			return fmt.Errorf("token.wildcard_actions: invalid resource type %q, expected type or type(class)", t)
+		}
+		for _, a := range actions {
+			if a == "" || a == "*" {
+				return fmt.Errorf("token.wildcard_actions.%s: invalid action %q", t, a)
+			}
+		}
+	}
+	for _, s := range []struct {
+		name  string
+		value int64
+	}{{"nbf_skew", c.Token.notBeforeSkew()}, {"iat_skew", c.Token.IssuedAtSkew}} {
+		if s.value < 0 || s.value > maxTokenSkew {
+			return fmt.Errorf("token.%s must be between 0 and %d, got %d", s.name, maxTokenSkew, s.value)
+		}
+	}
+	if c.Token.JWKSPath != "" && !strings.HasPrefix(c.Token.JWKSPath, "/") {
+		return errors.New("token.jwks_path must be an absolute path")
+	}
+	switch c.Token.SigningAlg {
+	case "", "RS256", "ES256", "ES384":
+	default:
+		return fmt.Errorf("token.signing_alg must be one of RS256, ES256, ES384, got %q", c.Token.SigningAlg)
+	}
+	if err := api.ValidateClaimNames(c.Token.ExtraClaims); err != nil {
+		return fmt.Errorf("token.extra_claims: %s", err)
+	}
+	if len(c.Token.Keys) > 0 {
+		if c.Token.CertFile != "" || c.Token.KeyFile != "" {
+			return errors.New("token.keys and token.{certificate,key} are mutually exclusive")
+		}
+		active := 0
+		for i, k := range c.Token.Keys {
+			if k.CertFile == "" || k.KeyFile == "" {
+				return fmt.Errorf("token.keys[%d]: certificate and key are required", i)
+			}
+			if k.Active {
+				active++
+				if !k.Expires.IsZero() {
+					return fmt.Errorf("token.keys[%d]: active key must not expire", i)
+				}
+			}
+		}
+		if active != 1 {
+			return fmt.Errorf("token.keys: exactly one key must be active, found %d", active)
+		}
+	}
+	allowedServices := map[string]bool{}
+	for _, s := range c.Token.AllowedServices {
+		if s == "" {
+			return errors.New("token.allowed_services: service names must not be empty")
+		}
+		if allowedServices[s] {
+			return fmt.Errorf("token.allowed_services: duplicate service %q", s)
+		}
+		allowedServices[s] = true
+	}
+	for s, k := range c.Token.ServiceKeys {
+		if k == nil || k.CertFile == "" || k.KeyFile == "" {
+			return fmt.Errorf("token.service_keys[%q]: certificate and key are required", s)
+		}
+		if k.Active || !k.Expires.IsZero() {
+			return fmt.Errorf("token.service_keys[%q]: only certificate, key and kid are supported", s)
+		}
+		if len(allowedServices) > 0 && !allowedServices[s] {
+			return fmt.Errorf("token.service_keys: service %q is not in token.allowed_services", s)
+		}
+	}
+	for s, iss := range c.Token.ServiceIssuers {
+		if iss == "" {
+			return fmt.Errorf("token.service_issuers[%q] must not be empty", s)
+		}
+		if len(allowedServices) > 0 && !allowedServices[s] {
+			return fmt.Errorf("token.service_issuers: service %q is not in token.allowed_services", s)
+		}
+	}
+	methods := authnMethods(c)
+	if len(methods) == 0 {
 		return errors.New("no auth methods are configured, this is probably a mistake. Use an empty user map if you really want to deny everyone.")
 	}
+	if err := authn.ValidatePasswordHash("users_password_hash", c.UsersPasswordHash); err != nil {
+		return err
+	}
+	if c.UsersBcryptCost != 0 {
+		if c.UsersBcryptCost < bcrypt.MinCost || c.UsersBcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("users_bcrypt_cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, c.UsersBcryptCost)
+		}
+		if err := authn.ValidateUsers(c.Users, c.UsersBcryptCost, c.UsersPasswordHash); err != nil {
+			return err
+		}
+	}
+	if c.UsersFile != nil {
+		if err := c.UsersFile.Validate("users_file"); err != nil {
+			return err
+		}
+		if _, err := authn.LoadUsersFile(c.UsersFile.Path, c.UsersBcryptCost, c.UsersPasswordHash); err != nil {
+			return err
+		}
+	}
+	if c.HtpasswdAuth != nil {
+		if err := c.HtpasswdAuth.Validate("htpasswd_auth"); err != nil {
+			return err
+		}
+		if err := authn.ValidateHtpasswdFile(c.HtpasswdAuth.Path); err != nil {
+			return err
+		}
+	}
+	if c.Server.TLSMinVersion == "" {
+		c.Server.TLSMinVersion = "1.2"
+	}
+	if v, ok := tlsVersions[c.Server.TLSMinVersion]; ok {
+		c.Server.tlsMinVersion = v
+	} else {
+		return fmt.Errorf("unknown server.tls_min_version %q, must be one of 1.0, 1.1, 1.2, 1.3", c.Server.TLSMinVersion)
+	}
+	c.Server.tlsCipherSuites = nil
+	for _, name := range c.Server.TLSCipherSuites {
+		cs, ok := tlsCipherSuites[name]
+		if !ok {
+			return fmt.Errorf("unknown or unsupported cipher suite %q in server.tls_cipher_suites", name)
+		}
+		c.Server.tlsCipherSuites = append(c.Server.tlsCipherSuites, cs)
+	}
+	if c.ClientCertAuth != nil {
+		if err := c.ClientCertAuth.Validate("client_cert_auth"); err != nil {
+			return err
+		}
+		if c.Server.ClientAuth == "" {
+			c.Server.ClientAuth = "verify_if_given"
+		}
+		c.Server.clientCAs = c.ClientCertAuth.CertPool()
+	}
+	if c.Server.Realm != nil && *c.Server.Realm == "" {
+		return fmt.Errorf("server.realm must not be empty")
+	}
+	for _, v := range []string{c.Server.realm(""), c.Server.Service} {
+		if strings.ContainsAny(v, "\"\\\r\n") {
+			return fmt.Errorf("server.realm and server.service must not contain quotes, backslashes or line breaks")
+		}
+	}
+	if err := c.Server.validateLimits(); err != nil {
+		return err
+	}
+	if err := c.Server.validateIPFilter(); err != nil {
+		return err
+	}
+	switch c.Server.VersionEndpoint {
+	case "":
+		c.Server.VersionEndpoint = versionAuthenticated
+	case versionAuthenticated, versionPublic, versionDisabled:
+	default:
+		return fmt.Errorf("server.version_endpoint must be %s, %s or %s, got %q", versionAuthenticated, versionPublic, versionDisabled, c.Server.VersionEndpoint)
+	}
+	switch c.Server.LogFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("server.log_format must be text or json, got %q", c.Server.LogFormat)
+	}
+	switch c.Server.BackendCheckFailure {
+	case "":
+		c.Server.BackendCheckFailure = backendCheckFail
+	case backendCheckFail, backendCheckWarn:
+	default:
+		return fmt.Errorf("server.backend_check_failure must be %s or %s, got %q", backendCheckFail, backendCheckWarn, c.Server.BackendCheckFailure)
+	}
+	if c.Server.BackendCheckTimeout < 0 {
+		return fmt.Errorf("server.backend_check_timeout must not be negative")
+	}
+	if c.Server.BackendCheckTimeout == 0 {
+		c.Server.BackendCheckTimeout = defaultBackendCheckTimeout
+	}
+	switch c.Server.ClientAuth {
+	case "", "none":
+	case "verify_if_given", "require":
+		if c.ClientCertAuth == nil {
+			return fmt.Errorf("server.client_auth requires client_cert_auth to be configured")
+		}
+	default:
+		return fmt.Errorf("server.client_auth must be one of none, verify_if_given, require, got %q", c.Server.ClientAuth)
+	}
+	if c.Server.Tracing != nil {
+		if err := c.Server.Tracing.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Server.RateLimit != nil {
+		if err := c.Server.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Server.CORS != nil {
+		if err := c.Server.CORS.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Server.validateResponseHeaders(); err != nil {
+		return err
+	}
+	if c.Token.Refresh != nil {
+		if err := c.Token.Refresh.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Token.Revocation != nil {
+		if err := c.Token.Revocation.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Authn != nil && c.Authn.Normalize != nil {
+		if err := c.Authn.Normalize.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Authn != nil {
+		if err := c.Authn.validateOrder(methods); err != nil {
+			return err
+		}
+	}
+	if c.Authn != nil && c.Authn.TOTP != nil {
+		if err := c.Authn.TOTP.Validate("authn.totp"); err != nil {
+			return err
+		}
+	}
+	if c.Authn != nil && c.Authn.ConstantTimeDeny != nil {
+		if err := c.Authn.ConstantTimeDeny.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Authz != nil && c.Authz.Cache != nil {
+		if err := c.Authz.Cache.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Authz != nil && c.Authz.LogUnmatched != nil {
+		if err := c.Authz.LogUnmatched.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Authz != nil && c.Authz.DenyWildcardResource && c.ACL == nil && c.ACLMongo == nil && c.ACLSQL == nil {
+		return errors.New("authz.deny_wildcard_resource requires acl, acl_mongo or acl_sql, other authorizers cannot grant wildcard names")
+	}
+	if c.Audit != nil {
+		if err := c.Audit.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Notifications != nil {
+		if err := c.Notifications.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Lockout != nil {
+		if err := c.Lockout.validate(); err != nil {
+			return err
+		}
+	}
+	if c.LDAPAuth != nil {
+		if err := c.LDAPAuth.Validate("ldap_auth"); err != nil {
+			return err
+		}
+	}
+	if c.JWTAuth != nil {
+		if err := c.JWTAuth.Validate("jwt_auth"); err != nil {
+			return err
+		}
+	}
+	if c.AzureAuth != nil {
+		if err := c.AzureAuth.Validate("azure_auth"); err != nil {
+			return err
+		}
+	}
+	if c.CognitoAuth != nil {
+		if err := c.CognitoAuth.Validate("cognito_auth"); err != nil {
+			return err
+		}
+	}
+	if c.K8sSAAuth != nil {
+		if err := c.K8sSAAuth.Validate("k8s_sa_auth"); err != nil {
+			return err
+		}
+	}
+	if c.OktaAuth != nil {
+		if err := c.OktaAuth.Validate("okta_auth"); err != nil {
+			return err
+		}
+	}
 	if c.MongoAuth != nil {
 		if err := c.MongoAuth.Validate("mongo_auth"); err != nil {
 			return err
 		}
 	}
 	if gac := c.GoogleAuth; gac != nil {
-		if gac.ClientSecretFile != "" {
-			contents, err := ioutil.ReadFile(gac.ClientSecretFile)
-			if err != nil {
-				return fmt.Errorf("could not read %s: %s", gac.ClientSecretFile, err)
-			}
-			gac.ClientSecret = strings.TrimSpace(string(contents))
+		secret, err := authn.ResolveClientSecret(gac.ClientSecret, gac.ClientSecretFile, gac.ClientSecretSource)
+		if err != nil {
+			return fmt.Errorf("google_auth.client_secret: %s", err)
 		}
-		if gac.ClientId == "" || gac.ClientSecret == "" || gac.TokenDB == "" {
+		gac.ClientSecret = secret
+		if gac.ClientId == "" || gac.ClientSecret == "" || (gac.TokenDB == "" && gac.RedisTokenDB == nil) {
 			return errors.New("google_auth.{client_id,client_secret,token_db} are required.")
 		}
+		if err := validateRedisTokenDB("google_auth", gac.TokenDB, gac.RedisTokenDB); err != nil {
+			return err
+		}
 		if gac.HTTPTimeout <= 0 {
 			gac.HTTPTimeout = 10
 		}
+		if gac.MembershipCache != nil {
+			if err := gac.MembershipCache.Validate("google_auth.membership_cache"); err != nil {
+				return err
+			}
+		}
 	}
 	if ghac := c.GitHubAuth; ghac != nil {
-		if ghac.ClientSecretFile != "" {
-			contents, err := ioutil.ReadFile(ghac.ClientSecretFile)
-			if err != nil {
-				return fmt.Errorf("could not read %s: %s", ghac.ClientSecretFile, err)
-			}
-			ghac.ClientSecret = strings.TrimSpace(string(contents))
+		secret, err := authn.ResolveClientSecret(ghac.ClientSecret, ghac.ClientSecretFile, ghac.ClientSecretSource)
+		if err != nil {
+			return fmt.Errorf("github_auth.client_secret: %s", err)
 		}
-		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.TokenDB == "" && ghac.GCSTokenDB == nil) {
+		ghac.ClientSecret = secret
+		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.TokenDB == "" && ghac.GCSTokenDB == nil && ghac.RedisTokenDB == nil) {
 			return errors.New("github_auth.{client_id,client_secret,token_db} are required")
 		}
+		if ghac.GCSTokenDB != nil && ghac.RedisTokenDB != nil {
+			return errors.New("github_auth.gcs_token_db and github_auth.redis_token_db are mutually exclusive")
+		}
+		if err := validateRedisTokenDB("github_auth", ghac.TokenDB, ghac.RedisTokenDB); err != nil {
+			return err
+		}
 
 		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.GCSTokenDB != nil && (ghac.GCSTokenDB.Bucket == "" || ghac.GCSTokenDB.ClientSecretFile == "")) {
 			return errors.New("github_auth.{client_id,client_secret,gcs_token_db{bucket,client_secret_file}} are required")
 		}
+		if ghac.GCSTokenDB != nil {
+			if err := ghac.GCSTokenDB.Validate("github_auth.gcs_token_db"); err != nil {
+				return err
+			}
+		}
 		if ghac.HTTPTimeout <= 0 {
 			ghac.HTTPTimeout = time.Duration(10 * time.Second)
 		}
@@ -137,31 +858,92 @@ func validate(c *Config) error {
 			// Token expires after 1 hour by default
 			ghac.RevalidateAfter = time.Duration(1 * time.Hour)
 		}
+		if ghac.MembershipCache != nil {
+			if err := ghac.MembershipCache.Validate("github_auth.membership_cache"); err != nil {
+				return err
+			}
+		}
+	}
+	if oac := c.OIDCAuth; oac != nil {
+		secret, err := authn.ResolveClientSecret(oac.ClientSecret, oac.ClientSecretFile, oac.ClientSecretSource)
+		if err != nil {
+			return fmt.Errorf("oidc_auth.client_secret: %s", err)
+		}
+		oac.ClientSecret = secret
+		if err := oac.Validate("oidc_auth"); err != nil {
+			return err
+		}
+		if err := validateRedisTokenDB("oidc_auth", oac.TokenDB, oac.RedisTokenDB); err != nil {
+			return err
+		}
+	}
+	if glac := c.GitLabAuth; glac != nil {
+		secret, err := authn.ResolveClientSecret(glac.ClientSecret, glac.ClientSecretFile, glac.ClientSecretSource)
+		if err != nil {
+			return fmt.Errorf("gitlab_auth.client_secret: %s", err)
+		}
+		glac.ClientSecret = secret
+		if glac.BaseURL == "" || glac.ClientId == "" || glac.ClientSecret == "" {
+			return errors.New("gitlab_auth.{base_url,client_id,client_secret} are required")
+		}
+		if !strings.HasPrefix(glac.BaseURL, "https://") && !strings.HasPrefix(glac.BaseURL, "http://") {
+			return fmt.Errorf("gitlab_auth.base_url must be an http(s) URL, got %q", glac.BaseURL)
+		}
+		if glac.RedirectURL == "" || (glac.TokenDB == "" && glac.RedisTokenDB == nil) {
+			return errors.New("gitlab_auth.{redirect_url,token_db} are required")
+		}
+		if err := validateRedisTokenDB("gitlab_auth", glac.TokenDB, glac.RedisTokenDB); err != nil {
+			return err
+		}
+		if glac.HTTPTimeout <= 0 {
+			glac.HTTPTimeout = 10 * time.Second
+		}
+		if glac.RevalidateAfter == 0 {
+			glac.RevalidateAfter = 1 * time.Hour
+		}
 	}
 	if c.ExtAuth != nil {
 		if err := c.ExtAuth.Validate(); err != nil {
 			return fmt.Errorf("bad ext_auth config: %s", err)
 		}
 	}
-	if c.ACL == nil && c.ACLMongo == nil && c.ExtAuthz == nil && c.PluginAuthz == nil {
+	if c.ACL == nil && c.ACLMongo == nil && c.ACLSQL == nil && c.ExtAuthz == nil && c.CasbinAuthz == nil && c.OPAAuthz == nil && c.PluginAuthz == nil {
 		return errors.New("ACL is empty, this is probably a mistake. Use an empty list if you really want to deny all actions")
 	}
 
 	if c.ACL != nil {
 		if err := authz.ValidateACL(c.ACL); err != nil {
-			return fmt.Errorf("invalid ACL: %s", err)
+			return api.WrapConfigError(err, "invalid ACL", "acl")
 		}
 	}
+	if err := authz.ValidateACLMode("acl_mode", &c.ACLMode); err != nil {
+		return err
+	}
 	if c.ACLMongo != nil {
 		if err := c.ACLMongo.Validate("acl_mongo"); err != nil {
 			return err
 		}
 	}
+	if c.ACLSQL != nil {
+		if err := c.ACLSQL.Validate("acl_sql"); err != nil {
+			return err
+		}
+	}
 	if c.ExtAuthz != nil {
 		if err := c.ExtAuthz.Validate(); err != nil {
 			return err
 		}
 	}
+	if c.CasbinAuthz != nil {
+		if err := c.CasbinAuthz.Validate("casbin_authz"); err != nil {
+			return err
+		}
+	}
+	if c.OPAAuthz != nil {
+		if err := c.OPAAuthz.Validate("opa_authz"); err != nil {
+			return err
+		}
+	}
 	if c.PluginAuthn != nil {
 		if err := c.PluginAuthn.Validate(); err != nil {
 			return fmt.Errorf("bad plugin_authn config: %s", err)
@@ -172,7 +954,7 @@ func validate(c *Config) error {
 			return fmt.Errorf("bad plugin_authz config: %s", err)
 		}
 	}
-	return nil
+	return validateTenants(c)
 }
 
 func loadCertAndKey(certFile, keyFile string) (pk libtrust.PublicKey, prk libtrust.PrivateKey, err error) {
@@ -192,50 +974,238 @@ func loadCertAndKey(certFile, keyFile string) (pk libtrust.PublicKey, prk libtru
 	return
 }
 
+func modTimes(certFile, keyFile string) (certModTime, keyModTime time.Time, err error) {
+	cfi, err := os.Stat(certFile)
+	if err != nil {
+		return
+	}
+	kfi, err := os.Stat(keyFile)
+	if err != nil {
+		return
+	}
+	return cfi.ModTime(), kfi.ModTime(), nil
+}
+
+// loadKeys loads the certificate and key pair, unless prev was loaded from the same files
+// and they have not been modified since, in which case prev is returned.
+func loadKeys(certFile, keyFile string, prevCertFile, prevKeyFile string, prev keyPair) (kp keyPair, err error) {
+	kp.certModTime, kp.keyModTime, err = modTimes(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	if prev.publicKey != nil && certFile == prevCertFile && keyFile == prevKeyFile &&
+		kp.certModTime.Equal(prev.certModTime) && kp.keyModTime.Equal(prev.keyModTime) {
+		glog.V(2).Infof("%s and %s have not changed, keeping loaded keys", certFile, keyFile)
+		return prev, nil
+	}
+	kp.publicKey, kp.privateKey, err = loadCertAndKey(certFile, keyFile)
+	return
+}
+
+// loadTokenKeys loads all of tc.Keys, makes the active one the signing key and checks that key IDs are unique.
+func loadTokenKeys(tc, prev *TokenConfig) error {
+	kids := map[string]bool{}
+	for i, k := range tc.Keys {
+		var pk keyPair
+		var pc, pkf string
+		for _, p := range prev.Keys {
+			if p.CertFile == k.CertFile && p.KeyFile == k.KeyFile {
+				pk, pc, pkf = p.keyPair, p.CertFile, p.KeyFile
+				break
+			}
+		}
+		kp, err := loadKeys(k.CertFile, k.KeyFile, pc, pkf, pk)
+		if err != nil {
+			return fmt.Errorf("failed to load token.keys[%d]: %s", i, err)
+		}
+		k.keyPair = kp
+		if k.KeyID == "" {
+			k.KeyID = kp.publicKey.KeyID()
+		}
+		if kids[k.KeyID] {
+			return fmt.Errorf("token.keys[%d]: duplicate kid %q", i, k.KeyID)
+		}
+		kids[k.KeyID] = true
+		if k.Active {
+			tc.keyPair, tc.kid = kp, k.KeyID
+		}
+	}
+	return nil
+}
+
+// loadServiceKeys loads all of tc.ServiceKeys and checks that their IDs do not clash with other token keys.
+func loadServiceKeys(tc, prev *TokenConfig) error {
+	kids := map[string]bool{}
+	for _, vk := range tc.verificationKeys(time.Time{}) {
+		kids[vk.kid] = true
+	}
+	services := make([]string, 0, len(tc.ServiceKeys))
+	for s := range tc.ServiceKeys {
+		services = append(services, s)
+	}
+	sort.Strings(services)
+	for _, s := range services {
+		k := tc.ServiceKeys[s]
+		var pk keyPair
+		var pc, pkf string
+		if p, ok := prev.ServiceKeys[s]; ok {
+			pk, pc, pkf = p.keyPair, p.CertFile, p.KeyFile
+		}
+		kp, err := loadKeys(k.CertFile, k.KeyFile, pc, pkf, pk)
+		if err != nil {
+			return fmt.Errorf("failed to load token.service_keys[%q]: %s", s, err)
+		}
+		k.keyPair = kp
+		if k.KeyID == "" {
+			k.KeyID = kp.publicKey.KeyID()
+		}
+		if kids[k.KeyID] {
+			return fmt.Errorf("token.service_keys[%q]: duplicate kid %q", s, k.KeyID)
+		}
+		kids[k.KeyID] = true
+		if tc.SigningAlg != "" {
+			if _, sigAlg, err := tc.signWith(kp.privateKey, "dummy"); err != nil {
+				return fmt.Errorf("failed to sign with token.service_keys[%q]: %s", s, err)
+			} else if sigAlg != tc.SigningAlg {
+				return fmt.Errorf("token.signing_alg is %s, but token.service_keys[%q] signs with %s", tc.SigningAlg, s, sigAlg)
+			}
+		}
+	}
+	return nil
+}
+
+// ExpandEnv controls whether environment variable references are expanded in config files.
+var ExpandEnv = true
+
+// Only upper case names are considered, so that ACL variables like ${account} are not affected.
+// For $VAR, the character after the name is captured: if it can be part of a BCrypt hash
+// ([./A-Za-z0-9]), as in $2y$05$LO.vz..., the reference is left alone. $$ is matched to be left
+// alone too, so that it does not start a reference.
+var envRefRegex = regexp.MustCompile(`\$\$|\$\{([A-Z_][A-Z0-9_]*)(:-[^}]*)?\}|\$([A-Z_][A-Z0-9_]*)([./A-Za-z0-9]?)`)
+
+// expandEnv replaces ${VAR}, ${VAR:-default} and $VAR with values of environment variables.
+// ${VAR} without a default must be set. Unset $VAR is left as is, as is everything else, including $$.
+func expandEnv(contents string) (string, error) {
+	var err error
+	res := envRefRegex.ReplaceAllStringFunc(contents, func(ref string) string {
+		m := envRefRegex.FindStringSubmatch(ref)
+		if ref == "$$" {
+			return ref
+		}
+		if m[3] != "" {
+			if v, ok := os.LookupEnv(m[3]); ok && m[4] == "" {
+				return v
+			}
+			return ref
+		}
+		v, ok := os.LookupEnv(m[1])
+		switch {
+		case m[2] != "" && v == "":
+			return m[2][2:]
+		case !ok && err == nil:
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return v
+	})
+	return res, err
+}
+
+// loadTokenConfig loads the token keys, reusing those of prev that haven't changed.
+// If no keys are configured, fallback is used, if set.
+func loadTokenConfig(tc, prev *TokenConfig, fallback *keyPair) error {
+	var err error
+	tokenConfigured := false
+	if len(tc.Keys) > 0 {
+		if err := loadTokenKeys(tc, prev); err != nil {
+			return err
+		}
+		tokenConfigured = true
+	} else if tc.CertFile != "" || tc.KeyFile != "" {
+		// Check for partial configuration.
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return fmt.Errorf("failed to load token cert and key: both were not provided")
+		}
+		tc.keyPair, err = loadKeys(tc.CertFile, tc.KeyFile, prev.CertFile, prev.KeyFile, prev.keyPair)
+		if err != nil {
+			return fmt.Errorf("failed to load token cert and key: %s", err)
+		}
+		tokenConfigured = true
+	}
+
+	if fallback != nil && !tokenConfigured {
+		tc.keyPair = *fallback
+		tokenConfigured = true
+	}
+
+	if !tokenConfigured {
+		return fmt.Errorf("failed to load token cert and key: none provided")
+	}
+
+	if tc.SigningAlg != "" {
+		if _, sigAlg, err := tc.sign("dummy"); err != nil {
+			return fmt.Errorf("failed to sign with token key: %s", err)
+		} else if sigAlg != tc.SigningAlg {
+			return fmt.Errorf("token.signing_alg is %s, but token key is %s and signs with %s", tc.SigningAlg, tc.publicKey.KeyType(), sigAlg)
+		}
+	}
+	return loadServiceKeys(tc, prev)
+}
+
 func LoadConfig(fileName string) (*Config, error) {
-	contents, err := ioutil.ReadFile(fileName)
+	return ReloadConfig(fileName, nil)
+}
+
+// ReloadConfig is like LoadConfig, but keys that were loaded as part of prev are
+// reused if neither their paths nor their files have changed since.
+func ReloadConfig(fileName string, prev *Config) (*Config, error) {
+	contents, files, merged, err := readConfig(fileName)
 	if err != nil {
-		return nil, fmt.Errorf("could not read %s: %s", fileName, err)
+		return nil, err
 	}
-	c := &Config{}
+	c := &Config{files: files}
 	if err = yaml.Unmarshal(contents, c); err != nil {
-		return nil, fmt.Errorf("could not parse config: %s", err)
+		return nil, fmt.Errorf("could not parse %s: %s", fileName, err)
 	}
 	if err = validate(c); err != nil {
+		if ce, ok := err.(*api.ConfigError); ok && !merged {
+			// Lines of merged contents don't match any of the files.
+			if line, column := configPosition(contents, ce.Path); line > 0 {
+				return nil, fmt.Errorf("invalid config: %s (at line %d, column %d)", err, line, column)
+			}
+		}
 		return nil, fmt.Errorf("invalid config: %s", err)
 	}
+	if prev == nil {
+		prev = &Config{}
+	}
 	serverConfigured := false
 	if c.Server.CertFile != "" || c.Server.KeyFile != "" {
 		// Check for partial configuration.
 		if c.Server.CertFile == "" || c.Server.KeyFile == "" {
 			return nil, fmt.Errorf("failed to load server cert and key: both were not provided")
 		}
-		c.Server.publicKey, c.Server.privateKey, err = loadCertAndKey(c.Server.CertFile, c.Server.KeyFile)
+		c.Server.keyPair, err = loadKeys(c.Server.CertFile, c.Server.KeyFile, prev.Server.CertFile, prev.Server.KeyFile, prev.Server.keyPair)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load server cert and key: %s", err)
 		}
 		serverConfigured = true
 	}
-	tokenConfigured := false
-	if c.Token.CertFile != "" || c.Token.KeyFile != "" {
-		// Check for partial configuration.
-		if c.Token.CertFile == "" || c.Token.KeyFile == "" {
-			return nil, fmt.Errorf("failed to load token cert and key: both were not provided")
-		}
-		c.Token.publicKey, c.Token.privateKey, err = loadCertAndKey(c.Token.CertFile, c.Token.KeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load token cert and key: %s", err)
-		}
-		tokenConfigured = true
+	var serverKeyPair *keyPair
+	if serverConfigured {
+		serverKeyPair = &c.Server.keyPair
 	}
-
-	if serverConfigured && !tokenConfigured {
-		c.Token.publicKey, c.Token.privateKey = c.Server.publicKey, c.Server.privateKey
-		tokenConfigured = true
+	if err := loadTokenConfig(&c.Token, &prev.Token, serverKeyPair); err != nil {
+		return nil, err
 	}
-
-	if !tokenConfigured {
-		return nil, fmt.Errorf("failed to load token cert and key: none provided")
+	for name, t := range c.Tenants {
+		// Tenants must have keys of their own.
+		pt := &TokenConfig{}
+		if p := prev.Tenants[name]; p != nil {
+			pt = &p.Token
+		}
+		if err := loadTokenConfig(&t.Token, pt, nil); err != nil {
+			return nil, fmt.Errorf("tenants.%s: %s", name, err)
+		}
 	}
 
 	if !serverConfigured && c.Server.LetsEncrypt.Email != "" {
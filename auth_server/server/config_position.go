@@ -0,0 +1,67 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	yamlnode "gopkg.in/yaml.v3"
+)
+
+// configPosition returns the line and column of the value at path (see api.ConfigError) in the config.
+// If the value is not in the config, e.g. because it is a default, the position of the closest
+// value that contains it is returned. Returns 0 if the config can't be parsed or the path is empty.
+func configPosition(contents []byte, path []interface{}) (int, int) {
+	var doc yamlnode.Node
+	if err := yamlnode.Unmarshal(contents, &doc); err != nil || len(doc.Content) == 0 || len(path) == 0 {
+		return 0, 0
+	}
+	n := doc.Content[0]
+	found := false
+	for _, p := range path {
+		for n.Kind == yamlnode.AliasNode {
+			n = n.Alias
+		}
+		next := childNode(n, p)
+		if next == nil {
+			break
+		}
+		n, found = next, true
+	}
+	if !found {
+		return 0, 0
+	}
+	return n.Line, n.Column
+}
+
+// childNode returns the value of the key in a mapping or the element at the index in a sequence, or nil.
+func childNode(n *yamlnode.Node, p interface{}) *yamlnode.Node {
+	switch k := p.(type) {
+	case string:
+		if n.Kind != yamlnode.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == k {
+				return n.Content[i+1]
+			}
+		}
+	case int:
+		if n.Kind == yamlnode.SequenceNode && k >= 0 && k < len(n.Content) {
+			return n.Content[k]
+		}
+	}
+	return nil
+}
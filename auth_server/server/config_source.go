@@ -0,0 +1,102 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Settings of fetching the config from a URL, see readConfigSource. They can't come from
+// the config itself and are set by flags.
+var (
+	// ConfigFetchTimeout limits the time it takes to fetch a remote config, including the body.
+	ConfigFetchTimeout = 10 * time.Second
+	// ConfigAuthorizationFile contains the value of the Authorization header to send when
+	// fetching a remote config, e.g. "Bearer <token>". Not sent if empty.
+	ConfigAuthorizationFile = ""
+)
+
+// IsConfigURL returns true if the config is fetched from a URL rather than read from a file.
+// Remote configs are not watched for changes, they are reloaded on SIGHUP.
+func IsConfigURL(name string) bool {
+	return strings.Contains(name, "://")
+}
+
+// readConfigSource returns the contents of the config file or of the http(s) URL. Contents that
+// are gzip-compressed (by the magic number, or .gz names which then must be) are decompressed.
+func readConfigSource(name string) ([]byte, error) {
+	var contents []byte
+	var err error
+	compressed := strings.HasSuffix(name, ".gz")
+	if IsConfigURL(name) {
+		var u *url.URL
+		if u, err = url.Parse(name); err != nil {
+			return nil, fmt.Errorf("invalid config URL %s: %s", name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid config URL %s: scheme must be http or https", name)
+		}
+		compressed = strings.HasSuffix(path.Clean(u.Path), ".gz")
+		if contents, err = fetchConfig(u); err != nil {
+			return nil, fmt.Errorf("could not fetch %s: %s", u.Redacted(), err)
+		}
+	} else if contents, err = ioutil.ReadFile(name); err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", name, err)
+	}
+	if compressed || bytes.HasPrefix(contents, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(contents))
+		if err == nil {
+			contents, err = ioutil.ReadAll(zr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress %s: %s", name, err)
+		}
+	}
+	return contents, nil
+}
+
+func fetchConfig(u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ConfigAuthorizationFile != "" {
+		auth, err := ioutil.ReadFile(ConfigAuthorizationFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read authorization: %s", err)
+		}
+		req.Header.Set("Authorization", strings.TrimSpace(string(auth)))
+	}
+	client := &http.Client{Timeout: ConfigFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
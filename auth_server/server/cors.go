@@ -0,0 +1,130 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig allows browser-based clients on other origins to call the token and JWKS endpoints.
+type CORSConfig struct {
+	// Origins allowed to make requests, e.g. https://ui.example.com. "*" allows any origin,
+	// a "*." prefix of the host allows its subdomains, e.g. https://*.example.com.
+	AllowedOrigins []string `yaml:"allowed_origins,omitempty"`
+	// Default is GET, POST and OPTIONS.
+	AllowedMethods []string `yaml:"allowed_methods,omitempty"`
+	// Request headers allowed in addition to the CORS-safelisted ones, default is Authorization and Content-Type.
+	AllowedHeaders []string `yaml:"allowed_headers,omitempty"`
+	// Allow requests with credentials (cookies, HTTP auth). Cannot be combined with wildcard origins.
+	AllowCredentials bool `yaml:"allow_credentials,omitempty"`
+	// How long browsers may cache preflight results. Zero leaves it to the browser.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+}
+
+func (c *CORSConfig) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("server.cors.allowed_origins is required")
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("server.cors: wildcard origins cannot be combined with allow_credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("server.cors.allowed_origins: invalid origin %q, must be scheme://host[:port]", o)
+		}
+		if strings.Contains(u.Host, "*") {
+			if c.AllowCredentials {
+				return fmt.Errorf("server.cors: wildcard origins cannot be combined with allow_credentials")
+			}
+			if !strings.HasPrefix(u.Host, "*.") || strings.Contains(u.Host[2:], "*") {
+				return fmt.Errorf("server.cors.allowed_origins: invalid origin %q, only a leading *. is supported", o)
+			}
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("server.cors.max_age must not be negative")
+	}
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = []string{"GET", "POST", "OPTIONS"}
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = []string{"Authorization", "Content-Type"}
+	}
+	return nil
+}
+
+// originAllowed matches the origin exactly, case-insensitively, or by a wildcard pattern.
+func (c *CORSConfig) originAllowed(origin string) bool {
+	origin = strings.TrimSuffix(strings.ToLower(origin), "/")
+	for _, o := range c.AllowedOrigins {
+		o = strings.TrimSuffix(strings.ToLower(o), "/")
+		if o == "*" || o == origin {
+			return true
+		}
+		if i := strings.Index(o, "://*."); i >= 0 {
+			scheme, suffix := o[:i+3], o[i+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) && len(origin) > len(scheme)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply adds CORS headers for requests from allowed origins and responds to preflight requests.
+// Returns true if the request has been handled.
+func (c *CORSConfig) apply(rw http.ResponseWriter, req *http.Request) bool {
+	if c == nil {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+	h := rw.Header()
+	h.Add("Vary", "Origin")
+	if origin == "" || !c.originAllowed(origin) {
+		if preflight {
+			http.Error(rw, "Origin not allowed", http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return false
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Longer delays would rather hold up clients than protect anyone.
+const maxDenyDelay = 10 * time.Second
+
+// ConstantTimeDenyConfig pads the response time of failed authentication, whichever backend and cause,
+// to at least min plus a random jitter of up to jitter, measured from the start of the request. This way
+// unknown users can't be told from wrong passwords by how long backends take to reject them.
+// Successful authentication and backend errors are not delayed.
+type ConstantTimeDenyConfig struct {
+	Min    time.Duration `yaml:"min,omitempty"`
+	Jitter time.Duration `yaml:"jitter,omitempty"`
+}
+
+func (c *ConstantTimeDenyConfig) validate() error {
+	if c.Min <= 0 || c.Jitter < 0 {
+		return fmt.Errorf("authn.constant_time_deny: min must be positive and jitter must not be negative")
+	}
+	if c.Min+c.Jitter > maxDenyDelay {
+		return fmt.Errorf("authn.constant_time_deny: min + jitter must not exceed %s, got %s", maxDenyDelay, c.Min+c.Jitter)
+	}
+	return nil
+}
+
+// wait sleeps until the delay has passed since start. It returns immediately if c is nil.
+func (c *ConstantTimeDenyConfig) wait(start time.Time) {
+	if c == nil {
+		return
+	}
+	d := c.Min
+	if c.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(c.Jitter) + 1))
+	}
+	time.Sleep(d - time.Since(start))
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const explainPath = "/explain"
+
+type explainResult struct {
+	Scope     string   `json:"scope"`
+	Requested []string `json:"requested"`
+	Granted   []string `json:"granted"`
+	Denied    []string `json:"denied"`
+	Rules     []string `json:"rules,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+type explainResponse struct {
+	Account string          `json:"account"`
+	Service string          `json:"service,omitempty"`
+	Results []explainResult `json:"results"`
+}
+
+// parseExplainRequest returns the request to explain: the account to authorize, with the given labels
+// (as label=key=value parameters), IP address and time (RFC 3339) of the request, and scopes.
+// Credentials of the account are not needed, it is not authenticated.
+func (as *AuthServer) parseExplainRequest(req *http.Request) (*authRequest, error) {
+	ar := &authRequest{Account: req.FormValue("account"), Service: req.FormValue("service"), Labels: api.Labels{}}
+	if ar.Account == "" {
+		return nil, fmt.Errorf("account is required")
+	}
+	var err error
+	if ar.Scopes, err = as.parseScopes(req.Form["scope"]); err != nil {
+		return nil, err
+	}
+	if len(ar.Scopes) == 0 {
+		return nil, fmt.Errorf("scope is required")
+	}
+	for _, l := range req.Form["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", l)
+		}
+		ar.Labels[kv[0]] = append(ar.Labels[kv[0]], kv[1])
+	}
+	if ip := req.FormValue("ip"); ip != "" {
+		if ar.RemoteIP = net.ParseIP(ip); ar.RemoteIP == nil {
+			return nil, fmt.Errorf("invalid ip %q", ip)
+		}
+		ar.RemoteAddr = ip
+	}
+	if t := req.FormValue("time"); t != "" {
+		if ar.evalTime, err = time.Parse(time.RFC3339, t); err != nil {
+			return nil, fmt.Errorf("invalid time %q, expected RFC 3339", t)
+		}
+	}
+	return ar, nil
+}
+
+// doExplain responds with the actions that would be granted to an account and the rules that decide,
+// without issuing a token. The request must be authenticated as one of authz.explain_admins.
+func (as *AuthServer) doExplain(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, "Bad request: invalid form value", http.StatusBadRequest)
+		return
+	}
+	admin, _, err := as.parseClient(req)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+	admin.Account = admin.User
+	admin.RequestID = requestID(req)
+	authnResult, _, err := as.Authenticate(admin)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), http.StatusServiceUnavailable)
+		return
+	}
+	if !authnResult || admin.Account == "" {
+		rw.Header()["WWW-Authenticate"] = []string{as.config.Server.basicChallenge(as.config.Token.Issuer)}
+		http.Error(rw, "Auth failed.", http.StatusUnauthorized)
+		return
+	}
+	if !containsString(as.config.Authz.ExplainAdmins, admin.Account) {
+		glog.Warningf("%s is not allowed to explain authorization decisions", admin)
+		http.Error(rw, "Not allowed.", http.StatusForbidden)
+		return
+	}
+	ar, err := as.parseExplainRequest(req)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+	ar.RequestID = admin.RequestID
+	glog.Infof("%s: %s explains %+v", ar.RequestID, admin.Account, ar)
+	ares, err := as.Authorize(ar)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Authorization failed (%s)", err), http.StatusServiceUnavailable)
+		return
+	}
+	resp := explainResponse{Account: ar.Account, Service: ar.Service}
+	for _, a := range ares {
+		r := explainResult{
+			Scope:     a.scope.String(),
+			Requested: a.scope.Actions,
+			Granted:   append([]string{}, a.autorizedActions...),
+			Denied:    []string{},
+			Rules:     a.rules,
+			Reason:    a.reason,
+		}
+		for _, action := range a.scope.Actions {
+			if !containsString(r.Granted, action) {
+				r.Denied = append(r.Denied, action)
+			}
+		}
+		resp.Results = append(resp.Results, r)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
@@ -0,0 +1,197 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A config file can include other files with the top-level "include" key, which is a file name
+// or a list of them. Relative names are relative to the directory of the including file. Names can be
+// glob patterns, which may match no files, or directories, in which all *.yml and *.yaml files are included.
+// Other files must exist. Included files can include further files, but not ones that include them.
+//
+// Files are merged in this order: the including file, then its includes in the order listed, with
+// glob matches and directory contents sorted by name. Each included file is merged with its own
+// includes before that. When merging, maps are merged key by key, recursively. Other values, including
+// lists, are replaced by those from later files, with one exception: entries of the top-level acl list
+// are concatenated, in merge order. A null value in a later file removes the key.
+const includeKey = "include"
+
+// readConfigFile reads the file (or fetches the URL) and expands environment variables in it.
+func readConfigFile(fileName string) ([]byte, error) {
+	contents, err := readConfigSource(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if ExpandEnv {
+		expanded, err := expandEnv(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("could not expand variables in %s: %s", fileName, err)
+		}
+		contents = []byte(expanded)
+	}
+	return contents, nil
+}
+
+// readConfig returns the contents of the config file merged with the files it includes,
+// the names of all the files that were read and whether the contents are the result of merging.
+func readConfig(fileName string) ([]byte, []string, bool, error) {
+	contents, err := readConfigFile(fileName)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var top map[interface{}]interface{}
+	if err := yaml.Unmarshal(contents, &top); err != nil {
+		return nil, nil, false, fmt.Errorf("could not parse %s: %s", fileName, err)
+	}
+	if _, found := top[includeKey]; !found {
+		// Parsed as is, so that errors refer to the original contents.
+		return contents, []string{fileName}, false, nil
+	}
+	if IsConfigURL(fileName) {
+		return nil, nil, false, fmt.Errorf("%s: include is not supported in remote configs", fileName)
+	}
+	il := &includeLoader{}
+	merged, err := il.load(fileName, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if contents, err = yaml.Marshal(merged); err != nil {
+		return nil, nil, false, fmt.Errorf("could not merge %s: %s", fileName, err)
+	}
+	return contents, il.files, true, nil
+}
+
+type includeLoader struct {
+	files []string
+}
+
+// load reads the file and merges its includes into it. stack contains the files that include it.
+func (il *includeLoader) load(fileName string, stack []string) (map[interface{}]interface{}, error) {
+	absName, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range stack {
+		if f == absName {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), absName)
+		}
+	}
+	stack = append(stack[:len(stack):len(stack)], absName)
+	contents, err := readConfigFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var m map[interface{}]interface{}
+	if err := yaml.Unmarshal(contents, &m); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", fileName, err)
+	}
+	if m == nil {
+		m = map[interface{}]interface{}{}
+	}
+	il.files = append(il.files, fileName)
+	includes, err := includedFiles(fileName, m[includeKey])
+	if err != nil {
+		return nil, err
+	}
+	delete(m, includeKey)
+	for _, inc := range includes {
+		im, err := il.load(inc, stack)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfig(m, im, true)
+	}
+	return m, nil
+}
+
+// includedFiles returns the names of the files that the value of the include key refers to, in merge order.
+func includedFiles(fileName string, include interface{}) ([]string, error) {
+	var names []string
+	switch v := include.(type) {
+	case nil:
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, n := range v {
+			s, ok := n.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: include must be a file name or a list of file names", fileName)
+			}
+			names = append(names, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a file name or a list of file names", fileName)
+	}
+	var files []string
+	for _, name := range names {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(fileName), name)
+		}
+		if strings.ContainsAny(name, "*?[") {
+			matches, err := filepath.Glob(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid include pattern %s: %s", fileName, name, err)
+			}
+			files = append(files, matches...)
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not include %s: %s", fileName, name, err)
+		}
+		if !fi.IsDir() {
+			files = append(files, name)
+			continue
+		}
+		var matches []string
+		for _, ext := range []string{"*.yml", "*.yaml"} {
+			m, _ := filepath.Glob(filepath.Join(name, ext))
+			matches = append(matches, m...)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// mergeConfig merges src into dst, see includeKey.
+func mergeConfig(dst, src map[interface{}]interface{}, top bool) {
+	for k, v := range src {
+		if top && k == "acl" {
+			dl, _ := dst[k].([]interface{})
+			if sl, ok := v.([]interface{}); ok {
+				dst[k] = append(dl, sl...)
+				continue
+			}
+		}
+		dm, dok := dst[k].(map[interface{}]interface{})
+		sm, sok := v.(map[interface{}]interface{})
+		if dok && sok {
+			mergeConfig(dm, sm, false)
+			continue
+		}
+		dst[k] = v
+	}
+}
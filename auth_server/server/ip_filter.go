@@ -0,0 +1,107 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cesanta/glog"
+)
+
+// parseNetworks parses a list of CIDRs or single addresses.
+func parseNetworks(configKey string, l []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for i, s := range l {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%s[%d]: invalid IP address %q", configKey, i, s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %s", configKey, i, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *ServerConfig) validateIPFilter() error {
+	var err error
+	if sc.allowedNets, err = parseNetworks("server.allowed_ips", sc.AllowedIPs); err != nil {
+		return err
+	}
+	if sc.AllowedIPs != nil && len(sc.allowedNets) == 0 {
+		return fmt.Errorf("server.allowed_ips must not be empty, remove it to allow all addresses")
+	}
+	sc.deniedNets, err = parseNetworks("server.denied_ips", sc.DeniedIPs)
+	return err
+}
+
+// ipFilterExempt returns true if the path is not subject to allowed_ips and denied_ips.
+func (sc *ServerConfig) ipFilterExempt(p string) bool {
+	if sc.IPFilterExemptHealth != nil && !*sc.IPFilterExemptHealth {
+		return false
+	}
+	return p == sc.PathPrefix+"/healthz" || p == sc.PathPrefix+"/readyz" ||
+		(sc.Metrics != nil && sc.Metrics.ListenAddress == "" && p == sc.PathPrefix+sc.Metrics.path())
+}
+
+// checkIPFilter rejects requests from clients that are in denied_ips or, if allowed_ips is set,
+// not in allowed_ips. Returns false if the request has been rejected. Clients whose address
+// cannot be determined are rejected too.
+func (sc *ServerConfig) checkIPFilter(rw http.ResponseWriter, req *http.Request) bool {
+	if (sc.allowedNets == nil && sc.deniedNets == nil) || sc.ipFilterExempt(req.URL.Path) {
+		return true
+	}
+	addr, err := sc.clientAddr(req)
+	var ip net.IP
+	if err == nil {
+		ip = parseRemoteAddr(addr)
+	}
+	switch {
+	case ip == nil:
+		glog.Warningf("Rejected request for %s: client address %q could not be determined", req.URL.Path, addr)
+	case containsIP(sc.deniedNets, ip):
+		glog.V(1).Infof("Rejected request for %s from %s: in server.denied_ips", req.URL.Path, ip)
+	case sc.allowedNets != nil && !containsIP(sc.allowedNets, ip):
+		glog.V(1).Infof("Rejected request for %s from %s: not in server.allowed_ips", req.URL.Path, ip)
+	default:
+		return true
+	}
+	http.Error(rw, "Forbidden", http.StatusForbidden)
+	return false
+}
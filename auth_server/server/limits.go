@@ -0,0 +1,95 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Defaults of the request size limits in ServerConfig. Docker clients send a few scopes
+// and short headers, these leave plenty of room for them.
+const (
+	defaultMaxHeaderBytes = 16 << 10
+	defaultMaxURLLength   = 8 << 10
+	defaultMaxBodyBytes   = 64 << 10
+	defaultMaxScopes      = 100
+	defaultMaxScopeLength = 1024
+)
+
+func (sc *ServerConfig) validateLimits() error {
+	for _, l := range []struct {
+		name  string
+		value *int
+		def   int
+	}{
+		{"max_header_bytes", &sc.MaxHeaderBytes, defaultMaxHeaderBytes},
+		{"max_url_length", &sc.MaxURLLength, defaultMaxURLLength},
+		{"max_body_bytes", &sc.MaxBodyBytes, defaultMaxBodyBytes},
+		{"max_scopes", &sc.MaxScopes, defaultMaxScopes},
+		{"max_scope_length", &sc.MaxScopeLength, defaultMaxScopeLength},
+	} {
+		if *l.value < 0 {
+			return fmt.Errorf("server.%s must be positive, got %d", l.name, *l.value)
+		}
+		if *l.value == 0 {
+			*l.value = l.def
+		}
+	}
+	return nil
+}
+
+// headerBytes returns the size of the request headers, as they would be sent.
+func headerBytes(h http.Header) int {
+	n := 0
+	for k, vv := range h {
+		for _, v := range vv {
+			n += len(k) + len(v) + 4 // ": " and CRLF.
+		}
+	}
+	return n
+}
+
+// checkLimits rejects requests with oversized headers or URLs and limits the size of the body.
+// Returns false if the request has been rejected. Limits that are not set are not enforced.
+func (sc *ServerConfig) checkLimits(rw http.ResponseWriter, req *http.Request) bool {
+	if sc.MaxHeaderBytes > 0 && headerBytes(req.Header) > sc.MaxHeaderBytes {
+		http.Error(rw, "Request headers too large", http.StatusRequestHeaderFieldsTooLarge)
+		return false
+	}
+	if sc.MaxURLLength > 0 && len(req.URL.RequestURI()) > sc.MaxURLLength {
+		http.Error(rw, "Request URL too long", http.StatusBadRequest)
+		return false
+	}
+	if sc.MaxBodyBytes > 0 && req.Body != nil {
+		req.Body = http.MaxBytesReader(rw, req.Body, int64(sc.MaxBodyBytes))
+	}
+	return true
+}
+
+// checkScopes enforces max_scopes and max_scope_length.
+func (sc *ServerConfig) checkScopes(scopes []string) error {
+	if sc.MaxScopes > 0 && len(scopes) > sc.MaxScopes {
+		return fmt.Errorf("too many scopes: %d, at most %d are allowed", len(scopes), sc.MaxScopes)
+	}
+	for _, s := range scopes {
+		if sc.MaxScopeLength > 0 && len(s) > sc.MaxScopeLength {
+			return fmt.Errorf("scope too long: %d bytes, at most %d are allowed", len(s), sc.MaxScopeLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type LockoutConfig struct {
+	// Number of failed authentication attempts within Window after which the account is locked.
+	MaxFailures int           `yaml:"max_failures,omitempty"`
+	Window      time.Duration `yaml:"window,omitempty"`
+	// For how long the account remains locked.
+	Cooldown time.Duration `yaml:"cooldown,omitempty"`
+	// Track failures per account and client IP rather than per account.
+	PerIP bool `yaml:"per_ip,omitempty"`
+}
+
+func (c *LockoutConfig) validate() error {
+	if c.MaxFailures <= 0 || c.Window <= 0 || c.Cooldown <= 0 {
+		return fmt.Errorf("lockout.{max_failures,window,cooldown} must be positive")
+	}
+	return nil
+}
+
+type lockoutEntry struct {
+	// Times of the recent failures, oldest first.
+	failures    []time.Time
+	lockedUntil time.Time
+}
+
+// lockoutTracker keeps track of failed authentication attempts in memory.
+type lockoutTracker struct {
+	config *LockoutConfig
+
+	lock      sync.Mutex
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+}
+
+// newLockoutTracker creates a tracker with settings from c. If prev has the same settings, it is
+// returned instead, so that reloading the config does not unlock accounts or reset failure counts.
+func newLockoutTracker(c *LockoutConfig, prev *lockoutTracker) *lockoutTracker {
+	if prev != nil && *prev.config == *c {
+		return prev
+	}
+	return &lockoutTracker{config: c, entries: make(map[string]*lockoutEntry), lastSweep: time.Now()}
+}
+
+func (lt *lockoutTracker) key(account string, ar *authRequest) string {
+	if lt.config.PerIP {
+		return fmt.Sprintf("%s@%s", account, ar.RemoteIP)
+	}
+	return account
+}
+
+// locked returns the time until which the account is locked, or zero time if it is not.
+func (lt *lockoutTracker) locked(key string) time.Time {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	if e := lt.entries[key]; e != nil && time.Now().Before(e.lockedUntil) {
+		return e.lockedUntil
+	}
+	return time.Time{}
+}
+
+// failure records a failed attempt. Returns true if the account got locked as a result.
+func (lt *lockoutTracker) failure(key string) bool {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	now := time.Now()
+	lt.sweep(now)
+	e := lt.entries[key]
+	if e == nil {
+		e = &lockoutEntry{}
+		lt.entries[key] = e
+	}
+	e.failures = append(e.expire(now, lt.config.Window), now)
+	if len(e.failures) < lt.config.MaxFailures {
+		return false
+	}
+	e.failures = nil
+	e.lockedUntil = now.Add(lt.config.Cooldown)
+	return true
+}
+
+func (lt *lockoutTracker) success(key string) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	delete(lt.entries, key)
+}
+
+// expire returns failures that happened within window before now.
+func (e *lockoutEntry) expire(now time.Time, window time.Duration) []time.Time {
+	n := 0
+	for n < len(e.failures) && now.Sub(e.failures[n]) > window {
+		n++
+	}
+	return e.failures[n:]
+}
+
+// sweep removes entries that are no longer relevant, so that memory use is bounded
+// by the number of accounts that failed recently. Must be called with lock held.
+func (lt *lockoutTracker) sweep(now time.Time) {
+	if now.Sub(lt.lastSweep) < lt.config.Window {
+		return
+	}
+	for key, e := range lt.entries {
+		e.failures = e.expire(now, lt.config.Window)
+		if len(e.failures) == 0 && !now.Before(e.lockedUntil) {
+			delete(lt.entries, key)
+		}
+	}
+	lt.lastSweep = now
+}
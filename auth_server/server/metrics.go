@@ -0,0 +1,231 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+)
+
+type MetricsConfig struct {
+	// Separate address to serve metrics on. If empty, metrics are served by the main listener.
+	ListenAddress string `yaml:"addr,omitempty"`
+	Path          string `yaml:"path,omitempty"`
+}
+
+var (
+	MetricsRegistry = prometheus.NewRegistry()
+
+	tokenRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "token_requests_total",
+		Help:      "Number of token requests, by HTTP status of the response.",
+	}, []string{"status"})
+	authnResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "authn_results_total",
+		Help:      "Number of authentication decisions, by backend and result (success, failure, totp_failure, password_expired, error).",
+	}, []string{"backend", "result"})
+	authzResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "authz_results_total",
+		Help:      "Number of authorization decisions per scope, by source and result (allow, deny, error).",
+	}, []string{"source", "result"})
+	authzCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "authz_cache_requests_total",
+		Help:      "Number of authorization cache lookups, by backend and result (hit, miss).",
+	}, []string{"backend", "result"})
+	notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "notifications_total",
+		Help:      "Number of notification events, by webhook host and result (delivered, failed, dropped).",
+	}, []string{"webhook", "result"})
+	lockouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "lockouts_total",
+		Help:      "Number of times an account was locked out after repeated authentication failures.",
+	})
+	ldapRetries = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "ldap_retries_total",
+		Help:      "Number of LDAP requests retried due to connection errors.",
+	}, func() float64 { return float64(authn.LDAPRetries()) })
+	gcsRetries = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "docker_auth",
+		Name:      "gcs_token_db_retries_total",
+		Help:      "Number of GCS token DB calls retried due to transient errors.",
+	}, func() float64 { return float64(authn.GCSTokenDBRetries()) })
+	gcsLatency = gcsLatencyCollector{prometheus.NewDesc(
+		"docker_auth_gcs_token_db_request_duration_seconds",
+		"Time taken by GCS token DB calls, including retried ones, by operation (get, store, delete).",
+		[]string{"op"}, nil)}
+	backendLatency = backendLatencyCollector{prometheus.NewDesc(
+		"docker_auth_backend_request_duration_seconds",
+		"Time taken by upstream calls of backends, by backend (ldap, mongo, gcs, ext, token), operation and outcome (success, failure, error). Only recorded when metrics are enabled.",
+		[]string{"backend", "op", "outcome"}, nil)}
+	failOpenRequests = []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "docker_auth",
+			Name:        "fail_open_requests_total",
+			Help:        "Number of requests allowed because a backend in fail-open mode failed, by backend.",
+			ConstLabels: prometheus.Labels{"backend": "ext_auth"},
+		}, func() float64 { return float64(authn.ExtAuthFailOpenRequests()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "docker_auth",
+			Name:        "fail_open_requests_total",
+			Help:        "Number of requests allowed because a backend in fail-open mode failed, by backend.",
+			ConstLabels: prometheus.Labels{"backend": "ext_authz"},
+		}, func() float64 { return float64(authz.ExtAuthzFailOpenRequests()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "docker_auth",
+			Name:        "fail_open_requests_total",
+			Help:        "Number of requests allowed because a backend in fail-open mode failed, by backend.",
+			ConstLabels: prometheus.Labels{"backend": "opa_authz"},
+		}, func() float64 { return float64(authz.OPAAuthzFailOpenRequests()) }),
+	}
+	membershipCacheRequests = membershipCacheCounters()
+	authnConcurrentCalls    = concurrentCallGauges()
+	tokenIssuanceLatency    = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "docker_auth",
+		Name:      "token_issuance_duration_seconds",
+		Help:      "Time taken to process token requests that resulted in a token.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(tokenRequests, authnResults, authzResults, authzCacheRequests, notifications, lockouts, ldapRetries, tokenIssuanceLatency)
+	MetricsRegistry.MustRegister(gcsRetries, gcsLatency, backendLatency)
+	MetricsRegistry.MustRegister(membershipCacheRequests...)
+	MetricsRegistry.MustRegister(authnConcurrentCalls...)
+	MetricsRegistry.MustRegister(failOpenRequests...)
+}
+
+// gcsLatencyCollector exports the latencies of GCS token DB calls kept by authn as histograms.
+type gcsLatencyCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c gcsLatencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c gcsLatencyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, op := range []string{"get", "store", "delete"} {
+		count, sum, buckets := authn.GCSTokenDBLatency(op)
+		ch <- prometheus.MustNewConstHistogram(c.desc, count, sum, buckets, op)
+	}
+}
+
+// backendLatencyCollector exports the latencies of backend calls kept by authn as histograms.
+// The number of failed calls is the count of the histogram with outcome error.
+type backendLatencyCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c backendLatencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c backendLatencyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, bc := range authn.BackendCalls() {
+		count, sum, buckets := authn.BackendCallLatency(bc)
+		ch <- prometheus.MustNewConstHistogram(c.desc, count, sum, buckets, bc.Backend, bc.Op, bc.Outcome)
+	}
+}
+
+// concurrentCallGauges returns gauges of upstream calls in progress of the backends that support concurrency limits.
+func concurrentCallGauges() []prometheus.Collector {
+	var gauges []prometheus.Collector
+	for _, backend := range []string{"ext", "ldap", "mongo"} {
+		backend := backend
+		gauges = append(gauges, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "docker_auth",
+			Name:        "authn_backend_in_flight_requests",
+			Help:        "Number of authentication backend requests in progress, by backend.",
+			ConstLabels: prometheus.Labels{"backend": backend},
+		}, func() float64 { return float64(authn.ConcurrentCalls(backend)) }))
+	}
+	return gauges
+}
+
+// membershipCacheCounters returns counters of GitHub, Google and Okta membership cache lookups, by backend and result.
+func membershipCacheCounters() []prometheus.Collector {
+	var counters []prometheus.Collector
+	for _, backend := range []string{"github", "google", "okta"} {
+		for _, result := range []string{"hit", "miss", "stale"} {
+			backend, result := backend, result
+			counters = append(counters, prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   "docker_auth",
+				Name:        "membership_cache_requests_total",
+				Help:        "Number of GitHub, Google and Okta membership cache lookups, by backend and result (hit, miss, stale).",
+				ConstLabels: prometheus.Labels{"backend": backend, "result": result},
+			}, func() float64 { return float64(authn.MembershipCacheLookups(backend, result)) }))
+		}
+	}
+	return counters
+}
+
+// Short backend names used as metric label values, keyed by Authenticator/Authorizer Name().
+var backendLabels = map[string]string{
+	"static":                     "static",
+	"external":                   "ext",
+	"Google":                     "google",
+	"GitHub":                     "github",
+	"OIDC":                       "oidc",
+	"GitLab":                     "gitlab",
+	"LDAP":                       "ldap",
+	"JWT":                        "jwt",
+	"Azure AD":                   "azure",
+	"Cognito":                    "cognito",
+	"Kubernetes service account": "k8s_sa",
+	"Okta":                       "okta",
+	"client certificate":         "cert",
+	"MongoDB":                    "mongo",
+	"plugin auth":                "plugin",
+	"static ACL":                 "acl",
+	"MongoDB ACL":                "mongo",
+	"SQL ACL":                    "sql",
+	"external authz":             "ext",
+	"plugin authz":               "plugin",
+}
+
+func backendLabel(name string) string {
+	if l, ok := backendLabels[name]; ok {
+		return l
+	}
+	return strings.ToLower(name)
+}
+
+func (mc *MetricsConfig) path() string {
+	if mc.Path == "" {
+		return "/metrics"
+	}
+	return mc.Path
+}
+
+// MetricsHandler returns the handler that exports metrics in Prometheus format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+}
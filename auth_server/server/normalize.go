@@ -0,0 +1,84 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NormalizeConfig specifies how account names are normalized after authentication,
+// before they are used for authorization and in tokens. Nothing is done by default.
+type NormalizeConfig struct {
+	// Remove leading and trailing whitespace.
+	Trim bool `yaml:"trim,omitempty"`
+	// Convert to lower case.
+	Lowercase bool `yaml:"lowercase,omitempty"`
+	// Turn user@domain into user.
+	StripDomain bool `yaml:"strip_domain,omitempty"`
+	// If set, only these domains are stripped (compared case-insensitively), others are kept.
+	Domains []string `yaml:"domains,omitempty"`
+}
+
+func (c *NormalizeConfig) validate() error {
+	if len(c.Domains) > 0 && !c.StripDomain {
+		return fmt.Errorf("authn.normalize.domains requires strip_domain")
+	}
+	for _, d := range c.Domains {
+		if d == "" || strings.Contains(d, "@") {
+			return fmt.Errorf("authn.normalize.domains: invalid domain %q", d)
+		}
+	}
+	return nil
+}
+
+// apply returns the normalized account. Accounts that would become empty are left as is,
+// so that "@domain" does not turn into the anonymous account.
+func (c *NormalizeConfig) apply(account string) string {
+	if c == nil || account == "" {
+		return account
+	}
+	result := account
+	if c.Trim {
+		result = strings.TrimSpace(result)
+	}
+	if at := strings.LastIndex(result, "@"); c.StripDomain && at >= 0 && c.stripsDomain(result[at+1:]) {
+		result = result[:at]
+		if c.Trim {
+			result = strings.TrimSpace(result)
+		}
+	}
+	if c.Lowercase {
+		result = strings.ToLower(result)
+	}
+	if result == "" {
+		return account
+	}
+	return result
+}
+
+func (c *NormalizeConfig) stripsDomain(domain string) bool {
+	if len(c.Domains) == 0 {
+		return true
+	}
+	for _, d := range c.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+)
+
+// Types of events webhooks can subscribe to.
+const (
+	// All the requested actions were granted.
+	NotifyAllow = "allow"
+	// Authentication failed or some of the requested actions were denied.
+	NotifyDeny = "deny"
+	// The request failed due to an internal error.
+	NotifyError = "error"
+	// One of the admin_actions was granted.
+	NotifyAdminAction = "admin-action"
+)
+
+const (
+	signatureHeader = "X-Docker-Auth-Signature"
+
+	defaultNotificationQueueSize = 1000
+	defaultWebhookTimeout        = 5 * time.Second
+	defaultWebhookRetries        = 3
+	defaultWebhookRetryBackoff   = 1 * time.Second
+	maxWebhookRetryBackoff       = 30 * time.Second
+)
+
+type NotificationsConfig struct {
+	Webhooks []*WebhookConfig `yaml:"webhooks,omitempty"`
+	// Granted actions that result in an admin-action event, default is "*" and "delete".
+	AdminActions []string `yaml:"admin_actions,omitempty"`
+	// Maximum number of events waiting for delivery, per webhook. When the queue is full, new events are dropped.
+	QueueSize int `yaml:"queue_size,omitempty"`
+}
+
+type WebhookConfig struct {
+	URL string `yaml:"url,omitempty"`
+	// Events to deliver: allow, deny, error, admin-action.
+	Events []string `yaml:"events,omitempty"`
+	// If set, payloads are signed with HMAC-SHA256 using this secret.
+	// The signature is sent in the X-Docker-Auth-Signature header as sha256=<hex>.
+	Secret     string `yaml:"secret,omitempty"`
+	SecretFile string `yaml:"secret_file,omitempty"`
+	// Timeout of a single delivery attempt.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Failed deliveries are retried this many times, with exponential backoff starting at retry_backoff.
+	Retries      int           `yaml:"retries,omitempty"`
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+}
+
+func (c *NotificationsConfig) validate() error {
+	if len(c.Webhooks) == 0 {
+		return fmt.Errorf("notifications.webhooks is required")
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("notifications.queue_size must not be negative")
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultNotificationQueueSize
+	}
+	if len(c.AdminActions) == 0 {
+		c.AdminActions = []string{"*", "delete"}
+	}
+	for i, wc := range c.Webhooks {
+		if err := wc.validate(fmt.Sprintf("notifications.webhooks[%d]", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *WebhookConfig) validate(configKey string) error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s.url must be an http or https URL, got %q", configKey, c.URL)
+	}
+	if len(c.Events) == 0 {
+		return fmt.Errorf("%s.events is required", configKey)
+	}
+	for _, e := range c.Events {
+		switch e {
+		case NotifyAllow, NotifyDeny, NotifyError, NotifyAdminAction:
+		default:
+			return fmt.Errorf("%s.events: unknown event %q, must be one of %s, %s, %s, %s",
+				configKey, e, NotifyAllow, NotifyDeny, NotifyError, NotifyAdminAction)
+		}
+	}
+	if c.Secret != "" && c.SecretFile != "" {
+		return fmt.Errorf("%s: secret and secret_file are mutually exclusive", configKey)
+	}
+	if c.SecretFile != "" {
+		contents, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return fmt.Errorf("could not read %s.secret_file: %s", configKey, err)
+		}
+		c.Secret = strings.TrimSpace(string(contents))
+	}
+	if c.Timeout < 0 || c.Retries < 0 || c.RetryBackoff < 0 {
+		return fmt.Errorf("%s.{timeout,retries,retry_backoff} must not be negative", configKey)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultWebhookTimeout
+	}
+	if c.Retries == 0 {
+		c.Retries = defaultWebhookRetries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultWebhookRetryBackoff
+	}
+	return nil
+}
+
+// notificationEvent is the payload that is POSTed to webhooks.
+type notificationEvent struct {
+	Events []string `json:"events"`
+	auditRecord
+}
+
+// notifier delivers events to webhooks in the background, so that slow or unavailable
+// receivers do not delay token requests.
+type notifier struct {
+	config   *NotificationsConfig
+	webhooks []*webhook
+}
+
+type webhook struct {
+	config *WebhookConfig
+	// Used in logs and as the metric label, to avoid exposing credentials that may be in the URL.
+	host   string
+	client *http.Client
+	queue  chan []byte
+	stop   chan struct{}
+}
+
+func newNotifier(c *NotificationsConfig) *notifier {
+	n := &notifier{config: c}
+	for _, wc := range c.Webhooks {
+		u, _ := url.Parse(wc.URL)
+		wh := &webhook{
+			config: wc,
+			host:   u.Host,
+			client: &http.Client{Timeout: wc.Timeout},
+			queue:  make(chan []byte, c.QueueSize),
+			stop:   make(chan struct{}),
+		}
+		go wh.run()
+		n.webhooks = append(n.webhooks, wh)
+	}
+	return n
+}
+
+// events returns the types of events the request has resulted in.
+func (n *notifier) events(r *auditRecord, ares []authzResult) []string {
+	var events []string
+	switch r.Decision {
+	case "allow":
+		events = append(events, NotifyAllow)
+	case "error":
+		events = append(events, NotifyError)
+	default:
+		events = append(events, NotifyDeny)
+	}
+	for _, a := range ares {
+		if containsAny(a.autorizedActions, n.config.AdminActions) {
+			return append(events, NotifyAdminAction)
+		}
+	}
+	return events
+}
+
+func containsAny(actions, wanted []string) bool {
+	for _, a := range actions {
+		for _, w := range wanted {
+			if a == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notify queues the event for delivery to the webhooks subscribed to any of its types. Never blocks.
+func (n *notifier) notify(r *auditRecord, ares []authzResult) {
+	events := n.events(r, ares)
+	var payload []byte
+	for _, wh := range n.webhooks {
+		if !containsAny(events, wh.config.Events) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(&notificationEvent{Events: events, auditRecord: *r}); err != nil {
+				glog.Errorf("Failed to marshal notification: %s", err)
+				return
+			}
+		}
+		select {
+		case wh.queue <- payload:
+		default:
+			glog.Warningf("Notification queue for %s is full, dropping event for request %s", wh.host, r.RequestID)
+			notifications.WithLabelValues(wh.host, "dropped").Inc()
+		}
+	}
+}
+
+func (n *notifier) close() {
+	for _, wh := range n.webhooks {
+		close(wh.stop)
+	}
+}
+
+func (wh *webhook) run() {
+	for {
+		select {
+		case payload := <-wh.queue:
+			wh.deliver(payload)
+		case <-wh.stop:
+			// Deliver what has already been queued, but don't wait for more.
+			for {
+				select {
+				case payload := <-wh.queue:
+					wh.deliver(payload)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *webhook) deliver(payload []byte) {
+	backoff := wh.config.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= wh.config.Retries; attempt++ {
+		if attempt > 0 {
+			glog.V(1).Infof("Webhook %s failed (%s), retrying in %s", wh.host, err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxWebhookRetryBackoff {
+				backoff = maxWebhookRetryBackoff
+			}
+		}
+		if err = wh.post(payload); err == nil {
+			notifications.WithLabelValues(wh.host, "delivered").Inc()
+			return
+		}
+	}
+	glog.Errorf("Failed to deliver notification to %s after %d attempts: %s", wh.host, wh.config.Retries+1, err)
+	notifications.WithLabelValues(wh.host, "failed").Inc()
+}
+
+func (wh *webhook) post(payload []byte) error {
+	req, err := http.NewRequest("POST", wh.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.config.Secret != "" {
+		req.Header.Set(signatureHeader, sign(wh.config.Secret, payload))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
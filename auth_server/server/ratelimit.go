@@ -0,0 +1,110 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type RateLimitConfig struct {
+	// Rate at which tokens are added to the bucket of each client, i.e. the sustained request rate.
+	RequestsPerSecond float64 `yaml:"requests_per_second,omitempty"`
+	// Size of the bucket, i.e. how many requests can be made in a burst.
+	Burst int `yaml:"burst,omitempty"`
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.RequestsPerSecond <= 0 || c.Burst <= 0 {
+		return errors.New("server.rate_limit.{requests_per_second,burst} must be positive")
+	}
+	return nil
+}
+
+// RateLimiter decides whether requests from a client should be served.
+// Implementations must be goroutine-safe.
+type RateLimiter interface {
+	// Allow reports whether a request from the client identified by key can proceed.
+	// If not, it also returns how long the client should wait before retrying.
+	Allow(key string) (bool, time.Duration)
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// memRateLimiter is a token bucket rate limiter that keeps state in memory.
+type memRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	lock      sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+// newMemRateLimiter creates a limiter with settings from c. If prev is a limiter with the same settings,
+// it is returned instead, so that reloading the config does not refill the buckets of all clients.
+func newMemRateLimiter(c *RateLimitConfig, prev RateLimiter) *memRateLimiter {
+	if p, ok := prev.(*memRateLimiter); ok && p.limit == rate.Limit(c.RequestsPerSecond) && p.burst == c.Burst {
+		return p
+	}
+	return &memRateLimiter{
+		limit:     rate.Limit(c.RequestsPerSecond),
+		burst:     c.Burst,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+func (rl *memRateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+	cl := rl.clients[key]
+	if cl == nil {
+		cl = &clientLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[key] = cl
+	}
+	cl.lastSeen = now
+	r := cl.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep forgets clients whose buckets have been refilled completely, they are no different from new ones.
+// Must be called with lock held.
+func (rl *memRateLimiter) sweep(now time.Time) {
+	refill := time.Duration(float64(rl.burst) / float64(rl.limit) * float64(time.Second))
+	if now.Sub(rl.lastSweep) < refill {
+		return
+	}
+	for key, cl := range rl.clients {
+		if now.Sub(cl.lastSeen) > refill {
+			delete(rl.clients, key)
+		}
+	}
+	rl.lastSweep = now
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/dchest/uniuri"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+const refreshPath = "/auth/refresh"
+
+type RefreshConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// How long refresh tokens remain valid. Default is 30 days.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// LevelDB database to store refresh tokens in.
+	TokenDB string `yaml:"token_db,omitempty"`
+}
+
+func (c *RefreshConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.TokenDB == "" {
+		return fmt.Errorf("token.refresh.token_db is required")
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("token.refresh.ttl must not be negative")
+	}
+	if c.TTL == 0 {
+		c.TTL = 30 * 24 * time.Hour
+	}
+	return nil
+}
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// refreshTokens issues and exchanges opaque refresh tokens.
+// A refresh token is <id>.<secret>, the token DB entry for id holds the account,
+// its labels and a hash of the secret.
+type refreshTokens struct {
+	config *RefreshConfig
+	db     authn.TokenDB
+	// Exchanges and revocation of the same token are serialized,
+	// so that once revocation returns no more exchanges succeed.
+	locks [64]sync.Mutex
+}
+
+func newRefreshTokens(c *RefreshConfig) (*refreshTokens, error) {
+	db, err := authn.NewTokenDB(c.TokenDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open refresh token DB %s: %s", c.TokenDB, err)
+	}
+	glog.Infof("Refresh token DB at %s", c.TokenDB)
+	return &refreshTokens{config: c, db: db}, nil
+}
+
+func (rt *refreshTokens) lock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &rt.locks[h.Sum32()%uint32(len(rt.locks))]
+}
+
+func (rt *refreshTokens) issue(account string, labels api.Labels) (string, error) {
+	id := uniuri.NewLen(20)
+	v := &authn.TokenDBValue{
+		TokenType:  "refresh",
+		Account:    account,
+		Labels:     labels,
+		ValidUntil: time.Now().Add(rt.config.TTL),
+	}
+	secret, err := rt.db.StoreToken(id, v, true)
+	if err != nil {
+		return "", err
+	}
+	return id + "." + secret, nil
+}
+
+// exchange validates the refresh token and returns the account and labels it was issued for.
+func (rt *refreshTokens) exchange(token string) (string, api.Labels, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, errInvalidRefreshToken
+	}
+	id, secret := parts[0], parts[1]
+	l := rt.lock(id)
+	l.Lock()
+	defer l.Unlock()
+	switch err := rt.db.ValidateToken(id, api.PasswordString(secret)); err {
+	case nil:
+	case api.NoMatch, api.WrongPass:
+		return "", nil, errInvalidRefreshToken
+	case authn.ExpiredToken:
+		rt.db.DeleteToken(id)
+		return "", nil, errInvalidRefreshToken
+	default:
+		return "", nil, err
+	}
+	v, err := rt.db.GetValue(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if v == nil {
+		return "", nil, errInvalidRefreshToken
+	}
+	return v.Account, v.Labels, nil
+}
+
+// revoke deletes the refresh token with the given id.
+func (rt *refreshTokens) revoke(id string) error {
+	l := rt.lock(id)
+	l.Lock()
+	defer l.Unlock()
+	return rt.db.DeleteToken(id)
+}
+
+func (rt *refreshTokens) close() {
+	rt.db.Close()
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// Structured request log entries are written here, one JSON object per line, if server.log_format is json.
+var requestLog io.Writer = os.Stdout
+var requestLogLock sync.Mutex
+
+type requestLogEntry struct {
+	Time      string   `json:"time"`
+	RequestID string   `json:"request_id"`
+	Account   string   `json:"account,omitempty"`
+	Service   string   `json:"service,omitempty"`
+	ClientIP  string   `json:"client_ip,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	Granted   []string `json:"granted,omitempty"`
+	Backend   string   `json:"backend,omitempty"`
+	Status    int      `json:"status"`
+	LatencyMs float64  `json:"latency_ms"`
+}
+
+// requestID returns the request ID provided by the client or a proxy, or generates a new one.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" && len(id) <= 128 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s authScope) String() string {
+	t := s.Type
+	if s.Class != "" {
+		t += "(" + s.Class + ")"
+	}
+	return fmt.Sprintf("%s:%s:%s", t, s.Name, strings.Join(s.Actions, ","))
+}
+
+func logRequest(id string, ar *authRequest, ares []authzResult, status int, start time.Time) {
+	e := requestLogEntry{
+		Time:      start.UTC().Format(time.RFC3339Nano),
+		RequestID: id,
+		Status:    status,
+		LatencyMs: time.Since(start).Seconds() * 1000,
+	}
+	if ar != nil {
+		e.Account = ar.Account
+		e.Service = ar.Service
+		e.ClientIP = ar.RemoteIP.String()
+		e.Backend = ar.authnBackend
+		for _, s := range ar.Scopes {
+			e.Scopes = append(e.Scopes, s.String())
+		}
+	}
+	for _, r := range ares {
+		if len(r.autorizedActions) > 0 {
+			e.Granted = append(e.Granted, authScope{Type: r.scope.Type, Class: r.scope.Class, Name: r.scope.Name, Actions: r.autorizedActions}.String())
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("Failed to marshal request log entry: %s", err)
+		return
+	}
+	requestLogLock.Lock()
+	defer requestLogLock.Unlock()
+	requestLog.Write(append(line, '\n'))
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Strict-Transport-Security sent by default when the server terminates TLS.
+const defaultHSTS = "max-age=31536000"
+
+// Headers that describe the message itself and are set by the server.
+var reservedResponseHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Transfer-Encoding": true,
+}
+
+// tlsEnabled returns true if the server terminates TLS itself.
+func (c *ServerConfig) tlsEnabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.LetsEncrypt.Email != ""
+}
+
+func (c *ServerConfig) validateResponseHeaders() error {
+	c.responseHeaders = http.Header{}
+	if c.tlsEnabled() {
+		c.responseHeaders.Set("Strict-Transport-Security", defaultHSTS)
+	}
+	seen := map[string]bool{}
+	for name, value := range c.ResponseHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("server.response_headers: invalid header name %q", name)
+		}
+		cn := textproto.CanonicalMIMEHeaderKey(name)
+		if seen[cn] {
+			return fmt.Errorf("server.response_headers: %s is set more than once", cn)
+		}
+		seen[cn] = true
+		if reservedResponseHeaders[cn] {
+			return fmt.Errorf("server.response_headers: %s cannot be set", cn)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("server.response_headers: invalid value of %s", cn)
+		}
+		if value == "" {
+			// Not sent, e.g. to turn off the default Strict-Transport-Security.
+			c.responseHeaders.Del(cn)
+		} else {
+			c.responseHeaders.Set(cn, value)
+		}
+	}
+	return nil
+}
+
+// setResponseHeaders adds the configured headers to the response.
+func (c *ServerConfig) setResponseHeaders(rw http.ResponseWriter) {
+	for name, values := range c.responseHeaders {
+		rw.Header()[name] = values
+	}
+}
@@ -0,0 +1,279 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cesanta/docker_auth/auth_server/mgo_session"
+)
+
+const (
+	revokePath  = "/auth/revoke"
+	revokedPath = "/auth/revoked"
+)
+
+// RevocationConfig specifies where IDs (jti) of revoked tokens are kept.
+// Note that registries verify tokens on their own and do not consult the list,
+// so it only has effect on clients that check it.
+type RevocationConfig struct {
+	// File with revoked token IDs, one per line.
+	File string `yaml:"file,omitempty"`
+	// Alternatively, a MongoDB collection.
+	MongoConfig *mgo_session.Config `yaml:"dial_info,omitempty"`
+	Collection  string              `yaml:"collection,omitempty"`
+	// Accounts that are allowed to revoke tokens.
+	Admins []string `yaml:"admins,omitempty"`
+}
+
+func (c *RevocationConfig) validate() error {
+	if (c.File == "") == (c.MongoConfig == nil) {
+		return fmt.Errorf("token.revocation: exactly one of file and dial_info must be set")
+	}
+	if c.MongoConfig != nil {
+		if err := c.MongoConfig.Validate("token.revocation"); err != nil {
+			return err
+		}
+		if c.Collection == "" {
+			return fmt.Errorf("token.revocation.collection is required")
+		}
+	}
+	if len(c.Admins) == 0 {
+		return fmt.Errorf("token.revocation.admins is required")
+	}
+	return nil
+}
+
+type revocationStore interface {
+	revoke(jti string) error
+	list() ([]string, error)
+	close()
+}
+
+func newRevocationStore(c *RevocationConfig) (revocationStore, error) {
+	if c.MongoConfig != nil {
+		session, err := mgo_session.New(c.MongoConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &mongoRevocationStore{session: session, config: c.MongoConfig, collection: c.Collection}, nil
+	}
+	return newFileRevocationStore(c.File)
+}
+
+// newTokenID returns a random token ID to use as jti.
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type fileRevocationStore struct {
+	file string
+
+	lock sync.Mutex
+	ids  map[string]bool
+}
+
+func newFileRevocationStore(file string) (*fileRevocationStore, error) {
+	rs := &fileRevocationStore{file: file, ids: make(map[string]bool)}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return rs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", file, err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if id := strings.TrimSpace(s.Text()); id != "" && !strings.HasPrefix(id, "#") {
+			rs.ids[id] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", file, err)
+	}
+	glog.Infof("Loaded %d revoked token IDs from %s", len(rs.ids), file)
+	return rs, nil
+}
+
+func (rs *fileRevocationStore) revoke(jti string) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rs.ids[jti] {
+		return nil
+	}
+	f, err := os.OpenFile(rs.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(f, jti); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	rs.ids[jti] = true
+	return nil
+}
+
+func (rs *fileRevocationStore) list() ([]string, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	ids := make([]string, 0, len(rs.ids))
+	for id := range rs.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (rs *fileRevocationStore) close() {
+}
+
+type mongoRevocationStore struct {
+	session    *mgo.Session
+	config     *mgo_session.Config
+	collection string
+}
+
+type revokedToken struct {
+	ID        string    `bson:"_id"`
+	RevokedAt time.Time `bson:"revoked_at"`
+}
+
+func (rs *mongoRevocationStore) revoke(jti string) error {
+	return rs.config.Retry(rs.session, func() error {
+		s := rs.session.Copy()
+		defer s.Close()
+		_, err := s.DB("").C(rs.collection).UpsertId(jti, bson.M{"$setOnInsert": bson.M{"revoked_at": time.Now()}})
+		return err
+	})
+}
+
+func (rs *mongoRevocationStore) list() ([]string, error) {
+	var tokens []revokedToken
+	err := rs.config.Retry(rs.session, func() error {
+		s := rs.session.Copy()
+		defer s.Close()
+		return s.DB("").C(rs.collection).Find(nil).Sort("_id").All(&tokens)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		ids = append(ids, t.ID)
+	}
+	return ids, nil
+}
+
+func (rs *mongoRevocationStore) close() {
+	rs.session.Close()
+}
+
+// doRevoke revokes access tokens by ID (jti parameter) and refresh tokens (refresh_token parameter).
+// The request must be authenticated as one of the revocation admins.
+func (as *AuthServer) doRevoke(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Revocation requests must be sent with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ar, err := as.ParseRequest(req)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+	ar.RequestID = requestID(req)
+	authnResult, _, err := as.Authenticate(ar)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), http.StatusInternalServerError)
+		return
+	}
+	if !authnResult || ar.Account == "" {
+		rw.Header()["WWW-Authenticate"] = []string{as.config.Server.basicChallenge(as.config.Token.Issuer)}
+		http.Error(rw, "Auth failed.", http.StatusUnauthorized)
+		return
+	}
+	isAdmin := false
+	for _, a := range as.config.Token.Revocation.Admins {
+		if a == ar.Account {
+			isAdmin = true
+		}
+	}
+	if !isAdmin {
+		glog.Warningf("%s is not allowed to revoke tokens", ar)
+		http.Error(rw, "Not allowed.", http.StatusForbidden)
+		return
+	}
+	jtis, refreshTokens := req.PostForm["jti"], req.PostForm["refresh_token"]
+	if len(jtis) == 0 && len(refreshTokens) == 0 {
+		http.Error(rw, "Bad request: jti or refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	for _, jti := range jtis {
+		if err := as.revocation.revoke(jti); err != nil {
+			glog.Errorf("%s: failed to revoke %s: %s", ar, jti, err)
+			http.Error(rw, fmt.Sprintf("Failed to revoke %s (%s)", jti, err), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Token %s revoked by %s", jti, ar.Account)
+	}
+	for _, rt := range refreshTokens {
+		if as.refresh == nil {
+			http.Error(rw, "Bad request: refresh tokens are not enabled", http.StatusBadRequest)
+			return
+		}
+		// Either the token itself or just its ID.
+		id := strings.SplitN(rt, ".", 2)[0]
+		if err := as.refresh.revoke(id); err != nil {
+			glog.Errorf("%s: failed to revoke refresh token %s: %s", ar, id, err)
+			http.Error(rw, fmt.Sprintf("Failed to revoke refresh token %s (%s)", id, err), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Refresh token %s revoked by %s", id, ar.Account)
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+// doRevoked serves the list of revoked token IDs.
+func (as *AuthServer) doRevoked(rw http.ResponseWriter, req *http.Request) {
+	ids, err := as.revocation.list()
+	if err != nil {
+		glog.Errorf("Failed to list revoked tokens: %s", err)
+		http.Error(rw, fmt.Sprintf("Failed to list revoked tokens (%s)", err), http.StatusInternalServerError)
+		return
+	}
+	result, _ := json.Marshal(&map[string][]string{"revoked": ids})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(result)
+}
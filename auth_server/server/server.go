@@ -17,15 +17,20 @@
 package server
 
 import (
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"math"
 	"net"
 	"net/http"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cesanta/glog"
@@ -38,90 +43,411 @@ import (
 
 var (
 	hostPortRegex = regexp.MustCompile(`\[?(.+?)\]?:\d+$`)
+	// resourcetype := resourcetypevalue [ '(' resourcetypevalue ')' ]
+	resourceTypeRegex = regexp.MustCompile(`^([a-z0-9]+)\(([a-z0-9]+)\)$`)
 )
 
 type AuthServer struct {
+	// Held for reading by requests in flight, so that backends are not stopped under them.
+	lock sync.RWMutex
+	// The server with the config in effect after Reload, it serves requests instead of this one.
+	active     atomic.Value
+	reloadLock sync.Mutex
+
 	config         *Config
 	authenticators []api.Authenticator
+	authnKeys      []string // Config keys of the authenticators, see authnMethods.
 	authorizers    []api.Authorizer
 	ga             *authn.GoogleAuth
 	gha            *authn.GitHubAuth
+	oa             *authn.OIDCAuth
+	gla            *authn.GitLabAuth
+	lockout        *lockoutTracker
+	rateLimiter    RateLimiter
+	refresh        *refreshTokens
+	revocation     revocationStore
+	audit          *auditLog
+	notifier       *notifier
+	authzCache     *authzCache
+	unmatchedLog   *unmatchedLog
+	tracing        *tracing
+	tenants        []*tenant
+	clock          *clockGuard
+	// Of the config in effect, for /version.
+	configHash string
+	configTime time.Time
+
+	// Tenants of the server replaced by Reload, whose state is carried over to those of this one.
+	prevTenants []*tenant
+
+	// Backends that have not yet passed a health check since init.
+	readyLock sync.Mutex
+	notReady  []backendCheck
+}
+
+// What to do if backends can't be reached at startup, see ServerConfig.CheckBackendsOnStart.
+const (
+	backendCheckFail           = "fail"
+	backendCheckWarn           = "warn"
+	defaultBackendCheckTimeout = 30 * time.Second
+)
+
+// Probes usually time out sooner, so checks of /readyz don't run for long.
+var readyzCheckTimeout = 5 * time.Second
+
+type backendCheck struct {
+	name string
+	hc   api.HealthChecker
 }
 
 func NewAuthServer(c *Config) (*AuthServer, error) {
-	as := &AuthServer{
-		config:      c,
-		authorizers: []api.Authorizer{},
+	as := &AuthServer{}
+	if err := as.init(c); err != nil {
+		return nil, err
+	}
+	as.configLoaded(c)
+	if c.Server.CheckBackendsOnStart {
+		if err := as.checkBackends(c.Server.BackendCheckTimeout); err != nil {
+			if c.Server.BackendCheckFailure != backendCheckWarn {
+				as.Stop()
+				return nil, fmt.Errorf("backend check failed: %s", err)
+			}
+			glog.Errorf("Backend check failed, starting anyway: %s", err)
+		} else {
+			glog.Infof("Backend check passed")
+		}
+	}
+	return as, nil
+}
+
+func (as *AuthServer) addAuthenticator(key string, a api.Authenticator) {
+	as.authenticators = append(as.authenticators, a)
+	as.authnKeys = append(as.authnKeys, key)
+}
+
+// orderAuthenticators moves the authenticators listed in authn.order to the front, in that order.
+// The rest remain in the default order after them.
+func (as *AuthServer) orderAuthenticators(order []string) {
+	rank := map[string]int{}
+	for i, key := range order {
+		rank[key] = i
+	}
+	keyRank := func(key string) int {
+		if r, found := rank[key]; found {
+			return r
+		}
+		return len(order)
+	}
+	idx := make([]int, len(as.authenticators))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return keyRank(as.authnKeys[idx[i]]) < keyRank(as.authnKeys[idx[j]]) })
+	authenticators, keys := make([]api.Authenticator, len(idx)), make([]string, len(idx))
+	for i, j := range idx {
+		authenticators[i], keys[i] = as.authenticators[j], as.authnKeys[j]
+	}
+	as.authenticators, as.authnKeys = authenticators, keys
+	glog.Infof("Authentication methods are tried in this order: %s", strings.Join(keys, ", "))
+}
+
+// fallsThrough returns true if rejected credentials of the i-th authenticator are passed on to the next one,
+// i.e. it is not authoritative.
+func (as *AuthServer) fallsThrough(i int) bool {
+	if as.config.Authn == nil || i >= len(as.authnKeys) {
+		return false
+	}
+	authoritative, found := as.config.Authn.Authoritative[as.authnKeys[i]]
+	return found && !authoritative
+}
+
+// init sets up authenticators and authorizers according to c.
+func (as *AuthServer) init(c *Config) error {
+	as.config = c
+	if c.tenant == "" {
+		// Tenants have no metrics settings of their own.
+		authn.EnableBackendMetrics(c.Server.Metrics != nil)
+	}
+	as.authenticators, as.authnKeys = nil, nil
+	as.authorizers = []api.Authorizer{}
+	as.ga, as.gha, as.oa, as.gla = nil, nil, nil, nil
+	prevLockout, prevRateLimiter := as.lockout, as.rateLimiter
+	as.lockout, as.rateLimiter, as.refresh, as.revocation, as.audit = nil, nil, nil, nil, nil
+	as.authzCache, as.notifier, as.tracing, as.unmatchedLog = nil, nil, nil, nil
+	as.clock = newClockGuard(c.Token.Clock, as.clock)
+	if c.Server.Tracing != nil {
+		t, err := newOTLPTracing(c.Server.Tracing)
+		if err != nil {
+			return err
+		}
+		as.tracing = t
+	}
+	if c.Authz != nil && c.Authz.Cache != nil {
+		ac, err := newAuthzCache(c.Authz.Cache)
+		if err != nil {
+			return err
+		}
+		as.authzCache = ac
+	}
+	if c.Authz != nil && c.Authz.LogUnmatched != nil {
+		as.unmatchedLog = newUnmatchedLog(c.Authz.LogUnmatched)
+	}
+	if c.Audit != nil {
+		al, err := newAuditLog(c.Audit)
+		if err != nil {
+			return err
+		}
+		as.audit = al
+	}
+	if c.Notifications != nil {
+		as.notifier = newNotifier(c.Notifications)
+	}
+	if c.Server.RateLimit != nil {
+		as.rateLimiter = newMemRateLimiter(c.Server.RateLimit, prevRateLimiter)
+	}
+	if c.Lockout != nil {
+		as.lockout = newLockoutTracker(c.Lockout, prevLockout)
+	}
+	if c.Token.Refresh != nil && c.Token.Refresh.Enabled {
+		rt, err := newRefreshTokens(c.Token.Refresh)
+		if err != nil {
+			return err
+		}
+		as.refresh = rt
+	}
+	if c.Token.Revocation != nil {
+		rs, err := newRevocationStore(c.Token.Revocation)
+		if err != nil {
+			return err
+		}
+		as.revocation = rs
+	}
+	if c.ClientCertAuth != nil {
+		// Only applies if the client presented a certificate, so this goes first.
+		ca, err := authn.NewClientCertAuth(c.ClientCertAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("client_cert_auth", ca)
+	}
+	if c.JWTAuth != nil {
+		// Tokens are recognized by their format, so this goes before any user name based authenticators.
+		ja, err := authn.NewJWTAuth(c.JWTAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("jwt_auth", ja)
+	}
+	if c.AzureAuth != nil {
+		aa, err := authn.NewAzureAuth(c.AzureAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("azure_auth", aa)
+	}
+	if c.CognitoAuth != nil {
+		ca, err := authn.NewCognitoAuth(c.CognitoAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("cognito_auth", ca)
+	}
+	if c.K8sSAAuth != nil {
+		ka, err := authn.NewK8sSAAuth(c.K8sSAAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("k8s_sa_auth", ka)
 	}
 	if c.ACL != nil {
-		staticAuthorizer, err := authz.NewACLAuthorizer(c.ACL)
+		staticAuthorizer, err := authz.NewACLAuthorizerWithMode(c.ACL, c.ACLMode)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		as.authorizers = append(as.authorizers, staticAuthorizer)
 	}
 	if c.ACLMongo != nil {
 		mongoAuthorizer, err := authz.NewACLMongoAuthorizer(c.ACLMongo)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		as.authorizers = append(as.authorizers, mongoAuthorizer)
+		as.authorizers = append(as.authorizers, as.authzCache.wrap(mongoAuthorizer))
+	}
+	if c.ACLSQL != nil {
+		sqlAuthorizer, err := authz.NewACLSQLAuthorizer(c.ACLSQL)
+		if err != nil {
+			return err
+		}
+		as.authorizers = append(as.authorizers, as.authzCache.wrap(sqlAuthorizer))
 	}
 	if c.ExtAuthz != nil {
 		extAuthorizer := authz.NewExtAuthzAuthorizer(c.ExtAuthz)
-		as.authorizers = append(as.authorizers, extAuthorizer)
+		as.authorizers = append(as.authorizers, as.authzCache.wrap(extAuthorizer))
+	}
+	if c.CasbinAuthz != nil {
+		casbinAuthorizer, err := authz.NewCasbinAuthorizer(c.CasbinAuthz)
+		if err != nil {
+			return err
+		}
+		as.authorizers = append(as.authorizers, casbinAuthorizer)
+	}
+	if c.OPAAuthz != nil {
+		opaAuthorizer, err := authz.NewOPAAuthorizer(c.OPAAuthz)
+		if err != nil {
+			return err
+		}
+		as.authorizers = append(as.authorizers, opaAuthorizer)
 	}
 	if c.Users != nil {
-		as.authenticators = append(as.authenticators, authn.NewStaticUserAuth(c.Users))
+		as.addAuthenticator("users", authn.NewStaticUserAuth(c.Users, c.UsersPasswordHash))
+	}
+	if c.UsersFile != nil {
+		sua, err := authn.NewStaticUsersFileAuth(c.UsersFile, c.UsersBcryptCost, c.UsersPasswordHash)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("users_file", sua)
+	}
+	if c.HtpasswdAuth != nil {
+		ha, err := authn.NewHtpasswdAuth(c.HtpasswdAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("htpasswd_auth", ha)
 	}
 	if c.ExtAuth != nil {
-		as.authenticators = append(as.authenticators, authn.NewExtAuth(c.ExtAuth))
+		as.addAuthenticator("ext_auth", authn.NewExtAuth(c.ExtAuth))
 	}
 	if c.GoogleAuth != nil {
 		ga, err := authn.NewGoogleAuth(c.GoogleAuth)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		as.authenticators = append(as.authenticators, ga)
+		as.addAuthenticator("google_auth", ga)
 		as.ga = ga
 	}
 	if c.GitHubAuth != nil {
 		gha, err := authn.NewGitHubAuth(c.GitHubAuth)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		as.authenticators = append(as.authenticators, gha)
+		as.addAuthenticator("github_auth", gha)
 		as.gha = gha
 	}
+	if c.OIDCAuth != nil {
+		oa, err := authn.NewOIDCAuth(c.OIDCAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("oidc_auth", oa)
+		as.oa = oa
+	}
+	if c.GitLabAuth != nil {
+		gla, err := authn.NewGitLabAuth(c.GitLabAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("gitlab_auth", gla)
+		as.gla = gla
+	}
 	if c.LDAPAuth != nil {
 		la, err := authn.NewLDAPAuth(c.LDAPAuth)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		as.authenticators = append(as.authenticators, la)
+		as.addAuthenticator("ldap_auth", la)
 	}
 	if c.MongoAuth != nil {
 		ma, err := authn.NewMongoAuth(c.MongoAuth)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		as.authenticators = append(as.authenticators, ma)
+		as.addAuthenticator("mongo_auth", ma)
+	}
+	if c.OktaAuth != nil {
+		// Okta does not tell unknown users from wrong passwords, so this goes after other user name based authenticators.
+		oa, err := authn.NewOktaAuth(c.OktaAuth)
+		if err != nil {
+			return err
+		}
+		as.addAuthenticator("okta_auth", oa)
 	}
 	if c.PluginAuthn != nil {
 		pluginAuthn, err := authn.NewPluginAuthn(c.PluginAuthn)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		as.authenticators = append(as.authenticators, pluginAuthn)
+		as.addAuthenticator("plugin_authn", pluginAuthn)
 	}
 	if c.PluginAuthz != nil {
 		pluginAuthz, err := authz.NewPluginAuthzAuthorizer(c.PluginAuthz)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		as.authorizers = append(as.authorizers, pluginAuthz)
 	}
-	return as, nil
+	if c.Authn != nil && len(c.Authn.Order) > 0 {
+		as.orderAuthenticators(c.Authn.Order)
+	}
+	as.readyLock.Lock()
+	as.notReady = nil
+	for _, an := range as.authenticators {
+		if hc, ok := an.(api.HealthChecker); ok {
+			as.notReady = append(as.notReady, backendCheck{an.Name(), hc})
+		}
+	}
+	for _, az := range as.authorizers {
+		if hc, ok := az.(api.HealthChecker); ok {
+			as.notReady = append(as.notReady, backendCheck{az.Name(), hc})
+		}
+	}
+	as.readyLock.Unlock()
+	return as.initTenants(c)
+}
+
+// current returns the server with the config in effect.
+func (as *AuthServer) current() *AuthServer {
+	if cur, ok := as.active.Load().(*AuthServer); ok {
+		return cur
+	}
+	return as
+}
+
+// acquire returns the current server, locked for reading until the request is done.
+func (as *AuthServer) acquire() *AuthServer {
+	for {
+		cur := as.current()
+		cur.lock.RLock()
+		if as.current() == cur {
+			return cur
+		}
+		// Replaced by Reload in the meantime.
+		cur.lock.RUnlock()
+	}
+}
+
+// Reload replaces configuration of the running server with c.
+// New authenticators and authorizers are set up while requests continue to be
+// served with the previous ones. If that fails, previous configuration remains in
+// effect. Otherwise new requests are switched over, and the previous backends are
+// stopped once requests in flight complete.
+func (as *AuthServer) Reload(c *Config) error {
+	as.reloadLock.Lock()
+	defer as.reloadLock.Unlock()
+	prev := as.current()
+	// Lockout and rate limiting state is carried over, unless their settings change.
+	next := &AuthServer{clock: prev.clock, lockout: prev.lockout, rateLimiter: prev.rateLimiter, prevTenants: prev.tenants}
+	if err := next.init(c); err != nil {
+		next.stopBackends()
+		return err
+	}
+	next.prevTenants = nil
+	next.configLoaded(c)
+	as.active.Store(next)
+	prev.lock.Lock()
+	prev.stopBackends()
+	prev.lock.Unlock()
+	return nil
 }
 
 type authRequest struct {
@@ -134,10 +460,27 @@ type authRequest struct {
 	Service        string
 	Scopes         []authScope
 	Labels         api.Labels
+	// Verified or not, see CertificateAuthenticator.
+	PeerCertificates []*x509.Certificate
+	RequestID        string
+	// Of OAuth2 token requests (POST with grant_type), see parseOAuth2TokenRequest.
+	GrantType string
+
+	// Name of the authenticator that made the decision.
+	authnBackend string
+	// Credentials were correct, but the password has expired, see api.PasswordExpired.
+	passwordExpired bool
+	// Time to authorize the request at instead of now, see doExplain.
+	evalTime time.Time
+	// A long-lived token is issued, see TokenConfig.OfflineExpiration.
+	offline bool
+	// Wall clock time the token was issued at, see CreateToken.
+	issuedAt time.Time
 }
 
 type authScope struct {
 	Type    string
+	Class   string
 	Name    string
 	Actions []string
 }
@@ -145,10 +488,16 @@ type authScope struct {
 type authzResult struct {
 	scope            authScope
 	autorizedActions []string
+	expiration       int64
+	claims           map[string]interface{}
+	// Why some of the actions were denied, see api.AuthzDecision.
+	reason string
+	// Rules that decided, see api.AuthzDecision.
+	rules []string
 }
 
 func (ar authRequest) String() string {
-	return fmt.Sprintf("{%s:%s@%s %s}", ar.User, ar.Password, ar.RemoteAddr, ar.Scopes)
+	return fmt.Sprintf("{%s %s:%s@%s %s}", ar.RequestID, ar.User, ar.Password, ar.RemoteAddr, ar.Scopes)
 }
 
 func parseRemoteAddr(ra string) net.IP {
@@ -160,112 +509,333 @@ func parseRemoteAddr(ra string) net.IP {
 	return res
 }
 
-func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
-	ar := &authRequest{RemoteConnAddr: req.RemoteAddr, RemoteAddr: req.RemoteAddr}
-	if as.config.Server.RealIPHeader != "" {
-		hv := req.Header.Get(as.config.Server.RealIPHeader)
-		ips := strings.Split(hv, ",")
+// clientAddr returns the address of the client, from server.real_ip_header if it is set.
+func (sc *ServerConfig) clientAddr(req *http.Request) (string, error) {
+	if sc.RealIPHeader == "" {
+		return req.RemoteAddr, nil
+	}
+	hv := req.Header.Get(sc.RealIPHeader)
+	ips := strings.Split(hv, ",")
 
-		realIPPos := as.config.Server.RealIPPos
+	realIPPos := sc.RealIPPos
+	if realIPPos < 0 {
+		realIPPos = len(ips) + realIPPos
 		if realIPPos < 0 {
-			realIPPos = len(ips) + realIPPos
-			if realIPPos < 0 {
-				realIPPos = 0
-			}
+			realIPPos = 0
 		}
+	}
 
-		ar.RemoteAddr = strings.TrimSpace(ips[realIPPos])
-		glog.V(3).Infof("Conn ip %s, %s: %s, addr: %s", ar.RemoteAddr, as.config.Server.RealIPHeader, hv, ar.RemoteAddr)
-		if ar.RemoteAddr == "" {
-			return nil, fmt.Errorf("client address not provided")
-		}
+	addr := strings.TrimSpace(ips[realIPPos])
+	glog.V(3).Infof("Conn ip %s, %s: %s, addr: %s", req.RemoteAddr, sc.RealIPHeader, hv, addr)
+	if addr == "" {
+		return "", fmt.Errorf("client address not provided")
 	}
-	ar.RemoteIP = parseRemoteAddr(ar.RemoteAddr)
-	if ar.RemoteIP == nil {
-		return nil, fmt.Errorf("unable to parse remote addr %s", ar.RemoteAddr)
+	return addr, nil
+}
+
+func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
+	// Parsed first, FormValue ignores errors, e.g. of bodies over server.max_body_bytes.
+	if err := req.ParseForm(); err != nil {
+		return nil, fmt.Errorf("invalid form value")
 	}
-	user, password, haveBasicAuth := req.BasicAuth()
-	if haveBasicAuth {
-		ar.User = user
-		ar.Password = api.PasswordString(password)
+	if err := parseJSONTokenRequest(req); err != nil {
+		return nil, err
+	}
+	ar, haveBasicAuth, err := as.parseClient(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseOAuth2TokenRequest(req, ar, haveBasicAuth); err != nil {
+		return nil, err
 	}
 	ar.Account = req.FormValue("account")
 	if ar.Account == "" {
 		ar.Account = ar.User
-	} else if haveBasicAuth && ar.Account != ar.User {
+	} else if (haveBasicAuth || ar.User != "") && ar.Account != ar.User {
 		return nil, fmt.Errorf("user and account are not the same (%q vs %q)", ar.User, ar.Account)
 	}
 	ar.Service = req.FormValue("service")
-	if err := req.ParseForm(); err != nil {
-		return nil, fmt.Errorf("invalid form value")
+	if !as.config.Token.allowsService(ar.Service) {
+		return nil, fmt.Errorf("tokens for service %q are not issued by this server", ar.Service)
+	}
+	if ar.Scopes, err = as.parseScopes(req.Form["scope"]); err != nil {
+		return nil, err
 	}
+	return ar, nil
+}
+
+// parseClient returns the request with the address and the credentials of the client filled in,
+// and whether they were presented with basic auth.
+func (as *AuthServer) parseClient(req *http.Request) (*authRequest, bool, error) {
+	ar := &authRequest{RemoteConnAddr: req.RemoteAddr, RemoteAddr: req.RemoteAddr}
+	addr, err := as.config.Server.clientAddr(req)
+	if err != nil {
+		return nil, false, err
+	}
+	ar.RemoteAddr = addr
+	ar.RemoteIP = parseRemoteAddr(ar.RemoteAddr)
+	if ar.RemoteIP == nil {
+		return nil, false, fmt.Errorf("unable to parse remote addr %s", ar.RemoteAddr)
+	}
+	if req.TLS != nil {
+		ar.PeerCertificates = req.TLS.PeerCertificates
+	}
+	user, password, haveBasicAuth := req.BasicAuth()
+	if haveBasicAuth {
+		ar.User = user
+		ar.Password = api.PasswordString(password)
+	} else if ah := req.Header.Get("Authorization"); strings.HasPrefix(ah, "Bearer ") {
+		// Token identifies the account, it is up to the authenticators to recognize it.
+		ar.Password = api.PasswordString(strings.TrimPrefix(ah, "Bearer "))
+	}
+	return ar, haveBasicAuth, nil
+}
+
+// parseScopes parses the values of scope parameters, which may contain several space-separated scopes each.
+func (as *AuthServer) parseScopes(values []string) ([]authScope, error) {
+	scopes := requestedScopes(values)
+	if err := as.config.Server.checkScopes(scopes); err != nil {
+		return nil, err
+	}
+	var result []authScope
 	// https://github.com/docker/distribution/blob/1b9ab303a477ded9bdd3fc97e9119fa8f9e58fca/docs/spec/auth/scope.md#resource-scope-grammar
-	if req.FormValue("scope") != "" {
-		for _, scopeStr := range req.Form["scope"] {
-			parts := strings.Split(scopeStr, ":")
-			var scope authScope
-			switch len(parts) {
-			case 3:
-				scope = authScope{
-					Type:    parts[0],
-					Name:    parts[1],
-					Actions: strings.Split(parts[2], ","),
-				}
-			case 4:
-				scope = authScope{
-					Type:    parts[0],
-					Name:    parts[1] + ":" + parts[2],
-					Actions: strings.Split(parts[3], ","),
-				}
-			default:
-				return nil, fmt.Errorf("invalid scope: %q", scopeStr)
+	for _, scopeStr := range scopes {
+		parts := strings.Split(scopeStr, ":")
+		var scope authScope
+		switch len(parts) {
+		case 3:
+			scope = authScope{
+				Type:    parts[0],
+				Name:    parts[1],
+				Actions: strings.Split(parts[2], ","),
+			}
+		case 4:
+			scope = authScope{
+				Type:    parts[0],
+				Name:    parts[1] + ":" + parts[2],
+				Actions: strings.Split(parts[3], ","),
 			}
-			sort.Strings(scope.Actions)
-			ar.Scopes = append(ar.Scopes, scope)
+		default:
+			return nil, fmt.Errorf("invalid scope: %q", scopeStr)
 		}
+		if m := resourceTypeRegex.FindStringSubmatch(scope.Type); m != nil {
+			scope.Type, scope.Class = m[1], m[2]
+		}
+		sort.Strings(scope.Actions)
+		result = append(result, scope)
 	}
-	return ar, nil
+	return result, nil
 }
 
 func (as *AuthServer) Authenticate(ar *authRequest) (bool, api.Labels, error) {
+	if as.lockout == nil || ar.Account == "" {
+		return as.authenticate(ar)
+	}
+	// Variants of the account name that normalize to the same account share the counter.
+	key := as.lockout.key(as.normalizeAccount(ar.Account), ar)
+	if until := as.lockout.locked(key); !until.IsZero() {
+		glog.Warningf("%s is locked out until %s", ar, until.Format(time.RFC3339))
+		ar.authnBackend = "lockout"
+		authnResults.WithLabelValues("lockout", "failure").Inc()
+		return false, nil, nil
+	}
+	result, labels, err := as.authenticate(ar)
+	if err == nil {
+		if result {
+			as.lockout.success(key)
+		} else if !ar.passwordExpired && as.lockout.failure(key) {
+			glog.Warningf("%s is locked out for %s after %d failed attempts", ar, as.config.Lockout.Cooldown, as.config.Lockout.MaxFailures)
+			lockouts.Inc()
+		}
+	}
+	return result, labels, err
+}
+
+// normalizeAccount applies authn.normalize, if configured.
+func (as *AuthServer) normalizeAccount(account string) string {
+	if as.config.Authn == nil {
+		return account
+	}
+	return as.config.Authn.Normalize.apply(account)
+}
+
+// constantTimeDeny returns authn.constant_time_deny, if configured.
+func (as *AuthServer) constantTimeDeny() *ConstantTimeDenyConfig {
+	if as.config.Authn == nil {
+		return nil
+	}
+	return as.config.Authn.ConstantTimeDeny
+}
+
+// totp returns authn.totp, if configured.
+func (as *AuthServer) totp() *authn.TOTPConfig {
+	if as.config.Authn == nil {
+		return nil
+	}
+	return as.config.Authn.TOTP
+}
+
+// verifyTOTP checks the second factor of an account that has been authenticated, if authn.totp requires it.
+func (as *AuthServer) verifyTOTP(ar *authRequest, code string) bool {
+	totp := as.totp()
+	if totp == nil || !totp.Required(ar.Account) {
+		return true
+	}
+	return totp.Verify(ar.Account, code)
+}
+
+func (as *AuthServer) authenticate(ar *authRequest) (bool, api.Labels, error) {
+	var totpCode string
+	if totp := as.totp(); totp != nil && totp.Required(as.normalizeAccount(ar.Account)) {
+		ar.Password, totpCode = authn.SplitTOTPCode(ar.Password)
+	}
+	rejected := false
 	for i, a := range as.authenticators {
-		result, labels, err := a.Authenticate(ar.Account, ar.Password)
+		var result bool
+		var labels api.Labels
+		var err error
+		if ca, ok := a.(api.CertificateAuthenticator); ok {
+			var account string
+			account, result, labels, err = ca.AuthenticateCertificate(ar.PeerCertificates)
+			if err == nil && result {
+				glog.V(2).Infof("Certificate for %q presented by %q", account, ar.Account)
+				ar.Account = account
+			}
+		} else if ta, ok := a.(api.TokenAuthenticator); ok {
+			var account string
+			account, result, labels, err = ta.AuthenticateToken(string(ar.Password))
+			if err == nil && result {
+				glog.V(2).Infof("Token for %q presented by %q", account, ar.Account)
+				ar.Account = account
+			}
+		} else if oa, ok := a.(api.OAuth2Authenticator); ok && ar.User == "" && ar.Password != "" {
+			var account string
+			account, result, labels, err = oa.AuthenticateAccessToken(string(ar.Password))
+			if err == nil && result {
+				glog.V(2).Infof("%s token for %q presented by %q", a.Name(), account, ar.Account)
+				ar.Account = account
+			}
+		} else {
+			result, labels, err = a.Authenticate(ar.Account, ar.Password)
+		}
 		glog.V(2).Infof("Authn %s %s -> %t, %+v, %v", a.Name(), ar.Account, result, labels, err)
 		if err != nil {
 			if err == api.NoMatch {
 				continue
-			} else if err == api.WrongPass {
+			}
+			ar.authnBackend = a.Name()
+			if err == api.WrongPass {
 				glog.Warningf("Failed authentication with %s: %s", err, ar.Account)
+				authnResults.WithLabelValues(backendLabel(a.Name()), "failure").Inc()
+				if as.fallsThrough(i) {
+					rejected = true
+					continue
+				}
+				return false, nil, nil
+			}
+			if err == api.WrongTOTP {
+				glog.Warningf("Failed second factor authentication (%s): %s", err, ar.Account)
+				authnResults.WithLabelValues(backendLabel(a.Name()), "totp_failure").Inc()
+				return false, nil, nil
+			}
+			if err == api.PasswordExpired {
+				glog.Warningf("Failed authentication with %s: %s", err, ar.Account)
+				authnResults.WithLabelValues(backendLabel(a.Name()), "password_expired").Inc()
+				ar.passwordExpired = true
 				return false, nil, nil
 			}
 			err = fmt.Errorf("authn #%d returned error: %s", i+1, err)
 			glog.Errorf("%s: %s", ar, err)
+			authnResults.WithLabelValues(backendLabel(a.Name()), "error").Inc()
 			return false, nil, err
 		}
+		ar.authnBackend = a.Name()
+		if result {
+			if account := as.normalizeAccount(ar.Account); account != ar.Account {
+				glog.V(2).Infof("Account %q normalized to %q", ar.Account, account)
+				ar.Account = account
+			}
+			if !as.verifyTOTP(ar, totpCode) {
+				glog.Warningf("Failed second factor authentication (%s): %s", api.WrongTOTP, ar.Account)
+				authnResults.WithLabelValues(backendLabel(a.Name()), "totp_failure").Inc()
+				return false, nil, nil
+			}
+			authnResults.WithLabelValues(backendLabel(a.Name()), "success").Inc()
+		} else {
+			authnResults.WithLabelValues(backendLabel(a.Name()), "failure").Inc()
+			if as.fallsThrough(i) {
+				glog.V(2).Infof("Authn %s is not authoritative, trying the next one", a.Name())
+				rejected = true
+				continue
+			}
+		}
 		return result, labels, nil
 	}
+	if rejected {
+		// Rejected by non-authoritative authenticators only, already counted.
+		return false, nil, nil
+	}
 	// Deny by default.
 	glog.Warningf("%s did not match any authn rule", ar)
+	authnResults.WithLabelValues("default", "failure").Inc()
 	return false, nil, nil
 }
 
-func (as *AuthServer) authorizeScope(ai *api.AuthRequestInfo) ([]string, error) {
+func authorize(a api.Authorizer, ai *api.AuthRequestInfo) (*api.AuthzDecision, error) {
+	if da, ok := a.(api.DetailedAuthorizer); ok {
+		return da.AuthorizeDetailed(ai)
+	}
+	actions, err := a.Authorize(ai)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AuthzDecision{Actions: actions}, nil
+}
+
+func (as *AuthServer) authorizeScope(ai *api.AuthRequestInfo) (*api.AuthzDecision, error) {
 	for i, a := range as.authorizers {
-		result, err := a.Authorize(ai)
-		glog.V(2).Infof("Authz %s %s -> %s, %s", a.Name(), *ai, result, err)
+		if ai.StrictWildcardName && !honorsStrictWildcardName(a) {
+			continue
+		}
+		result, err := authorize(a, ai)
+		glog.V(2).Infof("Authz %s %s -> %+v, %v", a.Name(), *ai, result, err)
 		if err != nil {
 			if err == api.NoMatch {
 				continue
 			}
 			err = fmt.Errorf("authz #%d returned error: %s", i+1, err)
 			glog.Errorf("%s: %s", *ai, err)
+			authzResults.WithLabelValues(backendLabel(a.Name()), "error").Inc()
 			return nil, err
 		}
+		if len(result.Rules) == 0 {
+			result.Rules = []string{a.Name()}
+		}
+		if len(result.Actions) > 0 {
+			authzResults.WithLabelValues(backendLabel(a.Name()), "allow").Inc()
+		} else {
+			authzResults.WithLabelValues(backendLabel(a.Name()), "deny").Inc()
+		}
+		if len(result.Actions) < len(ai.Actions) {
+			if result.Reason == "" {
+				result.Reason = fmt.Sprintf("denied by %s", a.Name())
+			}
+			glog.Infof("%s: %s", *ai, result.Reason)
+		}
 		return result, nil
 	}
 	// Deny by default.
-	glog.Warningf("%s did not match any authz rule", *ai)
-	return nil, nil
+	reason := "no authorization rule matched"
+	for _, a := range as.authorizers {
+		if e, ok := a.(api.Explainer); ok {
+			if explanation := e.ExplainNoMatch(ai); explanation != "" {
+				reason += "; " + explanation
+			}
+		}
+	}
+	as.unmatchedLog.log(ai, reason)
+	authzResults.WithLabelValues("default", "deny").Inc()
+	return &api.AuthzDecision{Reason: reason}, nil
 }
 
 func (as *AuthServer) Authorize(ar *authRequest) ([]authzResult, error) {
@@ -274,35 +844,161 @@ func (as *AuthServer) Authorize(ar *authRequest) ([]authzResult, error) {
 		ai := &api.AuthRequestInfo{
 			Account: ar.Account,
 			Type:    scope.Type,
+			Class:   scope.Class,
 			Name:    scope.Name,
 			Service: ar.Service,
 			IP:      ar.RemoteIP,
 			Actions: scope.Actions,
 			Labels:  ar.Labels,
+			Time:    ar.evalTime,
+		}
+		if as.config.Authz != nil && as.config.Authz.DenyWildcardResource && strings.Contains(scope.Name, "*") {
+			ai.StrictWildcardName = true
 		}
-		actions, err := as.authorizeScope(ai)
+		d, err := as.authorizeScope(ai)
 		if err != nil {
 			return nil, err
 		}
-		ares = append(ares, authzResult{scope: scope, autorizedActions: actions})
+		ares = append(ares, authzResult{scope: scope, autorizedActions: d.Actions, expiration: d.Expiration, claims: d.Claims, reason: d.Reason, rules: d.Rules})
 	}
 	return ares, nil
 }
 
+// tokenExpiration returns lifetime of the token (in seconds) for the given authorization results.
+// Authorizers can override the default for the scopes they grant actions for, and so can the
+// token_ttl label of the user. If there are several overrides, the shortest one is used.
+func (as *AuthServer) tokenExpiration(ar *authRequest, ares []authzResult) int64 {
+	exp := as.labelTTL(ar)
+	for _, a := range ares {
+		if len(a.autorizedActions) > 0 && a.expiration > 0 && (exp == 0 || a.expiration < exp) {
+			exp = a.expiration
+		}
+	}
+	if exp == 0 {
+		exp = as.config.Token.Expiration
+		if ar.offline {
+			exp = as.config.Token.OfflineExpiration
+		}
+	}
+	return exp
+}
+
+// offlineAccount returns true if the user is allowed offline tokens, see TokenConfig.OfflineExpiration.
+func (as *AuthServer) offlineAccount(ar *authRequest) bool {
+	if ar.Account == "" {
+		return false
+	}
+	for _, a := range as.config.Token.OfflineAccounts {
+		if a == ar.Account {
+			return true
+		}
+	}
+	label := as.config.Token.OfflineLabel
+	return label != "" && len(ar.Labels[label]) > 0 && ar.Labels[label][0] != ""
+}
+
+// tokenSubject returns the value of the token.subject_claim label of the user, or the account name
+// if it is not configured or the user does not have the label.
+func (as *AuthServer) tokenSubject(ar *authRequest) string {
+	label := as.config.Token.SubjectClaim
+	if label == "" {
+		return ar.Account
+	}
+	if v := ar.Labels[label]; len(v) > 0 && v[0] != "" {
+		if len(v) > 1 {
+			glog.Warningf("%s has %d values of the %s label, using the first one as token subject", ar.Account, len(v), label)
+		}
+		return v[0]
+	}
+	glog.Warningf("%s does not have the %s label, using the account name as token subject", ar.Account, label)
+	return ar.Account
+}
+
+// Label from authentication that sets the lifetime of tokens of the user, see labelTTL.
+const tokenTTLLabel = "token_ttl"
+
+// labelTTL returns the token lifetime (in seconds) set by the token_ttl label, or 0 if there is none.
+// Values are seconds or durations, e.g. "15m". Invalid values are ignored, values above
+// token.max_label_ttl are clamped to it. With several values, the shortest one is used.
+func (as *AuthServer) labelTTL(ar *authRequest) int64 {
+	ttl := int64(0)
+	for _, v := range ar.Labels[tokenTTLLabel] {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			d, derr := time.ParseDuration(v)
+			if derr != nil {
+				glog.Warningf("Ignoring invalid %s label of %s: %q", tokenTTLLabel, ar.Account, v)
+				continue
+			}
+			secs = int64(d / time.Second)
+		}
+		if secs <= 0 {
+			glog.Warningf("Ignoring invalid %s label of %s: %q", tokenTTLLabel, ar.Account, v)
+			continue
+		}
+		if max := as.config.Token.maxLabelTTL(); secs > max {
+			glog.Warningf("%s label of %s exceeds token.max_label_ttl, using %d: %q", tokenTTLLabel, ar.Account, max, v)
+			secs = max
+		}
+		if ttl == 0 || secs < ttl {
+			ttl = secs
+		}
+	}
+	return ttl
+}
+
 // https://github.com/docker/distribution/blob/master/docs/spec/auth/token.md#example
+// extraClaims returns the additional claims from token.extra_claims and the authorizers.
+// Claims of scopes that were granted no actions are ignored. If a claim is set more than once,
+// the last value wins: authorizer claims override extra_claims, later scopes override earlier ones.
+func (as *AuthServer) extraClaims(ar *authRequest, ares []authzResult) map[string]interface{} {
+	var extra map[string]interface{}
+	if len(as.config.Token.ExtraClaims) > 0 {
+		extra = authz.ExpandClaims(as.config.Token.ExtraClaims, &api.AuthRequestInfo{
+			Account: ar.Account, Service: ar.Service, IP: ar.RemoteIP, Labels: ar.Labels,
+		})
+	}
+	for _, a := range ares {
+		if len(a.autorizedActions) == 0 {
+			continue
+		}
+		for name, value := range a.claims {
+			if extra == nil {
+				extra = map[string]interface{}{}
+			}
+			extra[name] = value
+		}
+	}
+	return extra
+}
+
+// tokenTooLargeError is returned by CreateToken if the token would exceed token.max_access_entries
+// or token.max_size. The client asked for too much, so there is nothing to retry.
+type tokenTooLargeError string
+
+func (e tokenTooLargeError) Error() string {
+	return string(e)
+}
+
 func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string, error) {
-	now := time.Now().Unix()
+	issuedAt, err := as.clock.tokenTime()
+	if err != nil {
+		return "", err
+	}
+	ar.issuedAt = issuedAt
+	now := issuedAt.Unix()
 	tc := &as.config.Token
 
+	prk, kid := tc.signingKey(ar.Service)
 	// Sign something dummy to find out which algorithm is used.
-	_, sigAlg, err := tc.privateKey.Sign(strings.NewReader("dummy"), 0)
+	_, sigAlg, err := tc.signWith(prk, "dummy")
 	if err != nil {
 		return "", fmt.Errorf("failed to sign: %s", err)
 	}
 	header := token.Header{
 		Type:       "JWT",
 		SigningAlg: sigAlg,
-		KeyID:      tc.publicKey.KeyID(),
+		KeyID:      kid,
 	}
 	headerJSON, err := json.Marshal(header)
 	if err != nil {
@@ -310,54 +1006,107 @@ func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string,
 	}
 
 	claims := token.ClaimSet{
-		Issuer:     tc.Issuer,
-		Subject:    ar.Account,
+		Issuer:     tc.issuer(ar.Service),
+		Subject:    as.tokenSubject(ar),
 		Audience:   ar.Service,
-		NotBefore:  now - 10,
-		IssuedAt:   now,
-		Expiration: now + tc.Expiration,
-		JWTID:      fmt.Sprintf("%d", rand.Int63()),
-		Access:     []*token.ResourceActions{},
+		NotBefore:  now - tc.notBeforeSkew(),
+		IssuedAt:   now - tc.IssuedAtSkew,
+		Expiration: now + as.tokenExpiration(ar, ares),
+		JWTID:      newTokenID(),
+		Access:     tokenAccess(ares, tc.WildcardActions),
 	}
-	for _, a := range ares {
-		ra := &token.ResourceActions{
-			Type:    a.scope.Type,
-			Name:    a.scope.Name,
-			Actions: a.autorizedActions,
-		}
-		if ra.Actions == nil {
-			ra.Actions = []string{}
-		}
-		sort.Strings(ra.Actions)
-		claims.Access = append(claims.Access, ra)
+	if tc.MaxAccessEntries > 0 && len(claims.Access) > tc.MaxAccessEntries {
+		return "", tokenTooLargeError(fmt.Sprintf("token would have %d access entries, at most %d are allowed", len(claims.Access), tc.MaxAccessEntries))
 	}
 	claimsJSON, err := json.Marshal(claims)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal claims: %s", err)
 	}
+	if extra := as.extraClaims(ar, ares); len(extra) > 0 {
+		var merged map[string]interface{}
+		if err := json.Unmarshal(claimsJSON, &merged); err != nil {
+			return "", fmt.Errorf("failed to merge claims: %s", err)
+		}
+		for name, value := range extra {
+			if _, found := merged[name]; !found {
+				merged[name] = value
+			}
+		}
+		if claimsJSON, err = json.Marshal(merged); err != nil {
+			return "", fmt.Errorf("failed to marshal claims: %s", err)
+		}
+	}
 
 	payload := fmt.Sprintf("%s%s%s", joseBase64UrlEncode(headerJSON), token.TokenSeparator, joseBase64UrlEncode(claimsJSON))
 
-	sig, sigAlg2, err := tc.privateKey.Sign(strings.NewReader(payload), 0)
+	start := authn.StartBackendCall()
+	sig, sigAlg2, err := tc.signWith(prk, payload)
+	authn.ObserveBackendCall("token", "sign", start, authn.BackendOutcome(err))
 	if err != nil || sigAlg2 != sigAlg {
 		return "", fmt.Errorf("failed to sign token: %s", err)
 	}
+	tok := fmt.Sprintf("%s%s%s", payload, token.TokenSeparator, joseBase64UrlEncode(sig))
+	if tc.MaxSize > 0 && len(tok) > tc.MaxSize {
+		return "", tokenTooLargeError(fmt.Sprintf("token would be %d bytes, at most %d are allowed", len(tok), tc.MaxSize))
+	}
 	glog.Infof("New token for %s %+v: %s", *ar, ar.Labels, claimsJSON)
-	return fmt.Sprintf("%s%s%s", payload, token.TokenSeparator, joseBase64UrlEncode(sig)), nil
+	return tok, nil
 }
 
 func (as *AuthServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	glog.V(3).Infof("Request: %+v", req)
+	cur := as.acquire()
+	defer cur.lock.RUnlock()
+	cur.serve(rw, req)
+}
+
+func (as *AuthServer) serve(rw http.ResponseWriter, req *http.Request) {
+	as.config.Server.setResponseHeaders(rw)
+	if !as.config.Server.checkLimits(rw, req) || !as.config.Server.checkIPFilter(rw, req) {
+		return
+	}
+	if t := as.tenantFor(req); t != nil {
+		t.as.ServeHTTP(rw, req)
+		return
+	}
 	path_prefix := as.config.Server.PathPrefix
+	p := req.URL.Path
+	corsPath := p == path_prefix+"/auth" || p == path_prefix+refreshPath ||
+		(as.config.Token.JWKSPath != "" && p == path_prefix+as.config.Token.JWKSPath)
+	if corsPath && as.config.Server.CORS.apply(rw, req) {
+		return
+	}
 	switch {
 	case req.URL.Path == path_prefix+"/":
 		as.doIndex(rw, req)
 	case req.URL.Path == path_prefix+"/auth":
 		as.doAuth(rw, req)
+	case req.URL.Path == path_prefix+refreshPath && as.refresh != nil:
+		as.doAuth(rw, req)
+	case req.URL.Path == path_prefix+revokePath && as.revocation != nil:
+		as.doRevoke(rw, req)
+	case req.URL.Path == path_prefix+revokedPath && as.revocation != nil:
+		as.doRevoked(rw, req)
+	case req.URL.Path == path_prefix+explainPath && as.config.Authz != nil && len(as.config.Authz.ExplainAdmins) > 0:
+		as.doExplain(rw, req)
+	case req.URL.Path == path_prefix+"/healthz":
+		fmt.Fprintln(rw, "ok")
+	case req.URL.Path == path_prefix+"/readyz":
+		as.doReadyz(rw, req)
+	case req.URL.Path == path_prefix+"/version" && as.config.Server.VersionEndpoint != versionDisabled:
+		as.doVersion(rw, req)
+	case as.config.Token.JWKSPath != "" && req.URL.Path == path_prefix+as.config.Token.JWKSPath:
+		as.doJWKS(rw, req)
 	case req.URL.Path == path_prefix+"/google_auth" && as.ga != nil:
 		as.ga.DoGoogleAuth(rw, req)
 	case req.URL.Path == path_prefix+"/github_auth" && as.gha != nil:
 		as.gha.DoGitHubAuth(rw, req)
+	case req.URL.Path == path_prefix+"/oidc_auth" && as.oa != nil:
+		as.oa.DoOIDCAuth(rw, req)
+	case req.URL.Path == path_prefix+"/gitlab_auth" && as.gla != nil:
+		as.gla.DoGitLabAuth(rw, req)
+	case as.config.Server.Metrics != nil && as.config.Server.Metrics.ListenAddress == "" && req.URL.Path == path_prefix+as.config.Server.Metrics.path():
+		MetricsHandler().ServeHTTP(rw, req)
 	default:
 		http.Error(rw, "Not found", http.StatusNotFound)
 		return
@@ -374,64 +1123,415 @@ func (as *AuthServer) doIndex(rw http.ResponseWriter, req *http.Request) {
 	case as.gha != nil:
 		url := as.config.Server.PathPrefix + "/github_auth"
 		http.Redirect(rw, req, url, 301)
+	case as.oa != nil:
+		url := as.config.Server.PathPrefix + "/oidc_auth"
+		http.Redirect(rw, req, url, 301)
+	case as.gla != nil:
+		url := as.config.Server.PathPrefix + "/gitlab_auth"
+		http.Redirect(rw, req, url, 301)
 	default:
 		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
 		fmt.Fprintf(rw, "<h1>%s</h1>\n", as.config.Token.Issuer)
 	}
 }
 
+const denyReasonHeader = "X-Docker-Auth-Deny-Reason"
+
+// setDenyReasons adds a header with the reason for every scope that was not fully granted.
+// Clients don't show it, but it can be seen with e.g. curl -v or in registry proxy logs.
+func setDenyReasons(rw http.ResponseWriter, ares []authzResult) {
+	for _, a := range ares {
+		if a.reason != "" {
+			reason := strings.Map(func(r rune) rune {
+				if r < ' ' {
+					return ' '
+				}
+				return r
+			}, a.reason)
+			rw.Header().Add(denyReasonHeader, fmt.Sprintf("%s: %s", a.scope, reason))
+		}
+	}
+}
+
 func (as *AuthServer) doAuth(rw http.ResponseWriter, req *http.Request) {
-	ar, err := as.ParseRequest(req)
+	start := time.Now()
+	status := http.StatusOK
+	reqID := requestID(req)
+	rw.Header().Set(requestIDHeader, reqID)
+	isRefresh := strings.HasSuffix(req.URL.Path, refreshPath)
+	var ar *authRequest
 	ares := []authzResult{}
+	defer func() {
+		tokenRequests.WithLabelValues(strconv.Itoa(status)).Inc()
+		if as.config.Server.LogFormat == "json" {
+			logRequest(reqID, ar, ares, status, start)
+		}
+		if as.audit != nil {
+			as.audit.record(reqID, ar, ares, status, start)
+		}
+		if as.notifier != nil {
+			as.notifier.notify(newAuditRecord(reqID, ar, ares, status, start), ares)
+		}
+	}()
+	// Stages of the request are traced as children of the request span, each ends when the next one starts.
+	ctx, span := as.tracing.startRequest(req, "token request")
+	stage := noopSpan
+	startStage := func(name string) {
+		stage.End()
+		_, stage = as.tracing.start(ctx, name)
+	}
+	defer func() {
+		stage.End()
+		as.tracing.endRequest(span, ar, ares, status)
+	}()
+	if isRefresh && req.Method != "POST" {
+		status = http.StatusMethodNotAllowed
+		http.Error(rw, "Refresh token must be sent with POST", status)
+		return
+	}
+	startStage("parse")
+	ar, err := as.ParseRequest(req)
 	if err != nil {
-		glog.Warningf("Bad request: %s", err)
-		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+		glog.Warningf("%s: Bad request: %s", reqID, err)
+		status = http.StatusBadRequest
+		http.Error(rw, fmt.Sprintf("Bad request: %s", err), status)
 		return
 	}
+	ar.RequestID = reqID
+	if as.rateLimiter != nil {
+		if ok, retryAfter := as.rateLimiter.Allow(ar.RemoteIP.String()); !ok {
+			glog.Warningf("Rate limit exceeded by %s", ar)
+			status = http.StatusTooManyRequests
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(rw, "Too many requests", status)
+			return
+		}
+	}
 	glog.V(2).Infof("Auth request: %+v", ar)
-	{
+	startStage("authn")
+	exchanged := false
+	if isRefresh || (ar.GrantType == "refresh_token" && as.refresh != nil) {
+		account, labels, err := as.refresh.exchange(req.PostFormValue("refresh_token"))
+		switch {
+		case err == errInvalidRefreshToken && !isRefresh:
+			// Not one of ours, e.g. a token of an OAuth2 provider, it is up to the authenticators.
+		case err == errInvalidRefreshToken:
+			ar.authnBackend = "refresh token"
+			glog.Warningf("Invalid refresh token: %s", ar)
+			authnResults.WithLabelValues("refresh", "failure").Inc()
+			as.constantTimeDeny().wait(start)
+			status = http.StatusUnauthorized
+			http.Error(rw, "Invalid refresh token.", status)
+			return
+		case err != nil:
+			ar.authnBackend = "refresh token"
+			glog.Errorf("%s: refresh token exchange failed: %s", ar, err)
+			authnResults.WithLabelValues("refresh", "error").Inc()
+			status = http.StatusInternalServerError
+			http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), status)
+			return
+		default:
+			ar.authnBackend = "refresh token"
+			authnResults.WithLabelValues("refresh", "success").Inc()
+			ar.Account, ar.Labels = account, labels
+			exchanged = true
+		}
+	}
+	if !exchanged {
 		authnResult, labels, err := as.Authenticate(ar)
 		if err != nil {
-			http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), http.StatusInternalServerError)
+			// Backend could not be used, e.g. the database is unreachable: the credentials may well be fine,
+			// so this is not reported as 401, which would make clients discard them.
+			status = http.StatusServiceUnavailable
+			http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), status)
 			return
 		}
 		if !authnResult {
 			glog.Warningf("Auth failed: %s", *ar)
-			rw.Header()["WWW-Authenticate"] = []string{fmt.Sprintf(`Basic realm="%s"`, as.config.Token.Issuer)}
-			http.Error(rw, "Auth failed.", http.StatusUnauthorized)
+			as.constantTimeDeny().wait(start)
+			rw.Header()["WWW-Authenticate"] = []string{as.config.Server.basicChallenge(as.config.Token.Issuer)}
+			status = http.StatusUnauthorized
+			if ar.passwordExpired {
+				http.Error(rw, "Password expired, it must be changed before logging in.", status)
+				return
+			}
+			http.Error(rw, "Auth failed.", status)
 			return
 		}
 		ar.Labels = labels
 	}
 	if len(ar.Scopes) > 0 {
+		startStage("authz")
 		ares, err = as.Authorize(ar)
 		if err != nil {
-			http.Error(rw, fmt.Sprintf("Authorization failed (%s)", err), http.StatusInternalServerError)
+			// Denials are not errors, they result in a token with fewer or no actions granted.
+			status = http.StatusServiceUnavailable
+			http.Error(rw, fmt.Sprintf("Authorization failed (%s)", err), status)
 			return
 		}
+		if as.config.Authz != nil && as.config.Authz.Explain {
+			setDenyReasons(rw, ares)
+		}
 	} else {
-		// Authentication-only request ("docker login"), pass through.
+		// Authentication-only request ("docker login"): the token grants no access, so it is issued
+		// to any authenticated user, whether or not the ACL has entries for them.
+		glog.Infof("%s: login of %q, issuing a token without access", reqID, ar.Account)
+	}
+	offline := req.FormValue("offline_token") == "true" || (ar.GrantType == "password" && req.PostFormValue("access_type") == "offline")
+	if offline && as.config.Token.OfflineExpiration > 0 {
+		if ar.offline = as.offlineAccount(ar); !ar.offline {
+			glog.Infof("%s: %q requested an offline token, but is not an offline account, issuing a token with the normal expiration", reqID, ar.Account)
+		}
 	}
+	startStage("sign")
 	token, err := as.CreateToken(ar, ares)
+	stage.End()
 	if err != nil {
 		msg := fmt.Sprintf("Failed to generate token %s", err)
-		http.Error(rw, msg, http.StatusInternalServerError)
+		status = http.StatusInternalServerError
+		if _, ok := err.(tokenTooLargeError); ok {
+			status = http.StatusBadRequest
+		} else if _, ok := err.(clockError); ok {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(rw, msg, status)
 		glog.Errorf("%s: %s", ar, msg)
 		return
 	}
-	result, _ := json.Marshal(&map[string]string{"token": token})
+	resp := map[string]interface{}{"token": token}
+	if isRefresh || ar.GrantType != "" {
+		// OAuth2 response, see https://docs.docker.com/registry/spec/auth/oauth/#token-response-fields.
+		resp["access_token"] = token
+		resp["expires_in"] = as.tokenExpiration(ar, ares)
+		resp["issued_at"] = time.Unix(ar.issuedAt.Unix(), 0).UTC().Format(time.RFC3339)
+	}
+	if !isRefresh && !exchanged && as.refresh != nil && ar.Account != "" && offline {
+		rt, err := as.refresh.issue(ar.Account, ar.Labels)
+		if err != nil {
+			// The access token is still good, the client will have to log in again when it expires.
+			glog.Errorf("%s: failed to issue refresh token: %s", ar, err)
+		} else {
+			resp["refresh_token"] = rt
+		}
+	}
+	result, _ := json.Marshal(&resp)
 	glog.V(3).Infof("%s", result)
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Write(result)
+	tokenIssuanceLatency.Observe(time.Since(start).Seconds())
 }
 
-func (as *AuthServer) Stop() {
+// doReadyz reports whether all the backends that depend on external services
+// have been able to reach them at least once. Only names of the backends that are not ready
+// are returned, the errors are logged.
+func (as *AuthServer) doReadyz(rw http.ResponseWriter, req *http.Request) {
+	// Checks run without holding the lock, so that a slow backend doesn't hold up other probes.
+	as.readyLock.Lock()
+	checks := as.notReady
+	as.readyLock.Unlock()
+	errs := runHealthChecks(checks, readyzCheckTimeout)
+	ready := map[string]bool{}
+	var names []string
+	for i, bc := range checks {
+		if errs[i] != nil {
+			glog.Warningf("%s is not ready: %s", bc.name, errs[i])
+			names = append(names, bc.name)
+		} else {
+			ready[bc.name] = true
+		}
+	}
+	as.readyLock.Lock()
+	var notReady []backendCheck
+	for _, bc := range as.notReady {
+		if !ready[bc.name] {
+			notReady = append(notReady, bc)
+		}
+	}
+	as.notReady = notReady
+	as.readyLock.Unlock()
+	if len(names) > 0 {
+		http.Error(rw, fmt.Sprintf("Not ready: %s", strings.Join(names, ", ")), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+type verificationKey struct {
+	kid string
+	keyPair
+}
+
+// verificationKeys returns keys that tokens issued by this server can be verified with:
+// the signing key, the inactive keys that have not expired yet and the service keys.
+func (tc *TokenConfig) verificationKeys(now time.Time) []verificationKey {
+	var keys []verificationKey
+	if len(tc.Keys) == 0 {
+		keys = append(keys, verificationKey{tc.keyID(), tc.keyPair})
+	}
+	for _, k := range tc.Keys {
+		if k.Active || k.Expires.IsZero() || now.Before(k.Expires) {
+			keys = append(keys, verificationKey{k.KeyID, k.keyPair})
+		}
+	}
+	services := make([]string, 0, len(tc.ServiceKeys))
+	for s, k := range tc.ServiceKeys {
+		if k.publicKey != nil {
+			services = append(services, s)
+		}
+	}
+	sort.Strings(services)
+	for _, s := range services {
+		keys = append(keys, verificationKey{tc.ServiceKeys[s].KeyID, tc.ServiceKeys[s].keyPair})
+	}
+	return keys
+}
+
+// https://tools.ietf.org/html/rfc7517#section-5
+func (as *AuthServer) doJWKS(rw http.ResponseWriter, req *http.Request) {
+	tc := &as.config.Token
+	keys := []map[string]interface{}{}
+	for _, vk := range tc.verificationKeys(time.Now()) {
+		// Sign something dummy to find out which algorithm is used.
+		_, sigAlg, err := tc.signWith(vk.privateKey, "dummy")
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Failed to sign: %s", err), http.StatusInternalServerError)
+			return
+		}
+		kj, err := json.Marshal(vk.publicKey)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Failed to marshal key: %s", err), http.StatusInternalServerError)
+			return
+		}
+		var k map[string]interface{}
+		if err := json.Unmarshal(kj, &k); err != nil {
+			http.Error(rw, fmt.Sprintf("Failed to marshal key: %s", err), http.StatusInternalServerError)
+			return
+		}
+		k["kid"] = vk.kid
+		k["use"] = "sig"
+		k["alg"] = sigAlg
+		keys = append(keys, k)
+	}
+	result, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(result)
+}
+
+func (as *AuthServer) stopBackends() {
+	as.stopTenants()
 	for _, an := range as.authenticators {
 		an.Stop()
 	}
 	for _, az := range as.authorizers {
 		az.Stop()
 	}
+	if as.refresh != nil {
+		as.refresh.close()
+		as.refresh = nil
+	}
+	if as.revocation != nil {
+		as.revocation.close()
+		as.revocation = nil
+	}
+	if as.audit != nil {
+		as.audit.close()
+		as.audit = nil
+	}
+	if as.notifier != nil {
+		as.notifier.close()
+		as.notifier = nil
+	}
+	if as.tracing != nil {
+		as.tracing.close()
+		as.tracing = nil
+	}
+}
+
+// CheckBackends runs health checks of the backends that support them
+// and returns an error listing the ones that failed.
+func (as *AuthServer) CheckBackends() error {
+	return as.current().checkBackends(defaultBackendCheckTimeout)
+}
+
+// checkBackends runs the health checks in parallel. Checks that don't complete within
+// the timeout, e.g. because packets to the host are dropped, count as failed.
+func (as *AuthServer) checkBackends(timeout time.Duration) error {
+	as.readyLock.Lock()
+	checks := as.notReady
+	as.readyLock.Unlock()
+	for _, t := range as.tenants {
+		t.as.readyLock.Lock()
+		for _, bc := range t.as.notReady {
+			checks = append(checks, backendCheck{fmt.Sprintf("tenants.%s: %s", t.name, bc.name), bc.hc})
+		}
+		t.as.readyLock.Unlock()
+	}
+	var errs []string
+	for i, err := range runHealthChecks(checks, timeout) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", checks[i].name, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// runHealthChecks runs the checks in parallel and returns their errors, in the same order.
+// Checks that don't complete within the timeout get an error too.
+func runHealthChecks(checks []backendCheck, timeout time.Duration) []error {
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result, len(checks))
+	for i, bc := range checks {
+		go func(i int, hc api.HealthChecker) {
+			results <- result{i, hc.HealthCheck()}
+		}(i, bc.hc)
+	}
+	errs := make([]error, len(checks))
+	done := make([]bool, len(checks))
+	deadline := time.After(timeout)
+wait:
+	for range checks {
+		select {
+		case r := <-results:
+			done[r.i] = true
+			errs[r.i] = r.err
+		case <-deadline:
+			for i := range checks {
+				if !done[i] {
+					errs[i] = fmt.Errorf("no response within %s", timeout)
+				}
+			}
+			break wait
+		}
+	}
+	return errs
+}
+
+// ReopenLogs reopens the audit log file, after it has been rotated.
+func (as *AuthServer) ReopenLogs() {
+	cur := as.acquire()
+	defer cur.lock.RUnlock()
+	if cur.audit != nil {
+		cur.audit.reopen()
+	}
+	for _, t := range cur.tenants {
+		t.as.ReopenLogs()
+	}
+}
+
+func (as *AuthServer) Stop() {
+	as.reloadLock.Lock()
+	defer as.reloadLock.Unlock()
+	cur := as.current()
+	cur.lock.Lock()
+	defer cur.lock.Unlock()
+	cur.stopBackends()
 	glog.Infof("Server stopped")
 }
 
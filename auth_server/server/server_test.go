@@ -0,0 +1,3449 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/libtrust"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+)
+
+func testConfig(t *testing.T) *Config {
+	prk, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	all := []string{"*"}
+	return &Config{
+		Server: ServerConfig{ListenAddress: ":0"},
+		Token: TokenConfig{
+			Issuer:     "test issuer",
+			Expiration: 900,
+			JWKSPath:   "/auth/keys",
+			keyPair:    keyPair{publicKey: prk.PublicKey(), privateKey: prk},
+		},
+		Users: map[string]*authn.Requirements{"": {}},
+		ACL:   authz.ACL{{Match: &authz.MatchConditions{}, Actions: &all}},
+	}
+}
+
+func doRequest(t *testing.T, as *AuthServer, url string) []byte {
+	req := httptest.NewRequest("GET", url, nil)
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("%s: expected status 200, got %d: %s", url, rw.Code, rw.Body.String())
+	}
+	return rw.Body.Bytes()
+}
+
+func TestJWKSVerifiesIssuedToken(t *testing.T) {
+	c := testConfig(t)
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull"), &resp); err != nil {
+		t.Fatalf("failed to parse token response: %s", err)
+	}
+	keys, err := libtrust.UnmarshalPublicKeyJWKSet(doRequest(t, as, "/auth/keys"))
+	if err != nil {
+		t.Fatalf("failed to parse JWKS: %s", err)
+	}
+	trustedKeys := map[string]libtrust.PublicKey{}
+	for _, k := range keys {
+		trustedKeys[k.KeyID()] = k
+	}
+
+	tok, err := token.NewToken(resp.Token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %s", err)
+	}
+	if _, ok := trustedKeys[tok.Header.KeyID]; !ok {
+		t.Fatalf("kid %q of the token is not in JWKS", tok.Header.KeyID)
+	}
+	err = tok.Verify(token.VerifyOptions{
+		TrustedIssuers:    []string{c.Token.Issuer},
+		AcceptedAudiences: []string{"registry"},
+		TrustedKeys:       trustedKeys,
+	})
+	if err != nil {
+		t.Errorf("token verification failed: %s", err)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("DA_TEST_SET", "value")
+	os.Setenv("DA_TEST_EMPTY", "")
+	os.Unsetenv("DA_TEST_UNSET")
+	cases := []struct {
+		in, out string
+		ok      bool
+	}{
+		{"foo", "foo", true},
+		{"${DA_TEST_SET}", "value", true},
+		{"$DA_TEST_SET", "value", true},
+		{"$DA_TEST_SET x", "value x", true},
+		{`"$DA_TEST_SET"`, `"value"`, true},
+		{"$DA_TEST_SET-x", "value-x", true},
+		{"$DA_TEST_SET/x", "$DA_TEST_SET/x", true},
+		{"$DA_TEST_SET.x", "$DA_TEST_SET.x", true},
+		{"$DA_TEST_SETx", "$DA_TEST_SETx", true},
+		{"${DA_TEST_SET:-def}", "value", true},
+		{"${DA_TEST_UNSET:-def}", "def", true},
+		{"${DA_TEST_EMPTY:-def}", "def", true},
+		{"${DA_TEST_EMPTY}", "", true},
+		{"${DA_TEST_UNSET:-}", "", true},
+		{"$$DA_TEST_SET", "$$DA_TEST_SET", true},
+		{"$${DA_TEST_SET}", "$${DA_TEST_SET}", true},
+		{"$DA_TEST_UNSET", "$DA_TEST_UNSET", true},
+		{"$2y$05$LO.vzwpWC5LZGqThvEfznu8qhb5SGqvBSWY1J3yZ4AxtMRZ3kN5jC", "$2y$05$LO.vzwpWC5LZGqThvEfznu8qhb5SGqvBSWY1J3yZ4AxtMRZ3kN5jC", true},
+		{"$2y$05$WuwBasGDAgr.QCbGIjKJaep4dhxeai9gNZdmBnQXqpKly57oNutya", "$2y$05$WuwBasGDAgr.QCbGIjKJaep4dhxeai9gNZdmBnQXqpKly57oNutya", true},
+		{"${account}/* ${labels:group} ${account:1}", "${account}/* ${labels:group} ${account:1}", true},
+		{"${DA_TEST_UNSET}", "", false},
+	}
+	for i, c := range cases {
+		out, err := expandEnv(c.in)
+		if c.ok && (err != nil || out != c.out) {
+			t.Errorf("%d: %q: expected %q, got %q, %v", i, c.in, c.out, out, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%d: %q: expected to fail, got %q", i, c.in, out)
+		}
+	}
+}
+
+func TestExpandEnvDisabled(t *testing.T) {
+	os.Setenv("DA_TEST_SET", "value")
+	defer func() { ExpandEnv = true }()
+	ExpandEnv = false
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("a: ${DA_TEST_SET}\nb: $DA_TEST_SET\nc: ${DA_TEST_UNSET}\n")
+	f.Close()
+	contents, err := readConfigFile(f.Name())
+	if err != nil || string(contents) != "a: ${DA_TEST_SET}\nb: $DA_TEST_SET\nc: ${DA_TEST_UNSET}\n" {
+		t.Errorf("expected references to be left as is, got %q, %v", contents, err)
+	}
+}
+
+// Hashes in examples/simple.yml contain $LO and $W, which must not be taken for variables.
+func TestExpandEnvSimpleConfig(t *testing.T) {
+	os.Setenv("LO", "lo")
+	os.Setenv("W", "w")
+	defer os.Unsetenv("LO")
+	defer os.Unsetenv("W")
+	raw, err := ioutil.ReadFile("../../examples/simple.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _, _, err := readConfig("../../examples/simple.yml")
+	if err != nil {
+		t.Fatalf("failed to read config: %s", err)
+	}
+	if string(contents) != string(raw) {
+		t.Errorf("expected config to be unchanged, got\n%s", contents)
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal(contents, c); err != nil {
+		t.Fatal(err)
+	}
+	if p := c.Users["admin"].Password; p == nil || string(*p) != "$2y$05$LO.vzwpWC5LZGqThvEfznu8qhb5SGqvBSWY1J3yZ4AxtMRZ3kN5jC" {
+		t.Errorf("expected the admin password hash to be unchanged, got %v", p)
+	}
+	if p := c.Users["test"].Password; p == nil || string(*p) != "$2y$05$WuwBasGDAgr.QCbGIjKJaep4dhxeai9gNZdmBnQXqpKly57oNutya" {
+		t.Errorf("expected the test password hash to be unchanged, got %v", p)
+	}
+}
+
+type fakeChecker struct {
+	err   error
+	delay time.Duration
+}
+
+func (fc *fakeChecker) HealthCheck() error {
+	time.Sleep(fc.delay)
+	return fc.err
+}
+
+func TestReadyz(t *testing.T) {
+	as, err := NewAuthServer(testConfig(t))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	fc := &fakeChecker{err: errors.New("connection refused")}
+	as.notReady = []backendCheck{{"fake", fc}}
+
+	var body string
+	status := func(url string) int {
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, httptest.NewRequest("GET", url, nil))
+		body = rw.Body.String()
+		return rw.Code
+	}
+	if s := status("/healthz"); s != http.StatusOK {
+		t.Errorf("/healthz: expected 200, got %d", s)
+	}
+	if s := status("/readyz"); s != http.StatusServiceUnavailable {
+		t.Errorf("/readyz: expected 503 before the backend is up, got %d", s)
+	}
+	// Errors of backends are logged, not returned.
+	if body != "Not ready: fake\n" {
+		t.Errorf("/readyz: expected only the name of the backend, got %q", body)
+	}
+	fc.err = nil
+	if s := status("/readyz"); s != http.StatusOK {
+		t.Errorf("/readyz: expected 200 once the backend is up, got %d", s)
+	}
+	// Once a backend is up, it is not checked again.
+	fc.err = errors.New("connection reset")
+	if s := status("/readyz"); s != http.StatusOK {
+		t.Errorf("/readyz: expected 200 after the backend was up, got %d", s)
+	}
+}
+
+func TestReadyzSlowBackend(t *testing.T) {
+	as, err := NewAuthServer(testConfig(t))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	defer func(timeout time.Duration) { readyzCheckTimeout = timeout }(readyzCheckTimeout)
+	readyzCheckTimeout = 200 * time.Millisecond
+	as.notReady = []backendCheck{{"slow", &fakeChecker{delay: time.Second}}, {"fast", &fakeChecker{}}}
+
+	readyz := func() (int, string, time.Duration) {
+		start := time.Now()
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, httptest.NewRequest("GET", "/readyz", nil))
+		return rw.Code, rw.Body.String(), time.Since(start)
+	}
+	// Probes don't wait for each other, and a check that times out counts as failed.
+	results := make(chan time.Duration, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			code, body, d := readyz()
+			if code != http.StatusServiceUnavailable || body != "Not ready: slow\n" {
+				t.Errorf("expected slow backend to be not ready, got %d %q", code, body)
+			}
+			results <- d
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if d := <-results; d > 700*time.Millisecond {
+			t.Errorf("expected /readyz to give up after the timeout, took %s", d)
+		}
+	}
+	as.readyLock.Lock()
+	defer as.readyLock.Unlock()
+	if len(as.notReady) != 1 || as.notReady[0].name != "slow" {
+		t.Errorf("expected only the slow backend to be checked again, got %v", as.notReady)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	c.Lockout = &LockoutConfig{MaxFailures: 2, Window: time.Minute, Cooldown: time.Hour}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	auth := func(password string) bool {
+		ar := &authRequest{Account: "alice", Password: api.PasswordString(password), RemoteIP: net.ParseIP("127.0.0.1")}
+		result, _, err := as.Authenticate(ar)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return result
+	}
+	// Success resets the counter.
+	if auth("wrong") || !auth("secret") || auth("wrong") || !auth("secret") {
+		t.Fatalf("expected account to not be locked out by non-consecutive failures")
+	}
+	if auth("wrong") || auth("wrong") {
+		t.Fatalf("expected wrong password to be rejected")
+	}
+	if auth("secret") {
+		t.Errorf("expected correct password to be rejected while locked out")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := testConfig(t)
+	c.Server.RateLimit = &RateLimitConfig{RequestsPerSecond: 0.1, Burst: 2}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw
+	}
+	for i := 0; i < 2; i++ {
+		if rw := request("10.0.0.1:1234"); rw.Code != http.StatusOK {
+			t.Fatalf("%d: expected 200 within burst, got %d", i, rw.Code)
+		}
+	}
+	rw := request("10.0.0.1:1235")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the limit, got %d", rw.Code)
+	}
+	if ra := rw.Header().Get("Retry-After"); ra != "10" {
+		t.Errorf("expected Retry-After: 10, got %q", ra)
+	}
+	if rw := request("10.0.0.2:1234"); rw.Code != http.StatusOK {
+		t.Errorf("expected other clients to not be affected, got %d", rw.Code)
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	cases := []struct {
+		minVersion string
+		ciphers    []string
+		ok         bool
+	}{
+		{"", nil, true},
+		{"1.3", nil, true},
+		{"1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, true},
+		{"TLS1.2", nil, false},
+		{"1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}, false},
+	}
+	for i, tc := range cases {
+		c := testConfig(t)
+		c.Server.TLSMinVersion = tc.minVersion
+		c.Server.TLSCipherSuites = tc.ciphers
+		err := validate(c)
+		if tc.ok != (err == nil) {
+			t.Errorf("%d: expected ok = %t, got %v", i, tc.ok, err)
+			continue
+		}
+		if err == nil && tc.minVersion == "" && c.Server.BaseTLSConfig().MinVersion != tls.VersionTLS12 {
+			t.Errorf("%d: expected TLS 1.2 to be the default", i)
+		}
+	}
+}
+
+func TestJSONRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	requestLog = &buf
+	defer func() { requestLog = os.Stdout }()
+	c := testConfig(t)
+	c.Server.LogFormat = "json"
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull,push", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || rw.Header().Get("X-Request-Id") != "abc123" {
+		t.Fatalf("expected 200 with request ID, got %d %q", rw.Code, rw.Header().Get("X-Request-Id"))
+	}
+	var e requestLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("failed to parse log entry %q: %s", buf.String(), err)
+	}
+	if e.RequestID != "abc123" || e.Service != "registry" || e.ClientIP != "192.0.2.1" || e.Backend != "static" || e.Status != 200 ||
+		len(e.Scopes) != 1 || e.Scopes[0] != "repository:foo:pull,push" || len(e.Granted) != 1 || e.Granted[0] != "repository:foo:pull,push" {
+		t.Errorf("unexpected log entry: %+v", e)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	c.Token.Refresh = &RefreshConfig{Enabled: true, TokenDB: dir}
+	if err := c.Token.Refresh.validate(); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	req := httptest.NewRequest("GET", "/auth?service=registry&offline_token=true", nil)
+	req.SetBasicAuth("alice", "secret")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	var resp struct {
+		Token        string `json:"token"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil || resp.RefreshToken == "" {
+		t.Fatalf("expected a refresh token, got %d %s", rw.Code, rw.Body.String())
+	}
+	refreshToken := resp.RefreshToken
+
+	exchange := func(method, refreshToken string) *httptest.ResponseRecorder {
+		form := url.Values{"refresh_token": {refreshToken}, "service": {"registry"}, "scope": {"repository:foo:pull"}}
+		req := httptest.NewRequest(method, "/auth/refresh", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rw := exchange("POST", refreshToken); rw.Code != http.StatusOK {
+				t.Errorf("expected exchange to succeed, got %d %s", rw.Code, rw.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	rw = exchange("POST", refreshToken)
+	resp.AccessToken = ""
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil || resp.AccessToken == "" {
+		t.Fatalf("expected an access token, got %d %s", rw.Code, rw.Body.String())
+	}
+	tok, err := token.NewToken(resp.AccessToken)
+	if err != nil || tok.Claims.Subject != "alice" || len(tok.Claims.Access) != 1 {
+		t.Errorf("unexpected token: %+v, %v", tok, err)
+	}
+
+	if rw := exchange("GET", refreshToken); rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %d", rw.Code)
+	}
+	if rw := exchange("POST", refreshToken+"x"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong secret to be rejected, got %d", rw.Code)
+	}
+	if err := as.refresh.revoke(strings.Split(refreshToken, ".")[0]); err != nil {
+		t.Fatalf("failed to revoke: %s", err)
+	}
+	if rw := exchange("POST", refreshToken); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected revoked token to be rejected, got %d", rw.Code)
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}, "bob": {Password: &pw}}
+	c.Token.Revocation = &RevocationConfig{File: filepath.Join(dir, "revoked.txt"), Admins: []string{"alice"}}
+	if err := c.Token.Revocation.validate(); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+
+	req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+	req.SetBasicAuth("bob", "secret")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	var resp struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(rw.Body.Bytes(), &resp)
+	tok, err := token.NewToken(resp.Token)
+	if err != nil || len(tok.Claims.JWTID) != 32 {
+		t.Fatalf("expected a token with jti, got %+v, %v", tok, err)
+	}
+	jti := tok.Claims.JWTID
+
+	revoke := func(user string) int {
+		req := httptest.NewRequest("POST", "/auth/revoke", strings.NewReader(url.Values{"jti": {jti}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(user, "secret")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	if code := revoke("bob"); code != http.StatusForbidden {
+		t.Errorf("expected non-admin to be forbidden, got %d", code)
+	}
+	if code := revoke("alice"); code != http.StatusOK {
+		t.Errorf("expected admin to be allowed, got %d", code)
+	}
+	as.Stop()
+
+	// The list survives restarts.
+	as, err = NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	var list struct {
+		Revoked []string `json:"revoked"`
+	}
+	if err := json.Unmarshal(doRequest(t, as, "/auth/revoked"), &list); err != nil || len(list.Revoked) != 1 || list.Revoked[0] != jti {
+		t.Errorf("expected %s to be revoked, got %+v, %v", jti, list, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	c := testConfig(t)
+	pull := []string{"pull"}
+	c.ACL = authz.ACL{{Match: &authz.MatchConditions{}, Actions: &pull}}
+	c.Audit = &AuditConfig{File: file, MaxSizeMB: 1}
+	if err := c.Audit.validate(); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	records := func(file string) []auditRecord {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read audit log: %s", err)
+		}
+		var rs []auditRecord
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var r auditRecord
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				t.Fatalf("invalid audit record %q: %s", line, err)
+			}
+			rs = append(rs, r)
+		}
+		return rs
+	}
+	doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull,push")
+	rs := records(file)
+	if len(rs) != 1 || rs[0].Decision != "partial" || rs[0].ClientIP != "192.0.2.1" || rs[0].Backend != "static" ||
+		len(rs[0].Granted) != 1 || rs[0].Granted[0] != "repository:foo:pull" {
+		t.Errorf("unexpected audit records: %+v", rs)
+	}
+
+	// External rotation.
+	os.Rename(file, file+".old")
+	as.ReopenLogs()
+	doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull")
+	if rs := records(file); len(rs) != 1 || rs[0].Decision != "allow" {
+		t.Errorf("unexpected audit records after reopen: %+v", rs)
+	}
+
+	// Rotation by size.
+	as.audit.size = 1<<20 - 10
+	doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull")
+	if rs := records(file); len(rs) != 1 {
+		t.Errorf("expected the log to be rotated, got %+v", rs)
+	}
+	if rs := records(file + ".1"); len(rs) != 1 {
+		t.Errorf("expected the previous log to be kept, got %+v", rs)
+	}
+}
+
+type countingAuthorizer struct {
+	fakeChecker
+	calls   int
+	actions []string
+	err     error
+}
+
+func (ca *countingAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	ca.calls++
+	return ca.actions, ca.err
+}
+
+func (ca *countingAuthorizer) Stop() {}
+
+func (ca *countingAuthorizer) Name() string {
+	return "counting"
+}
+
+func TestAuthzCache(t *testing.T) {
+	ac, err := newAuthzCache(&AuthzCacheConfig{TTL: time.Hour, MaxSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingAuthorizer{actions: []string{"pull"}}
+	a := ac.wrap(backend)
+	if _, ok := a.(api.HealthChecker); !ok {
+		t.Errorf("expected health check to be passed through")
+	}
+	ai := func(account string) *api.AuthRequestInfo {
+		return &api.AuthRequestInfo{Account: account, Type: "repository", Name: "foo", Actions: []string{"pull", "push"},
+			Labels: api.Labels{"group": {"dev"}}}
+	}
+	check := func(ai *api.AuthRequestInfo, expectedCalls int) {
+		t.Helper()
+		actions, err := a.Authorize(ai)
+		if err != nil || len(actions) != 1 || actions[0] != "pull" {
+			t.Errorf("unexpected result: %v, %v", actions, err)
+		}
+		if backend.calls != expectedCalls {
+			t.Errorf("expected %d backend calls, got %d", expectedCalls, backend.calls)
+		}
+	}
+	check(ai("alice"), 1)
+	check(ai("alice"), 1)
+	check(ai("bob"), 2)
+	check(ai("alice"), 2)
+	// Labels are a part of the key.
+	other := ai("alice")
+	other.Labels = api.Labels{"group": {"ops"}}
+	check(other, 3)
+	// Least recently used entry (bob) has been evicted.
+	check(ai("alice"), 3)
+	check(ai("bob"), 4)
+
+	// Errors are not cached, NoMatch is.
+	backend.err = errors.New("connection refused")
+	for i := 5; i <= 6; i++ {
+		if _, err := a.Authorize(ai("carol")); err == nil || backend.calls != i {
+			t.Errorf("expected an error from the backend, got %v after %d calls", err, backend.calls)
+		}
+	}
+	backend.err = api.NoMatch
+	for i := 0; i < 2; i++ {
+		if _, err := a.Authorize(ai("dave")); err != api.NoMatch || backend.calls != 7 {
+			t.Errorf("expected a cached NoMatch, got %v after %d calls", err, backend.calls)
+		}
+	}
+
+	// Expired entries are not used.
+	ac.ttl = -time.Second
+	backend.err = nil
+	check(ai("erin"), 8)
+	check(ai("erin"), 9)
+}
+
+func TestExtraClaims(t *testing.T) {
+	c := testConfig(t)
+	all := []string{"*"}
+	c.Token.ExtraClaims = map[string]string{"tenant": "default", "client": "${account}"}
+	c.ACL = authz.ACL{{Match: &authz.MatchConditions{}, Actions: &all, Claims: map[string]string{"tenant": "acme"}}}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull"), &resp); err != nil {
+		t.Fatalf("failed to parse token response: %s", err)
+	}
+	parts := strings.Split(resp.Token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("failed to decode token: %s", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("failed to parse claims: %s", err)
+	}
+	if claims["tenant"] != "acme" || claims["client"] != "" || claims["iss"] != c.Token.Issuer || claims["access"] == nil {
+		t.Errorf("unexpected claims: %s", payload)
+	}
+
+	c.Token.ExtraClaims = map[string]string{"iss": "evil"}
+	if err := validate(c); err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Errorf("expected reserved claim to be rejected, got %v", err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	deliveries := make(chan delivery, 10)
+	var failures int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(rw, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		deliveries <- delivery{body, req.Header.Get(signatureHeader)}
+	}))
+	defer ts.Close()
+
+	c := testConfig(t)
+	pull := []string{"pull"}
+	c.ACL = authz.ACL{{Match: &authz.MatchConditions{}, Actions: &pull}}
+	c.Notifications = &NotificationsConfig{Webhooks: []*WebhookConfig{{
+		URL: ts.URL, Events: []string{NotifyDeny, NotifyAdminAction}, Secret: "s3cret", RetryBackoff: time.Millisecond,
+	}}}
+	if err := c.Notifications.validate(); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	// Allowed requests are not delivered, denied push is, after a retry.
+	doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull")
+	doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull,push")
+	select {
+	case d := <-deliveries:
+		if d.signature != sign("s3cret", d.body) {
+			t.Errorf("invalid signature %q", d.signature)
+		}
+		var e notificationEvent
+		if err := json.Unmarshal(d.body, &e); err != nil {
+			t.Fatalf("invalid event %q: %s", d.body, err)
+		}
+		if len(e.Events) != 1 || e.Events[0] != NotifyDeny || e.Decision != "partial" || e.Scopes[0] != "repository:foo:pull,push" {
+			t.Errorf("unexpected event: %s", d.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notification was not delivered")
+	}
+	select {
+	case d := <-deliveries:
+		t.Errorf("unexpected delivery: %s", d.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := (&WebhookConfig{URL: ts.URL, Events: []string{"push"}}).validate("wh"); err == nil {
+		t.Errorf("expected unknown event to be rejected")
+	}
+}
+
+func writeTokenKey(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	return certFile, keyFile
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCert, oldKey := writeTokenKey(t, dir, "old")
+	newCert, newKey := writeTokenKey(t, dir, "new")
+	expiredCert, expiredKey := writeTokenKey(t, dir, "expired")
+	config := func(keys string) string {
+		f := filepath.Join(dir, "config.yml")
+		ioutil.WriteFile(f, []byte(`
+server: {addr: ":0"}
+token:
+  issuer: test
+  expiration: 900
+  jwks_path: /auth/keys
+  keys:
+`+keys+`
+users: {"": {}}
+acl: [{match: {}, actions: ["*"]}]
+`), 0600)
+		return f
+	}
+
+	c, err := LoadConfig(config(`
+    - {certificate: "` + newCert + `", key: "` + newKey + `", kid: "new", active: true}
+    - {certificate: "` + oldCert + `", key: "` + oldKey + `", kid: "old", expires: "2100-01-01T00:00:00Z"}
+    - {certificate: "` + expiredCert + `", key: "` + expiredKey + `", expires: "2000-01-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull"), &resp); err != nil {
+		t.Fatalf("failed to parse token response: %s", err)
+	}
+	tok, err := token.NewToken(resp.Token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %s", err)
+	}
+	if tok.Header.KeyID != "new" {
+		t.Errorf("expected token to be signed with the active key, got kid %q", tok.Header.KeyID)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(doRequest(t, as, "/auth/keys"), &jwks); err != nil {
+		t.Fatalf("failed to parse JWKS: %s", err)
+	}
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != "new" || jwks.Keys[1].Kid != "old" {
+		t.Errorf("expected new and old keys in JWKS, got %+v", jwks.Keys)
+	}
+
+	for _, keys := range []string{
+		// No active key.
+		`    - {certificate: "` + newCert + `", key: "` + newKey + `"}`,
+		// Two active keys.
+		`    - {certificate: "` + newCert + `", key: "` + newKey + `", kid: a, active: true}
+    - {certificate: "` + oldCert + `", key: "` + oldKey + `", kid: b, active: true}`,
+		// Duplicate kid.
+		`    - {certificate: "` + newCert + `", key: "` + newKey + `", kid: a, active: true}
+    - {certificate: "` + oldCert + `", key: "` + oldKey + `", kid: a}`,
+		// Key that doesn't parse.
+		`    - {certificate: "` + newCert + `", key: "` + oldKey + `", active: true}`,
+	} {
+		if _, err := LoadConfig(config(keys)); err == nil {
+			t.Errorf("expected an error for keys:\n%s", keys)
+		}
+	}
+}
+
+func TestAllowedServices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeTokenKey(t, dir, "main")
+	stagingCert, stagingKey := writeTokenKey(t, dir, "staging")
+	config := func(token string) string {
+		f := filepath.Join(dir, "config.yml")
+		ioutil.WriteFile(f, []byte(`
+server: {addr: ":0"}
+token:
+  issuer: test
+  expiration: 900
+  jwks_path: /auth/keys
+  certificate: "`+cert+`"
+  key: "`+key+`"
+`+token+`
+users: {"": {}}
+acl: [{match: {}, actions: ["*"]}]
+`), 0600)
+		return f
+	}
+
+	c, err := LoadConfig(config(`
+  allowed_services: [registry, staging]
+  service_keys:
+    staging: {certificate: "` + stagingCert + `", key: "` + stagingKey + `", kid: staging}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	kids := map[string]string{}
+	for _, service := range []string{"registry", "staging"} {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(doRequest(t, as, "/auth?service="+service+"&scope=repository:foo:pull"), &resp); err != nil {
+			t.Fatalf("failed to parse token response: %s", err)
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		kids[service] = tok.Header.KeyID
+	}
+	if kids["staging"] != "staging" || kids["registry"] == "staging" {
+		t.Errorf("expected staging tokens to be signed with the service key, got %v", kids)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(doRequest(t, as, "/auth/keys"), &jwks); err != nil {
+		t.Fatalf("failed to parse JWKS: %s", err)
+	}
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != kids["registry"] || jwks.Keys[1].Kid != "staging" {
+		t.Errorf("expected token and service keys in JWKS, got %+v", jwks.Keys)
+	}
+	for _, url := range []string{"/auth?service=other&scope=repository:foo:pull", "/auth?scope=repository:foo:pull"} {
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, httptest.NewRequest("GET", url, nil))
+		if rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "not issued by this server") {
+			t.Errorf("%s: expected 400, got %d %s", url, rw.Code, rw.Body.String())
+		}
+	}
+
+	for _, token := range []string{
+		`  allowed_services: [registry, registry]`,
+		`  allowed_services: [""]`,
+		`  allowed_services: [registry]
+  service_keys:
+    staging: {certificate: "` + stagingCert + `", key: "` + stagingKey + `"}`,
+		`  service_keys:
+    staging: {certificate: "` + stagingCert + `"}`,
+		`  service_keys:
+    staging: {certificate: "` + stagingCert + `", key: "` + stagingKey + `", active: true}`,
+	} {
+		if _, err := LoadConfig(config(token)); err == nil {
+			t.Errorf("expected an error for:\n%s", token)
+		}
+	}
+}
+
+func TestDenyReasonHeader(t *testing.T) {
+	for _, explain := range []bool{false, true} {
+		c := testConfig(t)
+		pull, publicRepos := []string{"pull"}, "public/*"
+		c.ACL = authz.ACL{{Match: &authz.MatchConditions{Name: &publicRepos}, Actions: &pull}}
+		c.Authz = &AuthzConfig{Explain: explain}
+		as, err := NewAuthServer(c)
+		if err != nil {
+			t.Fatalf("failed to create server: %s", err)
+		}
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:public/foo:pull,push&scope=repository:foo:pull", nil)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		as.Stop()
+		reasons := rw.Header()[denyReasonHeader]
+		if !explain {
+			if len(reasons) != 0 {
+				t.Errorf("expected no reasons, got %q", reasons)
+			}
+			continue
+		}
+		if len(reasons) != 2 || reasons[0] != "repository:public/foo:pull,push: ACL entry 0 allows only pull" ||
+			!strings.HasPrefix(reasons[1], "repository:foo:pull: no authorization rule matched; no ACL entry matched, closest was ACL entry 0") {
+			t.Errorf("unexpected reasons: %q", reasons)
+		}
+	}
+}
+
+func TestNormalizeAccount(t *testing.T) {
+	all := &NormalizeConfig{Trim: true, Lowercase: true, StripDomain: true}
+	corp := &NormalizeConfig{Lowercase: true, StripDomain: true, Domains: []string{"corp.example"}}
+	cases := []struct {
+		c        *NormalizeConfig
+		in, want string
+	}{
+		{nil, " Alice@Corp.Example ", " Alice@Corp.Example "},
+		{&NormalizeConfig{}, " Alice ", " Alice "},
+		{&NormalizeConfig{Trim: true}, " Alice\t", "Alice"},
+		{&NormalizeConfig{Lowercase: true}, "ALICE", "alice"},
+		{&NormalizeConfig{StripDomain: true}, "Alice@corp.example", "Alice"},
+		{all, "alice", "alice"},
+		{all, "  ALICE@corp.example ", "alice"},
+		{all, "Alice @ corp.example", "alice"},
+		{all, "first.last@sub.corp.example", "first.last"},
+		// Only the last @ separates the domain.
+		{all, "we@ird@corp.example", "we@ird"},
+		// Never normalized to the empty account.
+		{all, "@corp.example", "@corp.example"},
+		{all, "   ", "   "},
+		{corp, "Alice@CORP.example", "alice"},
+		{corp, "alice@partner.example", "alice@partner.example"},
+		{corp, "Alice", "alice"},
+	}
+	for i, c := range cases {
+		if got := c.c.apply(c.in); got != c.want {
+			t.Errorf("%d: %+v: %q -> %q, expected %q", i, c.c, c.in, got, c.want)
+		}
+	}
+	if err := (&NormalizeConfig{Domains: []string{"corp.example"}}).validate(); err == nil {
+		t.Errorf("expected domains without strip_domain to be rejected")
+	}
+
+	// Authz and the token see the normalized account.
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"Alice@Corp.Example": {Password: &pw}}
+	pull, alice := []string{"pull"}, "alice"
+	c.ACL = authz.ACL{{Match: &authz.MatchConditions{Account: &alice}, Actions: &pull}}
+	c.Authn = &AuthnConfig{Normalize: all}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+	req.SetBasicAuth("Alice@Corp.Example", "secret")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse token response: %d %s", rw.Code, rw.Body.String())
+	}
+	tok, err := token.NewToken(resp.Token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %s", err)
+	}
+	if tok.Claims.Subject != "alice" || len(tok.Claims.Access) != 1 {
+		t.Errorf("expected access for alice, got %+v", tok.Claims)
+	}
+}
+
+// failingAuthenticator returns err, or a connection error if it is not set.
+type failingAuthenticator struct {
+	err error
+}
+
+func (f failingAuthenticator) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	if f.err != nil {
+		return false, nil, f.err
+	}
+	return false, nil, errors.New("connection refused")
+}
+
+func (failingAuthenticator) Stop() {}
+
+func (failingAuthenticator) Name() string {
+	return "failing"
+}
+
+func TestStatusCodes(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	pull, public := []string{"pull"}, "public/*"
+	c.ACL = authz.ACL{{Match: &authz.MatchConditions{Name: &public}, Actions: &pull}}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	do := func(user, password, scope string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope="+scope, nil)
+		req.SetBasicAuth(user, password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw
+	}
+	// Number of actions granted.
+	granted := func(rw *httptest.ResponseRecorder) int {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		json.Unmarshal(rw.Body.Bytes(), &resp)
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("expected a token, got %s: %s", rw.Body.String(), err)
+		}
+		n := 0
+		for _, ra := range tok.Claims.Access {
+			n += len(ra.Actions)
+		}
+		return n
+	}
+
+	// Bad credentials.
+	if rw := do("alice", "wrong", "repository:public/foo:pull"); rw.Code != http.StatusUnauthorized || len(rw.Header()["WWW-Authenticate"]) == 0 {
+		t.Errorf("expected 401 with WWW-Authenticate for bad credentials, got %d %v", rw.Code, rw.Header())
+	}
+	// Authorization granting nothing is not an error.
+	if rw := do("alice", "secret", "repository:private/foo:push"); rw.Code != http.StatusOK || granted(rw) != 0 {
+		t.Errorf("expected 200 with no access, got %d %s", rw.Code, rw.Body.String())
+	}
+	if rw := do("alice", "secret", "repository:public/foo:pull,push"); rw.Code != http.StatusOK || granted(rw) != 1 {
+		t.Errorf("expected 200 with limited access, got %d %s", rw.Code, rw.Body.String())
+	}
+	// Malformed request.
+	if rw := do("alice", "secret", "repository"); rw.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid scope, got %d", rw.Code)
+	}
+	// Backends that can't be reached.
+	as.authorizers = []api.Authorizer{&countingAuthorizer{err: errors.New("connection refused")}}
+	if rw := do("alice", "secret", "repository:public/foo:pull"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for authz backend error, got %d", rw.Code)
+	}
+	as.authenticators = []api.Authenticator{failingAuthenticator{}}
+	if rw := do("alice", "secret", "repository:public/foo:pull"); rw.Code != http.StatusServiceUnavailable ||
+		len(rw.Header()["WWW-Authenticate"]) != 0 {
+		t.Errorf("expected 503 without WWW-Authenticate for authn backend error, got %d %v", rw.Code, rw.Header())
+	}
+	// Expired passwords are denied with a distinct reason.
+	as.authenticators = []api.Authenticator{failingAuthenticator{err: api.PasswordExpired}}
+	before := testutil.ToFloat64(authnResults.WithLabelValues("failing", "password_expired"))
+	if rw := do("alice", "secret", "repository:public/foo:pull"); rw.Code != http.StatusUnauthorized ||
+		!strings.Contains(rw.Body.String(), "Password expired") {
+		t.Errorf("expected 401 for an expired password, got %d %s", rw.Code, rw.Body.String())
+	}
+	if testutil.ToFloat64(authnResults.WithLabelValues("failing", "password_expired")) != before+1 {
+		t.Errorf("expected the expired password to be counted")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("se:cret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}, "bob": {Password: &pw}}
+	c.Authn = &AuthnConfig{TOTP: &authn.TOTPConfig{Secrets: map[string]string{"alice": secret}}}
+	if err := c.Authn.TOTP.Validate("authn.totp"); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	code, _ := authn.TOTPCode(secret, time.Now())
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	cases := []struct {
+		account, password string
+		result            bool
+		totpFailure       bool
+	}{
+		{"alice", "se:cret:" + code, true, false},
+		{"alice", "wrong:" + code, false, false},
+		{"alice", "se:cret:" + wrong, false, true},
+		{"alice", "se:cret", false, true},
+		// Not required for other accounts, the password is used as is.
+		{"bob", "se:cret", true, false},
+		{"bob", "se:cret:" + code, false, false},
+	}
+	for i, c := range cases {
+		before := testutil.ToFloat64(authnResults.WithLabelValues("static", "totp_failure"))
+		result, _, err := as.Authenticate(&authRequest{Account: c.account, Password: api.PasswordString(c.password)})
+		totpFailure := testutil.ToFloat64(authnResults.WithLabelValues("static", "totp_failure")) > before
+		if result != c.result || err != nil || totpFailure != c.totpFailure {
+			t.Errorf("%d: %s %s: expected %t (TOTP failure: %t), got %t %v (TOTP failure: %t)",
+				i, c.account, c.password, c.result, c.totpFailure, result, err, totpFailure)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	for _, c := range []*CORSConfig{
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"https://ui.example.com/path"}},
+		{AllowedOrigins: []string{"https://ui.*.com"}},
+		{},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v: expected to be rejected", c)
+		}
+	}
+
+	c := testConfig(t)
+	c.Server.CORS = &CORSConfig{
+		AllowedOrigins: []string{"https://ui.example.com", "https://*.apps.example.com"},
+		MaxAge:         10 * time.Minute,
+	}
+	if err := c.Server.CORS.validate(); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	do := func(method, path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Preflight.
+	for _, path := range []string{"/auth?service=registry", "/auth/keys"} {
+		rw := do("OPTIONS", path, "https://ui.example.com")
+		h := rw.Header()
+		if rw.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://ui.example.com" ||
+			h.Get("Access-Control-Allow-Methods") != "GET, POST, OPTIONS" ||
+			h.Get("Access-Control-Allow-Headers") != "Authorization, Content-Type" ||
+			h.Get("Access-Control-Allow-Credentials") != "" || h.Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("%s: unexpected preflight response: %d %v", path, rw.Code, h)
+		}
+	}
+	if rw := do("OPTIONS", "/auth", "https://evil.example.com"); rw.Code != http.StatusForbidden || rw.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected preflight from other origins to be rejected, got %d %v", rw.Code, rw.Header())
+	}
+
+	// Actual requests.
+	rw := do("GET", "/auth?service=registry&scope=repository:foo:pull", "https://a.apps.example.com")
+	if rw.Code != http.StatusOK || rw.Header().Get("Access-Control-Allow-Origin") != "https://a.apps.example.com" ||
+		rw.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("unexpected response: %d %v", rw.Code, rw.Header())
+	}
+	for _, origin := range []string{"", "https://apps.example.com", "http://ui.example.com"} {
+		rw := do("GET", "/auth?service=registry&scope=repository:foo:pull", origin)
+		if rw.Code != http.StatusOK || rw.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%q: expected no CORS headers, got %d %v", origin, rw.Code, rw.Header())
+		}
+	}
+
+	as.config.Server.CORS = &CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}, AllowCredentials: true}
+	if err := as.config.Server.CORS.validate(); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	if rw := do("GET", "/auth/keys", "https://ui.example.com"); rw.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("expected credentials to be allowed, got %v", rw.Header())
+	}
+
+	// Disabled by default.
+	as.config.Server.CORS = nil
+	if rw := do("GET", "/auth/keys", "https://ui.example.com"); rw.Header().Get("Access-Control-Allow-Origin") != "" || len(rw.Header()["Vary"]) != 0 {
+		t.Errorf("expected no CORS headers when disabled, got %v", rw.Header())
+	}
+}
+
+func TestConfigIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, contents string) string {
+		f := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(f), 0700)
+		if err := ioutil.WriteFile(f, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	cert, key := writeTokenKey(t, dir, "token")
+	main := write("config.yml", `
+include: [acl.yml, conf.d]
+server: {addr: ":5001"}
+token: {issuer: test, expiration: 900, certificate: "`+cert+`", key: "`+key+`"}
+users:
+  admin: {labels: {group: [admins]}}
+acl:
+  - {match: {account: admin}, actions: ["*"], comment: main}
+`)
+	write("acl.yml", `
+include: acl-extra.yml
+acl:
+  - {match: {account: alice}, actions: [pull], comment: acl}
+`)
+	write("acl-extra.yml", `
+acl:
+  - {match: {account: bob}, actions: [pull], comment: acl-extra}
+`)
+	write("conf.d/20-last.yaml", `
+token: {expiration: 600}
+acl:
+  - {match: {}, actions: [], comment: last}
+`)
+	write("conf.d/10-first.yml", `
+token: {expiration: 300}
+users:
+  alice: {}
+acl:
+  - {match: {account: carol}, actions: [pull], comment: first}
+`)
+	write("conf.d/README", "not included")
+
+	c, err := LoadConfig(main)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if c.Server.ListenAddress != ":5001" || c.Token.Issuer != "test" || c.Token.Expiration != 600 {
+		t.Errorf("expected scalars to be overridden by later files, got %+v", c.Token)
+	}
+	if len(c.Users) != 2 || c.Users["admin"] == nil || len(c.Users["admin"].Labels["group"]) != 1 {
+		t.Errorf("expected users to be merged, got %+v", c.Users)
+	}
+	var comments []string
+	for _, e := range c.ACL {
+		comments = append(comments, *e.Comment)
+	}
+	if !reflect.DeepEqual(comments, []string{"main", "acl", "acl-extra", "first", "last"}) {
+		t.Errorf("unexpected ACL order: %v", comments)
+	}
+	if len(c.Files()) != 5 || c.Files()[0] != main {
+		t.Errorf("unexpected files: %v", c.Files())
+	}
+
+	write("acl-extra.yml", "include: config.yml")
+	if _, err := LoadConfig(main); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("expected include cycle to be detected, got %v", err)
+	}
+	write("acl-extra.yml", "include: missing.yml")
+	if _, err := LoadConfig(main); err == nil || !strings.Contains(err.Error(), "missing.yml") {
+		t.Errorf("expected missing include to be an error, got %v", err)
+	}
+	write("acl-extra.yml", "include: missing/*.yml")
+	if _, err := LoadConfig(main); err != nil {
+		t.Errorf("expected pattern without matches to be ignored, got %v", err)
+	}
+}
+
+func TestConfigSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeTokenKey(t, dir, "token")
+	config := `
+server: {addr: ":5001"}
+token: {issuer: test, expiration: 900, certificate: "` + cert + `", key: "` + key + `"}
+users:
+  admin: {}
+acl: []
+`
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(config))
+	zw.Close()
+	gzFile := filepath.Join(dir, "config.yml.gz")
+	if err := ioutil.WriteFile(gzFile, compressed.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := LoadConfig(gzFile); err != nil || c.Users["admin"] == nil {
+		t.Errorf("failed to load compressed config: %v", err)
+	}
+	ioutil.WriteFile(gzFile, []byte(config), 0600)
+	if _, err := LoadConfig(gzFile); err == nil || !strings.Contains(err.Error(), "could not decompress") {
+		t.Errorf("expected uncompressed .gz file to be rejected, got %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer config-token" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/config.yml":
+			rw.Write([]byte(config))
+		case "/config.yml.gz":
+			rw.Write(compressed.Bytes())
+		case "/include.yml":
+			rw.Write([]byte("include: other.yml\n" + config))
+		case "/slow.yml":
+			time.Sleep(200 * time.Millisecond)
+			rw.Write([]byte(config))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer ts.Close()
+	authFile := filepath.Join(dir, "authorization")
+	ioutil.WriteFile(authFile, []byte("Bearer config-token\n"), 0600)
+	defer func(timeout time.Duration) { ConfigFetchTimeout, ConfigAuthorizationFile = timeout, "" }(ConfigFetchTimeout)
+	ConfigFetchTimeout = 100 * time.Millisecond
+
+	if _, err := LoadConfig(ts.URL + "/config.yml"); err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("expected fetch without authorization to fail, got %v", err)
+	}
+	ConfigAuthorizationFile = authFile
+	for _, path := range []string{"/config.yml", "/config.yml.gz"} {
+		if c, err := LoadConfig(ts.URL + path); err != nil || c.Users["admin"] == nil {
+			t.Errorf("%s: failed to load remote config: %v", path, err)
+		}
+	}
+	for path, expected := range map[string]string{
+		"/missing.yml": "404 Not Found",
+		"/include.yml": "include is not supported",
+		"/slow.yml":    "could not fetch",
+	} {
+		if _, err := LoadConfig(ts.URL + path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error %q, got %v", path, expected, err)
+		}
+	}
+	if _, err := LoadConfig("ftp://example.com/config.yml"); err == nil || !strings.Contains(err.Error(), "scheme must be http or https") {
+		t.Errorf("expected unsupported scheme to be rejected, got %v", err)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeTokenKey(t, dir, "token")
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	otherHash, _ := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+	file := filepath.Join(dir, "config.yml")
+	load := func(expiration int, passwordHash []byte) *Config {
+		contents := fmt.Sprintf(`
+server: {addr: ":5001"}
+token: {issuer: test, expiration: %d, certificate: %q, key: %q}
+users:
+  admin: {password: %q}
+acl:
+  - {match: {account: admin}, actions: ["*"]}
+`, expiration, cert, key, passwordHash)
+		if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := LoadConfig(file)
+		if err != nil {
+			t.Fatalf("failed to load config: %s", err)
+		}
+		return c
+	}
+	c := load(900, hash)
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	version := func(user, password string) (int, versionResponse) {
+		req := httptest.NewRequest("GET", "/version", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		var resp versionResponse
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response %q: %s", rw.Body.String(), err)
+			}
+		}
+		return rw.Code, resp
+	}
+
+	if code, _ := version("", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous request to be rejected, got %d", code)
+	}
+	if code, _ := version("admin", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected wrong password to be rejected, got %d", code)
+	}
+	code, v1 := version("admin", "secret")
+	if code != http.StatusOK || v1.Version != Version || v1.ConfigHash == "" || v1.ConfigLoaded.IsZero() {
+		t.Fatalf("unexpected version response: %d %+v", code, v1)
+	}
+
+	// Secrets are not part of the hash.
+	if h, err := configHash(load(900, otherHash)); err != nil || h != v1.ConfigHash {
+		t.Errorf("expected config hash not to depend on password hashes, got %s, %v", h, err)
+	}
+
+	if err := as.Reload(load(600, hash)); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	code, v2 := version("admin", "secret")
+	if code != http.StatusOK || v2.ConfigHash == v1.ConfigHash || v2.ConfigLoaded.Before(v1.ConfigLoaded) {
+		t.Errorf("expected config hash and time to change after reload, got %+v, was %+v", v2, v1)
+	}
+
+	c = as.current().config
+	c.Server.VersionEndpoint = versionPublic
+	if code, _ := version("", ""); code != http.StatusOK {
+		t.Errorf("expected public endpoint to be accessible, got %d", code)
+	}
+	c.Server.VersionEndpoint = versionDisabled
+	if code, _ := version("admin", "secret"); code != http.StatusNotFound {
+		t.Errorf("expected disabled endpoint not to be found, got %d", code)
+	}
+	if buildCommit("20190101-120000/master@0123abcd+") != "0123abcd" || buildCommit("dev") != "" {
+		t.Errorf("unexpected commits of build IDs")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	exporter := tracetest.NewInMemoryExporter()
+	as.tracing = newTracing(&TracingConfig{SampleRatio: 1, ServiceName: "test", RedactAccount: true}, exporter)
+
+	req := httptest.NewRequest("GET", "/auth?service=registry&account=alice&scope=repository:foo:pull", nil)
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	as.tracing.provider.ForceFlush(context.Background())
+
+	spans := exporter.GetSpans()
+	var root tracetest.SpanStub
+	for _, s := range spans {
+		if s.Name == "token request" {
+			root = s
+		}
+	}
+	if root.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("expected request span to continue the incoming trace, got %+v", root)
+	}
+	var stages []string
+	for _, s := range spans {
+		if s.Name != root.Name {
+			if s.Parent.SpanID() != root.SpanContext.SpanID() {
+				t.Errorf("%s is not a child of the request span", s.Name)
+			}
+			stages = append(stages, s.Name)
+		}
+	}
+	if !reflect.DeepEqual(stages, []string{"parse", "authn", "authz", "sign"}) {
+		t.Errorf("unexpected stages: %v", stages)
+	}
+	attrs := map[string]string{}
+	for _, a := range root.Attributes {
+		attrs[string(a.Key)] = a.Value.Emit()
+	}
+	if attrs["docker_auth.authn.backend"] != "static" || attrs["docker_auth.decision"] != "allow" || attrs["http.status_code"] != "200" {
+		t.Errorf("unexpected attributes: %v", attrs)
+	}
+	if a := attrs["docker_auth.account"]; !strings.HasPrefix(a, "sha256:") {
+		t.Errorf("expected account to be redacted, got %q", a)
+	}
+}
+
+func TestBasicChallenge(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	challenge := func(c *Config) string {
+		as, err := NewAuthServer(c)
+		if err != nil {
+			t.Fatalf("failed to create server: %s", err)
+		}
+		defer as.Stop()
+		req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for unauthenticated request, got %d", rw.Code)
+		}
+		return strings.Join(rw.Header()["WWW-Authenticate"], ", ")
+	}
+
+	if h := challenge(c); h != `Basic realm="test issuer"` {
+		t.Errorf("expected issuer as the realm by default, got %q", h)
+	}
+	realm := "Registry Login"
+	c.Server.Realm, c.Server.Service = &realm, "registry.example.com"
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	if h := challenge(c); h != `Basic realm="Registry Login",service="registry.example.com"` {
+		t.Errorf("unexpected challenge %q", h)
+	}
+
+	for _, r := range []string{"", `say "hi"`} {
+		r := r
+		c.Server.Realm = &r
+		if err := validate(c); err == nil {
+			t.Errorf("expected realm %q to be rejected", r)
+		}
+	}
+}
+
+func TestDenyWildcardResource(t *testing.T) {
+	acl := authz.ACL{{Match: &authz.MatchConditions{}, Actions: &[]string{"*"}}}
+	access := func(c *Config, scope string) []string {
+		as, err := NewAuthServer(c)
+		if err != nil {
+			t.Fatalf("failed to create server: %s", err)
+		}
+		defer as.Stop()
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(doRequest(t, as, "/auth?service=registry&scope="+scope), &resp); err != nil {
+			t.Fatalf("failed to parse token response: %s", err)
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		if len(tok.Claims.Access) != 1 {
+			t.Fatalf("expected access to one resource, got %+v", tok.Claims.Access)
+		}
+		return tok.Claims.Access[0].Actions
+	}
+
+	c := testConfig(t)
+	c.ACL = acl
+	if actions := access(c, "repository:*:*"); !reflect.DeepEqual(actions, []string{"*"}) {
+		t.Errorf("expected wildcard request to be granted by default, got %v", actions)
+	}
+	c.Authz = &AuthzConfig{DenyWildcardResource: true}
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	if actions := access(c, "repository:*:*"); len(actions) != 0 {
+		t.Errorf("expected wildcard request to be denied, got %v", actions)
+	}
+	if actions := access(c, "repository:foo:push"); !reflect.DeepEqual(actions, []string{"push"}) {
+		t.Errorf("expected other requests to be granted, got %v", actions)
+	}
+	// Entries can opt into wildcard grants.
+	c.ACL = append(authz.ACL{{Match: &authz.MatchConditions{}, Actions: &[]string{"pull"}, AllowWildcardName: true}}, acl...)
+	if actions := access(c, "repository:*:pull,push"); !reflect.DeepEqual(actions, []string{"pull"}) {
+		t.Errorf("expected wildcard request to be granted by the entry that allows it, got %v", actions)
+	}
+
+	c.ACL = nil
+	c.ExtAuthz = &authz.ExtAuthzConfig{Command: "/bin/true"}
+	if err := validate(c); err == nil || !strings.Contains(err.Error(), "deny_wildcard_resource") {
+		t.Errorf("expected deny_wildcard_resource without ACL to be rejected, got %v", err)
+	}
+}
+
+func TestLoginWithoutScope(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	// No entry matches alice.
+	bob := "bob"
+	c.ACL = authz.ACL{{Match: &authz.MatchConditions{Account: &bob}, Actions: &[]string{"*"}}}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	login := func(password string) *httptest.ResponseRecorder {
+		// As sent by docker login.
+		req := httptest.NewRequest("GET", "/auth?account=alice&client_id=docker&offline_token=true&service=registry", nil)
+		req.SetBasicAuth("alice", password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := login("secret")
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); rw.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected login to succeed, got %d %s", rw.Code, rw.Body.String())
+	}
+	tok, err := token.NewToken(resp.Token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %s", err)
+	}
+	if tok.Claims.Subject != "alice" || tok.Claims.Access == nil || len(tok.Claims.Access) != 0 {
+		t.Errorf("expected a token of alice with an empty access list, got %+v", tok.Claims)
+	}
+	if rw := login("wrong"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected login with a wrong password to fail, got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAuthnOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authn_order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// alice has different passwords in the two backends, bob is only in the htpasswd file.
+	staticHash, _ := bcrypt.GenerateFromPassword([]byte("static"), bcrypt.MinCost)
+	fileHash, _ := bcrypt.GenerateFromPassword([]byte("file"), bcrypt.MinCost)
+	htpasswd := filepath.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte("alice:"+string(fileHash)+"\nbob:"+string(fileHash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newServer := func(authnConfig *AuthnConfig) *AuthServer {
+		c := testConfig(t)
+		pw := api.PasswordString(staticHash)
+		c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+		c.HtpasswdAuth = &authn.HtpasswdAuthConfig{Path: htpasswd}
+		c.Authn = authnConfig
+		if err := validate(c); err != nil {
+			t.Fatalf("invalid config: %s", err)
+		}
+		as, err := NewAuthServer(c)
+		if err != nil {
+			t.Fatalf("failed to create server: %s", err)
+		}
+		return as
+	}
+	login := func(as *AuthServer, user, password string) int {
+		req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+		req.SetBasicAuth(user, password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	for _, c := range []struct {
+		name     string
+		config   *AuthnConfig
+		accepted map[string]bool
+	}{
+		// Static users go first and are authoritative: alice's file password is rejected.
+		{"default", nil, map[string]bool{"alice:static": true, "alice:file": false, "bob:file": true}},
+		// Rejection by static users falls through to the file.
+		{"not authoritative", &AuthnConfig{Authoritative: map[string]bool{"users": false}},
+			map[string]bool{"alice:static": true, "alice:file": true, "bob:file": true, "alice:wrong": false}},
+		// The file goes first and is authoritative: alice's static password is rejected.
+		{"order", &AuthnConfig{Order: []string{"htpasswd_auth"}},
+			map[string]bool{"alice:static": false, "alice:file": true, "bob:file": true}},
+		{"order, not authoritative", &AuthnConfig{Order: []string{"htpasswd_auth", "users"}, Authoritative: map[string]bool{"htpasswd_auth": false, "users": true}},
+			map[string]bool{"alice:static": true, "alice:file": true, "bob:file": true, "bob:static": false}},
+	} {
+		as := newServer(c.config)
+		for creds, accepted := range c.accepted {
+			up := strings.SplitN(creds, ":", 2)
+			code := login(as, up[0], up[1])
+			if accepted && code != http.StatusOK || !accepted && code != http.StatusUnauthorized {
+				t.Errorf("%s: %s: expected accepted = %t, got %d", c.name, creds, accepted, code)
+			}
+		}
+		as.Stop()
+	}
+
+	c := testConfig(t)
+	c.HtpasswdAuth = &authn.HtpasswdAuthConfig{Path: htpasswd}
+	for _, ac := range []*AuthnConfig{
+		{Order: []string{"ldap_auth"}},
+		{Order: []string{"users", "users"}},
+		{Authoritative: map[string]bool{"okta_auth": false}},
+	} {
+		c.Authn = ac
+		if err := validate(c); err == nil {
+			t.Errorf("expected %+v to be rejected", ac)
+		}
+	}
+}
+
+func TestDefaultAuthnOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authn_order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(path, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig(t)
+	c.HtpasswdAuth = &authn.HtpasswdAuthConfig{Path: path}
+	c.ExtAuth = &authn.ExtAuthConfig{Command: "/bin/false"}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	if expected := authnMethods(c); !reflect.DeepEqual(as.authnKeys, expected) {
+		t.Errorf("expected authenticators in the order %v, got %v", expected, as.authnKeys)
+	}
+}
+
+func TestLabelTokenTTL(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Token.Expiration = 3600
+	c.Token.MaxLabelTTL = 43200
+	c.Users = map[string]*authn.Requirements{
+		"admin":   {Password: &pw, Labels: api.Labels{"token_ttl": {"15m"}}},
+		"user":    {Password: &pw, Labels: api.Labels{"token_ttl": {"43200"}}},
+		"greedy":  {Password: &pw, Labels: api.Labels{"token_ttl": {"720h"}}},
+		"invalid": {Password: &pw, Labels: api.Labels{"token_ttl": {"soon", "-5"}}},
+		"plain":   {Password: &pw},
+	}
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	ttl := func(user string) int64 {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+		req.SetBasicAuth(user, "secret")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+			t.Fatalf("%s: expected a token, got %d %s", user, rw.Code, rw.Body.String())
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		return tok.Claims.Expiration - tok.Claims.IssuedAt
+	}
+	for user, expected := range map[string]int64{"admin": 900, "user": 43200, "greedy": 43200, "invalid": 3600, "plain": 3600} {
+		if got := ttl(user); got != expected {
+			t.Errorf("%s: expected token lifetime %d, got %d", user, expected, got)
+		}
+	}
+
+	// Without max_label_ttl, labels can't extend the lifetime beyond expiration.
+	c.Token.MaxLabelTTL = 0
+	if got := ttl("user"); got != 3600 {
+		t.Errorf("expected token lifetime to be clamped to expiration, got %d", got)
+	}
+	c.Token.MaxLabelTTL = -1
+	if err := validate(c); err == nil {
+		t.Errorf("expected negative max_label_ttl to be rejected")
+	}
+}
+
+func TestTokenSubjectClaim(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Token.SubjectClaim = "uuid"
+	c.Users = map[string]*authn.Requirements{
+		"alice": {Password: &pw, Labels: api.Labels{"uuid": {"0b6a9e5c-8f3e-4d0b-9c2a-51f1e7a7c3d1"}}},
+		"bob":   {Password: &pw},
+		"carol": {Password: &pw, Labels: api.Labels{"uuid": {""}}},
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	subject := func(user string) string {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+		req.SetBasicAuth(user, "secret")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+			t.Fatalf("%s: expected a token, got %d %s", user, rw.Code, rw.Body.String())
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		return tok.Claims.Subject
+	}
+	// Users without the label fall back to the account name.
+	for user, expected := range map[string]string{"alice": "0b6a9e5c-8f3e-4d0b-9c2a-51f1e7a7c3d1", "bob": "bob", "carol": "carol"} {
+		if got := subject(user); got != expected {
+			t.Errorf("%s: expected subject %q, got %q", user, expected, got)
+		}
+	}
+	c.Token.SubjectClaim = ""
+	if got := subject("alice"); got != "alice" {
+		t.Errorf("expected the account name to be the subject by default, got %q", got)
+	}
+}
+
+func TestOfflineTokens(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Token.OfflineExpiration = 30 * 86400
+	c.Token.OfflineAccounts = []string{"ci"}
+	c.Token.OfflineLabel = "service_account"
+	c.Users = map[string]*authn.Requirements{
+		"ci":    {Password: &pw},
+		"robot": {Password: &pw, Labels: api.Labels{"service_account": {"true"}}},
+		"alice": {Password: &pw},
+	}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	lifetime := func(user, params string) int64 {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull"+params, nil)
+		req.SetBasicAuth(user, "secret")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+			t.Fatalf("%s: expected a token, got %d %s", user, rw.Code, rw.Body.String())
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		return tok.Claims.Expiration - tok.Claims.IssuedAt
+	}
+	for _, tc := range []struct {
+		user, params string
+		expected     int64
+	}{
+		{"ci", "&offline_token=true", c.Token.OfflineExpiration},
+		{"robot", "&offline_token=true", c.Token.OfflineExpiration},
+		{"ci", "", c.Token.Expiration},
+		{"alice", "&offline_token=true", c.Token.Expiration},
+	} {
+		if got := lifetime(tc.user, tc.params); got != tc.expected {
+			t.Errorf("%s %q: expected lifetime %d, got %d", tc.user, tc.params, tc.expected, got)
+		}
+	}
+
+	for _, tc := range []TokenConfig{
+		{OfflineExpiration: 60, OfflineAccounts: []string{"ci"}},
+		{OfflineExpiration: 86400},
+		{OfflineAccounts: []string{"ci"}},
+		{OfflineLabel: "service_account"},
+		{OfflineExpiration: 86400, OfflineAccounts: []string{""}},
+	} {
+		c := testConfig(t)
+		c.Token.OfflineExpiration, c.Token.OfflineAccounts, c.Token.OfflineLabel = tc.OfflineExpiration, tc.OfflineAccounts, tc.OfflineLabel
+		if err := validate(c); err == nil {
+			t.Errorf("expected %+v to be rejected", tc)
+		}
+	}
+}
+
+func TestTokenSkew(t *testing.T) {
+	claims := func(c *Config) *token.ClaimSet {
+		as, err := NewAuthServer(c)
+		if err != nil {
+			t.Fatalf("failed to create server: %s", err)
+		}
+		defer as.Stop()
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull"), &resp); err != nil {
+			t.Fatalf("failed to parse token response: %s", err)
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		// Relative to the time of issuance.
+		issued := tok.Claims.Expiration - c.Token.Expiration
+		tok.Claims.NotBefore -= issued
+		tok.Claims.IssuedAt -= issued
+		return tok.Claims
+	}
+
+	c := testConfig(t)
+	if cl := claims(c); cl.NotBefore != -10 || cl.IssuedAt != 0 {
+		t.Errorf("expected nbf 10s before issuance by default, got nbf %d, iat %d", cl.NotBefore, cl.IssuedAt)
+	}
+	nbf := int64(120)
+	c.Token.NotBeforeSkew, c.Token.IssuedAtSkew = &nbf, 30
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	if cl := claims(c); cl.NotBefore != -120 || cl.IssuedAt != -30 {
+		t.Errorf("expected nbf 120s and iat 30s before issuance, got nbf %d, iat %d", cl.NotBefore, cl.IssuedAt)
+	}
+
+	for _, skew := range []int64{-1, 3600} {
+		skew := skew
+		c.Token.NotBeforeSkew = &skew
+		if err := validate(c); err == nil {
+			t.Errorf("expected nbf_skew %d to be rejected", skew)
+		}
+	}
+}
+
+func TestUnmatchedLog(t *testing.T) {
+	c := &UnmatchedLogConfig{MaxPerMinute: 2}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	ul := newUnmatchedLog(c)
+	ai := &api.AuthRequestInfo{Account: "alice", Service: "registry", IP: net.ParseIP("10.0.0.1"), Type: "repository", Name: "foo/bar", Actions: []string{"pull", "push"}}
+	msg := ul.message(ai, "no authorization rule matched")
+	for _, s := range []string{`account="alice"`, `service="registry"`, "ip=10.0.0.1", "scope=repository:foo/bar:pull,push"} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("expected %q in %q", s, msg)
+		}
+	}
+	ul.message(ai, "")
+	for i := 0; i < 3; i++ {
+		if msg := ul.message(ai, ""); msg != "" {
+			t.Errorf("expected message to be rate limited, got %q", msg)
+		}
+	}
+	ul.limiter = rate.NewLimiter(rate.Inf, 1)
+	if msg := ul.message(ai, ""); !strings.Contains(msg, "3 more not logged") {
+		t.Errorf("expected the number of suppressed messages, got %q", msg)
+	}
+
+	ul = newUnmatchedLog(&UnmatchedLogConfig{SampleRatio: 0.0001, MaxPerMinute: 1000})
+	logged := 0
+	for i := 0; i < 1000; i++ {
+		if ul.message(ai, "") != "" {
+			logged++
+		}
+	}
+	if logged > 10 {
+		t.Errorf("expected few messages to be sampled, got %d", logged)
+	}
+
+	for _, bad := range []*UnmatchedLogConfig{{SampleRatio: 2}, {MaxPerMinute: -1}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestResourceClass(t *testing.T) {
+	c := testConfig(t)
+	pull, all := []string{"pull"}, []string{"*"}
+	repository, plugin, none := "repository", "plugin", ""
+	c.ACL = authz.ACL{
+		{Match: &authz.MatchConditions{Type: &repository, Class: &plugin}, Actions: &pull},
+		{Match: &authz.MatchConditions{Type: &repository, Class: &none}, Actions: &all},
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	url := "/auth?service=registry&scope=repository(plugin):vieux/sshfs:pull,push&scope=repository:foo:pull,push" +
+		"&scope=repository:team/project/sub/image:pull,push&scope=repository:registry.example.com:5000/team/project/image:pull"
+	if err := json.Unmarshal(doRequest(t, as, url), &resp); err != nil {
+		t.Fatalf("failed to parse token response: %s", err)
+	}
+	tok, err := token.NewToken(resp.Token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %s", err)
+	}
+	expected := []*token.ResourceActions{
+		{Type: "repository", Class: "plugin", Name: "vieux/sshfs", Actions: []string{"pull"}},
+		{Type: "repository", Name: "foo", Actions: []string{"pull", "push"}},
+		// Names with several slashes are kept whole.
+		{Type: "repository", Name: "team/project/sub/image", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "registry.example.com:5000/team/project/image", Actions: []string{"pull"}},
+	}
+	if !reflect.DeepEqual(tok.Claims.Access, expected) {
+		t.Errorf("unexpected access %+v", tok.Claims.Access)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	c := testConfig(t)
+	c.Server.MaxURLLength = 1 << 20
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.MaxScopes != defaultMaxScopes || c.Server.MaxHeaderBytes != defaultMaxHeaderBytes {
+		t.Errorf("expected default limits, got %+v", c.Server)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	do := func(req *http.Request) int {
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	scopes := strings.Repeat("&scope=repository:foo:pull", 5000)
+	if code := do(httptest.NewRequest("GET", "/auth?service=registry"+scopes, nil)); code != http.StatusBadRequest {
+		t.Errorf("expected 5000 scopes to be rejected, got %d", code)
+	}
+	scopes = strings.Repeat("&scope=repository:foo:pull", defaultMaxScopes)
+	if code := do(httptest.NewRequest("GET", "/auth?service=registry"+scopes, nil)); code != http.StatusOK {
+		t.Errorf("expected %d scopes to be accepted, got %d", defaultMaxScopes, code)
+	}
+	if code := do(httptest.NewRequest("GET", "/auth?service=registry&scope=repository:"+strings.Repeat("a", 2000)+":pull", nil)); code != http.StatusBadRequest {
+		t.Errorf("expected long scope to be rejected, got %d", code)
+	}
+	req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+	req.Header.Set("X-Junk", strings.Repeat("a", 20000))
+	if code := do(req); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("expected large headers to be rejected, got %d", code)
+	}
+	req = httptest.NewRequest("POST", "/auth", strings.NewReader("service=registry"+strings.Repeat("&scope=repository:foo:pull", 3000)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if code := do(req); code != http.StatusBadRequest {
+		t.Errorf("expected large body to be rejected, got %d", code)
+	}
+
+	c.Server.MaxURLLength = 100
+	if code := do(httptest.NewRequest("GET", "/auth?service=registry"+scopes, nil)); code != http.StatusBadRequest {
+		t.Errorf("expected long URL to be rejected, got %d", code)
+	}
+	c.Server.MaxScopes = -1
+	if err := validate(c); err == nil {
+		t.Errorf("expected negative max_scopes to be rejected")
+	}
+}
+
+func TestTokenLimits(t *testing.T) {
+	c := testConfig(t)
+	c.Token.MaxAccessEntries = 3
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	do := func(url string) (int, string) {
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, httptest.NewRequest("GET", url, nil))
+		return rw.Code, rw.Body.String()
+	}
+
+	// Scopes of the same resource are merged into one entry.
+	url := "/auth?service=registry&scope=repository:a:pull&scope=repository:a:push&scope=repository:b:pull&scope=repository:c:pull"
+	if code, body := do(url); code != http.StatusOK {
+		t.Errorf("expected 3 access entries to be allowed, got %d: %s", code, body)
+	}
+	code, body := do(url + "&scope=repository:d:pull")
+	if code != http.StatusBadRequest || !strings.Contains(body, "token would have 4 access entries, at most 3 are allowed") {
+		t.Errorf("expected 4 access entries to be rejected, got %d: %s", code, body)
+	}
+
+	c.Token.MaxAccessEntries = 0
+	c.Token.MaxSize = 1000
+	code, body = do("/auth?service=registry" + strings.Repeat("&scope=repository:"+strings.Repeat("x", 90)+":pull", 5))
+	if code != http.StatusOK {
+		t.Errorf("expected small token to be issued, got %d: %s", code, body)
+	}
+	code, body = do("/auth?service=registry&scope=repository:" + strings.Repeat("x", 900) + ":pull")
+	if code != http.StatusBadRequest || !strings.Contains(body, "at most 1000 are allowed") {
+		t.Errorf("expected large token to be rejected, got %d: %s", code, body)
+	}
+
+	c.Token.MaxSize = -1
+	if err := validate(c); err == nil {
+		t.Errorf("expected negative max_size to be rejected")
+	}
+}
+
+func TestWildcardActions(t *testing.T) {
+	c := testConfig(t)
+	c.Token.WildcardActions = map[string][]string{"repository": {"pull", "push", "delete"}, "repository(plugin)": {"pull", "push"}}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	var resp struct{ Token string }
+	body := doRequest(t, as, "/auth?service=registry&scope=repository:foo:*&scope=repository:foo:pull&scope=registry:catalog:*"+
+		"&scope=repository(plugin):bar:*&scope=repository(other):baz:*")
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+	tk, err := token.NewToken(resp.Token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %s", err)
+	}
+	expected := []*token.ResourceActions{
+		{Type: "repository", Name: "foo", Actions: []string{"delete", "pull", "push"}},
+		{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		// The class has its own actions, other classes fall back to the type.
+		{Type: "repository", Class: "plugin", Name: "bar", Actions: []string{"pull", "push"}},
+		{Type: "repository", Class: "other", Name: "baz", Actions: []string{"delete", "pull", "push"}},
+	}
+	if !reflect.DeepEqual(tk.Claims.Access, expected) {
+		got, _ := json.Marshal(tk.Claims.Access)
+		t.Errorf("expected repository wildcard to be expanded, got %s", got)
+	}
+
+	for _, wa := range []map[string][]string{{"repository": {}}, {"repository": {"pull", "*"}}, {"": {"pull"}}, {"repository()": {"pull"}}, {"repository(plugin": {"pull"}}} {
+		c.Token.WildcardActions = wa
+		if err := validate(c); err == nil {
+			t.Errorf("expected wildcard_actions %v to be rejected", wa)
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	c := testConfig(t)
+	c.Server.ResponseHeaders = map[string]string{"server": "registry-auth", "X-Content-Type-Options": "nosniff"}
+	c.Server.MaxURLLength = 200
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	for url, expected := range map[string]int{
+		"/auth?service=registry&scope=repository:foo:pull": http.StatusOK,
+		"/healthz":        http.StatusOK,
+		"/nonexistent":    http.StatusNotFound,
+		"/auth?scope=foo": http.StatusBadRequest,
+		"/auth?service=" + strings.Repeat("x", 200): http.StatusBadRequest,
+	} {
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, httptest.NewRequest("GET", url, nil))
+		h := rw.Header()
+		if rw.Code != expected || h.Get("Server") != "registry-auth" || h.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: expected %d with configured headers, got %d %v", url, expected, rw.Code, h)
+		}
+		if h.Get("Strict-Transport-Security") != "" {
+			t.Errorf("%s: expected no HSTS without TLS, got %v", url, h)
+		}
+	}
+
+	// HSTS is sent by default with TLS, and can be changed or turned off.
+	for hsts, expected := range map[string]string{"": "", "max-age=600; includeSubDomains": "max-age=600; includeSubDomains"} {
+		sc := ServerConfig{CertFile: "server.crt", KeyFile: "server.key", ResponseHeaders: map[string]string{"Strict-Transport-Security": hsts}}
+		if err := sc.validateResponseHeaders(); err != nil || sc.responseHeaders.Get("Strict-Transport-Security") != expected {
+			t.Errorf("expected HSTS %q, got %v %v", expected, sc.responseHeaders, err)
+		}
+	}
+	sc := ServerConfig{LetsEncrypt: LetsEncryptConfig{Email: "admin@example.com"}}
+	if err := sc.validateResponseHeaders(); err != nil || sc.responseHeaders.Get("Strict-Transport-Security") != defaultHSTS {
+		t.Errorf("expected default HSTS with TLS, got %v %v", sc.responseHeaders, err)
+	}
+
+	for _, rh := range []map[string]string{
+		{"Bad Name": "x"},
+		{"": "x"},
+		{"X-Foo": "a\r\nSet-Cookie: b"},
+		{"content-length": "0"},
+		{"Server": "a", "server": "b"},
+	} {
+		c.Server.ResponseHeaders = rh
+		if err := validate(c); err == nil {
+			t.Errorf("expected response_headers %q to be rejected", rh)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	c := testConfig(t)
+	c.Server.AllowedIPs = []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"}
+	c.Server.DeniedIPs = []string{"10.0.66.0/24", "2001:db8::bad"}
+	c.Server.Metrics = &MetricsConfig{}
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	do := func(path, addr string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = addr
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	for addr, expected := range map[string]int{
+		"10.1.2.3:1234":        http.StatusOK,
+		"192.168.1.10:1234":    http.StatusOK,
+		"[2001:db8::1]:1234":   http.StatusOK,
+		"10.0.66.7:1234":       http.StatusForbidden, // Denied takes precedence.
+		"[2001:db8::bad]:1234": http.StatusForbidden,
+		"192.168.1.11:1234":    http.StatusForbidden, // Not listed.
+		"172.16.0.1:1234":      http.StatusForbidden,
+		"[2001:db9::1]:1234":   http.StatusForbidden,
+		"not an address":       http.StatusForbidden,
+	} {
+		if code := do("/auth?service=registry", addr); code != expected {
+			t.Errorf("%s: expected %d, got %d", addr, expected, code)
+		}
+	}
+	// Health and metrics endpoints are exempt by default.
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		if code := do(path, "172.16.0.1:1234"); code != http.StatusOK {
+			t.Errorf("%s: expected %s to be exempt, got %d", path, path, code)
+		}
+	}
+	exempt := false
+	c.Server.IPFilterExemptHealth = &exempt
+	if code := do("/healthz", "172.16.0.1:1234"); code != http.StatusForbidden {
+		t.Errorf("expected /healthz not to be exempt, got %d", code)
+	}
+
+	// The address is taken from the real IP header if it is configured.
+	c.Server.RealIPHeader = "X-Forwarded-For"
+	req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "172.16.0.1")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("expected forwarded address to be rejected, got %d", rw.Code)
+	}
+
+	for _, l := range [][]string{{"10.0.0.0/33"}, {"10.0.0.*"}, {"foo"}, {}} {
+		c := testConfig(t)
+		c.Server.AllowedIPs = l
+		if err := validate(c); err == nil {
+			t.Errorf("expected allowed_ips %q to be rejected", l)
+		}
+	}
+}
+
+func TestPostTokenRequest(t *testing.T) {
+	c := testConfig(t)
+	pull, all := []string{"pull"}, []string{"*"}
+	foo, bar := "foo", "bar"
+	c.ACL = authz.ACL{
+		{Match: &authz.MatchConditions{Name: &foo}, Actions: &pull},
+		{Match: &authz.MatchConditions{Name: &bar}, Actions: &all},
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	access := func(contentType, body string) []*token.ResourceActions {
+		req := httptest.NewRequest("POST", "/auth", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", body, rw.Code, rw.Body.String())
+		}
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse token response: %s", err)
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		if tok.Claims.Audience != "registry" {
+			t.Errorf("expected audience registry, got %q", tok.Claims.Audience)
+		}
+		return tok.Claims.Access
+	}
+	// Overlapping scopes are merged, push on foo is denied by the ACL,
+	// a scope that is not granted anything still appears in the token.
+	expected := []*token.ResourceActions{
+		{Type: "repository", Name: "foo", Actions: []string{"pull"}},
+		{Type: "repository", Name: "bar", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "baz", Actions: []string{}},
+	}
+	jsonBody := `{"service": "registry", "scope": ["repository:foo:pull,push", "repository:bar:pull", "repository:foo:pull", "repository:bar:push", "repository:baz:pull"]}`
+	if a := access("application/json; charset=utf-8", jsonBody); !reflect.DeepEqual(a, expected) {
+		t.Errorf("unexpected access from JSON request %+v", a)
+	}
+	form := url.Values{"service": {"registry"}, "scope": {"repository:foo:pull,push repository:bar:pull", "repository:foo:pull", "repository:bar:push repository:baz:pull"}}
+	if a := access("application/x-www-form-urlencoded", form.Encode()); !reflect.DeepEqual(a, expected) {
+		t.Errorf("unexpected access from form request %+v", a)
+	}
+
+	req := httptest.NewRequest("POST", "/auth?service=other", strings.NewReader(`{"service": "registry"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("expected conflicting service to be rejected, got %d", rw.Code)
+	}
+}
+
+func TestServiceIssuers(t *testing.T) {
+	c := testConfig(t)
+	c.Token.ServiceIssuers = map[string]string{"staging": "staging issuer", "prod": "prod issuer"}
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	for service, iss := range map[string]string{"staging": "staging issuer", "prod": "prod issuer", "registry": "test issuer"} {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(doRequest(t, as, "/auth?service="+service+"&scope=repository:foo:pull"), &resp); err != nil {
+			t.Fatalf("failed to parse token response: %s", err)
+		}
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		if tok.Claims.Issuer != iss {
+			t.Errorf("%s: expected issuer %q, got %q", service, iss, tok.Claims.Issuer)
+		}
+	}
+
+	c.Token.ServiceIssuers = map[string]string{"staging": ""}
+	if err := validate(c); err == nil {
+		t.Errorf("expected empty issuer to be rejected")
+	}
+	c.Token.ServiceIssuers = map[string]string{"staging": "staging issuer"}
+	c.Token.AllowedServices = []string{"registry"}
+	if err := validate(c); err == nil {
+		t.Errorf("expected issuer of a service that is not allowed to be rejected")
+	}
+}
+
+func TestConfigErrorPosition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeTokenKey(t, dir, "token")
+	config := func(acl string) string {
+		f := filepath.Join(dir, "config.yml")
+		ioutil.WriteFile(f, []byte(`server: {addr: ":0"}
+token: {issuer: test, expiration: 900, certificate: "`+cert+`", key: "`+key+`"}
+users: {"": {}}
+acl:
+  - match: {account: admin}
+    actions: ["*"]
+`+acl), 0600)
+		return f
+	}
+	for _, tc := range []struct {
+		acl, expected string
+	}{
+		{"  - match: {account: alice, name: \"/[/\"}\n    actions: [pull]\n", "(at line 7, column 35)"},
+		{"  - match:\n      ip: [10.0.0.1, bad]\n    actions: [pull]\n", "(at line 8, column 22)"},
+		{"  - match: {}\n    actions: [pull]\n    expiration: -1\n", "(at line 9, column 17)"},
+		{"  - match: {}\n    actions: [pull]\n    claims: {iss: x}\n", "(at line 9, column 13)"},
+	} {
+		_, err := LoadConfig(config(tc.acl))
+		if err == nil || !strings.HasPrefix(err.Error(), "invalid config: invalid ACL: entry 1") || !strings.HasSuffix(err.Error(), tc.expected) {
+			t.Errorf("expected error ending with %q, got %v", tc.expected, err)
+		}
+	}
+
+	// Syntax errors are reported by the parser itself.
+	if _, err := LoadConfig(config("  - match: {account: [\n")); err == nil || !strings.Contains(err.Error(), "yaml: line 7") {
+		t.Errorf("expected syntax error with line number, got %v", err)
+	}
+}
+
+func TestCheckBackendsOnStart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on the port once it is closed.
+	addr := l.Addr().String()
+	l.Close()
+	c := testConfig(t)
+	c.LDAPAuth = &authn.LDAPAuthConfig{Addr: addr, TLS: "none", Base: "dc=example,dc=com", Filter: "(uid=${account})"}
+	c.Server.CheckBackendsOnStart = true
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	if _, err := NewAuthServer(c); err == nil || !strings.Contains(err.Error(), "LDAP") || !strings.Contains(err.Error(), addr) {
+		t.Errorf("expected the unreachable LDAP server to prevent startup, got %v", err)
+	}
+
+	c.Server.BackendCheckFailure = backendCheckWarn
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("expected the server to start with backend_check_failure: warn, got %s", err)
+	}
+	// Checks that hang count as failed.
+	fc := &hangingChecker{release: make(chan struct{})}
+	defer close(fc.release)
+	as.notReady = []backendCheck{{"slow", fc}}
+	if err := as.checkBackends(10 * time.Millisecond); err == nil || !strings.Contains(err.Error(), "slow: no response") {
+		t.Errorf("expected timeout to be reported, got %v", err)
+	}
+	as.Stop()
+
+	c.Server.BackendCheckFailure = "ignore"
+	if err := validate(c); err == nil {
+		t.Errorf("expected invalid backend_check_failure to be rejected")
+	}
+}
+
+type hangingChecker struct {
+	release chan struct{}
+}
+
+func (hc *hangingChecker) HealthCheck() error {
+	<-hc.release
+	return nil
+}
+
+// fakeOAuth2Authenticator accepts the upstream token as bob's.
+type fakeOAuth2Authenticator struct{}
+
+func (fakeOAuth2Authenticator) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	return false, nil, api.NoMatch
+}
+
+func (fakeOAuth2Authenticator) AuthenticateAccessToken(token string) (string, bool, api.Labels, error) {
+	if token != "upstream-token" {
+		return "", false, nil, api.NoMatch
+	}
+	return "bob", true, api.Labels{"groups": {"dev"}}, nil
+}
+
+func (fakeOAuth2Authenticator) Stop() {}
+
+func (fakeOAuth2Authenticator) Name() string {
+	return "fake OAuth2"
+}
+
+func TestOAuth2TokenRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	c.Token.Refresh = &RefreshConfig{Enabled: true, TokenDB: dir}
+	if err := c.Token.Refresh.validate(); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	as.authenticators = append([]api.Authenticator{fakeOAuth2Authenticator{}}, as.authenticators...)
+
+	type response struct {
+		Token        string `json:"token"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		IssuedAt     string `json:"issued_at"`
+	}
+	post := func(form url.Values, prepare func(*http.Request)) (int, response) {
+		form.Set("service", "registry")
+		form.Set("client_id", "docker")
+		form.Set("scope", "repository:foo:pull")
+		req := httptest.NewRequest("POST", "/auth", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if prepare != nil {
+			prepare(req)
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		var resp response
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse token response: %s", err)
+			}
+		}
+		return rw.Code, resp
+	}
+	subject := func(resp response) string {
+		if resp.AccessToken == "" || resp.AccessToken != resp.Token {
+			t.Fatalf("expected access_token to be set, got %+v", resp)
+		}
+		if resp.ExpiresIn != 900 {
+			t.Errorf("expected expires_in of 900, got %d", resp.ExpiresIn)
+		}
+		if _, err := time.Parse(time.RFC3339, resp.IssuedAt); err != nil {
+			t.Errorf("invalid issued_at %q: %s", resp.IssuedAt, err)
+		}
+		tok, err := token.NewToken(resp.AccessToken)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		return tok.Claims.Subject
+	}
+
+	code, resp := post(url.Values{"grant_type": {"password"}, "username": {"alice"}, "password": {"secret"}, "access_type": {"offline"}}, nil)
+	if code != http.StatusOK || subject(resp) != "alice" || resp.RefreshToken == "" {
+		t.Fatalf("expected a token and a refresh token for alice, got %d %+v", code, resp)
+	}
+	if code, resp := post(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {resp.RefreshToken}}, nil); code != http.StatusOK || subject(resp) != "alice" {
+		t.Errorf("expected our refresh token to be exchanged, got %d %+v", code, resp)
+	}
+	if code, resp := post(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"upstream-token"}}, nil); code != http.StatusOK || subject(resp) != "bob" {
+		t.Errorf("expected upstream token to be accepted, got %d %+v", code, resp)
+	}
+	basicAuth := func(req *http.Request) { req.SetBasicAuth("alice", "secret") }
+	if code, resp := post(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"upstream-token"}}, basicAuth); code != http.StatusOK || subject(resp) != "alice" {
+		t.Errorf("expected basic auth to take precedence, got %d %+v", code, resp)
+	}
+	if code, _ := post(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"bogus.token"}}, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected unknown refresh token to be rejected, got %d", code)
+	}
+	if code, _ := post(url.Values{"grant_type": {"password"}, "username": {"alice"}, "password": {"wrong"}}, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected wrong password to be rejected, got %d", code)
+	}
+	if code, _ := post(url.Values{"grant_type": {"client_credentials"}}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected unsupported grant type to be rejected, got %d", code)
+	}
+
+	req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+	req.Header.Set("Authorization", "Bearer upstream-token")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	var bearer struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &bearer); err != nil {
+		t.Fatalf("expected a token for a bearer credential, got %d %s", rw.Code, rw.Body.String())
+	}
+	if tok, err := token.NewToken(bearer.Token); err != nil || tok.Claims.Subject != "bob" {
+		t.Errorf("unexpected token for a bearer credential: %+v, %v", tok, err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"admin": {Password: &pw}, "alice": {Password: &pw}}
+	all, rw, pull := []string{"*"}, []string{"pull", "push"}, []string{"pull"}
+	admin, secret, anyone, noSecrets := "admin", "secret/*", "/.+/", "no secrets"
+	office := &authz.TimeWindow{Days: []string{"mon-fri"}, Hours: []string{"9-17"}, Timezone: "UTC"}
+	c.ACL = authz.ACL{
+		{Match: &authz.MatchConditions{Account: &admin}, Actions: &all},
+		{Match: &authz.MatchConditions{Name: &secret}, Actions: &all, Deny: true, Comment: &noSecrets},
+		{Match: &authz.MatchConditions{Labels: map[string]string{"group": "dev"}}, Actions: &rw},
+		{Match: &authz.MatchConditions{Account: &anyone, IP: authz.IPPatterns{"10.0.0.0/8"}, Time: office}, Actions: &rw},
+		{Match: &authz.MatchConditions{Account: &anyone}, Actions: &pull},
+	}
+	c.Authz = &AuthzConfig{ExplainAdmins: []string{"admin"}}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	explain := func(user, query string) (int, *explainResponse) {
+		req := httptest.NewRequest("GET", "/explain?"+query, nil)
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			return rw.Code, nil
+		}
+		var resp explainResponse
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response %s: %s", rw.Body.String(), err)
+		}
+		if strings.Contains(rw.Body.String(), "token") {
+			t.Errorf("expected no token in the response, got %s", rw.Body.String())
+		}
+		return rw.Code, &resp
+	}
+
+	for _, tc := range []struct {
+		query   string
+		granted []string
+		denied  []string
+		rules   []string
+	}{
+		// Allowed by a label.
+		{"account=alice&scope=repository:app/web:pull,push&label=group=dev", rw, []string{}, []string{"ACL entry 2"}},
+		// Partially allowed.
+		{"account=alice&scope=repository:app/web:pull,push", pull, []string{"push"}, []string{"ACL entry 4"}},
+		// Denied, entries below the deny entry can't grant the actions it denies.
+		{"account=alice&scope=repository:secret/keys:pull&label=group=dev", []string{}, pull, []string{"ACL entry 1 (no secrets)"}},
+		// IP and time of the request.
+		{"account=alice&scope=repository:app/web:pull,push&ip=10.1.2.3&time=2024-03-06T10:00:00Z", rw, []string{}, []string{"ACL entry 3"}},
+		{"account=alice&scope=repository:app/web:pull,push&ip=10.1.2.3&time=2024-03-09T10:00:00Z", pull, []string{"push"}, []string{"ACL entry 4"}},
+	} {
+		code, resp := explain("admin", tc.query)
+		if code != http.StatusOK || resp.Account != "alice" || len(resp.Results) != 1 {
+			t.Fatalf("%s: expected an explanation, got %d %+v", tc.query, code, resp)
+		}
+		r := resp.Results[0]
+		if !reflect.DeepEqual(r.Granted, tc.granted) || !reflect.DeepEqual(r.Denied, tc.denied) || !reflect.DeepEqual(r.Rules, tc.rules) {
+			t.Errorf("%s: expected %v granted, %v denied by %v, got %+v", tc.query, tc.granted, tc.denied, tc.rules, r)
+		}
+		if len(r.Denied) > 0 && r.Reason == "" {
+			t.Errorf("%s: expected a reason for the denial", tc.query)
+		}
+	}
+	code, resp := explain("admin", "account=bob&scope=repository:a:pull&scope=repository:b:push")
+	if code != http.StatusOK || len(resp.Results) != 2 || resp.Results[0].Scope != "repository:a:pull" {
+		t.Errorf("expected explanations of both scopes, got %d %+v", code, resp)
+	}
+
+	for query, expected := range map[string]int{
+		"account=alice":             http.StatusBadRequest,
+		"scope=repository:app:pull": http.StatusBadRequest,
+		"account=alice&scope=repository:app:pull&ip=nowhere":  http.StatusBadRequest,
+		"account=alice&scope=repository:app:pull&time=monday": http.StatusBadRequest,
+		"account=alice&scope=repository:app:pull&label=nokey": http.StatusBadRequest,
+	} {
+		if code, _ := explain("admin", query); code != expected {
+			t.Errorf("%s: expected %d, got %d", query, expected, code)
+		}
+	}
+	// Only admins can use it.
+	if code, _ := explain("", "account=alice&scope=repository:app:pull"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", code)
+	}
+	if code, _ := explain("alice", "account=alice&scope=repository:app:pull"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin, got %d", code)
+	}
+	c.Authz.ExplainAdmins = nil
+	if code, _ := explain("admin", "account=alice&scope=repository:app:pull"); code != http.StatusNotFound {
+		t.Errorf("expected the endpoint to be disabled, got %d", code)
+	}
+}
+
+func TestBackendMetrics(t *testing.T) {
+	c := testConfig(t)
+	c.Server.Metrics = &MetricsConfig{}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	defer authn.EnableBackendMetrics(false)
+
+	signed := authn.BackendCall{Backend: "token", Op: "sign", Outcome: authn.BackendSuccess}
+	before, _, _ := authn.BackendCallLatency(signed)
+	doRequest(t, as, "/auth?service=registry&scope=repository:foo:pull")
+	if n, _, _ := authn.BackendCallLatency(signed); n != before+1 {
+		t.Errorf("expected token signing to be recorded, got %d calls", n-before)
+	}
+	metrics := string(doRequest(t, as, "/metrics"))
+	if !strings.Contains(metrics, `docker_auth_backend_request_duration_seconds_count{backend="token",op="sign",outcome="success"}`) {
+		t.Errorf("expected backend latency to be exported, got:\n%s", metrics)
+	}
+}
+
+func TestConstantTimeDeny(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	c.Authn = &AuthnConfig{ConstantTimeDeny: &ConstantTimeDenyConfig{Min: 200 * time.Millisecond, Jitter: 50 * time.Millisecond}}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	auth := func(user, password string) (int, time.Duration) {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+		req.SetBasicAuth(user, password)
+		rw := httptest.NewRecorder()
+		start := time.Now()
+		as.ServeHTTP(rw, req)
+		return rw.Code, time.Since(start)
+	}
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}} {
+		if code, d := auth(creds[0], creds[1]); code != http.StatusUnauthorized || d < c.Authn.ConstantTimeDeny.Min {
+			t.Errorf("%s: expected denial after at least %s, got %d after %s", creds[0], c.Authn.ConstantTimeDeny.Min, code, d)
+		}
+	}
+	if code, d := auth("alice", "secret"); code != http.StatusOK || d >= c.Authn.ConstantTimeDeny.Min {
+		t.Errorf("expected success without delay, got %d after %s", code, d)
+	}
+
+	for _, ctd := range []ConstantTimeDenyConfig{{}, {Min: -time.Second}, {Min: time.Second, Jitter: -time.Second}, {Min: 8 * time.Second, Jitter: 5 * time.Second}} {
+		c := testConfig(t)
+		c.Authn = &AuthnConfig{ConstantTimeDeny: &ctd}
+		if err := validate(c); err == nil {
+			t.Errorf("expected %+v to be rejected", ctd)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	key := func(name string) string {
+		cert, key := writeTokenKey(t, dir, name)
+		return fmt.Sprintf(`{issuer: %s, expiration: 900, certificate: %q, key: %q}`, name, cert, key)
+	}
+	config := `
+server: {addr: ":5001"}
+token: ` + key("main") + `
+users:
+  admin: {password: "` + string(hash) + `"}
+acl:
+  - {match: {}, actions: ["*"]}
+tenants:
+  acme:
+    services: [registry.acme.com]
+    token: ` + key("acme") + `
+    users:
+      alice: {password: "` + string(hash) + `"}
+    acl:
+      - {match: {account: alice}, actions: [pull]}
+  globex:
+    path_prefix: /globex
+    token: ` + key("globex") + `
+    users:
+      bob: {password: "` + string(hash) + `"}
+    acl:
+      - {match: {account: bob}, actions: ["*"]}
+`
+	configFile := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(configFile, []byte(config), 0600)
+	c, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	issuer := func(path, service, user string) (int, string) {
+		req := httptest.NewRequest("GET", path+"?service="+service+"&scope=repository:foo:pull", nil)
+		req.SetBasicAuth(user, "secret")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			return rw.Code, ""
+		}
+		var resp struct {
+			Token string `json:"token"`
+		}
+		json.Unmarshal(rw.Body.Bytes(), &resp)
+		tok, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		return rw.Code, tok.Claims.Issuer
+	}
+	for _, tc := range []struct {
+		path, service, user string
+		status              int
+		issuer              string
+	}{
+		{"/auth", "registry.acme.com", "alice", http.StatusOK, "acme"},
+		{"/globex/auth", "registry.globex.com", "bob", http.StatusOK, "globex"},
+		{"/auth", "registry.example.com", "admin", http.StatusOK, "main"},
+		// Users of one tenant are unknown to the others and to the top level.
+		{"/auth", "registry.acme.com", "bob", http.StatusUnauthorized, ""},
+		{"/globex/auth", "registry.acme.com", "alice", http.StatusUnauthorized, ""},
+		{"/auth", "registry.example.com", "alice", http.StatusUnauthorized, ""},
+	} {
+		if status, iss := issuer(tc.path, tc.service, tc.user); status != tc.status || iss != tc.issuer {
+			t.Errorf("%s %s %s: expected %d from %q, got %d from %q", tc.path, tc.service, tc.user, tc.status, tc.issuer, status, iss)
+		}
+	}
+	// Tenants are set up again on reload.
+	c, err = ReloadConfig(configFile, c)
+	if err != nil {
+		t.Fatalf("failed to reload config: %s", err)
+	}
+	if err := as.Reload(c); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if status, iss := issuer("/globex/auth", "", "bob"); status != http.StatusOK || iss != "globex" {
+		t.Errorf("expected bob to get a globex token after reload, got %d from %q", status, iss)
+	}
+
+	for _, invalid := range []string{
+		`  initech: {services: [registry.initech.com], users: {}, acl: []}`,
+		`  initech: {services: [registry.initech.com], token: {issuer: initech, expiration: 900}, users: {}, acl: []}`,
+		`  initech: {token: ` + key("initech") + `, users: {}, acl: []}`,
+		`  initech: {services: [registry.acme.com], token: ` + key("initech") + `, users: {}, acl: []}`,
+		`  initech: {path_prefix: /globex/initech, token: ` + key("initech") + `, users: {}, acl: []}`,
+		`  initech: {services: [registry.initech.com], server: {addr: ":5002"}, token: ` + key("initech") + `, users: {}, acl: []}`,
+	} {
+		ioutil.WriteFile(configFile, []byte(config+invalid+"\n"), 0600)
+		if _, err := LoadConfig(configFile); err == nil || !strings.Contains(err.Error(), "tenants.initech") {
+			t.Errorf("expected %s to be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestClockGuard(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	c.Token.Clock = &ClockConfig{WarnBackwardJump: time.Second, RefuseBackwardJump: time.Minute}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	as.clock.now = func() time.Time { return now }
+
+	auth := func() (int, *token.Token) {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+		req.SetBasicAuth("alice", "secret")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			return rw.Code, nil
+		}
+		var resp struct{ Token string }
+		json.NewDecoder(rw.Body).Decode(&resp)
+		tk, err := token.NewToken(resp.Token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %s", err)
+		}
+		return rw.Code, tk
+	}
+	if code, tk := auth(); code != http.StatusOK || tk.Claims.IssuedAt != now.Unix() || tk.Claims.Expiration != now.Unix()+c.Token.Expiration {
+		t.Fatalf("expected token issued at the fake time, got %d %+v", code, tk)
+	}
+
+	for _, step := range []struct {
+		delta, behind time.Duration
+		code          int
+	}{
+		{-500 * time.Millisecond, 500 * time.Millisecond, http.StatusOK}, // Small steps back are tolerated.
+		{time.Second, 0, http.StatusOK},
+		{-30 * time.Second, 30 * time.Second, http.StatusOK}, // Logged, but tokens are still issued.
+		{-time.Hour, time.Hour + 30*time.Second, http.StatusServiceUnavailable},
+		{time.Hour, 30 * time.Second, http.StatusOK},
+		{time.Minute, 0, http.StatusOK}, // Caught up.
+	} {
+		now = now.Add(step.delta)
+		if _, behind := as.clock.observe(); behind != step.behind {
+			t.Errorf("after %s: expected clock to be %s behind, got %s", step.delta, step.behind, behind)
+		}
+		if code, _ := auth(); code != step.code {
+			t.Errorf("after %s: expected %d, got %d", step.delta, step.code, code)
+		}
+	}
+
+	// The newest time seen survives reloads.
+	now = now.Add(-2 * time.Minute)
+	if err := as.init(c); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	as.clock.now = func() time.Time { return now }
+	if code, _ := auth(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected clock to still be behind after reload, got %d", code)
+	}
+
+	c.Token.Clock = &ClockConfig{RefuseBackwardJump: -time.Second}
+	if err := validate(c); err == nil {
+		t.Errorf("expected negative refuse_backward_jump to be rejected")
+	}
+}
+
+func TestJWTAuthLeavesOtherIssuers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt_issuers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A Kubernetes API server that accepts the service account token.
+	enc := base64.RawURLEncoding.EncodeToString
+	saToken := enc([]byte(`{"alg":"RS256"}`)) + "." +
+		enc([]byte(`{"iss":"https://kubernetes.default.svc","sub":"system:serviceaccount:ci:builder"}`)) + ".c2ln"
+	reviews := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var tr struct{ Spec struct{ Token string } }
+		json.NewDecoder(req.Body).Decode(&tr)
+		reviews++
+		if tr.Spec.Token != saToken {
+			fmt.Fprintln(rw, `{"status": {"authenticated": false, "error": "invalid token"}}`)
+			return
+		}
+		fmt.Fprintln(rw, `{"status": {"authenticated": true, "user": {"username": "system:serviceaccount:ci:builder"}, "audiences": ["docker-registry"]}}`)
+	}))
+	defer ts.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	files := map[string][]byte{
+		"jwt.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		"ca.crt":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}),
+		"token":   []byte("reviewer-token"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := testConfig(t)
+	c.Users = nil
+	c.JWTAuth = &authn.JWTAuthConfig{Issuer: "https://ci.example.com", Audience: "docker_auth", PublicKeyFile: filepath.Join(dir, "jwt.pub")}
+	c.K8sSAAuth = &authn.K8sSAAuthConfig{
+		APIServer: ts.URL,
+		CAFile:    filepath.Join(dir, "ca.crt"),
+		TokenFile: filepath.Join(dir, "token"),
+		Audiences: []string{"docker-registry"},
+	}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+
+	for password, expected := range map[string]int{saToken: http.StatusOK, "p4ssw0rd": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+		req.SetBasicAuth("ci/builder", password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != expected {
+			t.Errorf("expected %d, got %d: %s", expected, rw.Code, rw.Body.String())
+		}
+	}
+	if reviews != 1 {
+		t.Errorf("expected the service account token to be reviewed once, got %d", reviews)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	htpasswd := filepath.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig(t)
+	c.Users = nil
+	c.HtpasswdAuth = &authn.HtpasswdAuthConfig{Path: htpasswd}
+	c.Authn = &AuthnConfig{ConstantTimeDeny: &ConstantTimeDenyConfig{Min: 500 * time.Millisecond}}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	auth := func(password string) int {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope=repository:foo:pull", nil)
+		req.SetBasicAuth("alice", password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// Neither the new config nor the previous one can be set up again, the previous backends remain in effect.
+	os.Remove(htpasswd)
+	if err := as.Reload(c); err == nil {
+		t.Fatalf("expected reload with a missing htpasswd file to fail")
+	}
+	if code := auth("secret"); code != http.StatusOK {
+		t.Errorf("expected previous config to remain in effect, got %d", code)
+	}
+
+	// A reload waits for the request in flight, new requests are served meanwhile.
+	c2 := testConfig(t)
+	pw := api.PasswordString(hash)
+	c2.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	if err := validate(c2); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	inFlight := make(chan int)
+	go func() { inFlight <- auth("wrong") }()
+	time.Sleep(100 * time.Millisecond)
+	reloaded := make(chan error)
+	go func() { reloaded <- as.Reload(c2) }()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if code := auth("secret"); code != http.StatusOK || time.Since(start) > 200*time.Millisecond {
+		t.Errorf("expected request to be served during reload, got %d after %s", code, time.Since(start))
+	}
+	select {
+	case err := <-reloaded:
+		t.Errorf("expected reload to wait for the request in flight, got %v", err)
+	default:
+	}
+	if code := <-inFlight; code != http.StatusUnauthorized {
+		t.Errorf("expected request in flight to complete with the previous config, got %d", code)
+	}
+	if err := <-reloaded; err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if as.current().config != c2 {
+		t.Errorf("expected new config to be in effect")
+	}
+}
+
+func TestReloadKeepsLockout(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	c.Lockout = &LockoutConfig{MaxFailures: 1, Window: time.Minute, Cooldown: time.Hour}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	auth := func(password string) int {
+		req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.SetBasicAuth("alice", password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	reload := func(lc LockoutConfig) {
+		t.Helper()
+		c2 := *c
+		c2.Lockout = &lc
+		if err := as.Reload(&c2); err != nil {
+			t.Fatalf("failed to reload: %s", err)
+		}
+	}
+	if code := auth("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong password to be rejected, got %d", code)
+	}
+	if code := auth("secret"); code != http.StatusUnauthorized {
+		t.Fatalf("expected alice to be locked out, got %d", code)
+	}
+
+	// Same settings: alice is still locked out.
+	reload(*c.Lockout)
+	if code := auth("secret"); code != http.StatusUnauthorized {
+		t.Errorf("expected alice to still be locked out after reload, got %d", code)
+	}
+
+	// Changed settings start afresh.
+	reload(LockoutConfig{MaxFailures: 2, Window: time.Minute, Cooldown: time.Hour})
+	if code := auth("secret"); code != http.StatusOK {
+		t.Errorf("expected alice to be let in with new lockout settings, got %d", code)
+	}
+}
+
+func TestReloadKeepsRateLimits(t *testing.T) {
+	c := testConfig(t)
+	c.Server.RateLimit = &RateLimitConfig{RequestsPerSecond: 0.1, Burst: 2}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	request := func() int {
+		req := httptest.NewRequest("GET", "/auth?service=registry", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	reload := func(rc RateLimitConfig) {
+		t.Helper()
+		c2 := *c
+		c2.Server.RateLimit = &rc
+		if err := as.Reload(&c2); err != nil {
+			t.Fatalf("failed to reload: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if code := request(); code != http.StatusOK {
+			t.Fatalf("%d: expected 200 within burst, got %d", i, code)
+		}
+	}
+
+	// Same settings: the burst is still used up.
+	reload(*c.Server.RateLimit)
+	if code := request(); code != http.StatusTooManyRequests {
+		t.Errorf("expected the rate limit to still apply after reload, got %d", code)
+	}
+
+	// Changed settings start afresh.
+	reload(RateLimitConfig{RequestsPerSecond: 0.1, Burst: 3})
+	if code := request(); code != http.StatusOK {
+		t.Errorf("expected a new burst with new rate limit settings, got %d", code)
+	}
+}
+
+func TestSigningAlgMustMatchKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing_alg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ecCert, ecKey := writeTokenKey(t, dir, "ec")
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &rk.PublicKey, rk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert, rsaKey := filepath.Join(dir, "rsa.pem"), filepath.Join(dir, "rsa.key")
+	ioutil.WriteFile(rsaCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(rsaKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rk)}), 0600)
+
+	configFile := filepath.Join(dir, "config.yml")
+	for _, tc := range []struct {
+		cert, key, alg string
+		err            string
+	}{
+		{ecCert, ecKey, "RS256", "token.signing_alg is RS256, but token key is EC and signs with ES256"},
+		{ecCert, ecKey, "ES384", "token.signing_alg is ES384, but token key is EC and signs with ES256"},
+		{rsaCert, rsaKey, "ES256", "token.signing_alg is ES256, but token key is RSA and signs with RS256"},
+		{ecCert, ecKey, "ES256", ""},
+		{rsaCert, rsaKey, "RS256", ""},
+	} {
+		ioutil.WriteFile(configFile, []byte(`
+server: {addr: ":5001"}
+token: {issuer: test, expiration: 900, certificate: "`+tc.cert+`", key: "`+tc.key+`", signing_alg: `+tc.alg+`}
+users: {admin: {}}
+acl: []
+`), 0600)
+		c, err := LoadConfig(configFile)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s with %s: expected error %q, got %v", tc.alg, tc.key, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s with %s: failed to load config: %s", tc.alg, tc.key, err)
+			continue
+		}
+		if _, alg, err := c.Token.sign("payload"); err != nil || alg != tc.alg {
+			t.Errorf("%s with %s: expected tokens to be signed with %s, got %s %v", tc.alg, tc.key, tc.alg, alg, err)
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	c := testConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	pw := api.PasswordString(hash)
+	c.Users = map[string]*authn.Requirements{"alice": {Password: &pw}}
+	foo, bar, pull, none := "foo", "bar", []string{"pull"}, []string{}
+	c.ACL = authz.ACL{
+		{Match: &authz.MatchConditions{Name: &foo}, Actions: &pull},
+		{Match: &authz.MatchConditions{Name: &bar}, Actions: &none},
+	}
+	if err := validate(c); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	issued := func() uint64 {
+		mfs, err := MetricsRegistry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == "docker_auth_token_issuance_duration_seconds" {
+				return mf.GetMetric()[0].GetHistogram().GetSampleCount()
+			}
+		}
+		return 0
+	}
+	counters := map[string]prometheus.Counter{
+		"requests 200":   tokenRequests.WithLabelValues("200"),
+		"requests 401":   tokenRequests.WithLabelValues("401"),
+		"authn success":  authnResults.WithLabelValues("static", "success"),
+		"authn failure":  authnResults.WithLabelValues("static", "failure"),
+		"authz allow":    authzResults.WithLabelValues("acl", "allow"),
+		"authz deny":     authzResults.WithLabelValues("acl", "deny"),
+		"authz fallback": authzResults.WithLabelValues("default", "deny"),
+	}
+	before := map[string]float64{}
+	for name, ctr := range counters {
+		before[name] = testutil.ToFloat64(ctr)
+	}
+	issuedBefore := issued()
+
+	for _, r := range []struct {
+		password, scope string
+		status          int
+	}{
+		{"secret", "repository:foo:pull", http.StatusOK},
+		{"secret", "repository:bar:pull", http.StatusOK},
+		{"wrong", "repository:foo:pull", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/auth?service=registry&scope="+r.scope, nil)
+		req.SetBasicAuth("alice", r.password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != r.status {
+			t.Fatalf("%s %s: expected %d, got %d", r.password, r.scope, r.status, rw.Code)
+		}
+	}
+	for name, expected := range map[string]float64{
+		"requests 200":   2,
+		"requests 401":   1,
+		"authn success":  2,
+		"authn failure":  1,
+		"authz allow":    1,
+		"authz deny":     1,
+		"authz fallback": 0,
+	} {
+		if d := testutil.ToFloat64(counters[name]) - before[name]; d != expected {
+			t.Errorf("%s: expected %v, got %v", name, expected, d)
+		}
+	}
+	if d := issued() - issuedBefore; d != 2 {
+		t.Errorf("expected 2 issued tokens in the latency histogram, got %d", d)
+	}
+}
+
+func TestUsersBcryptCost(t *testing.T) {
+	hash4, _ := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	hash6, _ := bcrypt.GenerateFromPassword([]byte("secret"), 6)
+	withCost := func(cost int, hash []byte) *Config {
+		c := testConfig(t)
+		pw := api.PasswordString(hash)
+		c.Users["alice"] = &authn.Requirements{Password: &pw}
+		c.UsersBcryptCost = cost
+		return c
+	}
+	for _, cost := range []int{bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+		if err := validate(withCost(cost, hash6)); err == nil || !strings.Contains(err.Error(), "users_bcrypt_cost must be between") {
+			t.Errorf("%d: expected cost to be rejected, got %v", cost, err)
+		}
+	}
+	if err := validate(withCost(5, hash4)); err == nil || !strings.Contains(err.Error(), `user "alice" has cost 4`) {
+		t.Errorf("expected hash below the cost to be rejected, got %v", err)
+	}
+	for _, cost := range []int{4, 6} {
+		if err := validate(withCost(cost, hash6)); err != nil {
+			t.Errorf("%d: expected hash to be accepted, got %s", cost, err)
+		}
+	}
+
+	// Without the setting, hashes of any cost are accepted as before.
+	dir, err := ioutil.TempDir("", "bcrypt_cost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTokenKey(t, dir, "token")
+	cf := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(cf, []byte(`
+server: {addr: ":0"}
+token: {issuer: test, expiration: 900, certificate: "`+certFile+`", key: "`+keyFile+`"}
+users: {alice: {password: "`+string(hash4)+`"}}
+acl: [{match: {account: alice}, actions: ["*"]}]
+`), 0600)
+	c, err := LoadConfig(cf)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if c.UsersBcryptCost != 0 || c.Users["alice"].Password == nil || string(*c.Users["alice"].Password) != string(hash4) {
+		t.Errorf("expected config to be loaded unchanged, got cost %d, users %v", c.UsersBcryptCost, c.Users)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer as.Stop()
+	if ok, _, err := as.Authenticate(&authRequest{Account: "alice", Password: "secret"}); !ok || err != nil {
+		t.Errorf("expected alice to be authenticated, got %t %v", ok, err)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// TenantConfig is a tenant served by the same instance in isolation from the others, with its own
+// users, authentication and authorization backends and token settings (including the signing key).
+// These are set the same way as at the top level of the config, except for server settings, which
+// are shared: they only come from the top level. Tracing and metrics are also the top level's.
+//
+// Requests under path_prefix (after server.path_prefix), e.g. /acme/auth, and token requests for
+// the services are served by the tenant. Other requests are served by the top level config.
+type TenantConfig struct {
+	Services   []string `yaml:"services,omitempty"`
+	PathPrefix string   `yaml:"path_prefix,omitempty"`
+	Config     `yaml:",inline"`
+}
+
+type tenant struct {
+	name   string
+	config *TenantConfig
+	as     *AuthServer
+}
+
+func validateTenants(c *Config) error {
+	services := map[string]string{}
+	prefixes := map[string]string{}
+	for _, name := range tenantNames(c) {
+		t := c.Tenants[name]
+		key := "tenants." + name
+		if t == nil {
+			return fmt.Errorf("%s must not be empty", key)
+		}
+		if t.tenant == "" && !reflect.DeepEqual(t.Server, ServerConfig{}) {
+			return fmt.Errorf("%s: server settings can only be set at the top level", key)
+		}
+		if len(t.Tenants) > 0 {
+			return fmt.Errorf("%s: tenants can't have tenants", key)
+		}
+		if len(t.Services) == 0 && t.PathPrefix == "" {
+			return fmt.Errorf("%s: services or path_prefix is required", key)
+		}
+		for _, s := range t.Services {
+			if s == "" {
+				return fmt.Errorf("%s.services must not contain empty names", key)
+			}
+			if other, found := services[s]; found {
+				return fmt.Errorf("%s: service %q is already served by tenant %s", key, s, other)
+			}
+			services[s] = name
+		}
+		if p := t.PathPrefix; p != "" {
+			if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+				return fmt.Errorf("%s.path_prefix must start with / and must not end with it, got %q", key, p)
+			}
+			for op, other := range prefixes {
+				if op == p || strings.HasPrefix(op, p+"/") || strings.HasPrefix(p, op+"/") {
+					return fmt.Errorf("%s.path_prefix %s overlaps with %s of tenant %s", key, p, op, other)
+				}
+			}
+			prefixes[p] = name
+		}
+		// Shared server settings, with the tenant's path prefix.
+		t.tenant = name
+		t.Server = c.Server
+		t.Server.PathPrefix = c.Server.PathPrefix + t.PathPrefix
+		t.Server.Metrics, t.Server.Tracing = nil, nil
+		if err := validate(&t.Config); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// tenantNames returns the names of the tenants, sorted.
+func tenantNames(c *Config) []string {
+	var names []string
+	for name := range c.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// initTenants sets up the servers of the tenants. They use the tracing of the top level server.
+func (as *AuthServer) initTenants(c *Config) error {
+	as.tenants = nil
+	for _, name := range tenantNames(c) {
+		t := &tenant{name: name, config: c.Tenants[name], as: &AuthServer{}}
+		for _, pt := range as.prevTenants {
+			if pt.name == name {
+				t.as.lockout, t.as.rateLimiter = pt.as.lockout, pt.as.rateLimiter
+			}
+		}
+		if err := t.as.init(&t.config.Config); err != nil {
+			t.as.stopBackends()
+			return fmt.Errorf("tenants.%s: %s", name, err)
+		}
+		t.as.tracing = as.tracing
+		t.as.configLoaded(&t.config.Config)
+		as.tenants = append(as.tenants, t)
+	}
+	return nil
+}
+
+func (as *AuthServer) stopTenants() {
+	for _, t := range as.tenants {
+		t.as.tracing = nil
+		t.as.stopBackends()
+	}
+	as.tenants = nil
+}
+
+// tenantFor returns the tenant that serves the request, nil if it is served by the top level.
+func (as *AuthServer) tenantFor(req *http.Request) *tenant {
+	if len(as.tenants) == 0 {
+		return nil
+	}
+	prefix, p := as.config.Server.PathPrefix, req.URL.Path
+	for _, t := range as.tenants {
+		if tp := prefix + t.config.PathPrefix; t.config.PathPrefix != "" && (p == tp || strings.HasPrefix(p, tp+"/")) {
+			return t
+		}
+	}
+	if p != prefix+"/auth" && p != prefix+refreshPath {
+		return nil
+	}
+	service := req.FormValue("service")
+	for _, t := range as.tenants {
+		for _, s := range t.config.Services {
+			if s == service {
+				return t
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/registry/auth/token"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// jsonTokenRequest is the body of a token request POSTed as JSON, the equivalent of the query parameters:
+//
+//	{"service": "registry", "account": "alice", "scope": ["repository:foo:pull", "repository:bar:pull,push"]}
+type jsonTokenRequest struct {
+	Service string   `json:"service"`
+	Account string   `json:"account"`
+	Scope   []string `json:"scope"`
+}
+
+// parseJSONTokenRequest adds the parameters of a JSON request body to the form values of the request.
+// Form bodies (application/x-www-form-urlencoded) are parsed by ParseForm, like query parameters.
+func parseJSONTokenRequest(req *http.Request) error {
+	if req.Method != "POST" || req.Body == nil {
+		return nil
+	}
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct != "application/json" {
+		return nil
+	}
+	var body jsonTokenRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return fmt.Errorf("invalid JSON body: %s", err)
+	}
+	for k, v := range map[string]string{"service": body.Service, "account": body.Account} {
+		if v == "" {
+			continue
+		}
+		if f := req.Form.Get(k); f != "" && f != v {
+			return fmt.Errorf("%s in the body and the URL are not the same (%q vs %q)", k, v, f)
+		}
+		req.Form.Set(k, v)
+	}
+	req.Form["scope"] = append(req.Form["scope"], body.Scope...)
+	return nil
+}
+
+// parseOAuth2TokenRequest handles the grant_type, username, password and refresh_token parameters
+// of OAuth2 token requests, see https://docs.docker.com/registry/spec/auth/oauth/.
+// Basic auth credentials, if any, take precedence over the ones in the body. A refresh token is
+// presented to the authenticators like a bearer token, unless it is one of ours (see refreshTokens).
+func parseOAuth2TokenRequest(req *http.Request, ar *authRequest, haveBasicAuth bool) error {
+	ar.GrantType = req.PostFormValue("grant_type")
+	switch ar.GrantType {
+	case "":
+	case "password":
+		if req.PostFormValue("username") == "" {
+			return fmt.Errorf("username is required for grant_type password")
+		}
+		if !haveBasicAuth {
+			ar.User = req.PostFormValue("username")
+			ar.Password = api.PasswordString(req.PostFormValue("password"))
+		}
+	case "refresh_token":
+		if req.PostFormValue("refresh_token") == "" {
+			return fmt.Errorf("refresh_token is required for grant_type refresh_token")
+		}
+		if !haveBasicAuth {
+			ar.Password = api.PasswordString(req.PostFormValue("refresh_token"))
+		}
+	default:
+		return fmt.Errorf("unsupported grant_type %q", ar.GrantType)
+	}
+	return nil
+}
+
+// requestedScopes returns the scopes of the request. Each value can contain multiple scopes
+// separated by spaces, as in OAuth2 token requests.
+func requestedScopes(values []string) []string {
+	var scopes []string
+	for _, v := range values {
+		scopes = append(scopes, strings.Fields(v)...)
+	}
+	return scopes
+}
+
+// tokenAccess returns the access claim of the token. Scopes of the same resource are merged,
+// the token grants the union of the actions allowed for each of them. Granted "*" is replaced
+// with the actions in wildcardActions for the resource type, if any.
+func tokenAccess(ares []authzResult, wildcardActions map[string][]string) []*token.ResourceActions {
+	access := []*token.ResourceActions{}
+	byResource := map[[3]string]*token.ResourceActions{}
+	for _, a := range ares {
+		key := [3]string{a.scope.Type, a.scope.Class, a.scope.Name}
+		ra := byResource[key]
+		if ra == nil {
+			ra = &token.ResourceActions{Type: a.scope.Type, Class: a.scope.Class, Name: a.scope.Name, Actions: []string{}}
+			byResource[key] = ra
+			access = append(access, ra)
+		}
+		for _, action := range a.autorizedActions {
+			expanded := []string{action}
+			if wa := wildcardActionsFor(wildcardActions, a.scope); action == "*" && len(wa) > 0 {
+				expanded = wa
+			}
+			for _, e := range expanded {
+				if !containsString(ra.Actions, e) {
+					ra.Actions = append(ra.Actions, e)
+				}
+			}
+		}
+		sort.Strings(ra.Actions)
+	}
+	return access
+}
+
+// wildcardActionsFor returns the actions for "*" on the scope: those of its type(class),
+// if listed, otherwise those of the bare type.
+func wildcardActionsFor(wildcardActions map[string][]string, scope authScope) []string {
+	if scope.Class != "" {
+		if wa, ok := wildcardActions[scope.Type+"("+scope.Class+")"]; ok {
+			return wa
+		}
+	}
+	return wildcardActions[scope.Type]
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cesanta/glog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig enables OpenTelemetry tracing of token requests, exported over OTLP/HTTP.
+type TracingConfig struct {
+	// Collector endpoint, e.g. http://otel-collector:4318. If there is no path, /v1/traces is used.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Additional headers of export requests, e.g. for authentication with the collector.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Value of the service.name resource attribute, default is docker_auth.
+	ServiceName string `yaml:"service_name,omitempty"`
+	// Fraction of requests to trace, default is 1. Requests with a traceparent header
+	// follow the sampling decision of the caller.
+	SampleRatio float64 `yaml:"sample_ratio,omitempty"`
+	// Record a hash of the account name instead of the name itself.
+	RedactAccount bool `yaml:"redact_account,omitempty"`
+}
+
+func (c *TracingConfig) validate() error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("server.tracing.endpoint must be an http or https URL, got %q", c.Endpoint)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("server.tracing.sample_ratio must be between 0 and 1, got %g", c.SampleRatio)
+	}
+	if c.SampleRatio == 0 {
+		c.SampleRatio = 1
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "docker_auth"
+	}
+	return nil
+}
+
+// tracing creates spans of token requests. A nil *tracing creates no spans, at almost no cost.
+type tracing struct {
+	config   *TracingConfig
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func newTracing(c *TracingConfig, exporter sdktrace.SpanExporter) *tracing {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", c.ServiceName))),
+	)
+	return &tracing{config: c, provider: provider, tracer: provider.Tracer("github.com/cesanta/docker_auth/auth_server")}
+}
+
+// newOTLPTracing exports spans to the collector. The connection is established lazily,
+// so an unreachable collector does not prevent the server from starting.
+func newOTLPTracing(c *TracingConfig) (*tracing, error) {
+	u, _ := url.Parse(c.Endpoint)
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(c.Endpoint)}
+	if u.Path == "" || u.Path == "/" {
+		opts = append(opts, otlptracehttp.WithURLPath("/v1/traces"))
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(c.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up trace exporter: %s", err)
+	}
+	glog.Infof("Exporting traces to %s", c.Endpoint)
+	return newTracing(c, exporter), nil
+}
+
+// Used for all spans if tracing is not enabled.
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// startRequest starts the root span of a request, as a child of the span in the traceparent header, if any.
+func (t *tracing) startRequest(req *http.Request, name string) (context.Context, trace.Span) {
+	if t == nil {
+		return req.Context(), noopSpan
+	}
+	ctx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.method", req.Method)))
+}
+
+// start starts a span of one of the stages of a request.
+func (t *tracing) start(ctx context.Context, name string) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noopSpan
+	}
+	return t.tracer.Start(ctx, name)
+}
+
+// account returns the account name to record in spans.
+func (t *tracing) account(account string) string {
+	if t == nil || !t.config.RedactAccount || account == "" {
+		return account
+	}
+	h := sha256.Sum256([]byte(account))
+	return "sha256:" + hex.EncodeToString(h[:8])
+}
+
+// endRequest records the outcome of the request and ends its root span.
+func (t *tracing) endRequest(span trace.Span, ar *authRequest, ares []authzResult, status int) {
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if ar != nil {
+			span.SetAttributes(
+				attribute.String("docker_auth.account", t.account(ar.Account)),
+				attribute.String("docker_auth.service", ar.Service),
+				attribute.String("docker_auth.authn.backend", ar.authnBackend),
+			)
+		}
+		if status == http.StatusOK {
+			span.SetAttributes(attribute.String("docker_auth.decision", decision(ares)))
+		} else if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+	span.End()
+}
+
+// decision summarizes authorization results: login if there were no scopes, allow if all
+// the requested actions were granted, deny if none were and partial otherwise.
+func decision(ares []authzResult) string {
+	if len(ares) == 0 {
+		return "login"
+	}
+	requested, granted := 0, 0
+	for _, a := range ares {
+		requested += len(a.scope.Actions)
+		granted += len(a.autorizedActions)
+	}
+	switch {
+	case granted == 0:
+		return "deny"
+	case granted >= requested:
+		return "allow"
+	}
+	return "partial"
+}
+
+// close flushes the spans that have not been exported yet.
+func (t *tracing) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		glog.Warningf("Failed to flush traces: %s", err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2019 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	"golang.org/x/time/rate"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const defaultUnmatchedLogMaxPerMinute = 60
+
+// UnmatchedLogConfig logs requests that no authorization rule matched, and were therefore denied
+// by default, at info level. This replaces the warning that is logged for each of them otherwise.
+type UnmatchedLogConfig struct {
+	// Fraction of unmatched requests to log, default is 1.
+	SampleRatio float64 `yaml:"sample_ratio,omitempty"`
+	// Maximum number of messages per minute, default is 60. The number of requests that were not
+	// logged because of the limit is included in the next message.
+	MaxPerMinute int `yaml:"max_per_minute,omitempty"`
+}
+
+func (c *UnmatchedLogConfig) validate() error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("authz.log_unmatched.sample_ratio must be between 0 and 1, got %g", c.SampleRatio)
+	}
+	if c.MaxPerMinute < 0 {
+		return fmt.Errorf("authz.log_unmatched.max_per_minute must not be negative")
+	}
+	if c.SampleRatio == 0 {
+		c.SampleRatio = 1
+	}
+	if c.MaxPerMinute == 0 {
+		c.MaxPerMinute = defaultUnmatchedLogMaxPerMinute
+	}
+	return nil
+}
+
+type unmatchedLog struct {
+	config  *UnmatchedLogConfig
+	limiter *rate.Limiter
+
+	lock       sync.Mutex
+	suppressed int
+}
+
+func newUnmatchedLog(c *UnmatchedLogConfig) *unmatchedLog {
+	return &unmatchedLog{
+		config:  c,
+		limiter: rate.NewLimiter(rate.Every(time.Minute/time.Duration(c.MaxPerMinute)), c.MaxPerMinute),
+	}
+}
+
+// message returns the message to log about the request, or "" if it is not sampled or over the limit.
+func (ul *unmatchedLog) message(ai *api.AuthRequestInfo, reason string) string {
+	if ul.config.SampleRatio < 1 && rand.Float64() >= ul.config.SampleRatio {
+		return ""
+	}
+	ul.lock.Lock()
+	defer ul.lock.Unlock()
+	if !ul.limiter.Allow() {
+		ul.suppressed++
+		return ""
+	}
+	scope := authScope{Type: ai.Type, Class: ai.Class, Name: ai.Name, Actions: ai.Actions}
+	msg := fmt.Sprintf("No authz rule matched, denying: account=%q service=%q ip=%s scope=%s (%s)",
+		ai.Account, ai.Service, ai.IP, scope, reason)
+	if ul.suppressed > 0 {
+		msg += fmt.Sprintf(", %d more not logged due to rate limit", ul.suppressed)
+		ul.suppressed = 0
+	}
+	return msg
+}
+
+// log logs the unmatched request, or the usual warning if log_unmatched is not enabled.
+func (ul *unmatchedLog) log(ai *api.AuthRequestInfo, reason string) {
+	if ul == nil {
+		glog.Warningf("%s did not match any authz rule: %s", *ai, reason)
+		return
+	}
+	if msg := ul.message(ai, reason); msg != "" {
+		glog.Info(msg)
+	}
+}